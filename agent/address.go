@@ -0,0 +1,224 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mdlayher/vsock"
+)
+
+const (
+	// DefaultPort is the vsock port the agent listens on.
+	DefaultPort = 1024
+	// DefaultReadyPort is the vsock port on the host the agent signals readiness to.
+	DefaultReadyPort = 1025
+)
+
+// Listen listens on address, which takes one of the forms:
+//
+//	vsock://:1024
+//	unix:///run/tart-agent.socket
+//	tcp://127.0.0.1:1024
+func Listen(address string) (l net.Listener, err error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		err = fmt.Errorf("parsing address: %w", err)
+		return
+	}
+
+	switch u.Scheme {
+	case "vsock":
+		var port uint32
+		port, err = vsockPort(u)
+		if err != nil {
+			return
+		}
+		l, err = vsock.Listen(port, nil)
+	case "unix":
+		l, err = net.Listen("unix", u.Path)
+	case "tcp":
+		l, err = net.Listen("tcp", u.Host)
+	default:
+		err = fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if err != nil {
+		err = fmt.Errorf("listening on %s: %w", address, err)
+		return
+	}
+
+	return
+}
+
+// Dial connects to address, which takes one of the forms:
+//
+//	vsock://2:1025
+//	unix:///run/tart-agent.socket
+//	tcp://127.0.0.1:1024
+func Dial(ctx context.Context, address string) (conn net.Conn, err error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		err = fmt.Errorf("parsing address: %w", err)
+		return
+	}
+
+	var dialer net.Dialer
+	switch u.Scheme {
+	case "vsock":
+		var (
+			cid  uint64
+			port uint32
+		)
+		cid, err = strconv.ParseUint(u.Hostname(), 10, 32)
+		if err != nil {
+			err = fmt.Errorf("parsing context ID: %w", err)
+			return
+		}
+		port, err = vsockPort(u)
+		if err != nil {
+			return
+		}
+		conn, err = vsock.Dial(uint32(cid), port, nil)
+	case "unix":
+		conn, err = dialer.DialContext(ctx, "unix", u.Path)
+	case "tcp":
+		conn, err = dialer.DialContext(ctx, "tcp", u.Host)
+	default:
+		err = fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if err != nil {
+		err = fmt.Errorf("dialing %s: %w", address, err)
+		return
+	}
+
+	return
+}
+
+// AddressDialer dials address for every request.
+func AddressDialer(address string) Dialer {
+	return func(ctx context.Context) (net.Conn, error) {
+		return Dial(ctx, address)
+	}
+}
+
+// FirecrackerDialer connects to port of the guest through the Unix socket
+// backing the Firecracker vsock device.
+//
+// See https://github.com/firecracker-microvm/firecracker/blob/main/docs/vsock.md
+func FirecrackerDialer(udsPath string, port uint32) Dialer {
+	return func(ctx context.Context) (conn net.Conn, err error) {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "unix", udsPath)
+		if err != nil {
+			err = fmt.Errorf("dialing vsock device: %w", err)
+			return
+		}
+		defer func() {
+			if err != nil {
+				_ = conn.Close()
+			}
+		}()
+
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = conn.SetDeadline(deadline)
+		}
+
+		_, err = fmt.Fprintf(conn, "CONNECT %d\n", port)
+		if err != nil {
+			err = fmt.Errorf("sending CONNECT: %w", err)
+			return
+		}
+
+		// read byte by byte, so that nothing after the reply line is swallowed
+		var reply strings.Builder
+		buf := make([]byte, 1)
+		for {
+			_, err = conn.Read(buf)
+			if err != nil {
+				err = fmt.Errorf("reading CONNECT reply: %w", err)
+				return
+			}
+			if buf[0] == '\n' {
+				break
+			}
+			reply.WriteByte(buf[0])
+		}
+		if !strings.HasPrefix(reply.String(), "OK ") {
+			err = fmt.Errorf("unexpected CONNECT reply %q", reply.String())
+			return
+		}
+
+		_ = conn.SetDeadline(time.Time{})
+		return
+	}
+}
+
+const readyMessage = "READY"
+
+// NotifyReady tells whoever listens on address the agent is serving.
+func NotifyReady(ctx context.Context, address string) (err error) {
+	conn, err := Dial(ctx, address)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	_, err = fmt.Fprintln(conn, readyMessage)
+	if err != nil {
+		err = fmt.Errorf("sending ready message: %w", err)
+		return
+	}
+
+	return
+}
+
+// WaitReady waits for the agent to call NotifyReady on l.
+func WaitReady(ctx context.Context, l net.Listener) (err error) {
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			accepted <- fmt.Errorf("accepting connection: %w", err)
+			return
+		}
+		defer conn.Close()
+
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			accepted <- fmt.Errorf("reading ready message: %w", err)
+			return
+		}
+		if strings.TrimSpace(line) != readyMessage {
+			accepted <- fmt.Errorf("unexpected ready message %q", line)
+			return
+		}
+
+		accepted <- nil
+	}()
+
+	select {
+	case <-ctx.Done():
+		// unblocks Accept
+		_ = l.Close()
+		err = ctx.Err()
+	case err = <-accepted:
+	}
+
+	return
+}
+
+func vsockPort(u *url.URL) (port uint32, err error) {
+	parsed, err := strconv.ParseUint(u.Port(), 10, 32)
+	if err != nil {
+		err = fmt.Errorf("parsing vsock port: %w", err)
+		return
+	}
+
+	port = uint32(parsed)
+	return
+}
@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func startServer(t *testing.T) *Client {
+	t.Helper()
+
+	address := "unix://" + filepath.Join(t.TempDir(), "agent.socket")
+	l, err := Listen(address)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	server, err := NewServer(zap.NewNop())
+	require.NoError(t, err)
+	go func() { _ = server.Serve(l) }()
+
+	client, err := NewClient(AddressDialer(address))
+	require.NoError(t, err)
+
+	return client
+}
+
+func TestClient_Exec(t *testing.T) {
+	client := startServer(t)
+	ctx := context.Background()
+
+	require.NoError(t, client.Ping(ctx))
+
+	var stdout, stderr bytes.Buffer
+	code, err := client.Exec(ctx, Command{
+		Args:   []string{"sh", "-c", "cat; echo $GREETING; echo oops >&2; exit 3"},
+		Env:    []string{"GREETING=hello"},
+		Stdin:  strings.NewReader("from stdin\n"),
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, code)
+	assert.Equal(t, "from stdin\nhello\n", stdout.String())
+	assert.Equal(t, "oops\n", stderr.String())
+
+	_, err = client.Exec(ctx, Command{Args: []string{"/nonexistent"}})
+	var remoteErr *RemoteError
+	assert.True(t, errors.As(err, &remoteErr))
+}
+
+func TestClient_ExecCancel(t *testing.T) {
+	client := startServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := client.Exec(ctx, Command{Args: []string{"sleep", "10"}})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestClient_File(t *testing.T) {
+	client := startServer(t)
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "sub", "file")
+	content := bytes.Repeat([]byte("tart"), chunkSize)
+
+	err := client.PutFile(ctx, path, 0600, bytes.NewReader(content))
+	require.NoError(t, err)
+
+	var got bytes.Buffer
+	err = client.GetFile(ctx, path, &got)
+	require.NoError(t, err)
+	assert.Equal(t, content, got.Bytes())
+
+	err = client.GetFile(ctx, filepath.Join(t.TempDir(), "absent"), &got)
+	assert.Error(t, err)
+}
+
+func TestWaitReady(t *testing.T) {
+	address := "unix://" + filepath.Join(t.TempDir(), "ready.socket")
+	l, err := Listen(address)
+	require.NoError(t, err)
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() { _ = NotifyReady(ctx, address) }()
+	assert.NoError(t, WaitReady(ctx, l))
+}
@@ -0,0 +1,210 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Dialer opens a new connection to the agent.
+type Dialer func(ctx context.Context) (net.Conn, error)
+
+// Client talks to the agent in the guest.
+type Client struct {
+	dial Dialer
+}
+
+func NewClient(dial Dialer) (c *Client, err error) {
+	if dial == nil {
+		err = errors.New("dialer must be non-nil")
+		return
+	}
+
+	c = &Client{dial: dial}
+	return
+}
+
+// RemoteError is an error reported by the agent.
+type RemoteError struct {
+	Message string
+}
+
+func (r *RemoteError) Error() string {
+	return "agent: " + r.Message
+}
+
+// Command is a command to be run in the guest.
+type Command struct {
+	// command and its arguments
+	Args []string
+	// extra environment variables in the form of key=value
+	Env []string
+	// working directory
+	Dir string
+
+	// optional
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Ping checks whether the agent is serving.
+func (c *Client) Ping(ctx context.Context) (err error) {
+	_, err = c.do(ctx, Request{Op: OpPing}, nil, nil)
+	return
+}
+
+// Exec runs cmd in the guest and returns its exit code.
+// The command is killed if ctx is done.
+func (c *Client) Exec(ctx context.Context, cmd Command) (code int, err error) {
+	req := Request{
+		Op:   OpExec,
+		Args: cmd.Args,
+		Env:  cmd.Env,
+		Dir:  cmd.Dir,
+	}
+	stdin := cmd.Stdin
+	if stdin == nil {
+		stdin = eofReader{}
+	}
+	stdout := cmd.Stdout
+	if stdout == nil {
+		stdout = io.Discard
+	}
+	stderr := cmd.Stderr
+	if stderr == nil {
+		stderr = io.Discard
+	}
+
+	send := func(conn net.Conn) error {
+		return copyFrames(conn, stdin)
+	}
+	recv := func(typ frameType, payload []byte) (err error) {
+		switch typ {
+		case frameStdout:
+			_, err = stdout.Write(payload)
+		case frameStderr:
+			_, err = stderr.Write(payload)
+		}
+		return
+	}
+
+	code, err = c.do(ctx, req, send, recv)
+	return
+}
+
+// PutFile writes content to path in the guest with mode.
+func (c *Client) PutFile(ctx context.Context, path string, mode uint32, content io.Reader) (err error) {
+	req := Request{
+		Op:   OpPut,
+		Path: path,
+		Mode: mode,
+	}
+	send := func(conn net.Conn) error {
+		return copyFrames(conn, content)
+	}
+
+	_, err = c.do(ctx, req, send, nil)
+	return
+}
+
+// GetFile reads the file at path in the guest into w.
+func (c *Client) GetFile(ctx context.Context, path string, w io.Writer) (err error) {
+	req := Request{
+		Op:   OpGet,
+		Path: path,
+	}
+	recv := func(typ frameType, payload []byte) (err error) {
+		if typ == frameData {
+			_, err = w.Write(payload)
+		}
+		return
+	}
+
+	_, err = c.do(ctx, req, nil, recv)
+	return
+}
+
+// do sends req, then runs send in background while passing replied frames to recv,
+// until an exit or error frame arrives.
+func (c *Client) do(ctx context.Context, req Request, send func(conn net.Conn) error, recv func(typ frameType, payload []byte) error) (code int, err error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		err = fmt.Errorf("dialing agent: %w", err)
+		return
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// unblocks reads and writes, the agent cancels the request in turn
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}()
+
+	err = writeRequest(conn, req)
+	if err != nil {
+		err = fmt.Errorf("sending request: %w", err)
+		return
+	}
+
+	sendErr := make(chan error, 1)
+	if send != nil {
+		go func() {
+			sendErr <- send(conn)
+		}()
+	}
+
+	for {
+		var (
+			typ     frameType
+			payload []byte
+		)
+		typ, payload, err = readFrame(conn)
+		if err != nil {
+			select {
+			case sErr := <-sendErr:
+				if sErr != nil {
+					err = sErr
+				}
+			default:
+			}
+			err = fmt.Errorf("receiving reply: %w", err)
+			return
+		}
+
+		switch typ {
+		case frameExit:
+			code, err = parseExit(payload)
+			return
+		case frameError:
+			err = &RemoteError{Message: string(payload)}
+			return
+		}
+
+		if recv != nil {
+			err = recv(typ, payload)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
@@ -0,0 +1,203 @@
+// Package agent implements tart agent, which runs in the guest and
+// serves command execution and file transfer to the host.
+//
+// Every operation takes a connection of its own.
+// The client sends a request frame, then both sides exchange frames
+// until the server sends an exit or error frame and closes the connection.
+//
+// A frame is a one byte type, followed by a big endian uint32 length and the payload.
+package agent
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Op is the operation of a request.
+type Op string
+
+const (
+	// OpPing replies an exit frame with code 0.
+	OpPing Op = "ping"
+	// OpExec runs Args, stdin is sent in data frames,
+	// stdout and stderr frames are replied and finally an exit frame.
+	OpExec Op = "exec"
+	// OpPut writes data frames to Path, an empty data frame ends the file.
+	OpPut Op = "put"
+	// OpGet replies content of Path in data frames, ended by an empty data frame.
+	OpGet Op = "get"
+)
+
+// Request is the payload of the request frame in JSON.
+type Request struct {
+	Op Op `json:"op"`
+
+	// command and its arguments for exec
+	Args []string `json:"args,omitempty"`
+	// extra environment variables for exec, in the form of key=value
+	Env []string `json:"env,omitempty"`
+	// working directory for exec
+	Dir string `json:"dir,omitempty"`
+
+	// file path for put and get
+	Path string `json:"path,omitempty"`
+	// file mode for put
+	Mode uint32 `json:"mode,omitempty"`
+}
+
+type frameType byte
+
+const (
+	frameRequest frameType = 'r'
+	// stdin of exec or file content
+	frameData   frameType = 'd'
+	frameStdout frameType = 'o'
+	frameStderr frameType = 'e'
+	// payload is the exit code in big endian int32
+	frameExit frameType = 'x'
+	// payload is the error message
+	frameError frameType = '!'
+)
+
+const (
+	frameHeaderSize = 5
+	// payload larger than this is rejected
+	maxFrameSize = 1 << 20
+	// data is sent in chunks of this size
+	chunkSize = 32 << 10
+)
+
+func writeFrame(w io.Writer, typ frameType, payload []byte) (err error) {
+	if len(payload) > maxFrameSize {
+		err = fmt.Errorf("frame size %d exceeds limit", len(payload))
+		return
+	}
+
+	buf := make([]byte, frameHeaderSize+len(payload))
+	buf[0] = byte(typ)
+	binary.BigEndian.PutUint32(buf[1:frameHeaderSize], uint32(len(payload)))
+	copy(buf[frameHeaderSize:], payload)
+
+	_, err = w.Write(buf)
+	return
+}
+
+func readFrame(r io.Reader) (typ frameType, payload []byte, err error) {
+	var header [frameHeaderSize]byte
+	_, err = io.ReadFull(r, header[:])
+	if err != nil {
+		return
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxFrameSize {
+		err = fmt.Errorf("frame size %d exceeds limit", size)
+		return
+	}
+
+	typ = frameType(header[0])
+	payload = make([]byte, size)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		err = fmt.Errorf("reading frame payload: %w", err)
+		return
+	}
+
+	return
+}
+
+func writeRequest(w io.Writer, req Request) (err error) {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		err = fmt.Errorf("marshaling request: %w", err)
+		return
+	}
+
+	err = writeFrame(w, frameRequest, payload)
+	return
+}
+
+func readRequest(r io.Reader) (req Request, err error) {
+	typ, payload, err := readFrame(r)
+	if err != nil {
+		return
+	}
+	if typ != frameRequest {
+		err = fmt.Errorf("expecting request frame, got %q", typ)
+		return
+	}
+
+	err = json.Unmarshal(payload, &req)
+	if err != nil {
+		err = fmt.Errorf("unmarshaling request: %w", err)
+		return
+	}
+
+	return
+}
+
+func exitPayload(code int) []byte {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(int32(code)))
+	return payload
+}
+
+func parseExit(payload []byte) (code int, err error) {
+	if len(payload) != 4 {
+		err = errors.New("malformed exit frame")
+		return
+	}
+
+	code = int(int32(binary.BigEndian.Uint32(payload)))
+	return
+}
+
+// copyFrames sends content of r as data frames, ended by an empty one.
+func copyFrames(w io.Writer, r io.Reader) (err error) {
+	buf := make([]byte, chunkSize)
+	for {
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			err = writeFrame(w, frameData, buf[:n])
+			if err != nil {
+				return
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			err = readErr
+			return
+		}
+	}
+
+	err = writeFrame(w, frameData, nil)
+	return
+}
+
+// frameWriter is an io.Writer sending frames of typ.
+type frameWriter struct {
+	w   io.Writer
+	typ frameType
+}
+
+func (f frameWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		err = writeFrame(f.w, f.typ, chunk)
+		if err != nil {
+			return
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+
+	return
+}
@@ -0,0 +1,243 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// Server serves requests from the host.
+type Server struct {
+	logger *zap.Logger
+}
+
+func NewServer(logger *zap.Logger) (s *Server, err error) {
+	if logger == nil {
+		err = errors.New("logger must be non-nil")
+		return
+	}
+
+	s = &Server{logger: logger}
+	return
+}
+
+// Serve accepts connections on l until l is closed.
+func (s *Server) Serve(l net.Listener) (err error) {
+	for {
+		var conn net.Conn
+		conn, err = l.Accept()
+		if err != nil {
+			err = fmt.Errorf("accepting connection: %w", err)
+			return
+		}
+
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	req, err := readRequest(conn)
+	if err != nil {
+		s.logger.Info("reading request", zap.Error(err))
+		return
+	}
+
+	logger := s.logger.With(zap.String("op", string(req.Op)))
+	logger.Debug("handling request", zap.Strings("args", req.Args), zap.String("path", req.Path))
+
+	code := 0
+	switch req.Op {
+	case OpPing:
+	case OpExec:
+		code, err = s.exec(conn, req)
+	case OpPut:
+		err = s.put(conn, req)
+	case OpGet:
+		err = s.get(conn, req)
+	default:
+		err = fmt.Errorf("unknown op %q", req.Op)
+	}
+	if err != nil {
+		logger.Info("request failed", zap.Error(err))
+		_ = writeFrame(conn, frameError, []byte(err.Error()))
+		return
+	}
+
+	err = writeFrame(conn, frameExit, exitPayload(code))
+	if err != nil {
+		logger.Info("replying exit", zap.Error(err))
+		return
+	}
+}
+
+// exec runs the command, which is killed if the connection breaks.
+func (s *Server) exec(conn net.Conn, req Request) (code int, err error) {
+	if len(req.Args) == 0 {
+		err = errors.New("args is empty")
+		return
+	}
+
+	out := &lockedWriter{w: conn}
+	cmd := exec.Command(req.Args[0], req.Args[1:]...)
+	cmd.Env = append(os.Environ(), req.Env...)
+	cmd.Dir = req.Dir
+	cmd.Stdout = frameWriter{w: out, typ: frameStdout}
+	cmd.Stderr = frameWriter{w: out, typ: frameStderr}
+	// the whole process group is killed on cancellation
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		err = fmt.Errorf("stdin pipe: %w", err)
+		return
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		err = fmt.Errorf("starting command: %w", err)
+		return
+	}
+
+	pid := cmd.Process.Pid
+	exited := make(chan struct{})
+	go func() {
+		defer stdin.Close()
+		for {
+			typ, payload, readErr := readFrame(conn)
+			if readErr != nil {
+				select {
+				case <-exited:
+				default:
+					// client has gone
+					_ = syscall.Kill(-pid, syscall.SIGKILL)
+				}
+				return
+			}
+			if typ != frameData {
+				continue
+			}
+			if len(payload) == 0 {
+				_ = stdin.Close()
+				continue
+			}
+			_, _ = stdin.Write(payload)
+		}
+	}()
+
+	err = cmd.Wait()
+	close(exited)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		err = nil
+		code = exitErr.ExitCode()
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			code = 128 + int(status.Signal())
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("waiting command: %w", err)
+		return
+	}
+
+	return
+}
+
+func (s *Server) put(conn net.Conn, req Request) (err error) {
+	if req.Path == "" {
+		err = errors.New("path is empty")
+		return
+	}
+	mode := os.FileMode(req.Mode)
+	if mode == 0 {
+		mode = 0644
+	}
+
+	err = os.MkdirAll(filepath.Dir(req.Path), 0755)
+	if err != nil {
+		err = fmt.Errorf("creating parent directory: %w", err)
+		return
+	}
+	file, err := os.OpenFile(req.Path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		err = fmt.Errorf("opening file: %w", err)
+		return
+	}
+	defer file.Close()
+
+	for {
+		var (
+			typ     frameType
+			payload []byte
+		)
+		typ, payload, err = readFrame(conn)
+		if err != nil {
+			err = fmt.Errorf("receiving file: %w", err)
+			return
+		}
+		if typ != frameData {
+			err = fmt.Errorf("expecting data frame, got %q", typ)
+			return
+		}
+		if len(payload) == 0 {
+			break
+		}
+
+		_, err = file.Write(payload)
+		if err != nil {
+			err = fmt.Errorf("writing file: %w", err)
+			return
+		}
+	}
+
+	// mode is subject to umask on creation
+	err = file.Chmod(mode)
+	if err != nil {
+		err = fmt.Errorf("chmod: %w", err)
+		return
+	}
+	err = file.Close()
+	if err != nil {
+		err = fmt.Errorf("closing file: %w", err)
+		return
+	}
+
+	return
+}
+
+func (s *Server) get(conn net.Conn, req Request) (err error) {
+	file, err := os.Open(req.Path)
+	if err != nil {
+		err = fmt.Errorf("opening file: %w", err)
+		return
+	}
+	defer file.Close()
+
+	err = copyFrames(conn, file)
+	if err != nil {
+		err = fmt.Errorf("sending file: %w", err)
+		return
+	}
+
+	return
+}
+
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (n int, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.w.Write(p)
+}
@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nanmu42/tart/agent"
+
+	"go.uber.org/zap"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	agentListen string
+	agentNotify string
+)
+
+func init() {
+	rootCmd.AddCommand(agentCmd)
+	agentCmd.Flags().StringVar(&agentListen, "listen", fmt.Sprintf("vsock://:%d", agent.DefaultPort), "address to serve on, vsock://:port, unix:///path or tcp://host:port")
+	agentCmd.Flags().StringVar(&agentNotify, "notify", fmt.Sprintf("vsock://2:%d", agent.DefaultReadyPort), "address to signal readiness to once serving, empty to disable")
+}
+
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Run in the microVM and serve command execution and file transfer to the host",
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		ctx := cmd.Context()
+
+		logger, err := zap.NewProduction()
+		if err != nil {
+			err = fmt.Errorf("initializing logger: %w", err)
+			return
+		}
+
+		server, err := agent.NewServer(logger)
+		if err != nil {
+			err = fmt.Errorf("initializing agent: %w", err)
+			return
+		}
+
+		l, err := agent.Listen(agentListen)
+		if err != nil {
+			return
+		}
+		go func() {
+			<-ctx.Done()
+			_ = l.Close()
+		}()
+
+		if agentNotify != "" {
+			go func() {
+				notifyCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+				defer cancel()
+
+				notifyErr := agent.NotifyReady(notifyCtx, agentNotify)
+				if notifyErr != nil {
+					logger.Warn("signaling readiness", zap.Error(notifyErr))
+				}
+			}()
+		}
+
+		logger.Info("agent is serving", zap.String("address", agentListen))
+		err = server.Serve(l)
+		if ctx.Err() != nil {
+			err = nil
+			return
+		}
+
+		return
+	},
+}
@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/nanmu42/tart/executor"
+
+	"github.com/spf13/cobra"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+func init() {
+	rootCmd.AddCommand(debugCmd)
+	debugCmd.AddCommand(debugAttachCmd)
+	debugCmd.AddCommand(debugReleaseCmd)
+}
+
+var debugCmd = &cobra.Command{
+	Use:   "debug",
+	Short: "Debug microVMs kept by failed jobs with " + executor.DebugVariable,
+}
+
+var debugAttachCmd = &cobra.Command{
+	Use:   "attach <job-id>",
+	Short: "Open a shell in the microVM of the failed job",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		session, err := loadDebugSession(args[0])
+		if err != nil {
+			return
+		}
+
+		client, err := session.Dial()
+		if err != nil {
+			err = fmt.Errorf("connecting to microVM %s: %w", session.VMID, err)
+			return
+		}
+		defer client.Close()
+
+		fmt.Fprintf(os.Stderr, "Attached to microVM %s of job %d, which is kept until %s.\n",
+			session.VMID, session.JobID, session.Until.Local().Format("15:04:05"))
+		err = interactiveShell(client, session.Dir)
+		return
+	},
+}
+
+var debugReleaseCmd = &cobra.Command{
+	Use:   "release <job-id>",
+	Short: "Finish debugging of the failed job, whose microVM is torn down then",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		jobID, err := strconv.Atoi(args[0])
+		if err != nil {
+			err = fmt.Errorf("parsing job ID: %w", err)
+			return
+		}
+		cfg, err := loadConfig()
+		if err != nil {
+			err = fmt.Errorf("loading config: %w", err)
+			return
+		}
+
+		err = cfg.Executor.Debug.ReleaseSession(jobID)
+		if err != nil {
+			return
+		}
+
+		fmt.Printf("released job %d\n", jobID)
+		return
+	},
+}
+
+func loadDebugSession(arg string) (session executor.DebugSession, err error) {
+	jobID, err := strconv.Atoi(arg)
+	if err != nil {
+		err = fmt.Errorf("parsing job ID: %w", err)
+		return
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		err = fmt.Errorf("loading config: %w", err)
+		return
+	}
+
+	session, err = cfg.Executor.Debug.LoadSession(jobID)
+	return
+}
+
+// interactiveShell runs a login shell in dir over client,
+// with a PTY if stdin is a terminal.
+func interactiveShell(client *ssh.Client, dir string) (err error) {
+	session, err := client.NewSession()
+	if err != nil {
+		err = fmt.Errorf("init ssh session: %w", err)
+		return
+	}
+	defer session.Close()
+
+	session.Stdin = os.Stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		width, height, sizeErr := term.GetSize(fd)
+		if sizeErr != nil {
+			width, height = 80, 24
+		}
+		termType := os.Getenv("TERM")
+		if termType == "" {
+			termType = "xterm-256color"
+		}
+		err = session.RequestPty(termType, height, width, ssh.TerminalModes{ssh.ECHO: 1})
+		if err != nil {
+			err = fmt.Errorf("requesting PTY: %w", err)
+			return
+		}
+
+		var state *term.State
+		state, err = term.MakeRaw(fd)
+		if err != nil {
+			err = fmt.Errorf("making terminal raw: %w", err)
+			return
+		}
+		defer term.Restore(fd, state)
+
+		resized := make(chan os.Signal, 1)
+		signal.Notify(resized, syscall.SIGWINCH)
+		defer func() {
+			signal.Stop(resized)
+			close(resized)
+		}()
+		go func() {
+			for range resized {
+				if width, height, sizeErr := term.GetSize(fd); sizeErr == nil {
+					_ = session.WindowChange(height, width)
+				}
+			}
+		}()
+	}
+
+	err = session.Start(executor.LoginShell(dir))
+	if err != nil {
+		err = fmt.Errorf("starting shell: %w", err)
+		return
+	}
+
+	err = session.Wait()
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		// what the shell exits with is the user's business
+		err = nil
+	}
+
+	return
+}
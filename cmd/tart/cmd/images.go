@@ -0,0 +1,205 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nanmu42/tart/helper"
+	"github.com/nanmu42/tart/imagestore"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	imagesStoreDir string
+	imagesKernel   string
+	imagesRootFS   string
+)
+
+func init() {
+	rootCmd.AddCommand(imagesCmd)
+	imagesCmd.PersistentFlags().StringVar(&imagesStoreDir, "store", "", "directory of the image store, defaults to ImageStoreDir under [Executor] in config, or "+imagestore.DefaultDir)
+	imagesCmd.AddCommand(imagesImportCmd)
+	imagesImportCmd.Flags().StringVar(&imagesKernel, "kernel", "", "path to linux kernel file")
+	imagesImportCmd.Flags().StringVar(&imagesRootFS, "rootfs", "", "path to RootFS file")
+	_ = imagesImportCmd.MarkFlagRequired("kernel")
+	_ = imagesImportCmd.MarkFlagRequired("rootfs")
+	imagesCmd.AddCommand(imagesListCmd)
+	imagesCmd.AddCommand(imagesInspectCmd)
+	imagesCmd.AddCommand(imagesRemoveCmd)
+	imagesCmd.AddCommand(imagesGCCmd)
+}
+
+var imagesCmd = &cobra.Command{
+	Use:   "images",
+	Short: "Manage kernels and RootFS images in the image store",
+}
+
+var imagesImportCmd = &cobra.Command{
+	Use:   "import <tag>",
+	Short: "Import a kernel and a RootFS as an image of tag, replacing the old one",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		store, err := openImageStore()
+		if err != nil {
+			return
+		}
+
+		img, err := store.Import(cmd.Context(), args[0], imagesKernel, imagesRootFS)
+		if err != nil {
+			err = fmt.Errorf("importing image: %w", err)
+			return
+		}
+
+		fmt.Printf("imported %s, kernel %s, RootFS %s\n", img.Tag, img.Kernel.Digest, img.RootFS.Digest)
+		return
+	},
+}
+
+var imagesListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List images",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		store, err := openImageStore()
+		if err != nil {
+			return
+		}
+
+		images, err := store.List()
+		if err != nil {
+			err = fmt.Errorf("listing images: %w", err)
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(w, "TAG\tKERNEL\tROOTFS\tSIZE\tCREATED")
+		for _, img := range images {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+				img.Tag,
+				shortDigest(img.Kernel.Digest),
+				shortDigest(img.RootFS.Digest),
+				helper.HumanSize(img.Kernel.Size+img.RootFS.Size),
+				img.Created.Local().Format(time.RFC3339),
+			)
+		}
+		err = w.Flush()
+		return
+	},
+}
+
+var imagesInspectCmd = &cobra.Command{
+	Use:   "inspect <tag>",
+	Short: "Print details of an image in JSON",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		store, err := openImageStore()
+		if err != nil {
+			return
+		}
+
+		img, err := store.Get(args[0])
+		if err != nil {
+			return
+		}
+		kernelPath, err := store.BlobPath(img.Kernel.Digest)
+		if err != nil {
+			return
+		}
+		rootFSPath, err := store.BlobPath(img.RootFS.Digest)
+		if err != nil {
+			return
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(struct {
+			imagestore.Image
+			KernelPath string `json:"kernel_path"`
+			RootFSPath string `json:"rootfs_path"`
+		}{
+			Image:      img,
+			KernelPath: kernelPath,
+			RootFSPath: rootFSPath,
+		})
+		return
+	},
+}
+
+var imagesRemoveCmd = &cobra.Command{
+	Use:   "remove <tag>...",
+	Short: "Remove tags, whose files are deleted by gc",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		store, err := openImageStore()
+		if err != nil {
+			return
+		}
+
+		for _, tag := range args {
+			err = store.Remove(tag)
+			if err != nil {
+				err = fmt.Errorf("removing image: %w", err)
+				return
+			}
+			fmt.Printf("removed %s\n", tag)
+		}
+
+		return
+	},
+}
+
+var imagesGCCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Delete kernels and RootFS images no tag points to",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		store, err := openImageStore()
+		if err != nil {
+			return
+		}
+
+		removed, freed, err := store.GC()
+		if err != nil {
+			err = fmt.Errorf("collecting garbage: %w", err)
+			return
+		}
+
+		for _, name := range removed {
+			fmt.Printf("deleted %s\n", name)
+		}
+		fmt.Printf("%s freed\n", helper.HumanSize(freed))
+		return
+	},
+}
+
+// openImageStore opens the store in flags or config,
+// it's fine to have no config.
+func openImageStore() (store *imagestore.Store, err error) {
+	dir := imagesStoreDir
+	if dir == "" {
+		cfg, loadErr := loadConfig()
+		if loadErr != nil && !errors.Is(loadErr, fs.ErrNotExist) {
+			err = fmt.Errorf("loading config: %w", loadErr)
+			return
+		}
+		dir = cfg.Executor.ImageStoreDir
+	}
+
+	return imagestore.Open(dir)
+}
+
+func shortDigest(digest string) string {
+	digest = strings.TrimPrefix(digest, "sha256:")
+	if len(digest) > 12 {
+		return digest[:12]
+	}
+
+	return digest
+}
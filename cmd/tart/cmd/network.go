@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/nanmu42/tart/vmnet"
+
+	"go.uber.org/zap"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(networkCmd)
+	networkCmd.AddCommand(networkSetupCmd)
+	networkCmd.AddCommand(networkTeardownCmd)
+}
+
+var networkCmd = &cobra.Command{
+	Use:   "network",
+	Short: "Manage host network for microVMs, requires CAP_NET_ADMIN",
+}
+
+var networkSetupCmd = &cobra.Command{
+	Use:   "setup",
+	Short: "Create bridge, tap devices and NAT rules per config, it's safe to run multiple times",
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		cfg, err := loadConfig()
+		if err != nil {
+			err = fmt.Errorf("loading config: %w", err)
+			return
+		}
+
+		err = vmnet.Setup(cfg.Network)
+		if err != nil {
+			err = fmt.Errorf("setting up network: %w", err)
+			return
+		}
+
+		fmt.Printf("network is ready, tap devices: %v\n", cfg.Network.TapNames())
+		return
+	},
+}
+
+var networkTeardownCmd = &cobra.Command{
+	Use:   "teardown",
+	Short: "Remove bridge, tap devices and NAT rules created by setup",
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		cfg, err := loadConfig()
+		if err != nil {
+			err = fmt.Errorf("loading config: %w", err)
+			return
+		}
+
+		err = vmnet.Teardown(cfg.Network)
+		if err != nil {
+			err = fmt.Errorf("tearing down network: %w", err)
+			return
+		}
+
+		return
+	},
+}
+
+// autoSetupNetwork sets up network if it's configured to be automatic,
+// the returned teardown is always non-nil.
+func autoSetupNetwork(logger *zap.Logger, cfg vmnet.Config) (teardown func(), err error) {
+	teardown = func() {}
+	if !cfg.Auto {
+		return
+	}
+
+	err = vmnet.Setup(cfg)
+	if err != nil {
+		err = fmt.Errorf("setting up network: %w", err)
+		return
+	}
+	logger.Info("network is ready", zap.Strings("tapDevices", cfg.TapNames()))
+
+	teardown = func() {
+		err := vmnet.Teardown(cfg)
+		if err != nil {
+			logger.Warn("tearing down network", zap.Error(err))
+			return
+		}
+		logger.Info("network is torn down")
+	}
+
+	return
+}
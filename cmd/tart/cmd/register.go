@@ -7,6 +7,7 @@ import (
 	"github.com/nanmu42/tart/config"
 	"github.com/nanmu42/tart/executor"
 	"github.com/nanmu42/tart/network"
+	"github.com/nanmu42/tart/vmnet"
 
 	"github.com/pelletier/go-toml/v2"
 
@@ -58,14 +59,18 @@ tart register --endpoint https://gitlab.example.com --token your_token_here > ta
 			GitlabEndpoint: endpoint,
 			AccessToken:    accessToken,
 			Executor: executor.Config{
-				KernelPath: "vmlinux-5.10.bin",
-				RootFSPath: "jammy.rootfs.ext4",
-				IP:         "172.18.0.2",
-				GatewayIP:  "172.18.0.1",
-				Netmask:    "255.255.255.0",
-				TapDevice:  "tap0",
-				TapMac:     "AA:FC:42:42:66:88",
+				Hypervisor:  executor.HypervisorFirecracker,
+				KernelPath:  "vmlinux-5.10.bin",
+				RootFSPath:  "jammy.rootfs.ext4",
+				IP:          "172.18.0.2",
+				GatewayIP:   "172.18.0.1",
+				Netmask:     "255.255.255.0",
+				TapDevice:   "tart0-tap0",
+				TapMac:      "AA:FC:42:42:66:88",
+				Nameservers: []string{"223.5.5.5", "223.6.6.6"},
+				MMDSVersion: executor.MMDSv1,
 			},
+			Network: vmnet.DefaultConfig(),
 		}
 
 		encoder := toml.NewEncoder(os.Stdout)
@@ -56,6 +56,11 @@ func loadConfig() (cfg config.Config, err error) {
 		err = fmt.Errorf("decoding config from TOML: %w", err)
 		return
 	}
+	err = cfg.Validate()
+	if err != nil {
+		err = fmt.Errorf("validating config: %w", err)
+		return
+	}
 
 	return
 }
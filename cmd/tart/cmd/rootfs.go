@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/nanmu42/tart/rootfs"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	rootfsOutput      string
+	rootfsSizeMiB     int64
+	rootfsRef         string
+	rootfsPlatform    string
+	rootfsAgent       string
+	rootfsNameservers []string
+)
+
+func init() {
+	rootCmd.AddCommand(rootfsCmd)
+	rootfsCmd.AddCommand(rootfsBuildCmd)
+	rootfsBuildCmd.Flags().StringVarP(&rootfsOutput, "output", "o", "rootfs.ext4", "path of the ext4 image")
+	rootfsBuildCmd.Flags().Int64Var(&rootfsSizeMiB, "size", 2048, "size of the image in MiB")
+	rootfsBuildCmd.Flags().StringVar(&rootfsRef, "ref", "", "image to pick if the source contains many, e.g. golang:1.19")
+	rootfsBuildCmd.Flags().StringVar(&rootfsPlatform, "platform", "linux/amd64", "platform to pick in multi-platform images")
+	rootfsBuildCmd.Flags().StringVar(&rootfsAgent, "agent", "", "statically linked tart binary installed into the image for agent transport, e.g. built with CGO_ENABLED=0")
+	rootfsBuildCmd.Flags().StringSliceVar(&rootfsNameservers, "nameserver", []string{"223.5.5.5", "223.6.6.6"}, "nameservers in /etc/resolv.conf, which MMDS metadata overrides at boot")
+}
+
+var rootfsCmd = &cobra.Command{
+	Use:   "rootfs",
+	Short: "Manage RootFS images of microVMs",
+}
+
+var rootfsBuildCmd = &cobra.Command{
+	Use:   "build <OCI image layout or docker save tarball>",
+	Short: "Build a RootFS image from a container image, requires neither root nor Docker",
+	Long: `Build a RootFS image from a container image, requires neither root nor Docker.
+
+The source is an OCI image layout directory, e.g. made by skopeo copy docker://golang:1.19 oci:golang,
+or a tarball made by docker save. Layers are applied with whiteouts, Tart's guest requirements are added,
+and an ext4 image is written with mkfs.ext4 and debugfs of e2fsprogs 1.43 or newer.
+
+The container image must come with systemd, openssh-server, curl, jq, iproute2 and git,
+which jammy.rootfs.ext4 installs in in-container-setup.sh.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		err = rootfs.Build(cmd.Context(), rootfs.BuildOpt{
+			Source:      args[0],
+			Ref:         rootfsRef,
+			Platform:    rootfsPlatform,
+			Output:      rootfsOutput,
+			Size:        rootfsSizeMiB << 20,
+			Nameservers: rootfsNameservers,
+			AgentPath:   rootfsAgent,
+		})
+		if err != nil {
+			err = fmt.Errorf("building RootFS: %w", err)
+			return
+		}
+
+		fmt.Printf("RootFS is written to %s\n", rootfsOutput)
+		return
+	},
+}
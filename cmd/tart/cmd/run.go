@@ -6,8 +6,10 @@ import (
 	"fmt"
 
 	"github.com/nanmu42/tart/executor"
+	"github.com/nanmu42/tart/metrics"
 	"github.com/nanmu42/tart/network"
 	"github.com/nanmu42/tart/runner"
+	"github.com/nanmu42/tart/session"
 
 	"go.uber.org/zap"
 
@@ -36,9 +38,26 @@ var runCmd = &cobra.Command{
 			return
 		}
 
+		teardownNetwork, err := autoSetupNetwork(logger, cfg.Network)
+		if err != nil {
+			return
+		}
+		defer teardownNetwork()
+
+		startMetricsServer(ctx, logger, cfg.Metrics)
+
+		sessionServer, err := startSessionServer(ctx, logger, cfg.Session)
+		if err != nil {
+			return
+		}
+		features := executor.SupportFeatures()
+		features.Terminal = sessionServer != nil
+		features.Session = sessionServer != nil
+		features.Artifacts = cfg.Executor.TransfersArtifacts()
+
 		client, err := network.NewClient(network.ClientOpt{
 			Endpoint: cfg.GitlabEndpoint,
-			Features: executor.SupportFeatures(),
+			Features: features,
 		})
 		if err != nil {
 			err = fmt.Errorf("initializing Gitlab client: %w", err)
@@ -50,6 +69,7 @@ var runCmd = &cobra.Command{
 			AccessToken:    cfg.AccessToken,
 			Client:         client,
 			ExecutorConfig: cfg.Executor,
+			SessionServer:  sessionServer,
 		})
 		if err != nil {
 			err = fmt.Errorf("initializing runner: %w", err)
@@ -87,3 +107,41 @@ func runSingle(ctx context.Context, tart *runner.Runner) (err error) {
 
 	return
 }
+
+// startMetricsServer serves metrics of the runner and jobs if it's enabled.
+func startMetricsServer(ctx context.Context, logger *zap.Logger, cfg metrics.Config) {
+	if cfg.ListenAddress == "" {
+		return
+	}
+
+	go func() {
+		logger.Info("serving metrics", zap.String("address", cfg.ListenAddress))
+		metricsErr := metrics.Serve(ctx, cfg.ListenAddress, metrics.Default)
+		if metricsErr != nil {
+			logger.Error("serving metrics", zap.Error(metricsErr))
+		}
+	}()
+}
+
+// startSessionServer serves web terminals of jobs if it's enabled, returning nil otherwise.
+func startSessionServer(ctx context.Context, logger *zap.Logger, cfg session.Config) (server *session.Server, err error) {
+	if !cfg.Enabled() {
+		return
+	}
+
+	server, err = session.NewServer(logger, cfg)
+	if err != nil {
+		err = fmt.Errorf("initializing session server: %w", err)
+		return
+	}
+
+	go func() {
+		logger.Info("serving sessions", zap.String("address", cfg.ListenAddress))
+		sessionErr := server.Serve(ctx)
+		if sessionErr != nil {
+			logger.Error("serving sessions", zap.Error(sessionErr))
+		}
+	}()
+
+	return
+}
@@ -35,9 +35,26 @@ var singleCmd = &cobra.Command{
 			return
 		}
 
+		teardownNetwork, err := autoSetupNetwork(logger, cfg.Network)
+		if err != nil {
+			return
+		}
+		defer teardownNetwork()
+
+		startMetricsServer(ctx, logger, cfg.Metrics)
+
+		sessionServer, err := startSessionServer(ctx, logger, cfg.Session)
+		if err != nil {
+			return
+		}
+		features := executor.SupportFeatures()
+		features.Terminal = sessionServer != nil
+		features.Session = sessionServer != nil
+		features.Artifacts = cfg.Executor.TransfersArtifacts()
+
 		client, err := network.NewClient(network.ClientOpt{
 			Endpoint: cfg.GitlabEndpoint,
-			Features: executor.SupportFeatures(),
+			Features: features,
 		})
 		if err != nil {
 			err = fmt.Errorf("initializing Gitlab client: %w", err)
@@ -49,6 +66,7 @@ var singleCmd = &cobra.Command{
 			AccessToken:    cfg.AccessToken,
 			Client:         client,
 			ExecutorConfig: cfg.Executor,
+			SessionServer:  sessionServer,
 		})
 		if err != nil {
 			err = fmt.Errorf("initializing runner: %w", err)
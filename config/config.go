@@ -1,6 +1,13 @@
 package config
 
-import "github.com/nanmu42/tart/executor"
+import (
+	"fmt"
+
+	"github.com/nanmu42/tart/executor"
+	"github.com/nanmu42/tart/metrics"
+	"github.com/nanmu42/tart/session"
+	"github.com/nanmu42/tart/vmnet"
+)
 
 type Config struct {
 	// Gitlab instance URL, only scheme + host, e.g. https://gitlab.example.com
@@ -10,4 +17,24 @@ type Config struct {
 
 	// config of executor
 	Executor executor.Config `comment:"config of executor"`
+	// host network for microVMs
+	Network vmnet.Config `comment:"host network for microVMs, managed by tart network setup/teardown"`
+	// metrics of the runner
+	Metrics metrics.Config `comment:"metrics of the runner and jobs in Prometheus format"`
+	// session server of web terminals
+	Session session.Config `comment:"session server through which Gitlab opens interactive web terminals into running jobs, which requires ssh transport"`
+}
+
+// Validate checks what spans sections of the config,
+// each section is validated where it's used.
+func (c Config) Validate() (err error) {
+	if c.Session.Enabled() {
+		err = c.Executor.ValidateTerminal()
+		if err != nil {
+			err = fmt.Errorf("session: %w", err)
+			return
+		}
+	}
+
+	return
 }
@@ -0,0 +1,207 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// BootConfig controls how Tart waits for the microVM to boot.
+type BootConfig struct {
+	// how readiness of microVM is detected
+	Readiness string `comment:"how readiness of microVM is detected, poll keeps trying to connect, console waits for the guest to print ConsoleMarker on serial console first. Defaults to poll"`
+	// line printed on serial console by the guest once it's ready
+	ConsoleMarker string `comment:"line printed on serial console by the guest once it's ready, defaults to TART-READY"`
+	// overall boot timeout
+	Timeout string `comment:"overall timeout of booting and connecting to microVM, e.g. 30s, defaults to 60s"`
+}
+
+const (
+	ReadinessPoll    = "poll"
+	ReadinessConsole = "console"
+
+	defaultConsoleMarker = "TART-READY"
+	defaultBootTimeout   = 60 * time.Second
+
+	kernelPanicMarker = "Kernel panic - not syncing"
+)
+
+func (c BootConfig) Validate() (err error) {
+	switch c.Readiness {
+	case "", ReadinessPoll, ReadinessConsole:
+	default:
+		err = fmt.Errorf("unknown readiness %q", c.Readiness)
+		return
+	}
+
+	_, err = c.timeout()
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func (c BootConfig) readiness() string {
+	if c.Readiness == "" {
+		return ReadinessPoll
+	}
+
+	return c.Readiness
+}
+
+func (c BootConfig) consoleMarker() string {
+	if c.ConsoleMarker == "" {
+		return defaultConsoleMarker
+	}
+
+	return c.ConsoleMarker
+}
+
+func (c BootConfig) timeout() (timeout time.Duration, err error) {
+	if c.Timeout == "" {
+		timeout = defaultBootTimeout
+		return
+	}
+
+	timeout, err = time.ParseDuration(c.Timeout)
+	if err != nil {
+		err = fmt.Errorf("parsing boot timeout: %w", err)
+		return
+	}
+	if timeout <= 0 {
+		err = fmt.Errorf("boot timeout must be positive, got %s", timeout)
+		return
+	}
+
+	return
+}
+
+// bootWatcher follows serial console and hypervisor process during boot.
+// It's an io.Writer receiving the console.
+type bootWatcher struct {
+	marker []byte
+
+	mu sync.Mutex
+	// incomplete line
+	partial []byte
+	ready   chan struct{}
+	dead    chan struct{}
+	cause   error
+}
+
+func newBootWatcher(marker string) *bootWatcher {
+	return &bootWatcher{
+		marker: []byte(marker),
+		ready:  make(chan struct{}),
+		dead:   make(chan struct{}),
+	}
+}
+
+func (b *bootWatcher) Write(p []byte) (n int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n = len(p)
+	b.partial = append(b.partial, p...)
+	for {
+		idx := bytes.IndexByte(b.partial, '\n')
+		if idx < 0 {
+			break
+		}
+		line := bytes.TrimRight(b.partial[:idx], "\r")
+		b.partial = b.partial[idx+1:]
+
+		if bytes.Equal(bytes.TrimSpace(line), b.marker) {
+			b.markReady()
+		}
+		if bytes.Contains(line, []byte(kernelPanicMarker)) {
+			b.markDead(errors.New("kernel panic"))
+		}
+	}
+
+	// a console without line breaks should not pile up
+	if len(b.partial) > 4096 {
+		b.partial = nil
+	}
+
+	return
+}
+
+// the caller must hold the lock
+func (b *bootWatcher) markReady() {
+	select {
+	case <-b.ready:
+	default:
+		close(b.ready)
+	}
+}
+
+// the caller must hold the lock
+func (b *bootWatcher) markDead(cause error) {
+	select {
+	case <-b.dead:
+	default:
+		b.cause = cause
+		close(b.dead)
+	}
+}
+
+// exited reports the hypervisor has exited.
+func (b *bootWatcher) exited(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		err = errors.New("hypervisor exited")
+	} else {
+		err = fmt.Errorf("hypervisor exited: %w", err)
+	}
+	b.markDead(err)
+}
+
+// err returns why the microVM died, or nil if it's alive.
+func (b *bootWatcher) err() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.cause
+}
+
+// watch returns a context of boot timeout, which is cancelled as soon as
+// the microVM is found dead.
+func (b *bootWatcher) watch(ctx context.Context, timeout time.Duration, wait func(ctx context.Context) error) (bootCtx context.Context, cancel context.CancelFunc) {
+	bootCtx, cancel = context.WithTimeout(ctx, timeout)
+
+	go func() {
+		waitErr := wait(bootCtx)
+		if bootCtx.Err() != nil {
+			// boot is over, the process is alive then
+			return
+		}
+		b.exited(waitErr)
+	}()
+	go func() {
+		select {
+		case <-b.dead:
+			cancel()
+		case <-bootCtx.Done():
+		}
+	}()
+
+	return
+}
+
+// waitReady waits for the console marker.
+func (b *bootWatcher) waitReady(ctx context.Context) (err error) {
+	select {
+	case <-b.ready:
+	case <-ctx.Done():
+		err = fmt.Errorf("waiting for ready marker on serial console: %w", ctx.Err())
+	}
+
+	return
+}
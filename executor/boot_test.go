@@ -0,0 +1,59 @@
+package executor
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBootWatcher_Ready(t *testing.T) {
+	b := newBootWatcher(defaultConsoleMarker)
+	_, _ = io.WriteString(b, "[    1.000000] systemd[1]: Starting Print Tart ready marker...\r\n")
+	_, _ = io.WriteString(b, "TART-")
+	select {
+	case <-b.ready:
+		t.Fatal("ready before the marker line is complete")
+	default:
+	}
+
+	_, _ = io.WriteString(b, "READY\r")
+	_, _ = io.WriteString(b, "\n[    2.000000] systemd[1]: Reached target Multi-User System.\r\n")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, b.waitReady(ctx))
+	assert.NoError(t, b.err())
+
+	// a mention is no marker
+	b = newBootWatcher(defaultConsoleMarker)
+	_, _ = io.WriteString(b, "echo TART-READY > /dev/ttyS0\n")
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Error(t, b.waitReady(ctx))
+}
+
+func TestBootWatcher_KernelPanic(t *testing.T) {
+	b := newBootWatcher(defaultConsoleMarker)
+	bootCtx, cancel := b.watch(context.Background(), time.Minute, func(ctx context.Context) error {
+		// the hypervisor lives on
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	defer cancel()
+
+	_, _ = io.WriteString(b, "[    0.500000] Kernel pan")
+	_, _ = io.WriteString(b, "ic - not syncing: VFS: Unable to mount root fs")
+	assert.NoError(t, b.err())
+	_, _ = io.WriteString(b, " on unknown-block(0,0)\r\n")
+
+	select {
+	case <-bootCtx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("boot goes on after kernel panic")
+	}
+	assert.EqualError(t, b.err(), "kernel panic")
+	assert.Error(t, b.waitReady(bootCtx))
+}
@@ -41,13 +41,31 @@ func (b *Build) repoURL() string {
 	return b.job.GitInfo.RepoURL
 }
 
-func (b *Build) PrepareScript(w io.Writer) (err error) {
+// variable returns value of the job variable, or empty string if it's absent.
+func (b *Build) variable(key string) string {
+	for _, v := range b.job.Variables {
+		if v.Key == key {
+			return v.Value
+		}
+	}
+
+	return ""
+}
+
+// PrepareScript clones the repo, borrowing objects from the mirror
+// at reference if it's not empty.
+func (b *Build) PrepareScript(w io.Writer, reference string) (err error) {
 	_, err = io.WriteString(w, "set -euo pipefail\n")
 	if err != nil {
 		return
 	}
 
-	_, err = io.WriteString(w, fmt.Sprintf("git clone -b %s --single-branch --depth %d %s %s\n",
+	referenceArg := ""
+	if reference != "" {
+		referenceArg = "--reference-if-able " + helper.ShellEscape(reference) + " "
+	}
+	_, err = io.WriteString(w, fmt.Sprintf("git clone %s-b %s --single-branch --depth %d %s %s\n",
+		referenceArg,
 		b.job.GitInfo.Ref,
 		b.job.GitInfo.Depth,
 		b.job.GitInfo.RepoURL,
@@ -92,26 +110,21 @@ func (b *Build) BuildScript(w io.Writer) (err error) {
 			return
 		}
 
-		_, err = io.WriteString(w, "set +x\n")
-		if err != nil {
-			return
-		}
-
 		stepName := step.Name
 		if stepName == "" {
 			stepName = strconv.Itoa(idx)
 		}
-		_, err = fmt.Fprintf(w, "echo %s\n", color.BlueString("running step %s...", stepName))
-		if err != nil {
-			return
-		}
-
-		_, err = io.WriteString(w, "set -x\n")
+		_, err = fmt.Fprintf(w, "echo %s\n", helper.ShellEscape(color.BlueString("running step %s...", stepName)))
 		if err != nil {
 			return
 		}
 
+		// commands are echoed as written, unlike set -x, which reveals values of variables
 		for _, script := range step.Script {
+			_, err = fmt.Fprintf(w, "echo %s\n", helper.ShellEscape(color.GreenString("$ %s", script)))
+			if err != nil {
+				return
+			}
 			_, err = io.WriteString(w, script)
 			if err != nil {
 				return
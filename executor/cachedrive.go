@@ -0,0 +1,316 @@
+package executor
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// CacheDriveConfig attaches a persistent ext4 volume to microVMs,
+// which keeps things like ~/go/pkg/mod, ~/.cargo and ~/.npm across jobs.
+type CacheDriveConfig struct {
+	// directory of volumes, enables cache drive if not empty
+	Dir string `comment:"directory of cache volumes on the host, enables cache drive if not empty. Under jailer, it must be on the same file system as ChrootBaseDir"`
+	// where the volume is mounted in microVM
+	MountPoint string `comment:"where the volume is mounted in microVM, defaults to /cache"`
+	// what volumes are keyed by
+	Key string `comment:"what volumes are keyed by, project or ref, defaults to project. ref gives every branch and tag of a project its own volume"`
+	// size quota of each volume
+	SizeMiB int `comment:"size of each volume in MiB, which is the quota, defaults to 10240"`
+	// how long a job waits for the volume in use
+	WaitTimeout string `comment:"how long a job waits for the volume used by another job, e.g. 5m, defaults to 10m. The job runs without the volume after that"`
+}
+
+const (
+	CacheKeyProject = "project"
+	CacheKeyRef     = "ref"
+
+	defaultCacheMountPoint  = "/cache"
+	defaultCacheSizeMiB     = 10240
+	defaultCacheWaitTimeout = 10 * time.Minute
+)
+
+func (c CacheDriveConfig) Validate() (err error) {
+	if c.Dir == "" {
+		return
+	}
+
+	switch c.Key {
+	case "", CacheKeyProject, CacheKeyRef:
+	default:
+		err = fmt.Errorf("unknown key %q", c.Key)
+		return
+	}
+	if c.SizeMiB < 0 {
+		err = fmt.Errorf("size must not be negative, got %d", c.SizeMiB)
+		return
+	}
+	if c.MountPoint != "" && !filepath.IsAbs(c.MountPoint) {
+		err = fmt.Errorf("mount point %s is not absolute", c.MountPoint)
+		return
+	}
+	_, err = c.waitTimeout()
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func (c CacheDriveConfig) enabled() bool {
+	return c.Dir != ""
+}
+
+func (c CacheDriveConfig) mountPoint() string {
+	if c.MountPoint == "" {
+		return defaultCacheMountPoint
+	}
+
+	return c.MountPoint
+}
+
+func (c CacheDriveConfig) size() int64 {
+	if c.SizeMiB == 0 {
+		return defaultCacheSizeMiB << 20
+	}
+
+	return int64(c.SizeMiB) << 20
+}
+
+func (c CacheDriveConfig) waitTimeout() (timeout time.Duration, err error) {
+	if c.WaitTimeout == "" {
+		timeout = defaultCacheWaitTimeout
+		return
+	}
+
+	timeout, err = time.ParseDuration(c.WaitTimeout)
+	if err != nil {
+		err = fmt.Errorf("parsing wait timeout: %w", err)
+		return
+	}
+
+	return
+}
+
+// cacheKey names the volume of build.
+func (c CacheDriveConfig) cacheKey(build *Build) string {
+	key := fmt.Sprintf("project-%d", build.job.JobInfo.ProjectID)
+	if c.Key == CacheKeyRef {
+		sum := sha256.Sum256([]byte(build.job.GitInfo.Ref))
+		key += "-" + hex.EncodeToString(sum[:8])
+	}
+
+	return key
+}
+
+// cacheVolume is a persistent ext4 image, locked while it's attached.
+type cacheVolume struct {
+	path string
+	lock *os.File
+}
+
+// openCacheVolume locks the volume of key, and creates, resizes or repairs it as needed.
+// Volumes are never shared, a job waits until the volume is released by others.
+func openCacheVolume(ctx context.Context, config CacheDriveConfig, key string, logger *zap.Logger) (v *cacheVolume, err error) {
+	err = os.MkdirAll(config.Dir, 0755)
+	if err != nil {
+		err = fmt.Errorf("creating cache directory: %w", err)
+		return
+	}
+
+	lock, err := os.OpenFile(filepath.Join(config.Dir, key+".lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		err = fmt.Errorf("opening lock file: %w", err)
+		return
+	}
+	timeout, _ := config.waitTimeout()
+	err = flockUntil(ctx, lock, timeout)
+	if err != nil {
+		_ = lock.Close()
+		return
+	}
+
+	v = &cacheVolume{
+		path: filepath.Join(config.Dir, key+".ext4"),
+		lock: lock,
+	}
+	defer func() {
+		if err != nil {
+			v.release()
+			v = nil
+		}
+	}()
+
+	err = v.ensure(ctx, config.size(), logger)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// flockUntil takes an exclusive lock on file, giving up after timeout.
+func flockUntil(ctx context.Context, file *os.File, timeout time.Duration) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			err = fmt.Errorf("locking volume: %w", err)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			err = fmt.Errorf("volume is in use by another job, gave up after %s", timeout)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ensure makes the volume usable with size.
+// A corrupted volume that can not be repaired is recreated, which empties the cache.
+func (v *cacheVolume) ensure(ctx context.Context, size int64, logger *zap.Logger) (err error) {
+	info, err := os.Stat(v.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		err = mkfsExt4(ctx, v.path, size, "cache", "", true)
+		if err != nil {
+			err = fmt.Errorf("creating volume: %w", err)
+			return
+		}
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("stat volume: %w", err)
+		return
+	}
+
+	err = fsckExt4(ctx, v.path)
+	if err == nil && info.Size() != size {
+		err = resizeExt4(ctx, v.path, size)
+	}
+	if err == nil {
+		return
+	}
+
+	logger.Warn("recreating cache volume", zap.String("path", v.path), zap.Error(err))
+	err = mkfsExt4(ctx, v.path, size, "cache", "", true)
+	if err != nil {
+		err = fmt.Errorf("recreating volume: %w", err)
+		return
+	}
+
+	return
+}
+
+func (v *cacheVolume) release() {
+	_ = syscall.Flock(int(v.lock.Fd()), syscall.LOCK_UN)
+	_ = v.lock.Close()
+}
+
+// fsckExt4 checks and repairs the image, errors if it's beyond repair.
+func fsckExt4(ctx context.Context, path string) (err error) {
+	output, err := exec.CommandContext(ctx, "e2fsck", "-p", "-f", path).CombinedOutput()
+	var exitErr *exec.ExitError
+	// 1 and 2 mean errors are corrected
+	if errors.As(err, &exitErr) && exitErr.ExitCode() <= 2 {
+		err = nil
+	}
+	if err != nil {
+		err = fmt.Errorf("running e2fsck: %w, output: %s", err, output)
+		return
+	}
+
+	return
+}
+
+func resizeExt4(ctx context.Context, path string, size int64) (err error) {
+	if info, statErr := os.Stat(path); statErr == nil && info.Size() < size {
+		// resize2fs grows the file system to the file size
+		err = os.Truncate(path, size)
+		if err != nil {
+			err = fmt.Errorf("growing volume: %w", err)
+			return
+		}
+	}
+
+	output, err := exec.CommandContext(ctx, "resize2fs", path, strconv.FormatInt(size/1024, 10)+"K").CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("running resize2fs: %w, output: %s", err, output)
+		return
+	}
+
+	err = os.Truncate(path, size)
+	if err != nil {
+		err = fmt.Errorf("truncating volume: %w", err)
+		return
+	}
+
+	return
+}
+
+// cacheDrive locks and prepares the cache volume of the job, and returns its path for the microVM.
+// The volume stays locked until the microVM is closed. If it's in use by another job past
+// the wait timeout or fails to prepare, the job runs without it, holding no lock,
+// and an empty path is returned.
+func (e *MicroVM) cacheDrive(ctx context.Context) (path string) {
+	key := e.config.CacheDrive.cacheKey(e.build)
+	err := e.line("Attaching cache volume %s...", key)
+	if err != nil {
+		return
+	}
+
+	v, err := openCacheVolume(ctx, e.config.CacheDrive, key, e.logger)
+	if err == nil {
+		path = v.path
+		if e.config.Jailer.Enabled {
+			// drives must reside in the chroot under jailer, the volume is persistent thus linked
+			path = filepath.Join(e.config.Jailer.chrootDir(e.vmID), "cache.ext4")
+			err = os.Link(v.path, path)
+			if err != nil {
+				err = fmt.Errorf("linking volume into chroot: %w", err)
+				v.release()
+			}
+		}
+	}
+	if err != nil {
+		path = ""
+		e.logger.Warn("cache volume is not available", zap.Error(err))
+		_ = e.yellowLine("Cache volume is skipped: %s", err)
+		return
+	}
+
+	e.cacheVolume = v
+	return
+}
+
+// mountCache mounts the cache drive in the microVM.
+func (e *MicroVM) mountCache(ctx context.Context, device string) (err error) {
+	script := fmt.Sprintf("mkdir -p %[1]s && mount %[2]s %[1]s", e.config.CacheDrive.mountPoint(), device)
+	err = e.RunStep(ctx, StageGetSources, script)
+	if err != nil {
+		err = fmt.Errorf("mounting cache drive: %w", err)
+		return
+	}
+
+	return
+}
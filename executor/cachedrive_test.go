@@ -0,0 +1,84 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestCacheVolume(t *testing.T) {
+	ctx := context.Background()
+	config := CacheDriveConfig{
+		Dir:         t.TempDir(),
+		SizeMiB:     16,
+		WaitTimeout: "1s",
+	}
+
+	v, err := openCacheVolume(ctx, config, "project-1", zap.NewNop())
+	require.NoError(t, err)
+	info, err := os.Stat(v.path)
+	require.NoError(t, err)
+	assert.EqualValues(t, 16<<20, info.Size())
+
+	// only one job at a time
+	_, err = openCacheVolume(ctx, config, "project-1", zap.NewNop())
+	assert.ErrorContains(t, err, "in use by another job")
+	other, err := openCacheVolume(ctx, config, "project-2", zap.NewNop())
+	require.NoError(t, err)
+	other.release()
+	v.release()
+
+	// quota follows config
+	config.SizeMiB = 32
+	v, err = openCacheVolume(ctx, config, "project-1", zap.NewNop())
+	require.NoError(t, err)
+	info, err = os.Stat(v.path)
+	require.NoError(t, err)
+	assert.EqualValues(t, 32<<20, info.Size())
+	assert.NoError(t, fsckExt4(ctx, v.path))
+	v.release()
+
+	// a broken volume is recreated
+	require.NoError(t, os.WriteFile(v.path, []byte("garbage"), 0644))
+	v, err = openCacheVolume(ctx, config, "project-1", zap.NewNop())
+	require.NoError(t, err)
+	assert.NoError(t, fsckExt4(ctx, v.path))
+	v.release()
+}
+
+// stuckHypervisor fails to stop.
+type stuckHypervisor struct {
+	hypervisor
+}
+
+func (stuckHypervisor) stop(_ context.Context) error {
+	return errors.New("firecracker is stuck")
+}
+
+func TestMicroVM_CloseReleasesCacheVolume(t *testing.T) {
+	ctx := context.Background()
+	config := CacheDriveConfig{
+		Dir:         t.TempDir(),
+		SizeMiB:     16,
+		WaitTimeout: "1s",
+	}
+	v, err := openCacheVolume(ctx, config, "project-1", zap.NewNop())
+	require.NoError(t, err)
+
+	e := &MicroVM{
+		logger:      zap.NewNop(),
+		hypervisor:  stuckHypervisor{},
+		cacheVolume: v,
+	}
+	assert.ErrorContains(t, e.Close(ctx), "firecracker is stuck")
+
+	// the next job of the project gets the volume
+	v, err = openCacheVolume(ctx, config, "project-1", zap.NewNop())
+	require.NoError(t, err)
+	v.release()
+}
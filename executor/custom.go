@@ -0,0 +1,402 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/nanmu42/tart/version"
+
+	"go.uber.org/zap"
+)
+
+// CustomConfig is config of custom executor, which drives executables
+// following the contract of GitLab Runner custom executor:
+// https://docs.gitlab.com/runner/executors/custom.html
+type CustomConfig struct {
+	// executable printing driver config
+	ConfigExec string `comment:"optional executable printing driver config in JSON, like hostname, driver and job_env"`
+	// arguments of ConfigExec
+	ConfigArgs []string `comment:"arguments of ConfigExec"`
+	// timeout of ConfigExec
+	ConfigExecTimeout string `comment:"timeout of ConfigExec, e.g. 10m, defaults to 1h"`
+	// executable preparing the environment
+	PrepareExec string `comment:"optional executable preparing the environment"`
+	// arguments of PrepareExec
+	PrepareArgs []string `comment:"arguments of PrepareExec"`
+	// timeout of PrepareExec
+	PrepareExecTimeout string `comment:"timeout of PrepareExec, e.g. 10m, defaults to 1h"`
+	// executable running scripts
+	RunExec string `comment:"executable running scripts, which is called with RunArgs, path to the script and name of the stage"`
+	// arguments of RunExec
+	RunArgs []string `comment:"arguments of RunExec, placed before path to the script and name of the stage"`
+	// executable cleaning up the environment
+	CleanupExec string `comment:"optional executable cleaning up the environment, which always runs at the end of the job"`
+	// arguments of CleanupExec
+	CleanupArgs []string `comment:"arguments of CleanupExec"`
+	// timeout of CleanupExec
+	CleanupExecTimeout string `comment:"timeout of CleanupExec, e.g. 10m, defaults to 1h"`
+	// time between SIGTERM and SIGKILL
+	GracefulKillTimeout string `comment:"how long an executable is given to exit after SIGTERM on job cancellation or timeout before it's killed, defaults to 10m"`
+}
+
+const (
+	// exit codes telling the kind of failure, passed to executables
+	customBuildFailureExitCode  = 1
+	customSystemFailureExitCode = 2
+
+	defaultCustomExecTimeout   = time.Hour
+	defaultGracefulKillTimeout = 10 * time.Minute
+)
+
+func (c CustomConfig) Validate() (err error) {
+	if c.RunExec == "" {
+		err = errors.New("run exec is required")
+		return
+	}
+
+	for name, value := range map[string]string{
+		"config exec timeout":   c.ConfigExecTimeout,
+		"prepare exec timeout":  c.PrepareExecTimeout,
+		"cleanup exec timeout":  c.CleanupExecTimeout,
+		"graceful kill timeout": c.GracefulKillTimeout,
+	} {
+		_, err = customTimeout(value, time.Second)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", name, err)
+			return
+		}
+	}
+
+	return
+}
+
+// customTimeout parses value, which falls back to fallback when empty.
+func customTimeout(value string, fallback time.Duration) (timeout time.Duration, err error) {
+	if value == "" {
+		timeout = fallback
+		return
+	}
+
+	timeout, err = time.ParseDuration(value)
+	if err != nil {
+		err = fmt.Errorf("parsing timeout: %w", err)
+		return
+	}
+	if timeout <= 0 {
+		err = fmt.Errorf("timeout must be positive, got %s", timeout)
+		return
+	}
+
+	return
+}
+
+// customDriverConfig is what ConfigExec prints.
+type customDriverConfig struct {
+	Hostname string `json:"hostname"`
+	Driver   struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"driver"`
+	// extra environment variables of the following executables
+	JobEnv map[string]string `json:"job_env"`
+}
+
+// Custom runs the job with executables of GitLab Runner custom executor.
+type Custom struct {
+	logger *zap.Logger
+	build  *Build
+	config Config
+
+	tracer
+	// TMPDIR of executables, where scripts are written
+	tmpDir string
+	// environment of executables
+	env []string
+}
+
+func NewCustom(opt Option) (c *Custom, err error) {
+	err = opt.validate()
+	if err != nil {
+		return
+	}
+
+	c = &Custom{
+		logger: opt.Logger.With(zap.Int("jobId", opt.Build.job.ID)),
+		build:  opt.Build,
+		config: opt.Config,
+		tracer: tracer{logSink: opt.JobTrace},
+	}
+
+	c.tmpDir, err = os.MkdirTemp("", fmt.Sprintf("tart-custom-%d-*", opt.Build.job.ID))
+	if err != nil {
+		err = fmt.Errorf("creating temp directory: %w", err)
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(c.tmpDir)
+		}
+	}()
+
+	jobResponse, err := json.Marshal(opt.Build.job)
+	if err != nil {
+		err = fmt.Errorf("marshaling job response: %w", err)
+		return
+	}
+	jobResponseFile := filepath.Join(c.tmpDir, "response.json")
+	err = os.WriteFile(jobResponseFile, jobResponse, 0600)
+	if err != nil {
+		err = fmt.Errorf("writing job response: %w", err)
+		return
+	}
+
+	c.env = append(os.Environ(),
+		"TMPDIR="+c.tmpDir,
+		"JOB_RESPONSE_FILE="+jobResponseFile,
+		"BUILD_FAILURE_EXIT_CODE="+strconv.Itoa(customBuildFailureExitCode),
+		"SYSTEM_FAILURE_EXIT_CODE="+strconv.Itoa(customSystemFailureExitCode),
+	)
+	for _, v := range opt.Build.job.Variables {
+		c.env = append(c.env, "CUSTOM_ENV_"+v.Key+"="+v.Value)
+	}
+
+	return
+}
+
+// Prepare runs ConfigExec and PrepareExec, then clones the repo.
+func (c *Custom) Prepare(ctx context.Context) (err error) {
+	defer func() {
+		if err != nil {
+			c.logger.Debug("Build failed during preparing", zap.Error(err))
+			_ = c.redLine("Build failed during preparing: %s", err)
+		}
+	}()
+
+	err = c.yellowLine("Running with %s\n", version.FullName)
+	if err != nil {
+		return
+	}
+
+	err = c.configure(ctx)
+	if err != nil {
+		err = fmt.Errorf("config exec: %w", err)
+		return
+	}
+
+	if c.config.Custom.PrepareExec != "" {
+		err = c.greenLine("Preparing environment...")
+		if err != nil {
+			return
+		}
+
+		timeout, _ := customTimeout(c.config.Custom.PrepareExecTimeout, defaultCustomExecTimeout)
+		err = c.execWithTimeout(ctx, timeout, c.config.Custom.PrepareExec, c.config.Custom.PrepareArgs, c.logSink)
+		if err != nil {
+			err = fmt.Errorf("prepare exec: %w", err)
+			return
+		}
+	}
+
+	err = c.greenLine("Cloning repo and checking out...")
+	if err != nil {
+		return
+	}
+
+	err = cloneRepo(ctx, c.logger, c, c.build, "")
+	if err != nil {
+		return
+	}
+
+	err = c.greenLine("Repo cloned and checked out.")
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// configure runs ConfigExec and applies its output.
+func (c *Custom) configure(ctx context.Context) (err error) {
+	if c.config.Custom.ConfigExec == "" {
+		return
+	}
+
+	var stdout bytes.Buffer
+	timeout, _ := customTimeout(c.config.Custom.ConfigExecTimeout, defaultCustomExecTimeout)
+	err = c.execWithTimeout(ctx, timeout, c.config.Custom.ConfigExec, c.config.Custom.ConfigArgs, &stdout)
+	if err != nil {
+		return
+	}
+
+	var driverConfig customDriverConfig
+	err = json.Unmarshal(stdout.Bytes(), &driverConfig)
+	if err != nil {
+		err = fmt.Errorf("decoding output: %w", err)
+		return
+	}
+
+	for key, value := range driverConfig.JobEnv {
+		c.env = append(c.env, key+"="+value)
+	}
+
+	if driverConfig.Driver.Name != "" {
+		err = c.line("Using custom executor with driver %s %s...", driverConfig.Driver.Name, driverConfig.Driver.Version)
+		if err != nil {
+			return
+		}
+	}
+	if driverConfig.Hostname != "" {
+		err = c.line("Running on %s...", driverConfig.Hostname)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// RunStep writes script into a file and runs RunExec with it.
+//
+// RunExec exiting with BUILD_FAILURE_EXIT_CODE fails the job as script failure,
+// any other non-zero exit code is a system failure.
+func (c *Custom) RunStep(ctx context.Context, stage Stage, script string) (err error) {
+	file, err := os.CreateTemp(c.tmpDir, "script-*")
+	if err != nil {
+		err = fmt.Errorf("creating script file: %w", err)
+		return
+	}
+	defer os.Remove(file.Name())
+
+	_, err = fmt.Fprintf(file, "#!/usr/bin/env bash\n\n%s", script)
+	if err != nil {
+		_ = file.Close()
+		err = fmt.Errorf("writing script file: %w", err)
+		return
+	}
+	err = file.Chmod(0700)
+	if err != nil {
+		_ = file.Close()
+		err = fmt.Errorf("chmod script file: %w", err)
+		return
+	}
+	err = file.Close()
+	if err != nil {
+		err = fmt.Errorf("closing script file: %w", err)
+		return
+	}
+
+	args := make([]string, 0, len(c.config.Custom.RunArgs)+2)
+	args = append(args, c.config.Custom.RunArgs...)
+	args = append(args, file.Name(), string(stage))
+
+	err = c.exec(ctx, c.config.Custom.RunExec, args, c.logSink)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == customBuildFailureExitCode {
+		err = &ExitError{Code: customBuildFailureExitCode}
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("run exec on stage %s: %w", stage, err)
+		return
+	}
+
+	return
+}
+
+func (c *Custom) Upload(_ context.Context, _ string, _ uint32, _ io.Reader) error {
+	return errors.New("custom executor does not support file transfer")
+}
+
+func (c *Custom) Download(_ context.Context, _ string, _ io.Writer) error {
+	return errors.New("custom executor does not support file transfer")
+}
+
+// Close runs CleanupExec and removes the temp directory.
+//
+// CleanupExec runs even if ctx is done, e.g. the runner is shutting down,
+// as GitLab Runner does, or the environment of the driver leaks.
+// It's bounded by CleanupExecTimeout only.
+func (c *Custom) Close(_ context.Context) (err error) {
+	defer os.RemoveAll(c.tmpDir)
+
+	if c.config.Custom.CleanupExec == "" {
+		return
+	}
+
+	timeout, _ := customTimeout(c.config.Custom.CleanupExecTimeout, defaultCustomExecTimeout)
+	err = c.execWithTimeout(context.Background(), timeout, c.config.Custom.CleanupExec, c.config.Custom.CleanupArgs, c.logSink)
+	if err != nil {
+		err = fmt.Errorf("cleanup exec: %w", err)
+		return
+	}
+
+	return
+}
+
+func (c *Custom) execWithTimeout(ctx context.Context, timeout time.Duration, path string, args []string, stdout io.Writer) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err = c.exec(ctx, path, args, stdout)
+	if err != nil && ctx.Err() != nil {
+		err = fmt.Errorf("%w, timeout is %s", err, timeout)
+	}
+
+	return
+}
+
+// exec runs the executable with stderr going to job trace.
+// Once ctx is done, the executable and its children receive SIGTERM,
+// and SIGKILL if they are still around after graceful kill timeout.
+func (c *Custom) exec(ctx context.Context, path string, args []string, stdout io.Writer) (err error) {
+	cmd := exec.Command(path, args...)
+	cmd.Env = c.env
+	cmd.Stdout = stdout
+	cmd.Stderr = c.logSink
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	c.logger.Debug("running custom executable", zap.String("path", path), zap.Strings("args", args))
+	err = cmd.Start()
+	if err != nil {
+		err = fmt.Errorf("starting %s: %w", path, err)
+		return
+	}
+
+	gracefulKillTimeout, _ := customTimeout(c.config.Custom.GracefulKillTimeout, defaultGracefulKillTimeout)
+	exited := make(chan struct{})
+	defer close(exited)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-exited:
+			return
+		}
+
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+		timer := time.NewTimer(gracefulKillTimeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-exited:
+		}
+	}()
+
+	err = cmd.Wait()
+	if err != nil {
+		err = fmt.Errorf("running %s: %w", path, err)
+		return
+	}
+
+	return
+}
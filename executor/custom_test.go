@@ -0,0 +1,126 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nanmu42/tart/network"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// customDriver writes executables running scripts locally,
+// with home directory told by config exec.
+func customDriver(t *testing.T) (config CustomConfig, home string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	home = t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte("#!/usr/bin/env bash\nset -eo pipefail\n"+content), 0700))
+		return path
+	}
+
+	config = CustomConfig{
+		ConfigExec:  write("config", `echo '{"driver": {"name": "test", "version": "v1"}, "job_env": {"DRIVER_HOME": "`+home+`"}}'`+"\n"),
+		PrepareExec: write("prepare", `echo "preparing $CUSTOM_ENV_GREETING"`+"\n"),
+		RunExec: write("run", `echo "stage $2"
+cd "$DRIVER_HOME"
+HOME="$DRIVER_HOME" bash "$1" || exit "$BUILD_FAILURE_EXIT_CODE"
+`),
+		// takes a while, as drivers removing VMs do
+		CleanupExec: write("cleanup", `sleep 0.2 && touch "$DRIVER_HOME/cleaned"`+"\n"),
+	}
+	return
+}
+
+func TestCustom_RunBuild(t *testing.T) {
+	repo := gitRepo(t)
+	config, home := customDriver(t)
+
+	run := func(script string) (result BuildResult, trace string) {
+		build, err := NewBuild(BuildOpt{
+			Job: network.RequestJobResp{
+				ID: 42,
+				GitInfo: network.GitInfo{
+					Depth:   1,
+					Ref:     "main",
+					RepoURL: "file://" + repo,
+				},
+				Steps: []network.JobStep{
+					{Name: "script", Script: []string{script}, Timeout: 60, When: "on_success"},
+				},
+				Variables: []network.JobVariable{
+					{Key: "GREETING", Value: "hello tart"},
+				},
+			},
+			WorkingDir: "ci-repo",
+		})
+		require.NoError(t, err)
+		require.NoError(t, os.RemoveAll(filepath.Join(home, "ci-repo")))
+
+		var buf bytes.Buffer
+		ctx := context.Background()
+		logger := zap.NewNop()
+		exe, err := New(Option{
+			Logger:   logger,
+			Ctx:      ctx,
+			Build:    build,
+			JobTrace: &buf,
+			Config:   Config{Kind: KindCustom, Custom: config},
+		})
+		require.NoError(t, err)
+
+		require.NoError(t, exe.Prepare(ctx))
+		result = RunBuild(ctx, logger, exe, build, &buf)
+		require.NoError(t, exe.Close(ctx))
+
+		trace = buf.String()
+		return
+	}
+
+	result, trace := run("test -f README.md && echo $GREETING")
+	assert.NoError(t, result.Err)
+	assert.Contains(t, trace, "driver test v1")
+	assert.Contains(t, trace, "preparing hello tart")
+	assert.Contains(t, trace, "stage get_sources")
+	assert.Contains(t, trace, "stage step_script")
+	assert.FileExists(t, filepath.Join(home, "cleaned"))
+
+	result, _ = run("exit 3")
+	assert.Error(t, result.Err)
+	assert.Equal(t, network.FailureReasonScriptFailure, result.FailureReason)
+}
+
+func TestCustom_CloseCancelled(t *testing.T) {
+	config, home := customDriver(t)
+	build, err := NewBuild(BuildOpt{
+		Job:        network.RequestJobResp{ID: 42},
+		WorkingDir: "ci-repo",
+	})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	exe, err := NewCustom(Option{
+		Logger:   zap.NewNop(),
+		Ctx:      context.Background(),
+		Build:    build,
+		JobTrace: &buf,
+		Config:   Config{Kind: KindCustom, Custom: config},
+	})
+	require.NoError(t, err)
+	require.NoError(t, exe.configure(context.Background()))
+
+	// the runner is shutting down
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.NoError(t, exe.Close(ctx), buf.String())
+	assert.FileExists(t, filepath.Join(home, "cleaned"))
+	assert.NoDirExists(t, exe.tmpDir)
+}
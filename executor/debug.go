@@ -0,0 +1,345 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DebugVariable asks to keep the microVM of the job for debugging if the job fails,
+// its value is true, minutes like 15, or a duration like 20m.
+const DebugVariable = "TART_DEBUG_ON_FAILURE"
+
+// DebugConfig lets failed jobs keep their microVMs for a while,
+// so that someone on the runner host can look into them.
+type DebugConfig struct {
+	// projects whose jobs may keep their microVMs
+	AllowedProjects []string `comment:"glob patterns of paths of projects whose failed jobs may keep their microVMs for debugging by setting TART_DEBUG_ON_FAILURE, e.g. group/*. No job may if empty"`
+	// the longest a microVM is kept
+	MaxTime string `comment:"the longest a failed job may keep its microVM, e.g. 1h, defaults to 30m. TART_DEBUG_ON_FAILURE=true asks for 10m"`
+	// where connection info of kept microVMs is written
+	SessionDir string `comment:"directory holding connection info of microVMs kept for debugging, which only root may read, defaults to /run/tart/debug"`
+}
+
+const (
+	defaultDebugMaxTime    = 30 * time.Minute
+	defaultDebugTime       = 10 * time.Minute
+	defaultDebugSessionDir = "/run/tart/debug"
+	// how often the session file is checked for being released
+	debugReleaseInterval = 3 * time.Second
+)
+
+func (c DebugConfig) Validate() (err error) {
+	for _, pattern := range c.AllowedProjects {
+		_, err = path.Match(pattern, "")
+		if err != nil {
+			err = fmt.Errorf("allowed project pattern %q: %w", pattern, err)
+			return
+		}
+	}
+	_, err = c.maxTime()
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func (c DebugConfig) enabled() bool {
+	return len(c.AllowedProjects) > 0
+}
+
+func (c DebugConfig) maxTime() (max time.Duration, err error) {
+	if c.MaxTime == "" {
+		max = defaultDebugMaxTime
+		return
+	}
+
+	max, err = time.ParseDuration(c.MaxTime)
+	if err != nil {
+		err = fmt.Errorf("parsing max time: %w", err)
+		return
+	}
+	if max <= 0 {
+		err = fmt.Errorf("max time must be positive, got %s", c.MaxTime)
+		return
+	}
+
+	return
+}
+
+func (c DebugConfig) sessionDir() string {
+	if c.SessionDir == "" {
+		return defaultDebugSessionDir
+	}
+
+	return c.SessionDir
+}
+
+// projectAllowed tells whether jobs of the project may keep their microVMs.
+func (c DebugConfig) projectAllowed(project string) bool {
+	for _, pattern := range c.AllowedProjects {
+		if ok, _ := path.Match(pattern, project); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// debugTime parses value of DebugVariable, capped at max.
+// Zero means the job does not ask for debugging.
+func debugTime(value string, max time.Duration) (d time.Duration, err error) {
+	value = strings.TrimSpace(value)
+	switch strings.ToLower(value) {
+	case "", "0", "false", "no", "off":
+		return
+	case "true", "yes", "on":
+		d = defaultDebugTime
+	default:
+		minutes, atoiErr := strconv.Atoi(value)
+		if atoiErr == nil {
+			d = time.Duration(minutes) * time.Minute
+			break
+		}
+		d, err = time.ParseDuration(value)
+		if err != nil {
+			err = fmt.Errorf("%q is neither true, minutes nor a duration", value)
+			return
+		}
+	}
+	if d < 0 {
+		err = fmt.Errorf("%q is negative", value)
+		return
+	}
+
+	if d > max {
+		d = max
+	}
+	return
+}
+
+// DebugSession is how to reach a microVM kept for debugging,
+// which is written into SessionDir while the microVM is kept.
+type DebugSession struct {
+	JobID int    `json:"jobId"`
+	VMID  string `json:"vmId"`
+	// SSH address of the microVM
+	Address string `json:"address"`
+	User    string `json:"user"`
+	// PEM encoded private key to log in with
+	ClientKey string `json:"clientKey"`
+	// host key of the microVM, in authorized_keys format
+	HostKey string `json:"hostKey"`
+	// working directory of the job
+	Dir   string    `json:"dir"`
+	Until time.Time `json:"until"`
+}
+
+func (c DebugConfig) sessionPath(jobID int) string {
+	return filepath.Join(c.sessionDir(), fmt.Sprintf("job-%d.json", jobID))
+}
+
+// writeSession writes session where only the owner can read.
+func (c DebugConfig) writeSession(session DebugSession) (sessionPath string, err error) {
+	err = os.MkdirAll(c.sessionDir(), 0700)
+	if err != nil {
+		err = fmt.Errorf("creating session directory: %w", err)
+		return
+	}
+
+	content, err := json.Marshal(session)
+	if err != nil {
+		err = fmt.Errorf("marshaling session: %w", err)
+		return
+	}
+
+	sessionPath = c.sessionPath(session.JobID)
+	err = os.WriteFile(sessionPath, content, 0600)
+	if err != nil {
+		err = fmt.Errorf("writing session: %w", err)
+		return
+	}
+
+	return
+}
+
+// LoadSession reads the session of the job whose microVM is kept for debugging.
+func (c DebugConfig) LoadSession(jobID int) (session DebugSession, err error) {
+	content, err := os.ReadFile(c.sessionPath(jobID))
+	if errors.Is(err, fs.ErrNotExist) {
+		err = fmt.Errorf("no microVM of job %d is kept for debugging on this runner", jobID)
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("reading session: %w", err)
+		return
+	}
+
+	err = json.Unmarshal(content, &session)
+	if err != nil {
+		err = fmt.Errorf("unmarshaling session: %w", err)
+		return
+	}
+	if time.Now().After(session.Until) {
+		err = fmt.Errorf("debugging time of job %d is up", jobID)
+		return
+	}
+
+	return
+}
+
+// ReleaseSession ends debugging of the job,
+// whose microVM is torn down soon after.
+func (c DebugConfig) ReleaseSession(jobID int) (err error) {
+	err = os.Remove(c.sessionPath(jobID))
+	if errors.Is(err, fs.ErrNotExist) {
+		err = fmt.Errorf("no microVM of job %d is kept for debugging on this runner", jobID)
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("removing session: %w", err)
+		return
+	}
+
+	return
+}
+
+// Dial connects to the microVM over SSH.
+func (s DebugSession) Dial() (client *ssh.Client, err error) {
+	signer, err := ssh.ParsePrivateKey([]byte(s.ClientKey))
+	if err != nil {
+		err = fmt.Errorf("parsing client key: %w", err)
+		return
+	}
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s.HostKey))
+	if err != nil {
+		err = fmt.Errorf("parsing host key: %w", err)
+		return
+	}
+
+	config := &ssh.ClientConfig{
+		User: s.User,
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(signer),
+		},
+		HostKeyCallback: ssh.FixedHostKey(hostKey),
+		Timeout:         5 * time.Second,
+	}
+
+	client, err = ssh.Dial("tcp", s.Address, config)
+	if err != nil {
+		err = fmt.Errorf("dialing ssh: %w", err)
+		return
+	}
+
+	return
+}
+
+// Debuggable is an executor able to keep the environment of a failed job for debugging.
+type Debuggable interface {
+	// HoldForDebug keeps the environment if the job asks for it and is allowed to,
+	// returning when the debugging time is up or ctx is done.
+	HoldForDebug(ctx context.Context) error
+}
+
+// HoldForDebug keeps the environment of the failed job for debugging before it's closed,
+// executors unable to do so are skipped.
+func HoldForDebug(ctx context.Context, logger *zap.Logger, exe Executor, build *Build) {
+	debuggable, ok := exe.(Debuggable)
+	if !ok {
+		return
+	}
+
+	err := debuggable.HoldForDebug(ctx)
+	if err != nil {
+		logger.Warn("keeping environment for debugging", zap.Int("jobId", build.job.ID), zap.Error(err))
+	}
+}
+
+// HoldForDebug keeps the microVM running for debugging,
+// until the debugging time is up, the session is released, or ctx is done.
+func (e *MicroVM) HoldForDebug(ctx context.Context) (err error) {
+	value := e.build.variable(DebugVariable)
+	if value == "" || e.transport == nil {
+		return
+	}
+
+	max, err := e.config.Debug.maxTime()
+	if err != nil {
+		return
+	}
+	window, err := debugTime(value, max)
+	if err != nil {
+		err = e.yellowLine("WARNING: %s is ignored: %s", DebugVariable, err)
+		return
+	}
+	if window == 0 {
+		return
+	}
+	project := e.build.project()
+	if !e.config.Debug.projectAllowed(project) {
+		err = e.yellowLine("WARNING: %s is ignored: project %s is not allowed to keep microVMs for debugging on this runner", DebugVariable, project)
+		return
+	}
+
+	until := time.Now().Add(window)
+	sessionPath, err := e.config.Debug.writeSession(DebugSession{
+		JobID:     e.build.job.ID,
+		VMID:      e.vmID,
+		Address:   net.JoinHostPort(e.vmIP, "22"),
+		User:      "root",
+		ClientKey: string(e.keys.clientPEM),
+		HostKey:   string(ssh.MarshalAuthorizedKey(e.keys.host.PublicKey())),
+		Dir:       path.Join(agentHome, e.build.workingDir),
+		Until:     until,
+	})
+	if err != nil {
+		return
+	}
+	defer os.Remove(sessionPath)
+
+	e.logger.Info("keeping microVM for debugging", zap.String("VMID", e.vmID), zap.Time("until", until))
+	err = e.yellowLine("Keeping microVM %s for debugging until %s (%s).", e.vmID, until.Format(time.RFC3339), window)
+	if err != nil {
+		return
+	}
+	err = e.line("On the runner host, run as root `tart debug attach %d` to open a shell in the working directory, "+
+		"and `tart debug release %d` to finish the job early. Variables of the job are not set in the shell.",
+		e.build.job.ID, e.build.job.ID)
+	if err != nil {
+		return
+	}
+
+	timer := time.NewTimer(window)
+	defer timer.Stop()
+	ticker := time.NewTicker(debugReleaseInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			err = e.line("Debugging time is up, tearing down microVM.")
+			return
+		case <-ticker.C:
+			if _, statErr := os.Stat(sessionPath); errors.Is(statErr, fs.ErrNotExist) {
+				err = e.line("Debugging is released, tearing down microVM.")
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nanmu42/tart/network"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestDebugTime(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{value: "", want: 0},
+		{value: "false", want: 0},
+		{value: "0", want: 0},
+		{value: "true", want: defaultDebugTime},
+		{value: "15", want: 15 * time.Minute},
+		{value: "90s", want: 90 * time.Second},
+		{value: "2h", want: time.Hour},
+		{value: "-5", wantErr: true},
+		{value: "sure", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := debugTime(tt.value, time.Hour)
+		if tt.wantErr {
+			assert.Error(t, err, tt.value)
+			continue
+		}
+		require.NoError(t, err, tt.value)
+		assert.Equal(t, tt.want, got, tt.value)
+	}
+}
+
+func TestDebugConfig_ProjectAllowed(t *testing.T) {
+	config := DebugConfig{AllowedProjects: []string{"infra/*", "web/app"}}
+	require.NoError(t, config.Validate())
+
+	assert.True(t, config.projectAllowed("infra/runner"))
+	assert.True(t, config.projectAllowed("web/app"))
+	assert.False(t, config.projectAllowed("web/app2"))
+	assert.False(t, config.projectAllowed("infra/sub/project"))
+
+	assert.Error(t, DebugConfig{AllowedProjects: []string{"["}}.Validate())
+	assert.Error(t, DebugConfig{MaxTime: "-1m"}.Validate())
+
+	// tart debug attach logs in over SSH
+	err := Config{KernelPath: "vmlinux", RootFSPath: "rootfs.ext4", Transport: TransportAgent, Debug: config}.Validate()
+	assert.ErrorContains(t, err, "debugging requires ssh transport")
+}
+
+// serveSSH accepts one SSH connection with keys of a microVM,
+// granting PTYs, and answering every exec request with the command and exit status 0.
+func serveSSH(t *testing.T, keys vmKeys) (address string) {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), keys.client.PublicKey().Marshal()) {
+				return nil, assert.AnError
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(keys.host)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		_, channels, requests, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(requests)
+		for newChannel := range channels {
+			channel, channelRequests, err := newChannel.Accept()
+			if err != nil {
+				return
+			}
+			for req := range channelRequests {
+				_ = req.Reply(req.Type == "exec" || req.Type == "pty-req", nil)
+				if req.Type == "exec" {
+					var exec struct{ Command string }
+					_ = ssh.Unmarshal(req.Payload, &exec)
+					_, _ = channel.Write([]byte(exec.Command))
+					_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+					_ = channel.Close()
+				}
+			}
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestMicroVM_HoldForDebug(t *testing.T) {
+	keys, err := generateVMKeys()
+	require.NoError(t, err)
+	address := serveSSH(t, keys)
+	host, _, err := net.SplitHostPort(address)
+	require.NoError(t, err)
+
+	build, err := NewBuild(BuildOpt{
+		Job: network.RequestJobResp{
+			ID: 42,
+			Variables: []network.JobVariable{
+				{Key: "CI_PROJECT_PATH", Value: "infra/runner"},
+				{Key: DebugVariable, Value: "true"},
+			},
+		},
+		WorkingDir: "ci-repo",
+	})
+	require.NoError(t, err)
+	config := DebugConfig{AllowedProjects: []string{"infra/*"}, SessionDir: t.TempDir()}
+
+	var trace bytes.Buffer
+	e := &MicroVM{
+		logger:    zap.NewNop(),
+		build:     build,
+		config:    Config{Debug: config},
+		tracer:    tracer{logSink: &trace},
+		vmID:      "tart-42",
+		keys:      keys,
+		vmIP:      host,
+		transport: &sshTransport{},
+	}
+
+	held := make(chan error, 1)
+	go func() {
+		held <- e.HoldForDebug(context.Background())
+	}()
+
+	var session DebugSession
+	require.Eventually(t, func() bool {
+		session, err = config.LoadSession(42)
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+	info, err := os.Stat(config.sessionPath(42))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	assert.Equal(t, "/root/ci-repo", session.Dir)
+	assert.WithinDuration(t, time.Now().Add(defaultDebugTime), session.Until, time.Minute)
+	assert.Equal(t, net.JoinHostPort(host, "22"), session.Address)
+
+	// the session logs in to the microVM
+	session.Address = address
+	client, err := session.Dial()
+	require.NoError(t, err)
+	sshSession, err := client.NewSession()
+	require.NoError(t, err)
+	assert.NoError(t, sshSession.Run("true"))
+	_ = client.Close()
+
+	require.NoError(t, config.ReleaseSession(42))
+	select {
+	case err = <-held:
+		require.NoError(t, err)
+	case <-time.After(2 * debugReleaseInterval):
+		t.Fatal("microVM is still held after release")
+	}
+	assert.Contains(t, trace.String(), "tart debug attach 42")
+	assert.Contains(t, trace.String(), "Debugging is released")
+
+	_, err = config.LoadSession(42)
+	assert.ErrorContains(t, err, "no microVM of job 42")
+}
+
+func TestMicroVM_HoldForDebug_NotAllowed(t *testing.T) {
+	build, err := NewBuild(BuildOpt{
+		Job: network.RequestJobResp{
+			ID: 42,
+			Variables: []network.JobVariable{
+				{Key: "CI_PROJECT_PATH", Value: "web/app"},
+				{Key: DebugVariable, Value: "15"},
+			},
+		},
+		WorkingDir: "ci-repo",
+	})
+	require.NoError(t, err)
+
+	var trace bytes.Buffer
+	e := &MicroVM{
+		logger:    zap.NewNop(),
+		build:     build,
+		config:    Config{Debug: DebugConfig{AllowedProjects: []string{"infra/*"}, SessionDir: t.TempDir()}},
+		tracer:    tracer{logSink: &trace},
+		transport: &sshTransport{},
+	}
+
+	require.NoError(t, e.HoldForDebug(context.Background()))
+	assert.Contains(t, trace.String(), "project web/app is not allowed")
+}
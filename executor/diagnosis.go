@@ -0,0 +1,276 @@
+package executor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DiagnosisConfig controls logs kept for diagnosing microVMs.
+type DiagnosisConfig struct {
+	// directory of per-job logs
+	LogDir string `comment:"directory of per-job serial console, Firecracker log and metrics, defaults to /var/log/tart if Retention is set, or a directory under the system temp directory otherwise"`
+	// lines appended to job trace on failure
+	TailLines int `comment:"lines of serial console and Firecracker log appended to job trace on boot or connection failure, defaults to 50"`
+	// how long logs are kept after the job
+	Retention string `comment:"how long logs are kept after the job ends, e.g. 72h. Empty or 0 removes them once the job ends"`
+}
+
+const (
+	defaultLogDir = "/var/log/tart"
+	// under os.TempDir(), for logs removed once the job ends
+	transientLogDir  = "tart-logs"
+	defaultTailLines = 50
+
+	consoleLogName     = "console.log"
+	firecrackerLogName = "firecracker.log"
+	metricsLogName     = "metrics.log"
+
+	// at most this many bytes from the end of a log are read for tailing
+	tailWindow = 64 << 10
+)
+
+func (c DiagnosisConfig) Validate() (err error) {
+	if c.TailLines < 0 {
+		err = fmt.Errorf("tail lines must not be negative, got %d", c.TailLines)
+		return
+	}
+	_, err = c.retention()
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// logDir defaults to /var/log/tart only for logs kept after the job,
+// so that runners without root need no setup otherwise.
+func (c DiagnosisConfig) logDir() string {
+	if c.LogDir != "" {
+		return c.LogDir
+	}
+	if retention, _ := c.retention(); retention > 0 {
+		return defaultLogDir
+	}
+
+	return filepath.Join(os.TempDir(), transientLogDir)
+}
+
+func (c DiagnosisConfig) tailLines() int {
+	if c.TailLines == 0 {
+		return defaultTailLines
+	}
+
+	return c.TailLines
+}
+
+func (c DiagnosisConfig) retention() (retention time.Duration, err error) {
+	if c.Retention == "" {
+		return
+	}
+
+	retention, err = time.ParseDuration(c.Retention)
+	if err != nil {
+		err = fmt.Errorf("parsing retention: %w", err)
+		return
+	}
+	if retention < 0 {
+		err = fmt.Errorf("retention must not be negative, got %s", retention)
+		return
+	}
+
+	return
+}
+
+// jobLogs are the log files of a microVM.
+type jobLogs struct {
+	// directory of the files
+	dir string
+	// serial console, along with Firecracker stdout and stderr
+	console *os.File
+	// where Firecracker writes to, which is in the chroot under jailer
+	firecrackerLog string
+	metrics        string
+}
+
+// createJobLogs creates the log directory of the microVM.
+// Firecracker logs are placed in runDir, which may differ from the log directory.
+func createJobLogs(cfg DiagnosisConfig, vmID string, runDir string) (logs jobLogs, err error) {
+	logs.dir = filepath.Join(cfg.logDir(), vmID)
+	err = os.MkdirAll(logs.dir, 0750)
+	if err != nil {
+		err = fmt.Errorf("creating log directory: %w", err)
+		return
+	}
+
+	logs.console, err = os.Create(filepath.Join(logs.dir, consoleLogName))
+	if err != nil {
+		err = fmt.Errorf("creating console log: %w", err)
+		return
+	}
+
+	if runDir == "" {
+		runDir = logs.dir
+	}
+	logs.firecrackerLog = filepath.Join(runDir, firecrackerLogName)
+	logs.metrics = filepath.Join(runDir, metricsLogName)
+
+	return
+}
+
+// close moves Firecracker logs into the log directory,
+// and removes the directory unless retention is set.
+func (l jobLogs) close(cfg DiagnosisConfig, logger *zap.Logger) {
+	if l.console != nil {
+		_ = l.console.Close()
+	}
+
+	for _, path := range []string{l.firecrackerLog, l.metrics} {
+		if path == "" || filepath.Dir(path) == l.dir {
+			continue
+		}
+
+		err := moveFile(path, filepath.Join(l.dir, filepath.Base(path)))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Warn("moving Firecracker log", zap.String("path", path), zap.Error(err))
+		}
+	}
+
+	retention, _ := cfg.retention()
+	if retention == 0 {
+		_ = os.RemoveAll(l.dir)
+		return
+	}
+
+	pruneLogs(cfg.logDir(), retention, logger)
+}
+
+// pruneLogs removes job log directories older than retention.
+func pruneLogs(logDir string, retention time.Duration, logger *zap.Logger) {
+	entries, err := os.ReadDir(logDir)
+	if err != nil {
+		logger.Warn("reading log directory", zap.Error(err))
+		return
+	}
+
+	deadline := time.Now().Add(-retention)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(deadline) {
+			continue
+		}
+
+		err = os.RemoveAll(filepath.Join(logDir, entry.Name()))
+		if err != nil {
+			logger.Warn("removing expired logs", zap.String("name", entry.Name()), zap.Error(err))
+		}
+	}
+}
+
+func moveFile(src, dst string) (err error) {
+	err = os.Rename(src, dst)
+	if err == nil {
+		return
+	}
+
+	// rename does not work across file systems
+	err = copyFile(src, dst)
+	if err != nil {
+		return
+	}
+
+	err = os.Remove(src)
+	return
+}
+
+// tailFile returns at most n last lines of the file.
+func tailFile(path string, n int) (lines []string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return
+	}
+	offset := info.Size() - tailWindow
+	if offset < 0 {
+		offset = 0
+	}
+
+	content, err := io.ReadAll(io.NewSectionReader(file, offset, info.Size()-offset))
+	if err != nil {
+		return
+	}
+	content = bytes.TrimRight(content, "\n")
+	if len(content) == 0 {
+		return
+	}
+
+	lines = strings.Split(string(content), "\n")
+	if offset > 0 && len(lines) > 1 {
+		// the first line is likely partial
+		lines = lines[1:]
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+
+	return
+}
+
+// dumpLogs appends tails of serial console and Firecracker log to the job trace,
+// each in a collapsed section.
+func (e *MicroVM) dumpLogs() {
+	n := e.config.Diagnosis.tailLines()
+	logs := []struct {
+		section string
+		header  string
+		path    string
+	}{
+		{"vm_console", "Serial console of microVM", e.logs.console.Name()},
+		{"firecracker_log", "Firecracker log", e.logs.firecrackerLog},
+	}
+
+	for _, log := range logs {
+		lines, err := tailFile(log.path, n)
+		if err != nil {
+			e.logger.Debug("tailing log", zap.String("path", log.path), zap.Error(err))
+			continue
+		}
+		if len(lines) == 0 {
+			continue
+		}
+
+		err = e.section(log.section, fmt.Sprintf("%s, last %d lines", log.header, len(lines)), true, func(w io.Writer) (err error) {
+			for _, line := range lines {
+				_, err = fmt.Fprintln(w, strings.TrimRight(line, "\r"))
+				if err != nil {
+					return
+				}
+			}
+			return
+		})
+		if err != nil {
+			e.logger.Debug("dumping log", zap.String("path", log.path), zap.Error(err))
+			return
+		}
+	}
+
+	retention, _ := e.config.Diagnosis.retention()
+	if retention > 0 {
+		_ = e.line("Logs of microVM are kept at %s for %s", e.logs.dir, retention)
+	}
+}
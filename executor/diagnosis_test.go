@@ -0,0 +1,16 @@
+package executor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiagnosisConfig_LogDir(t *testing.T) {
+	assert.Equal(t, filepath.Join(os.TempDir(), transientLogDir), DiagnosisConfig{}.logDir())
+	assert.Equal(t, filepath.Join(os.TempDir(), transientLogDir), DiagnosisConfig{Retention: "0"}.logDir())
+	assert.Equal(t, defaultLogDir, DiagnosisConfig{Retention: "72h"}.logDir())
+	assert.Equal(t, "/srv/tart", DiagnosisConfig{LogDir: "/srv/tart"}.logDir())
+}
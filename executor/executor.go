@@ -6,32 +6,65 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"os"
 	"time"
 
 	"github.com/nanmu42/tart/network"
-	"github.com/nanmu42/tart/rootfs"
-	"github.com/nanmu42/tart/version"
+	"github.com/nanmu42/tart/vmnet"
 
 	"go.uber.org/zap"
+)
 
-	"github.com/fatih/color"
-
-	"golang.org/x/crypto/ssh"
+const (
+	// KindFirecracker runs jobs in microVMs, with Firecracker or QEMU.
+	KindFirecracker = "firecracker"
+	// KindShell runs jobs on the host, only trusted jobs should be run this way.
+	KindShell = "shell"
+	// KindSSH runs jobs on existing hosts over SSH.
+	KindSSH = "ssh"
+	// KindCustom runs jobs with drivers of GitLab Runner custom executor.
+	KindCustom = "custom"
+)
 
-	"github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+// Stage names the part of a job a script belongs to, after GitLab Runner.
+type Stage string
 
-	"github.com/firecracker-microvm/firecracker-go-sdk"
+const (
+	StageGetSources Stage = "get_sources"
+	StageStepScript Stage = "step_script"
+	// packs caches and artifacts for the host to carry out, in offline mode
+	StageArchive Stage = "archive"
 )
 
 type Config struct {
+	// kind of executor
+	Kind string `comment:"kind of executor, firecracker, shell, ssh or custom, defaults to firecracker. shell runs jobs on the host directly, for trusted jobs only. ssh runs jobs on existing hosts. custom runs jobs with drivers of GitLab Runner custom executor"`
+	// config of shell executor
+	Shell ShellConfig `comment:"config of shell executor"`
+	// config of ssh executor
+	SSH SSHConfig `comment:"config of ssh executor"`
+	// config of custom executor
+	Custom CustomConfig `comment:"config of custom executor"`
+
+	// hypervisor running microVMs
+	Hypervisor string `comment:"hypervisor running microVMs, firecracker or qemu, defaults to firecracker. qemu works without /dev/kvm, at the cost of speed, but supports neither CNI, jailer, MMDS nor agent transport"`
+	// config of QEMU hypervisor
+	QEMU QEMUConfig `comment:"config of QEMU hypervisor"`
+
 	// path to linux kernel file
 	KernelPath string `comment:"path to linux kernel file"`
 	// path to RootFS file
 	RootFSPath string `comment:"path to RootFS file"`
-
-	// IP address of Firecracker microVM
-	IP string `comment:"IP address of Firecracker microVM"`
+	// catalog of images
+	Images []ImageConfig `comment:"catalog of images jobs may pick with image keyword in .gitlab-ci.yml, each is a pair of kernel and RootFS. image keyword is ignored without it"`
+	// image of jobs without image keyword
+	DefaultImage string `comment:"name of the image in Images booted for jobs without image keyword, KernelPath and RootFSPath are booted if empty"`
+	// directory of the image store
+	ImageStoreDir string `comment:"directory of the image store managed by tart images, defaults to /var/lib/tart/images"`
+	// which images jobs may pick
+	AllowedImages []string `comment:"glob patterns of image names jobs may pick, e.g. jammy-*, defaults to all images in Images. Jobs asking for other images fail as runner_unsupported"`
+
+	// IP address of microVM
+	IP string `comment:"IP address of microVM"`
 	// Gateway IP address, normally is the tap address
 	GatewayIP string `comment:"Gateway IP address, normally is the tap address"`
 	// Netmask like 255.255.255.0
@@ -41,6 +74,69 @@ type Config struct {
 	TapDevice string `comment:"Tap device name like tap0"`
 	// microVM tap MAC address
 	TapMac string `comment:"microVM tap MAC address"`
+
+	// microVM has no network at all
+	Offline bool `comment:"run microVMs without network. The host clones the repo into a drive mounted at working directory, and Tart talks to microVMs with agent transport. Caches and artifacts of jobs are carried in and out on the drive. IP, GatewayIP, Netmask, TapDevice, TapMac, CNI and network policy are ignored"`
+	// caches of offline jobs on the host
+	OfflineCacheDir string `comment:"directory keeping caches declared by offline jobs on the host, one tar archive for each project and cache key. Caches are skipped if empty"`
+
+	// CNI network name, enables CNI mode if not empty.
+	// In CNI mode, IP, GatewayIP, Netmask, TapDevice and TapMac are ignored,
+	// the interface and IP of microVM are provided by CNI plugins.
+	CNINetworkName string `comment:"CNI network name, enables CNI mode if not empty. In CNI mode, IP, GatewayIP, Netmask, TapDevice and TapMac are ignored, the network is provided by CNI plugins, which must include tc-redirect-tap"`
+	// directory of CNI network configurations
+	CNIConfDir string `comment:"directory of CNI network configurations, defaults to /etc/cni/conf.d"`
+	// directory of CNI plugin binaries
+	CNIBinDir string `comment:"directory of CNI plugin binaries, defaults to /opt/cni/bin"`
+
+	// outbound network policy of microVM, jobs may tighten it via variables
+	NetworkPolicy vmnet.EgressPolicy `comment:"outbound network policy of microVM, jobs may tighten it via variables TART_NETWORK_POLICY and TART_NETWORK_ALLOW. Not supported in CNI mode"`
+
+	// DNS servers of microVM, published through MMDS
+	Nameservers []string `comment:"DNS servers of microVM, published through MMDS. Ignored in CNI mode"`
+	// version of microVM metadata service
+	MMDSVersion string `comment:"version of microVM metadata service(MMDS), V1, V2 or off, defaults to V1. V2 requires guests to acquire a session token. Always off with qemu"`
+
+	// how Tart talks to microVM
+	Transport string `comment:"how Tart talks to microVM, ssh or agent, defaults to ssh. agent requires tart agent running in the microVM, see rootfs/README.md"`
+
+	// how Tart waits for microVM to boot
+	Boot BootConfig `comment:"how Tart waits for microVM to boot"`
+
+	// confinement of Firecracker process
+	Jailer JailerConfig `comment:"confinement of Firecracker process"`
+
+	// logs for diagnosing microVMs
+	Diagnosis DiagnosisConfig `comment:"logs for diagnosing microVMs"`
+
+	// host side git mirrors speeding up clones
+	GitCache GitCacheConfig `comment:"host side git mirrors speeding up clones, for firecracker and shell executors"`
+
+	// persistent volumes keeping caches across jobs
+	CacheDrive CacheDriveConfig `comment:"persistent per-project ext4 volumes attached to microVMs, keeping caches across jobs"`
+
+	// services of jobs in microVMs
+	Services ServicesConfig `comment:"services of jobs in microVMs, on a private network shared with the microVM of the job"`
+
+	// keeping microVMs of failed jobs for debugging
+	Debug DebugConfig `comment:"keeping microVMs of failed jobs for debugging, reachable from the runner host with tart debug attach. Requires ssh transport"`
+
+	// digests of KernelPath and RootFSPath verified before boot, for images in the image store
+	kernelDigest string
+	rootFSDigest string
+}
+
+func (c Config) transport() string {
+	if c.Transport == "" {
+		return TransportSSH
+	}
+
+	return c.Transport
+}
+
+// cniEnabled reports whether the microVM network is provided by CNI.
+func (c Config) cniEnabled() bool {
+	return !c.Offline && c.CNINetworkName != ""
 }
 
 func SupportFeatures() network.Features {
@@ -57,288 +153,275 @@ func SupportFeatures() network.Features {
 	}
 }
 
+// TransfersArtifacts reports whether the executor carries artifacts of jobs.
+func (c Config) TransfersArtifacts() bool {
+	return c.kind() == KindFirecracker && c.Offline
+}
+
+func (c Config) kind() string {
+	if c.Kind == "" {
+		return KindFirecracker
+	}
+
+	return c.Kind
+}
+
 func (c Config) Validate() (err error) {
-	if c.KernelPath == "" {
-		err = errors.New("kernel path is required")
+	switch c.kind() {
+	case KindFirecracker:
+	case KindShell:
+		err = c.Shell.Validate()
+		if err != nil {
+			err = fmt.Errorf("shell: %w", err)
+			return
+		}
+		// the rest is for Firecracker
 		return
-	}
-	if c.RootFSPath == "" {
-		err = errors.New("rootFS path is required")
+	case KindSSH:
+		err = c.SSH.Validate()
+		if err != nil {
+			err = fmt.Errorf("ssh: %w", err)
+			return
+		}
 		return
-	}
-	if c.IP == "" {
-		err = errors.New("ip is required")
+	case KindCustom:
+		err = c.Custom.Validate()
+		if err != nil {
+			err = fmt.Errorf("custom: %w", err)
+			return
+		}
 		return
-	}
-	if c.GatewayIP == "" {
-		err = errors.New("gatewayIP is required")
+	default:
+		err = fmt.Errorf("unknown executor kind %q", c.Kind)
 		return
 	}
-	if c.Netmask == "" {
-		err = errors.New("netmask is required")
+
+	err = c.validateImages()
+	if err != nil {
 		return
 	}
-	if c.TapDevice == "" {
-		err = errors.New("tap device is required")
+	switch c.Transport {
+	case "", TransportSSH, TransportAgent:
+	default:
+		err = fmt.Errorf("unknown transport %q", c.Transport)
 		return
 	}
-	if c.TapMac == "" {
-		err = errors.New("tap MAC is required")
+	if c.Offline && c.transport() != TransportAgent {
+		err = errors.New("offline mode requires agent transport")
 		return
 	}
-
-	return
-}
-
-type Option struct {
-	Logger *zap.Logger
-	// The context must not be cancelled while the microVM is running.
-	Ctx      context.Context
-	Build    *Build
-	JobTrace *network.JobTrace
-
-	Config
-}
-
-type Executor struct {
-	logger *zap.Logger
-	// The context must not be cancelled while the microVM is running.
-	ctx    context.Context
-	build  *Build
-	config Config
-
-	logSink        io.Writer
-	socketFilePath string
-	tempRootFS     *os.File
-	machine        *firecracker.Machine
-	ssh            *ssh.Client
-}
-
-func NewExecutor(opt Option) (e *Executor, err error) {
-	if opt.Logger == nil {
-		err = errors.New("logger must be non-nil")
+	switch c.hypervisor() {
+	case HypervisorFirecracker:
+	case HypervisorQEMU:
+		err = c.QEMU.Validate()
+		if err != nil {
+			err = fmt.Errorf("qemu: %w", err)
+			return
+		}
+		if c.transport() != TransportSSH {
+			err = errors.New("qemu supports only ssh transport")
+			return
+		}
+		if c.cniEnabled() {
+			err = errors.New("qemu does not support CNI")
+			return
+		}
+		if c.Jailer.Enabled {
+			err = errors.New("qemu does not support jailer")
+			return
+		}
+		if c.MMDSVersion == MMDSv1 || c.MMDSVersion == MMDSv2 {
+			err = errors.New("qemu does not support MMDS, set MMDSVersion to off or leave it empty")
+			return
+		}
+	default:
+		err = fmt.Errorf("unknown hypervisor %q", c.Hypervisor)
 		return
 	}
-	if opt.Ctx == nil {
-		err = errors.New("ctx must be non-nil")
+	switch c.MMDSVersion {
+	case "", MMDSv1, MMDSv2, MMDSOff:
+	default:
+		err = fmt.Errorf("unknown MMDS version %q", c.MMDSVersion)
 		return
 	}
-	if opt.Build == nil {
-		err = errors.New("build is required")
+	err = c.Boot.Validate()
+	if err != nil {
+		err = fmt.Errorf("boot: %w", err)
 		return
 	}
-	if opt.JobTrace == nil {
-		err = errors.New("job trace is required")
+	err = c.Jailer.Validate()
+	if err != nil {
+		err = fmt.Errorf("jailer: %w", err)
 		return
 	}
-
-	err = opt.Config.Validate()
+	err = c.Diagnosis.Validate()
 	if err != nil {
-		err = fmt.Errorf("validating config: %w", err)
+		err = fmt.Errorf("diagnosis: %w", err)
 		return
 	}
 
-	logger := opt.Logger.With(zap.Int("jobId", opt.Build.job.ID))
-
-	e = &Executor{
-		logger:     logger,
-		ctx:        opt.Ctx,
-		build:      opt.Build,
-		config:     opt.Config,
-		logSink:    opt.JobTrace,
-		tempRootFS: nil,
-		machine:    nil,
-		ssh:        nil,
-	}
-
-	rootFSOrigin, err := os.Open(e.config.RootFSPath)
+	err = c.NetworkPolicy.Validate()
 	if err != nil {
-		err = fmt.Errorf("open original RootFS file: %w", err)
+		err = fmt.Errorf("network policy: %w", err)
 		return
 	}
-	defer rootFSOrigin.Close()
-
-	e.tempRootFS, err = os.CreateTemp("", "tart-rootfs-*.ext4")
+	err = c.CacheDrive.Validate()
 	if err != nil {
-		err = fmt.Errorf("creating temp rootFS: %w", err)
+		err = fmt.Errorf("cache drive: %w", err)
 		return
 	}
-	_, err = io.Copy(e.tempRootFS, rootFSOrigin)
+	err = c.Services.Validate(c)
 	if err != nil {
-		err = fmt.Errorf("clone rootFS: %w", err)
+		err = fmt.Errorf("services: %w", err)
+		return
+	}
+	if c.Services.enabled() && (c.Offline || c.cniEnabled()) {
+		err = errors.New("services are supported in neither offline nor CNI mode")
 		return
 	}
-	err = e.tempRootFS.Sync()
+	err = c.Debug.Validate()
 	if err != nil {
-		err = fmt.Errorf("file system sync on rootFS: %w", err)
+		err = fmt.Errorf("debug: %w", err)
+		return
+	}
+	if c.Debug.enabled() && c.transport() != TransportSSH {
+		// tart debug attach logs in over SSH
+		err = errors.New("debugging requires ssh transport")
 		return
 	}
 
-	return
-}
-
-type freezeReader struct{}
-
-func (f freezeReader) Read(p []byte) (n int, err error) {
-	// freezes here
-	select {}
-}
-
-// Prepare start the VM, clones the repo.
-func (e *Executor) Prepare(ctx context.Context) (err error) {
-	defer func() {
-		if err != nil {
-			e.logger.Debug("Build failed during preparing", zap.Error(err))
-			_ = e.redLine("Build failed during preparing: %s", err)
+	if c.Offline {
+		// no network
+		return
+	}
+	if c.cniEnabled() {
+		if !c.NetworkPolicy.IsFull() {
+			err = errors.New("network policy is not supported in CNI mode, use a CNI firewall plugin instead")
+			return
 		}
-	}()
 
-	err = e.yellowLine("Running with %s on %s\n", version.FullName, e.config.IP)
-	if err != nil {
+		// the rest are provided by CNI
 		return
 	}
-
-	e.logger.Debug("Spinning up microVM...")
-	err = e.blueLine("Spinning up microVM...")
-	if err != nil {
+	if c.IP == "" {
+		err = errors.New("ip is required")
 		return
 	}
-
-	e.socketFilePath = fmt.Sprintf("/tmp/tart-firecracker-%d.socket", time.Now().UnixNano())
-	cmd := firecracker.VMCommandBuilder{}.
-		WithStdin(freezeReader{}).
-		WithStdout(io.Discard).
-		WithStderr(io.Discard).
-		WithSocketPath(e.socketFilePath).
-		Build(ctx)
-
-	machine, err := firecracker.NewMachine(ctx, firecracker.Config{
-		SocketPath:      e.socketFilePath,
-		KernelImagePath: e.config.KernelPath,
-		KernelArgs:      e.kernelArgs(),
-		Drives: []models.Drive{
-			{
-				DriveID:      firecracker.String("1"),
-				IsReadOnly:   firecracker.Bool(false),
-				IsRootDevice: firecracker.Bool(true),
-				PathOnHost:   firecracker.String(e.tempRootFS.Name()),
-			},
-		},
-		NetworkInterfaces: []firecracker.NetworkInterface{
-			{
-				StaticConfiguration: &firecracker.StaticNetworkConfiguration{
-					MacAddress:  e.config.TapMac,
-					HostDevName: e.config.TapDevice,
-				},
-			},
-		},
-		MachineCfg: models.MachineConfiguration{
-			MemSizeMib: firecracker.Int64(1024),
-			VcpuCount:  firecracker.Int64(2),
-		},
-	}, firecracker.WithProcessRunner(cmd))
-	if err != nil {
-		err = fmt.Errorf("init firecracker machine: %w", err)
+	if c.GatewayIP == "" {
+		err = errors.New("gatewayIP is required")
 		return
 	}
-
-	e.logger.Debug("MicroVM is initialized, starting...", zap.String("VMID", machine.Cfg.VMID))
-	err = e.greenLine("MicroVM %s is initialized, starting...", machine.Cfg.VMID)
-	if err != nil {
+	if c.Netmask == "" {
+		err = errors.New("netmask is required")
 		return
 	}
-
-	err = machine.Start(e.ctx)
-	if err != nil {
-		err = fmt.Errorf("starting the VM: %w", err)
+	if c.TapDevice == "" {
+		err = errors.New("tap device is required")
 		return
 	}
-	e.machine = machine
-
-	e.logger.Debug("MicroVM started, connecting...")
-	err = e.greenLine("MicroVM started, connecting...")
-	if err != nil {
+	if c.TapMac == "" {
+		err = errors.New("tap MAC is required")
 		return
 	}
 
-	// retry until timeout since the VM is booting and may not be ready
-	sshCtx, cancelSSHCtx := context.WithTimeout(ctx, 10*time.Second)
-	defer cancelSSHCtx()
-	ticker := time.NewTicker(500 * time.Millisecond)
-	defer ticker.Stop()
+	return
+}
 
-TRYSSH:
-	for {
-		select {
-		case <-sshCtx.Done():
-			err = fmt.Errorf("waiting for SSH connection to VM: %w", err)
-			return
-		case <-ticker.C:
-			e.ssh, err = e.dialSSH()
-			if err == nil {
-				break TRYSSH
-			}
-			e.logger.Debug("trying to establishing SSH connection to VM", zap.Error(err))
-		}
-	}
+// Executor runs a CI job in an environment of its kind.
+type Executor interface {
+	// Prepare sets up the environment, and clones the repo.
+	Prepare(ctx context.Context) error
+	// RunStep runs script of stage with bash in the environment,
+	// returns *ExitError if the script exits non-zero.
+	RunStep(ctx context.Context, stage Stage, script string) error
+	// Upload writes content to path in the environment,
+	// a relative path is relative to home directory of the environment.
+	Upload(ctx context.Context, path string, mode uint32, content io.Reader) error
+	// Download reads the file at path in the environment into w,
+	// a relative path is relative to home directory of the environment.
+	Download(ctx context.Context, path string, w io.Writer) error
+	// Close tears down the environment.
+	Close(ctx context.Context) error
+}
 
-	session, err := e.ssh.NewSession()
-	if err != nil {
-		err = fmt.Errorf("init ssh session: %w", err)
-		return
-	}
-	defer session.Close()
+type Option struct {
+	Logger *zap.Logger
+	// The context must not be cancelled while the environment is running.
+	Ctx      context.Context
+	Build    *Build
+	JobTrace io.Writer
+	// optional, moves artifacts of offline jobs
+	Artifacts ArtifactClient
 
-	session.Stdout = e.logSink
-	session.Stderr = e.logSink
+	Config
+}
 
-	err = e.greenLine("MicroVM connected, cloning repo and checking out...")
-	if err != nil {
+func (o Option) validate() (err error) {
+	if o.Logger == nil {
+		err = errors.New("logger must be non-nil")
 		return
 	}
-
-	var buf bytes.Buffer
-	err = e.build.PrepareScript(&buf)
-	if err != nil {
-		err = fmt.Errorf("forging prepare script: %w", err)
+	if o.Ctx == nil {
+		err = errors.New("ctx must be non-nil")
 		return
 	}
-
-	e.logger.Debug("MicroVM connected, cloning repo and checking out...", zap.String("script", buf.String()))
-	err = session.Start(buf.String())
-	if err != nil {
-		err = fmt.Errorf("sending prepare script over SSH: %w", err)
+	if o.Build == nil {
+		err = errors.New("build is required")
 		return
 	}
-
-	err = runUntilTimeout(e.build.Timeout(), session.Wait)
-	if err != nil {
-		err = fmt.Errorf("running prepare script over SSH: %w", err)
+	if o.JobTrace == nil {
+		err = errors.New("job trace is required")
 		return
 	}
 
-	err = e.greenLine("Repo cloned and checked out.")
+	err = o.Config.Validate()
 	if err != nil {
+		err = fmt.Errorf("validating config: %w", err)
 		return
 	}
 
 	return
 }
 
+// New creates the executor of kind in config.
+func New(opt Option) (e Executor, err error) {
+	switch opt.Config.kind() {
+	case KindShell:
+		e, err = NewShell(opt)
+	case KindSSH:
+		e, err = NewSSH(opt)
+	case KindCustom:
+		e, err = NewCustom(opt)
+	default:
+		opt.Config, err = opt.Config.withImage(opt.Build.job.Image.Name)
+		if err == nil {
+			err = opt.Config.Services.checkServices(opt.Build.job.Services)
+		}
+		if err != nil {
+			_ = tracer{logSink: opt.JobTrace}.redLine("Build failed during preparing: %s", err)
+			return
+		}
+		e, err = NewMicroVM(opt)
+	}
+
+	return
+}
+
 type BuildResult struct {
 	Err           error
 	ExitCode      int
 	FailureReason network.FailureReason
 }
 
-// Build runs the build and returns encountered error.
-func (e *Executor) Build() (result BuildResult) {
+// RunBuild runs the build script with exe and returns encountered error.
+func RunBuild(ctx context.Context, logger *zap.Logger, exe Executor, build *Build, jobTrace io.Writer) (result BuildResult) {
 	var err error
+	trace := tracer{logSink: jobTrace}
 
 	defer func() {
 		if err != nil {
-			e.logger.Debug("Build failed", zap.Error(err))
-			_ = e.redLine("Build failed: %s", err)
+			logger.Debug("Build failed", zap.Error(err))
+			_ = trace.redLine("Build failed: %s", err)
 
 			if result.Err == nil {
 				result.Err = err
@@ -349,46 +432,45 @@ func (e *Executor) Build() (result BuildResult) {
 		}
 	}()
 
-	err = e.blueLine("build phase starting...")
-	if err != nil {
-		return
-	}
-
-	session, err := e.ssh.NewSession()
+	err = trace.blueLine("build phase starting...")
 	if err != nil {
-		err = fmt.Errorf("init ssh session: %w", err)
 		return
 	}
-	defer session.Close()
-
-	session.Stdout = e.logSink
-	session.Stderr = e.logSink
 
 	var buf bytes.Buffer
-	err = e.build.BuildScript(&buf)
+	err = build.BuildScript(&buf)
 	if err != nil {
 		err = fmt.Errorf("forging build script: %w", err)
 		return
 	}
 
-	e.logger.Debug("excuting build script", zap.String("script", buf.String()))
-	err = session.Start(buf.String())
-	if err != nil {
-		err = fmt.Errorf("sending build script over SSH: %w", err)
+	logger.Debug("excuting build script", zap.String("script", buf.String()))
+	err = runStepUntilTimeout(ctx, exe, build.Timeout(), StageStepScript, buf.String())
+	var exhaustedErr *ExhaustionError
+	var exitErr *ExitError
+	if errors.As(err, &exhaustedErr) {
+		logger.Debug("Build failed of resource exhaustion", zap.Error(err))
+		_ = trace.redLine("Build failed: %s", exhaustedErr)
+		result = BuildResult{
+			Err:           exhaustedErr,
+			FailureReason: exhaustedErr.FailureReason(),
+		}
+		if errors.As(err, &exitErr) {
+			result.ExitCode = exitErr.Code
+		}
+
 		return
 	}
-
-	err = runUntilTimeout(e.build.Timeout(), session.Wait)
-	switch typed := err.(type) {
-	case *ssh.ExitError:
+	if errors.As(err, &exitErr) {
 		result = BuildResult{
-			Err:           typed,
-			ExitCode:      typed.ExitStatus(),
+			Err:           exitErr,
+			ExitCode:      exitErr.Code,
 			FailureReason: network.FailureReasonScriptFailure,
 		}
 
 		return
-	case *ssh.ExitMissingError:
+	}
+	if errors.Is(err, errExitMissing) {
 		result = BuildResult{
 			Err:           err,
 			ExitCode:      0,
@@ -396,117 +478,47 @@ func (e *Executor) Build() (result BuildResult) {
 		}
 	}
 	if err != nil {
-		err = fmt.Errorf("running build script over SSH: %w", err)
-		return
-	}
-
-	e.logger.Debug("Job succeeded")
-	err = e.greenLine("Job succeeded")
-	if err != nil {
-		return
-	}
-
-	return
-}
-
-func (e *Executor) Close(ctx context.Context) (err error) {
-	if e.ssh != nil {
-		_ = e.ssh.Close()
-	}
-
-	if e.machine != nil {
-		err = e.machine.Shutdown(ctx)
-		if err != nil {
-			err = e.machine.StopVMM()
-		}
-		if err != nil {
-			err = fmt.Errorf("stopping VM: %w", err)
-			return
-		}
-	}
-	if e.socketFilePath != "" {
-		_ = os.Remove(e.socketFilePath)
-	}
-
-	tempRootFSPath := e.tempRootFS.Name()
-	_ = e.tempRootFS.Close()
-
-	_ = os.Remove(tempRootFSPath)
-
-	return
-}
-
-func (e *Executor) kernelArgs() string {
-	return "ro console=ttyS0 noapic reboot=k panic=1 pci=off nomodules random.trust_cpu=on " +
-		fmt.Sprintf("ip=%s::%s:%s::eth0:off", e.config.IP, e.config.GatewayIP, e.config.Netmask)
-}
-
-func (e *Executor) dialSSH() (client *ssh.Client, err error) {
-	config := &ssh.ClientConfig{
-		User: "root",
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(rootfs.SSHSigner),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         5 * time.Second,
-	}
-
-	client, err = ssh.Dial("tcp", e.config.IP+":22", config)
-	if err != nil {
-		err = fmt.Errorf("dialing ssh: %w", err)
-		return
-	}
-
-	return
-}
-
-func (e *Executor) redLine(format string, args ...any) (err error) {
-	_, err = io.WriteString(e.logSink, color.HiRedString(format+"\n", args...))
-	if err != nil {
-		err = fmt.Errorf("print red line: %w", err)
+		err = fmt.Errorf("running build script: %w", err)
 		return
 	}
 
-	return
-}
-
-func (e *Executor) yellowLine(format string, args ...any) (err error) {
-	_, err = io.WriteString(e.logSink, color.HiYellowString(format+"\n", args...))
+	logger.Debug("Job succeeded")
+	err = trace.greenLine("Job succeeded")
 	if err != nil {
-		err = fmt.Errorf("print yellow line: %w", err)
 		return
 	}
 
 	return
 }
 
-func (e *Executor) blueLine(format string, args ...any) (err error) {
-	_, err = io.WriteString(e.logSink, color.HiBlueString(format+"\n", args...))
+// cloneRepo runs the prepare script of build with exe,
+// reference is the path to git mirror in the environment, which is optional.
+func cloneRepo(ctx context.Context, logger *zap.Logger, exe Executor, build *Build, reference string) (err error) {
+	var buf bytes.Buffer
+	err = build.PrepareScript(&buf, reference)
 	if err != nil {
-		err = fmt.Errorf("print blue line: %w", err)
+		err = fmt.Errorf("forging prepare script: %w", err)
 		return
 	}
 
-	return
-}
-
-func (e *Executor) greenLine(format string, args ...any) (err error) {
-	_, err = io.WriteString(e.logSink, color.HiGreenString(format+"\n", args...))
+	logger.Debug("cloning repo and checking out...", zap.String("script", buf.String()))
+	err = runStepUntilTimeout(ctx, exe, build.Timeout(), StageGetSources, buf.String())
 	if err != nil {
-		err = fmt.Errorf("print green line: %w", err)
+		err = fmt.Errorf("running prepare script: %w", err)
 		return
 	}
 
 	return
 }
 
-func (e *Executor) line(format string, args ...any) (err error) {
-	_, err = fmt.Fprintf(e.logSink, format+"\n", args...)
-	if err != nil {
-		err = fmt.Errorf("print line: %w", err)
-		return
-	}
+// runStepUntilTimeout runs script of stage with exe, which is cancelled on timeout.
+func runStepUntilTimeout(ctx context.Context, exe Executor, timeout time.Duration, stage Stage, script string) (err error) {
+	stepCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
+	err = runUntilTimeout(timeout, func() error {
+		return exe.RunStep(stepCtx, stage, script)
+	})
 	return
 }
 
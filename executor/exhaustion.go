@@ -0,0 +1,238 @@
+package executor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nanmu42/tart/network"
+
+	"go.uber.org/zap"
+)
+
+const (
+	ResourceMemory = "memory"
+	ResourceDisk   = "disk"
+	// disk of the host holding drives of the microVM
+	ResourceHostDisk = "host disk"
+
+	// how long the guest check may take after a step
+	guestCheckTimeout = 10 * time.Second
+)
+
+// ExhaustionError reports the microVM ran out of memory or disk space.
+type ExhaustionError struct {
+	// ResourceMemory, ResourceDisk or ResourceHostDisk
+	Resource string
+	// size of the resource in MiB, zero if unknown
+	SizeMiB int64
+	// what tells so
+	Evidence string
+	// what the job failed with, if any
+	Err error
+}
+
+func (e *ExhaustionError) Error() string {
+	switch e.Resource {
+	case ResourceMemory:
+		return fmt.Sprintf("the job ran out of memory, the microVM has %d MiB (%s), please use less memory, e.g. with fewer parallel jobs in the build", e.SizeMiB, e.Evidence)
+	case ResourceDisk:
+		return fmt.Sprintf("the job ran out of disk space, the RootFS of the microVM is %d MiB (%s), please clean up during the build or put large files elsewhere", e.SizeMiB, e.Evidence)
+	default:
+		return fmt.Sprintf("the host failed writing drives of the microVM, which is likely out of disk space (%s), please contact the admin of the runner", e.Evidence)
+	}
+}
+
+func (e *ExhaustionError) Unwrap() error {
+	return e.Err
+}
+
+// FailureReason classifies the failure for GitLab,
+// which is the job's to fix unless the host is out of space.
+func (e *ExhaustionError) FailureReason() network.FailureReason {
+	if e.Resource == ResourceHostDisk {
+		return network.FailureReasonRunnerSystemFailure
+	}
+
+	return network.FailureReasonScriptFailure
+}
+
+var (
+	// kernel messages of the OOM killer
+	oomPattern = regexp.MustCompile(`Out of memory: Kill|invoked oom-killer|oom-kill:|Memory cgroup out of memory`)
+	// kernel messages of ext4 running out of space on RootFS, which is vda,
+	// other drives like the cache volume are none of the job's RootFS
+	diskFullPattern = regexp.MustCompile(`EXT4-fs [^(]*\((device )?(vda|root)\):.*(error 28|No space left|ENOSPC)`)
+)
+
+// exhaustionWatcher looks for signs of resource exhaustion on serial console,
+// keeping the first message of each kind.
+type exhaustionWatcher struct {
+	mu      sync.Mutex
+	partial []byte
+	oom     string
+	disk    string
+}
+
+func (w *exhaustionWatcher) Write(p []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	n = len(p)
+	w.partial = append(w.partial, p...)
+	for {
+		idx := bytes.IndexByte(w.partial, '\n')
+		if idx < 0 {
+			break
+		}
+		line := string(bytes.TrimSpace(w.partial[:idx]))
+		w.partial = w.partial[idx+1:]
+
+		if w.oom == "" && oomPattern.MatchString(line) {
+			w.oom = line
+		}
+		if w.disk == "" && diskFullPattern.MatchString(line) {
+			w.disk = line
+		}
+	}
+
+	// a console without line breaks should not pile up
+	if len(w.partial) > 4096 {
+		w.partial = nil
+	}
+
+	return
+}
+
+// take returns the first messages of OOM and disk full since the last call,
+// empty if none.
+func (w *exhaustionWatcher) take() (oom, disk string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	oom, disk = w.oom, w.disk
+	w.oom, w.disk = "", ""
+	return
+}
+
+// guestCheckScript prints count of OOM kills since boot,
+// and total and free blocks of RootFS, including those reserved for root.
+const guestCheckScript = `awk '$1 == "oom_kill" {print "oom_kill", $2}' /proc/vmstat
+stat -f -c 'rootfs %b %f' /
+`
+
+// guestUsage is what the guest check reports.
+type guestUsage struct {
+	oomKills   int64
+	diskBlocks int64
+	diskFree   int64
+}
+
+func parseGuestCheck(output []byte) (usage guestUsage, err error) {
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch {
+		case fields[0] == "oom_kill" && len(fields) == 2:
+			usage.oomKills, err = strconv.ParseInt(fields[1], 10, 64)
+		case fields[0] == "rootfs" && len(fields) == 3:
+			usage.diskBlocks, err = strconv.ParseInt(fields[1], 10, 64)
+			if err == nil {
+				usage.diskFree, err = strconv.ParseInt(fields[2], 10, 64)
+			}
+		}
+		if err != nil {
+			err = fmt.Errorf("parsing %q: %w", scanner.Text(), err)
+			return
+		}
+	}
+
+	err = scanner.Err()
+	return
+}
+
+// diskFull tells whether less than 1% of RootFS is free.
+func (u guestUsage) diskFull() bool {
+	return u.diskBlocks > 0 && u.diskFree*100 < u.diskBlocks
+}
+
+// checkExhaustion looks for resource exhaustion of the microVM since the last check
+// on serial console, in the guest, and in metrics of the hypervisor,
+// returning nil if none is found.
+//
+// Every source is consulted, even after one tells, so that counters are
+// up to date for the next check.
+func (e *MicroVM) checkExhaustion(ctx context.Context) (exhausted *ExhaustionError) {
+	rootFSMiB := int64(0)
+	if info, err := e.tempRootFS.Stat(); err == nil {
+		rootFSMiB = info.Size() >> 20
+	}
+
+	// the first found wins, console messages are the most telling
+	found := func(err *ExhaustionError) {
+		if exhausted == nil {
+			exhausted = err
+		}
+	}
+
+	oom, disk := e.exhaustion.take()
+	if oom != "" {
+		found(&ExhaustionError{Resource: ResourceMemory, SizeMiB: vmMemSizeMiB, Evidence: "serial console: " + oom})
+	}
+	if disk != "" {
+		found(&ExhaustionError{Resource: ResourceDisk, SizeMiB: rootFSMiB, Evidence: "serial console: " + disk})
+	}
+
+	if e.transport != nil {
+		checkCtx, cancel := context.WithTimeout(ctx, guestCheckTimeout)
+		var output, errOutput bytes.Buffer
+		err := e.transport.run(checkCtx, StageStepScript, guestCheckScript, &output, &errOutput)
+		cancel()
+		usage, parseErr := parseGuestCheck(output.Bytes())
+		switch {
+		case err != nil && strings.Contains(errOutput.String()+err.Error(), "No space left on device"):
+			// not even the check fits in
+			found(&ExhaustionError{Resource: ResourceDisk, SizeMiB: rootFSMiB, Evidence: "no space left for the resource check"})
+		case err != nil:
+			// the guest may be too sick to answer
+			e.logger.Debug("checking resource usage in guest", zap.Error(err))
+		case parseErr != nil:
+			e.logger.Debug("parsing resource usage of guest", zap.Error(parseErr))
+		default:
+			oomKills := usage.oomKills - e.oomKills
+			e.oomKills = usage.oomKills
+			if oomKills > 0 {
+				found(&ExhaustionError{Resource: ResourceMemory, SizeMiB: vmMemSizeMiB, Evidence: fmt.Sprintf("%d processes killed by the OOM killer", oomKills)})
+			}
+			if usage.diskFull() {
+				found(&ExhaustionError{Resource: ResourceDisk, SizeMiB: rootFSMiB, Evidence: fmt.Sprintf("%d of %d blocks free", usage.diskFree, usage.diskBlocks)})
+			}
+		}
+	}
+
+	metrics, err := e.hypervisor.metrics(ctx)
+	if err != nil {
+		e.logger.Debug("reading metrics of microVM", zap.Error(err))
+		return
+	}
+	last := e.lastMetrics
+	e.lastMetrics = metrics
+	if metrics.diskErrors > last.diskErrors {
+		found(&ExhaustionError{Resource: ResourceHostDisk, Evidence: fmt.Sprintf("%d failed drive requests", metrics.diskErrors-last.diskErrors)})
+	}
+	if metrics.fileSizeExceeded > last.fileSizeExceeded {
+		found(&ExhaustionError{Resource: ResourceHostDisk, Evidence: "file size limit exceeded"})
+	}
+
+	return
+}
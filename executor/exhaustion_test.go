@@ -0,0 +1,122 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/nanmu42/tart/network"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestExhaustionWatcher(t *testing.T) {
+	var w exhaustionWatcher
+	_, _ = io.WriteString(&w, "[   12.000000] systemd[1]: Started Tart ready.\r\n")
+	_, _ = io.WriteString(&w, "[   42.000000] go invoked oom-killer: gfp_mask=0x100cca(GFP_HIGHUSER_MOVABLE), order=0\r\n[   42.1] Out of memory: Killed proc")
+	_, _ = io.WriteString(&w, "ess 321 (go) total-vm:2048000kB\r\n")
+	// errors of other drives, or not about space, are none of RootFS running out of space
+	_, _ = io.WriteString(&w, "[   45.000000] EXT4-fs (vdc): Delayed block allocation failed for inode 12 at logical offset 0 with max blocks 2 with error 28\n")
+	_, _ = io.WriteString(&w, "[   46.000000] EXT4-fs error (device vdc): ext4_validate_block_bitmap:390: comm kworker: bg 0: bad block bitmap checksum\n")
+	_, _ = io.WriteString(&w, "[   47.000000] EXT4-fs (vda): Remounting filesystem read-only\n")
+	_, _ = io.WriteString(&w, "[   50.000000] EXT4-fs (vda): Delayed block allocation failed for inode 1234 at logical offset 0 with max blocks 2 with error 28\n")
+
+	oom, disk := w.take()
+	assert.Contains(t, oom, "invoked oom-killer")
+	assert.Contains(t, disk, "EXT4-fs (vda)")
+	assert.Contains(t, disk, "error 28")
+
+	oom, disk = w.take()
+	assert.Empty(t, oom)
+	assert.Empty(t, disk)
+
+	_, _ = io.WriteString(&w, "[   60.000000] EXT4-fs warning (device vda): ext4_dx_add_entry:2461: No space left on device\n")
+	_, disk = w.take()
+	assert.Contains(t, disk, "No space left")
+}
+
+func TestParseGuestCheck(t *testing.T) {
+	usage, err := parseGuestCheck([]byte("oom_kill 2\nrootfs 524288 1000\n"))
+	require.NoError(t, err)
+	assert.Equal(t, guestUsage{oomKills: 2, diskBlocks: 524288, diskFree: 1000}, usage)
+	assert.True(t, usage.diskFull())
+
+	usage, err = parseGuestCheck([]byte("rootfs 524288 262144\n"))
+	require.NoError(t, err)
+	assert.Zero(t, usage.oomKills)
+	assert.False(t, usage.diskFull())
+
+	_, err = parseGuestCheck([]byte("oom_kill many\n"))
+	assert.Error(t, err)
+}
+
+func TestExhaustionError(t *testing.T) {
+	err := error(&ExhaustionError{
+		Resource: ResourceMemory,
+		SizeMiB:  1024,
+		Evidence: "1 processes killed by the OOM killer",
+		Err:      &ExitError{Code: 137},
+	})
+	assert.EqualError(t, err, "the job ran out of memory, the microVM has 1024 MiB (1 processes killed by the OOM killer), please use less memory, e.g. with fewer parallel jobs in the build")
+
+	var exitErr *ExitError
+	require.True(t, errors.As(err, &exitErr))
+	assert.Equal(t, 137, exitErr.Code)
+
+	var exhaustedErr *ExhaustionError
+	require.True(t, errors.As(err, &exhaustedErr))
+	assert.Equal(t, network.FailureReasonScriptFailure, exhaustedErr.FailureReason())
+	assert.Equal(t, network.FailureReasonRunnerSystemFailure, (&ExhaustionError{Resource: ResourceHostDisk}).FailureReason())
+}
+
+// guestCheckTransport answers guest checks with outputs in turn.
+type guestCheckTransport struct {
+	transport
+	outputs []string
+}
+
+func (g *guestCheckTransport) run(_ context.Context, _ Stage, _ string, stdout, _ io.Writer) error {
+	output := g.outputs[0]
+	g.outputs = g.outputs[1:]
+	_, err := io.WriteString(stdout, output)
+	return err
+}
+
+// quietHypervisor reports no metrics.
+type quietHypervisor struct {
+	hypervisor
+}
+
+func (quietHypervisor) metrics(_ context.Context) (vmMetrics, error) {
+	return vmMetrics{}, nil
+}
+
+func TestMicroVM_CheckExhaustion(t *testing.T) {
+	ctx := context.Background()
+	e := &MicroVM{
+		logger:     zap.NewNop(),
+		hypervisor: quietHypervisor{},
+		transport: &guestCheckTransport{outputs: []string{
+			"oom_kill 1\nrootfs 524288 262144\n",
+			"oom_kill 1\nrootfs 524288 262144\n",
+			"oom_kill 3\nrootfs 524288 262144\n",
+		}},
+	}
+
+	// the console tells first, the guest agrees
+	_, _ = io.WriteString(&e.exhaustion, "[   42.000000] Out of memory: Killed process 321 (go)\n")
+	exhausted := e.checkExhaustion(ctx)
+	require.NotNil(t, exhausted)
+	assert.Equal(t, ResourceMemory, exhausted.Resource)
+	assert.Contains(t, exhausted.Evidence, "serial console")
+
+	// the same kill is not reported again
+	assert.Nil(t, e.checkExhaustion(ctx))
+
+	exhausted = e.checkExhaustion(ctx)
+	require.NotNil(t, exhausted)
+	assert.Equal(t, "2 processes killed by the OOM killer", exhausted.Evidence)
+}
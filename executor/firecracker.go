@@ -0,0 +1,286 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+// firecrackerHypervisor runs the microVM with Firecracker,
+// optionally under the jailer.
+type firecrackerHypervisor struct {
+	// The context must not be cancelled while the microVM is running.
+	ctx    context.Context
+	config Config
+	vmID   string
+	logs   jobLogs
+
+	socketFilePath string
+	machine        *firecracker.Machine
+}
+
+func (h *firecrackerHypervisor) String() string {
+	return "Firecracker"
+}
+
+func (h *firecrackerHypervisor) kernelArgs() string {
+	return "ro console=ttyS0 noapic reboot=k panic=1 pci=off nomodules random.trust_cpu=on"
+}
+
+type freezeReader struct{}
+
+func (f freezeReader) Read(p []byte) (n int, err error) {
+	// freezes here
+	select {}
+}
+
+func (h *firecrackerHypervisor) start(ctx context.Context, spec vmSpec) (err error) {
+	fcConfig := firecracker.Config{
+		VMID:            h.vmID,
+		KernelImagePath: h.config.KernelPath,
+		KernelArgs:      spec.kernelArgs,
+		LogPath:         h.logs.firecrackerLog,
+		LogLevel:        "Info",
+		MetricsPath:     h.logs.metrics,
+		Drives: []models.Drive{
+			{
+				DriveID:      firecracker.String("1"),
+				IsReadOnly:   firecracker.Bool(false),
+				IsRootDevice: firecracker.Bool(true),
+				PathOnHost:   firecracker.String(spec.rootFS),
+			},
+			{
+				DriveID:      firecracker.String("2"),
+				IsReadOnly:   firecracker.Bool(true),
+				IsRootDevice: firecracker.Bool(false),
+				PathOnHost:   firecracker.String(spec.configDrive),
+			},
+		},
+		MachineCfg: models.MachineConfiguration{
+			MemSizeMib: firecracker.Int64(vmMemSizeMiB),
+			VcpuCount:  firecracker.Int64(vmVcpuCount),
+		},
+	}
+	if !h.config.Offline {
+		fcConfig.NetworkInterfaces = []firecracker.NetworkInterface{h.networkInterface(spec.metadata != nil)}
+	}
+	for _, nic := range spec.nics {
+		fcConfig.NetworkInterfaces = append(fcConfig.NetworkInterfaces, firecracker.NetworkInterface{
+			StaticConfiguration: &firecracker.StaticNetworkConfiguration{
+				MacAddress:  nic.mac,
+				HostDevName: nic.tap,
+			},
+		})
+	}
+	for i, drive := range spec.drives {
+		fcConfig.Drives = append(fcConfig.Drives, models.Drive{
+			DriveID:      firecracker.String(strconv.Itoa(i + 3)),
+			IsReadOnly:   firecracker.Bool(drive.readOnly),
+			IsRootDevice: firecracker.Bool(false),
+			PathOnHost:   firecracker.String(drive.path),
+		})
+	}
+	if spec.metadata != nil {
+		fcConfig.MmdsAddress = net.ParseIP(mmdsAddress)
+		fcConfig.MmdsVersion = firecracker.MMDSVersion(h.config.mmdsVersion())
+	}
+
+	if spec.vsockPath != "" {
+		// Firecracker resolves the path in chroot under jailer
+		vsockPath := spec.vsockPath
+		if h.config.Jailer.Enabled {
+			vsockPath = agentVsockName
+		}
+		fcConfig.VsockDevices = []firecracker.VsockDevice{
+			{ID: "agent", Path: vsockPath, CID: guestCID},
+		}
+	}
+
+	var cmd *exec.Cmd
+	if h.config.Jailer.Enabled {
+		if h.config.cniEnabled() {
+			// jailer joins the network namespace on behalf of Firecracker
+			fcConfig.NetNS = filepath.Join("/var/run/netns", h.vmID)
+		}
+		fcConfig.SocketPath = jailerSocketName
+		fcConfig.JailerCfg, err = h.config.Jailer.sdkConfig(h.vmID)
+		if err != nil {
+			return
+		}
+		cmd, err = h.config.Jailer.command(ctx, h.vmID, fcConfig.NetNS, freezeReader{}, spec.console, spec.console)
+		if err != nil {
+			err = fmt.Errorf("forging jailer command: %w", err)
+			return
+		}
+	} else {
+		fcConfig.SocketPath = fmt.Sprintf("/tmp/tart-firecracker-%d.socket", time.Now().UnixNano())
+		cmd = firecracker.VMCommandBuilder{}.
+			WithStdin(freezeReader{}).
+			WithStdout(spec.console).
+			WithStderr(spec.console).
+			WithSocketPath(fcConfig.SocketPath).
+			Build(ctx)
+	}
+
+	machine, err := firecracker.NewMachine(ctx, fcConfig, firecracker.WithProcessRunner(cmd))
+	if err != nil {
+		err = fmt.Errorf("init firecracker machine: %w", err)
+		return
+	}
+	// jailer moves the socket into the chroot
+	h.socketFilePath = machine.Cfg.SocketPath
+	if spec.metadata != nil {
+		machine.Handlers.FcInit = machine.Handlers.FcInit.AppendAfter(firecracker.ConfigMmdsHandlerName, h.setMetadataHandler(*spec.metadata))
+	}
+
+	err = machine.Start(h.ctx)
+	if err != nil {
+		return
+	}
+	h.machine = machine
+
+	return
+}
+
+func (h *firecrackerHypervisor) networkInterface(allowMMDS bool) firecracker.NetworkInterface {
+	if h.config.cniEnabled() {
+		cni := &firecracker.CNIConfiguration{
+			NetworkName: h.config.CNINetworkName,
+			IfName:      "veth0",
+			VMIfName:    "eth0",
+			ConfDir:     h.config.CNIConfDir,
+		}
+		if h.config.CNIBinDir != "" {
+			cni.BinPath = []string{h.config.CNIBinDir}
+		}
+
+		return firecracker.NetworkInterface{
+			CNIConfiguration: cni,
+			AllowMMDS:        allowMMDS,
+		}
+	}
+
+	return firecracker.NetworkInterface{
+		StaticConfiguration: &firecracker.StaticNetworkConfiguration{
+			MacAddress:  h.config.TapMac,
+			HostDevName: h.config.TapDevice,
+		},
+		AllowMMDS: allowMMDS,
+	}
+}
+
+// ip returns the IP of the started microVM.
+func (h *firecrackerHypervisor) ip() (ip string, err error) {
+	if h.config.Offline {
+		return
+	}
+	if !h.config.cniEnabled() {
+		ip = h.config.IP
+		return
+	}
+
+	// CNI result is written back into the static configuration
+	iface := h.machine.Cfg.NetworkInterfaces[0]
+	if iface.StaticConfiguration == nil || iface.StaticConfiguration.IPConfiguration == nil {
+		err = errors.New("CNI result contains no IP configuration")
+		return
+	}
+
+	ip = iface.StaticConfiguration.IPConfiguration.IPAddr.IP.String()
+	return
+}
+
+// firecrackerMetrics is a line in the metrics file, whose counters
+// are deltas since the previous line.
+type firecrackerMetrics struct {
+	Block struct {
+		ExecuteFails uint64 `json:"execute_fails"`
+		WriteBytes   uint64 `json:"write_bytes"`
+	} `json:"block"`
+	Net struct {
+		RxBytesCount uint64 `json:"rx_bytes_count"`
+		TxBytesCount uint64 `json:"tx_bytes_count"`
+	} `json:"net"`
+	Signals struct {
+		SIGXFSZ uint64 `json:"sigxfsz"`
+	} `json:"signals"`
+}
+
+// metrics flushes metrics of Firecracker and sums up the metrics file.
+func (h *firecrackerHypervisor) metrics(ctx context.Context) (m vmMetrics, err error) {
+	if h.machine == nil {
+		return
+	}
+
+	client := firecracker.NewClient(h.socketFilePath, h.machine.Logger(), false)
+	_, err = client.CreateSyncAction(ctx, &models.InstanceActionInfo{
+		ActionType: firecracker.String(models.InstanceActionInfoActionTypeFlushMetrics),
+	})
+	if err != nil {
+		err = fmt.Errorf("flushing metrics: %w", err)
+		return
+	}
+
+	file, err := os.Open(h.logs.metrics)
+	if err != nil {
+		err = fmt.Errorf("opening metrics: %w", err)
+		return
+	}
+	defer file.Close()
+
+	m.reported = true
+	decoder := json.NewDecoder(file)
+	for {
+		var line firecrackerMetrics
+		err = decoder.Decode(&line)
+		if errors.Is(err, io.EOF) {
+			err = nil
+			break
+		}
+		if err != nil {
+			err = fmt.Errorf("decoding metrics: %w", err)
+			return
+		}
+
+		m.diskErrors += line.Block.ExecuteFails
+		m.fileSizeExceeded += line.Signals.SIGXFSZ
+		m.diskWritten += line.Block.WriteBytes
+		m.networkIn += line.Net.RxBytesCount
+		m.networkOut += line.Net.TxBytesCount
+	}
+
+	return
+}
+
+func (h *firecrackerHypervisor) wait(ctx context.Context) error {
+	return h.machine.Wait(ctx)
+}
+
+func (h *firecrackerHypervisor) stop(ctx context.Context) (err error) {
+	if h.machine != nil {
+		err = h.machine.Shutdown(ctx)
+		if err != nil {
+			err = h.machine.StopVMM()
+		}
+		if err != nil {
+			return
+		}
+	}
+	if h.socketFilePath != "" {
+		_ = os.Remove(h.socketFilePath)
+	}
+
+	return
+}
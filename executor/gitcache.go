@@ -0,0 +1,491 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// GitCacheConfig keeps bare mirrors of repos on the host,
+// so that clones in jobs only fetch objects added since the last job.
+type GitCacheConfig struct {
+	// directory of mirrors, enables the cache if not empty
+	Dir string `comment:"directory of bare mirrors of repos on the host, enables git cache if not empty. Mirrors are updated with git fetch before each job, and are attached to microVMs as read-only drives"`
+}
+
+const (
+	// where mirror drive is mounted in the microVM
+	gitMirrorMountPoint = "/mnt/tart-git-mirror"
+	// room for file system metadata in mirror images
+	gitMirrorImageOverhead = 64 << 20
+)
+
+func (c GitCacheConfig) enabled() bool {
+	return c.Dir != ""
+}
+
+// gitMirror is the bare mirror of a repo.
+type gitMirror struct {
+	// directory of the bare repo
+	dir string
+	// read-only ext4 image of dir
+	image string
+	lock  *os.File
+}
+
+// gitMirrorKey identifies a repo by its URL without credentials.
+func gitMirrorKey(repoURL string) string {
+	if u, err := url.Parse(repoURL); err == nil {
+		u.User = nil
+		repoURL = u.String()
+	}
+
+	sum := sha256.Sum256([]byte(repoURL))
+	return hex.EncodeToString(sum[:])
+}
+
+// openGitMirror locks the mirror of repoURL and fetches into it,
+// the lock is held until release.
+func openGitMirror(ctx context.Context, config GitCacheConfig, repoURL string) (m *gitMirror, err error) {
+	err = os.MkdirAll(config.Dir, 0755)
+	if err != nil {
+		err = fmt.Errorf("creating cache directory: %w", err)
+		return
+	}
+
+	key := gitMirrorKey(repoURL)
+	lock, err := os.OpenFile(filepath.Join(config.Dir, key+".lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		err = fmt.Errorf("opening lock file: %w", err)
+		return
+	}
+	err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		_ = lock.Close()
+		err = fmt.Errorf("locking mirror: %w", err)
+		return
+	}
+
+	m = &gitMirror{
+		dir:   filepath.Join(config.Dir, key+".git"),
+		image: filepath.Join(config.Dir, key+".ext4"),
+		lock:  lock,
+	}
+	defer func() {
+		if err != nil {
+			m.release()
+			m = nil
+			err = maskURLPassword(err, repoURL)
+		}
+	}()
+
+	if _, statErr := os.Stat(m.dir); errors.Is(statErr, fs.ErrNotExist) {
+		err = runGit(ctx, "init", "--bare", "--quiet", m.dir)
+		if err != nil {
+			return
+		}
+	}
+
+	// The URL carries job token, which is not saved in the mirror.
+	// Objects are never collected, in case of jobs referencing them.
+	err = runGit(ctx, "-C", m.dir, "-c", "gc.auto=0", "fetch", "--quiet", "--prune", "--force", repoURL,
+		"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*")
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func (m *gitMirror) release() {
+	_ = syscall.Flock(int(m.lock.Fd()), syscall.LOCK_UN)
+	_ = m.lock.Close()
+}
+
+// buildImage updates the ext4 image of the mirror when refs have changed.
+//
+// Files changed since the last build are written into a copy of the image,
+// which replaces the image while running microVMs keep the old one.
+// The image is built from scratch if there is none, or the update fails.
+func (m *gitMirror) buildImage(ctx context.Context) (err error) {
+	refs, err := outputGit(ctx, "-C", m.dir, "for-each-ref", "--format=%(objectname) %(refname)")
+	if err != nil {
+		return
+	}
+	refsSum := sha256.Sum256(refs)
+	refsDigest := hex.EncodeToString(refsSum[:])
+	refsFile := m.image + ".refs"
+
+	built, _ := os.ReadFile(refsFile)
+	if _, statErr := os.Stat(m.image); statErr == nil && string(built) == refsDigest {
+		return
+	}
+
+	files, err := listMirrorFiles(m.dir)
+	if err != nil {
+		err = fmt.Errorf("listing mirror: %w", err)
+		return
+	}
+	var size int64
+	for _, file := range files {
+		size += file.Size
+	}
+	size = size + size/4 + gitMirrorImageOverhead
+
+	// files in the image, which are unknown once the image is being replaced
+	filesPath := m.image + ".files"
+	previous, readErr := readMirrorFiles(filesPath)
+	err = os.Remove(filesPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		err = fmt.Errorf("removing file list: %w", err)
+		return
+	}
+
+	tempImage := m.image + ".tmp"
+	_ = os.Remove(tempImage)
+	defer os.Remove(tempImage)
+
+	err = readErr
+	if err == nil {
+		err = m.updateImage(ctx, tempImage, size, previous, files)
+	}
+	if err != nil {
+		_ = os.Remove(tempImage)
+		// no journal, the image is always mounted read-only
+		err = mkfsExt4(ctx, tempImage, size, "git-mirror", m.dir, false)
+		if err != nil {
+			err = fmt.Errorf("making mirror image: %w", err)
+			return
+		}
+	}
+
+	// running microVMs keep the old one
+	err = os.Rename(tempImage, m.image)
+	if err != nil {
+		err = fmt.Errorf("renaming mirror image: %w", err)
+		return
+	}
+	err = writeMirrorFiles(filesPath, files)
+	if err != nil {
+		err = fmt.Errorf("writing file list: %w", err)
+		return
+	}
+	err = os.WriteFile(refsFile, []byte(refsDigest), 0644)
+	if err != nil {
+		err = fmt.Errorf("writing refs digest: %w", err)
+		return
+	}
+
+	return
+}
+
+// mirrorFile is a file or directory of the mirror, by its path relative to the mirror.
+type mirrorFile struct {
+	Dir     bool  `json:"dir,omitempty"`
+	Size    int64 `json:"size,omitempty"`
+	ModTime int64 `json:"mtime,omitempty"`
+}
+
+func listMirrorFiles(dir string) (files map[string]mirrorFile, err error) {
+	files = make(map[string]mirrorFile)
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			files[filepath.ToSlash(rel)] = mirrorFile{Dir: true}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = mirrorFile{Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+		return nil
+	})
+
+	return
+}
+
+func readMirrorFiles(path string) (files map[string]mirrorFile, err error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(content, &files)
+	return
+}
+
+func writeMirrorFiles(path string, files map[string]mirrorFile) (err error) {
+	content, err := json.Marshal(files)
+	if err != nil {
+		return
+	}
+
+	err = os.WriteFile(path, content, 0644)
+	return
+}
+
+// updateImage writes into output a copy of the image, updated from previous files to current ones,
+// which is grown to size if it's smaller.
+func (m *gitMirror) updateImage(ctx context.Context, output string, size int64, previous, current map[string]mirrorFile) (err error) {
+	err = cloneFile(m.image, output)
+	if err != nil {
+		err = fmt.Errorf("copying mirror image: %w", err)
+		return
+	}
+
+	info, err := os.Stat(output)
+	if err != nil {
+		return
+	}
+	if info.Size() < size {
+		err = fsckExt4(ctx, output)
+		if err != nil {
+			return
+		}
+		err = resizeExt4(ctx, output, size)
+		if err != nil {
+			return
+		}
+	}
+
+	var (
+		removed []string
+		added   []string
+	)
+	for name, file := range previous {
+		if now, ok := current[name]; !ok || now != file {
+			removed = append(removed, name)
+		}
+	}
+	for name, file := range current {
+		if before, ok := previous[name]; !ok || before != file {
+			added = append(added, name)
+		}
+	}
+	// children go before their parents are removed, and after their parents are created
+	sort.Sort(sort.Reverse(sort.StringSlice(removed)))
+	sort.Strings(added)
+	if len(removed) == 0 && len(added) == 0 {
+		return
+	}
+
+	var script strings.Builder
+	for _, name := range removed {
+		if previous[name].Dir {
+			fmt.Fprintf(&script, "rmdir %q\n", "/"+name)
+			continue
+		}
+		fmt.Fprintf(&script, "rm %q\n", "/"+name)
+	}
+	for _, name := range added {
+		if current[name].Dir {
+			fmt.Fprintf(&script, "mkdir %q\n", "/"+name)
+			continue
+		}
+		// write names the file in the current directory
+		dir, base := path.Split("/" + name)
+		fmt.Fprintf(&script, "cd %q\nwrite %q %q\n", dir, filepath.Join(m.dir, filepath.FromSlash(name)), base)
+	}
+
+	err = runDebugfs(ctx, output, script.String())
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// runDebugfs runs script of debugfs commands on the image in write mode.
+func runDebugfs(ctx context.Context, image string, script string) (err error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "debugfs", "-w", "-f", "-", image)
+	cmd.Stdin = strings.NewReader(script)
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		err = fmt.Errorf("running debugfs: %w, stderr: %s", err, stderr.Bytes())
+		return
+	}
+	// debugfs exits zero on failed commands, which print to stderr after the banner
+	for _, line := range strings.Split(stderr.String(), "\n") {
+		if line != "" && !strings.HasPrefix(line, "debugfs ") {
+			err = fmt.Errorf("running debugfs: %s", line)
+			return
+		}
+	}
+
+	return
+}
+
+// cloneFile copies src to dst, sharing their blocks if the file system supports it.
+func cloneFile(src, dst string) (err error) {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return
+	}
+	defer dstFile.Close()
+
+	if unix.IoctlFileClone(int(dstFile.Fd()), int(srcFile.Fd())) != nil {
+		_, err = io.Copy(dstFile, srcFile)
+		if err != nil {
+			return
+		}
+	}
+
+	err = dstFile.Close()
+	return
+}
+
+// maskURLPassword hides password of rawURL in err, which git may print.
+func maskURLPassword(err error, rawURL string) error {
+	u, parseErr := url.Parse(rawURL)
+	if parseErr != nil {
+		return err
+	}
+	password, ok := u.User.Password()
+	if !ok || password == "" {
+		return err
+	}
+
+	return errors.New(strings.ReplaceAll(err.Error(), password, "[MASKED]"))
+}
+
+func dirSize(dir string) (size int64, err error) {
+	err = filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+
+	return
+}
+
+func runGit(ctx context.Context, args ...string) (err error) {
+	_, err = outputGit(ctx, args...)
+	return
+}
+
+func outputGit(ctx context.Context, args ...string) (output []byte, err error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Stderr = &stderr
+	// never wait for credentials
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+
+	output, err = cmd.Output()
+	if err != nil {
+		err = fmt.Errorf("running git: %w, stderr: %s", err, bytes.TrimSpace(stderr.Bytes()))
+		return
+	}
+
+	return
+}
+
+// gitMirrorDrive updates the mirror of the repo and returns its image for the microVM.
+// The cache is an optimization, an empty path is returned if it's not available.
+func (e *MicroVM) gitMirrorDrive(ctx context.Context) (path string) {
+	err := e.line("Updating git cache...")
+	if err != nil {
+		return
+	}
+
+	m, err := openGitMirror(ctx, e.config.GitCache, e.build.repoURL())
+	if err == nil {
+		defer m.release()
+		err = m.buildImage(ctx)
+	}
+	if err == nil {
+		path = m.image
+		if e.config.Jailer.Enabled {
+			// drives must reside in the chroot under jailer, the image is replaced rather than changed thus linked
+			path = filepath.Join(e.config.Jailer.chrootDir(e.vmID), "git-mirror.ext4")
+			err = os.Link(m.image, path)
+			if err != nil {
+				err = fmt.Errorf("linking mirror image into chroot: %w", err)
+			}
+		}
+	}
+	if err != nil {
+		path = ""
+		e.logger.Warn("git cache is not available", zap.Error(err))
+		_ = e.yellowLine("Git cache is skipped: %s", err)
+		return
+	}
+
+	return
+}
+
+// mountGitMirror mounts the mirror drive in the microVM,
+// and returns the mount point, or empty string on failure.
+func (e *MicroVM) mountGitMirror(ctx context.Context, device string) (mountPoint string) {
+	script := fmt.Sprintf("mkdir -p %[1]s && mount -o ro %[2]s %[1]s", gitMirrorMountPoint, device)
+	err := e.RunStep(ctx, StageGetSources, script)
+	if err != nil {
+		e.logger.Warn("mounting git mirror", zap.Error(err))
+		_ = e.yellowLine("Git cache is skipped: mounting git mirror: %s", err)
+		return
+	}
+
+	mountPoint = gitMirrorMountPoint
+	return
+}
+
+// gitMirrorDir updates the mirror of the repo and returns its directory.
+// The cache is an optimization, an empty path is returned if it's not available.
+func (s *Shell) gitMirrorDir(ctx context.Context) (dir string) {
+	err := s.line("Updating git cache...")
+	if err != nil {
+		return
+	}
+
+	// clones only add objects to their own repo, the mirror needs no lock then
+	m, err := openGitMirror(ctx, s.config.GitCache, s.build.repoURL())
+	if err != nil {
+		s.logger.Warn("git cache is not available", zap.Error(err))
+		_ = s.yellowLine("Git cache is skipped: %s", err)
+		return
+	}
+	m.release()
+
+	dir = m.dir
+	return
+}
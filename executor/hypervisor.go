@@ -0,0 +1,109 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+const (
+	HypervisorFirecracker = "firecracker"
+	HypervisorQEMU        = "qemu"
+)
+
+// hypervisor runs a microVM for MicroVM executor.
+type hypervisor interface {
+	fmt.Stringer
+	// kernelArgs returns the kernel command line without network configuration.
+	kernelArgs() string
+	// start boots the microVM, which keeps running after start returns.
+	start(ctx context.Context, spec vmSpec) error
+	// ip returns IP address of the started microVM.
+	ip() (string, error)
+	// metrics returns counters of the microVM since it started,
+	// which are zero if the hypervisor does not report them.
+	metrics(ctx context.Context) (vmMetrics, error)
+	// wait blocks until the hypervisor exits or ctx is done.
+	wait(ctx context.Context) error
+	// stop shuts down the microVM and releases resources of the hypervisor,
+	// it's a no-op if the microVM is not started.
+	stop(ctx context.Context) error
+}
+
+// vmSpec describes the microVM to start.
+type vmSpec struct {
+	kernelArgs string
+	rootFS     string
+	// read-only tar archive
+	configDrive string
+	// extra drives following config drive
+	drives []vmDrive
+	// extra network interfaces following eth0
+	nics []vmNIC
+	// receives serial console and output of hypervisor
+	console io.Writer
+	// host side Unix socket of vsock device, empty for none
+	vsockPath string
+	// published to the guest, nil for none
+	metadata *Metadata
+}
+
+// vmDrive is an extra drive of the microVM.
+type vmDrive struct {
+	path     string
+	readOnly bool
+}
+
+// vmMetrics are counters the hypervisor keeps of the microVM.
+type vmMetrics struct {
+	// whether the hypervisor reports metrics at all
+	reported bool
+	// failed I/O of drives on the host
+	diskErrors uint64
+	// times the hypervisor hit the file size limit
+	fileSizeExceeded uint64
+	// bytes written to drives
+	diskWritten uint64
+	// bytes the microVM received and transmitted over network
+	networkIn  uint64
+	networkOut uint64
+}
+
+// vmNIC is an extra network interface of the microVM, attached to a tap device.
+type vmNIC struct {
+	tap string
+	mac string
+}
+
+// guestDrive returns the device name of the extra drive at index in the guest,
+// which follows rootFS(vda) and config drive(vdb).
+func guestDrive(index int) string {
+	return fmt.Sprintf("/dev/vd%c", 'c'+index)
+}
+
+func (c Config) hypervisor() string {
+	if c.Hypervisor == "" {
+		return HypervisorFirecracker
+	}
+
+	return c.Hypervisor
+}
+
+// newHypervisor returns the configured hypervisor,
+// ctx must not be cancelled while the microVM is running.
+func newHypervisor(ctx context.Context, config Config, vmID string, logs jobLogs) hypervisor {
+	switch config.hypervisor() {
+	case HypervisorQEMU:
+		return &qemuHypervisor{
+			config: config,
+			accel:  config.QEMU.accel(),
+		}
+	default:
+		return &firecrackerHypervisor{
+			ctx:    ctx,
+			config: config,
+			vmID:   vmID,
+			logs:   logs,
+		}
+	}
+}
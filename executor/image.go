@@ -0,0 +1,218 @@
+package executor
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/nanmu42/tart/imagestore"
+)
+
+// ImageConfig is an image in the catalog, which jobs pick by name
+// with image keyword in .gitlab-ci.yml.
+type ImageConfig struct {
+	// name in .gitlab-ci.yml
+	Name string `comment:"name of the image in .gitlab-ci.yml, e.g. jammy-go"`
+	// tag in the image store
+	Tag string `comment:"tag of the image in the image store, managed by tart images, instead of KernelPath and RootFSPath"`
+	// path to linux kernel file
+	KernelPath string `comment:"path to linux kernel file, defaults to KernelPath of the executor"`
+	// path to RootFS file
+	RootFSPath string `comment:"path to RootFS file"`
+}
+
+// UnsupportedError is a job asking for what the runner does not offer,
+// which fails the job as runner_unsupported.
+type UnsupportedError struct {
+	Reason string
+}
+
+func (e *UnsupportedError) Error() string {
+	return e.Reason
+}
+
+func (c Config) validateImages() (err error) {
+	names := make(map[string]bool, len(c.Images))
+	for i, image := range c.Images {
+		if image.Name == "" {
+			err = fmt.Errorf("name of image #%d is required", i)
+			return
+		}
+		if names[image.Name] {
+			err = fmt.Errorf("duplicated image %s", image.Name)
+			return
+		}
+		names[image.Name] = true
+
+		err = c.validateImage(image)
+		if err != nil {
+			return
+		}
+	}
+
+	for _, pattern := range c.AllowedImages {
+		_, err = path.Match(pattern, "")
+		if err != nil {
+			err = fmt.Errorf("allowed image pattern %q: %w", pattern, err)
+			return
+		}
+	}
+
+	if c.DefaultImage == "" {
+		if c.KernelPath == "" {
+			err = errors.New("kernel path is required")
+			return
+		}
+		if c.RootFSPath == "" {
+			err = errors.New("rootFS path is required")
+			return
+		}
+		return
+	}
+	if !names[c.DefaultImage] {
+		err = fmt.Errorf("default image %s is not in images", c.DefaultImage)
+		return
+	}
+
+	return
+}
+
+// validateImage checks image has either a tag, or a RootFS with a kernel.
+func (c Config) validateImage(image ImageConfig) (err error) {
+	if image.Tag != "" {
+		if image.KernelPath != "" || image.RootFSPath != "" {
+			err = fmt.Errorf("image %s has both tag and paths", image.Name)
+			return
+		}
+		return
+	}
+	if image.RootFSPath == "" {
+		err = fmt.Errorf("rootFS path or tag of image %s is required", image.Name)
+		return
+	}
+	if image.KernelPath == "" && c.KernelPath == "" {
+		err = fmt.Errorf("kernel path of image %s is required", image.Name)
+		return
+	}
+
+	return
+}
+
+// imagesEnabled tells whether jobs pick images from the catalog.
+func (c Config) imagesEnabled() bool {
+	return len(c.Images) > 0
+}
+
+// imageAllowed tells whether jobs may pick the image.
+func (c Config) imageAllowed(name string) bool {
+	if len(c.AllowedImages) == 0 {
+		return true
+	}
+
+	for _, pattern := range c.AllowedImages {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withImage returns config booting the image of name,
+// the default image is used if name is empty.
+//
+// Without a catalog, name is ignored and KernelPath and RootFSPath are booted,
+// since pipelines may carry image keyword meant for other runners, e.g. docker ones.
+func (c Config) withImage(name string) (config Config, err error) {
+	config = c
+	if !c.imagesEnabled() {
+		return
+	}
+	if name == "" {
+		name = c.DefaultImage
+	} else if !c.imageAllowed(name) {
+		err = &UnsupportedError{Reason: fmt.Sprintf("image %s is not allowed on this runner, available images: %s", name, c.availableImages())}
+		return
+	}
+	if name == "" {
+		// KernelPath and RootFSPath
+		return
+	}
+
+	for _, image := range c.Images {
+		if image.Name != name {
+			continue
+		}
+
+		config, err = config.withImageConfig(image)
+		return
+	}
+
+	err = &UnsupportedError{Reason: fmt.Sprintf("image %s is not supported by this runner, available images: %s", name, c.availableImages())}
+	return
+}
+
+// withImageConfig returns config booting the kernel and RootFS of image.
+func (c Config) withImageConfig(image ImageConfig) (config Config, err error) {
+	if image.Tag != "" {
+		config, err = c.withStoreImage(image.Tag)
+		return
+	}
+
+	config = c
+	config.RootFSPath = image.RootFSPath
+	if image.KernelPath != "" {
+		config.KernelPath = image.KernelPath
+	}
+	// digests are for images in the image store
+	config.kernelDigest = ""
+	config.rootFSDigest = ""
+	return
+}
+
+// availableImages lists images jobs may pick.
+func (c Config) availableImages() string {
+	var names []string
+	for _, image := range c.Images {
+		if c.imageAllowed(image.Name) {
+			names = append(names, image.Name)
+		}
+	}
+	if len(names) == 0 {
+		return "none, please remove image keyword from .gitlab-ci.yml"
+	}
+
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// withStoreImage returns config booting the image of tag in the image store,
+// whose digests are verified before boot.
+func (c Config) withStoreImage(tag string) (config Config, err error) {
+	config = c
+
+	store, err := imagestore.Open(c.ImageStoreDir)
+	if err != nil {
+		return
+	}
+	image, err := store.Get(tag)
+	if err != nil {
+		err = fmt.Errorf("looking up image store: %w", err)
+		return
+	}
+
+	config.KernelPath, err = store.BlobPath(image.Kernel.Digest)
+	if err != nil {
+		return
+	}
+	config.RootFSPath, err = store.BlobPath(image.RootFS.Digest)
+	if err != nil {
+		return
+	}
+	config.kernelDigest = image.Kernel.Digest
+	config.rootFSDigest = image.RootFS.Digest
+
+	return
+}
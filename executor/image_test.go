@@ -0,0 +1,102 @@
+package executor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nanmu42/tart/imagestore"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_WithImage(t *testing.T) {
+	config := Config{
+		KernelPath: "vmlinux",
+		RootFSPath: "jammy.ext4",
+		Images: []ImageConfig{
+			{Name: "jammy-go", RootFSPath: "jammy-go.ext4"},
+			{Name: "jammy-node", RootFSPath: "jammy-node.ext4"},
+			{Name: "alpine-minimal", KernelPath: "vmlinux-alpine", RootFSPath: "alpine.ext4"},
+		},
+		AllowedImages: []string{"jammy-*", "alpine-minimal"},
+	}
+	require.NoError(t, config.validateImages())
+
+	got, err := config.withImage("")
+	require.NoError(t, err)
+	assert.Equal(t, "vmlinux", got.KernelPath)
+	assert.Equal(t, "jammy.ext4", got.RootFSPath)
+
+	got, err = config.withImage("alpine-minimal")
+	require.NoError(t, err)
+	assert.Equal(t, "vmlinux-alpine", got.KernelPath)
+	assert.Equal(t, "alpine.ext4", got.RootFSPath)
+
+	config.DefaultImage = "jammy-go"
+	require.NoError(t, config.validateImages())
+	got, err = config.withImage("")
+	require.NoError(t, err)
+	assert.Equal(t, "vmlinux", got.KernelPath)
+	assert.Equal(t, "jammy-go.ext4", got.RootFSPath)
+
+	var unsupportedErr *UnsupportedError
+	_, err = config.withImage("ubuntu:22.04")
+	require.ErrorAs(t, err, &unsupportedErr)
+	assert.EqualError(t, err, "image ubuntu:22.04 is not allowed on this runner, available images: alpine-minimal, jammy-go, jammy-node")
+
+	config.AllowedImages = []string{"*"}
+	_, err = config.withImage("ubuntu:22.04")
+	require.ErrorAs(t, err, &unsupportedErr)
+	assert.EqualError(t, err, "image ubuntu:22.04 is not supported by this runner, available images: alpine-minimal, jammy-go, jammy-node")
+
+	config.DefaultImage = "ubuntu"
+	assert.Error(t, config.validateImages())
+}
+
+func TestConfig_WithImage_NoCatalog(t *testing.T) {
+	config := Config{KernelPath: "vmlinux", RootFSPath: "jammy.ext4"}
+	require.NoError(t, config.validateImages())
+
+	// image keyword meant for docker runners
+	got, err := config.withImage("golang:1.19")
+	require.NoError(t, err)
+	assert.Equal(t, "vmlinux", got.KernelPath)
+	assert.Equal(t, "jammy.ext4", got.RootFSPath)
+
+	config.AllowedImages = []string{"jammy-*"}
+	got, err = config.withImage("golang:1.19")
+	require.NoError(t, err)
+	assert.Equal(t, "jammy.ext4", got.RootFSPath)
+}
+
+func TestConfig_WithStoreImage(t *testing.T) {
+	dir := t.TempDir()
+	kernel := filepath.Join(dir, "vmlinux")
+	require.NoError(t, os.WriteFile(kernel, []byte("\x7fELF fake kernel"), 0644))
+	rootFS := filepath.Join(dir, "rootfs.ext4")
+	require.NoError(t, mkfsExt4(context.Background(), rootFS, 4<<20, "rootfs", "", false))
+
+	store, err := imagestore.Open(filepath.Join(dir, "store"))
+	require.NoError(t, err)
+	img, err := store.Import(context.Background(), "jammy-go-1.19", kernel, rootFS)
+	require.NoError(t, err)
+
+	config := Config{
+		ImageStoreDir: store.Dir(),
+		Images:        []ImageConfig{{Name: "jammy-go", Tag: "jammy-go-1.19"}, {Name: "gone", Tag: "gone"}},
+		DefaultImage:  "jammy-go",
+	}
+	require.NoError(t, config.validateImages())
+
+	got, err := config.withImage("")
+	require.NoError(t, err)
+	assert.Equal(t, img.RootFS.Digest, got.rootFSDigest)
+	assert.NoError(t, imagestore.Verify(got.RootFSPath, got.rootFSDigest))
+	assert.NoError(t, imagestore.Verify(got.KernelPath, got.kernelDigest))
+
+	_, err = config.withImage("gone")
+	assert.ErrorIs(t, err, imagestore.ErrNotFound)
+}
@@ -0,0 +1,349 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+// JailerConfig runs Firecracker under the jailer,
+// which confines it in a chroot, cgroups and seccomp filters.
+type JailerConfig struct {
+	// run Firecracker under the jailer
+	Enabled bool `comment:"run Firecracker under the jailer"`
+	// path to jailer binary
+	JailerBinary string `comment:"path to jailer binary, defaults to jailer in $PATH"`
+	// absolute path to Firecracker binary
+	FirecrackerBinary string `comment:"absolute path to Firecracker binary, defaults to firecracker in $PATH"`
+	// uid Firecracker runs as
+	UID int `comment:"uid Firecracker runs as, which should own the tap device"`
+	// gid Firecracker runs as
+	GID int `comment:"gid Firecracker runs as"`
+	// base directory of chroot jails
+	ChrootBaseDir string `comment:"base directory of chroot jails, defaults to /srv/jailer"`
+	// cgroup version, 1 or 2
+	CgroupVersion string `comment:"cgroup version, 1 or 2, defaults to 1"`
+	// CPUs Firecracker can run on
+	CPUs string `comment:"CPUs Firecracker can run on, e.g. 0-3, empty means no limit"`
+	// memory limit of Firecracker process in MiB
+	MemoryLimitMiB int `comment:"memory limit of Firecracker process in MiB, including guest memory, 0 means no limit"`
+	// CPU quota in percent of one CPU
+	CPUQuotaPercent int `comment:"CPU quota in percent of one CPU, e.g. 150 for one and a half CPUs, 0 means no limit"`
+	// extra cgroup settings passed to jailer
+	Cgroups []string `comment:"extra cgroup settings passed to jailer as --cgroup, e.g. [\"cpu.weight=50\"]"`
+}
+
+const (
+	defaultChrootBaseDir = "/srv/jailer"
+	// relative to the chroot
+	jailerSocketName = "api.socket"
+	jailerKernelName = "vmlinux"
+	// CFS period of CPU quota, in microseconds
+	cpuPeriod = 100000
+)
+
+func (c JailerConfig) Validate() (err error) {
+	if !c.Enabled {
+		return
+	}
+
+	switch c.CgroupVersion {
+	case "", "1", "2":
+	default:
+		err = fmt.Errorf("unknown cgroup version %q", c.CgroupVersion)
+		return
+	}
+	if c.MemoryLimitMiB < 0 {
+		err = fmt.Errorf("memory limit must not be negative, got %d", c.MemoryLimitMiB)
+		return
+	}
+	if c.CPUQuotaPercent < 0 {
+		err = fmt.Errorf("CPU quota must not be negative, got %d", c.CPUQuotaPercent)
+		return
+	}
+
+	_, err = c.firecrackerBinary()
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func (c JailerConfig) jailerBinary() string {
+	if c.JailerBinary == "" {
+		return "jailer"
+	}
+
+	return c.JailerBinary
+}
+
+// firecrackerBinary returns absolute path to Firecracker, which jailer requires.
+func (c JailerConfig) firecrackerBinary() (path string, err error) {
+	path = c.FirecrackerBinary
+	if path == "" {
+		path, err = exec.LookPath("firecracker")
+		if err != nil {
+			err = fmt.Errorf("looking up firecracker binary: %w", err)
+			return
+		}
+	}
+
+	path, err = filepath.Abs(path)
+	if err != nil {
+		err = fmt.Errorf("resolving absolute path of firecracker binary: %w", err)
+		return
+	}
+
+	return
+}
+
+func (c JailerConfig) chrootBaseDir() string {
+	if c.ChrootBaseDir == "" {
+		return defaultChrootBaseDir
+	}
+
+	return c.ChrootBaseDir
+}
+
+func (c JailerConfig) cgroupVersion() string {
+	if c.CgroupVersion == "" {
+		return "1"
+	}
+
+	return c.CgroupVersion
+}
+
+// jailDir is the directory jailer creates for the VM,
+// whose sub directory "root" is the chroot.
+func (c JailerConfig) jailDir(vmID string) string {
+	binary, _ := c.firecrackerBinary()
+	return filepath.Join(c.chrootBaseDir(), filepath.Base(binary), vmID)
+}
+
+func (c JailerConfig) chrootDir(vmID string) string {
+	return filepath.Join(c.jailDir(vmID), "root")
+}
+
+// cgroupArgs translates resource limits into jailer --cgroup arguments.
+func (c JailerConfig) cgroupArgs() (args []string) {
+	v2 := c.cgroupVersion() == "2"
+
+	if c.CPUs != "" {
+		args = append(args, "--cgroup", "cpuset.cpus="+c.CPUs)
+	}
+	if c.MemoryLimitMiB > 0 {
+		limit := strconv.Itoa(c.MemoryLimitMiB * 1024 * 1024)
+		if v2 {
+			args = append(args, "--cgroup", "memory.max="+limit)
+		} else {
+			args = append(args, "--cgroup", "memory.limit_in_bytes="+limit)
+		}
+	}
+	if c.CPUQuotaPercent > 0 {
+		quota := cpuPeriod * c.CPUQuotaPercent / 100
+		if v2 {
+			args = append(args, "--cgroup", fmt.Sprintf("cpu.max=%d %d", quota, cpuPeriod))
+		} else {
+			args = append(args,
+				"--cgroup", fmt.Sprintf("cpu.cfs_period_us=%d", cpuPeriod),
+				"--cgroup", fmt.Sprintf("cpu.cfs_quota_us=%d", quota),
+			)
+		}
+	}
+	for _, cgroup := range c.Cgroups {
+		args = append(args, "--cgroup", cgroup)
+	}
+
+	return
+}
+
+// sdkConfig is the jailer config firecracker-go-sdk needs to locate the chroot.
+func (c JailerConfig) sdkConfig(vmID string) (cfg *firecracker.JailerConfig, err error) {
+	binary, err := c.firecrackerBinary()
+	if err != nil {
+		return
+	}
+
+	cfg = &firecracker.JailerConfig{
+		GID:            firecracker.Int(c.GID),
+		UID:            firecracker.Int(c.UID),
+		ID:             vmID,
+		NumaNode:       firecracker.Int(0),
+		ExecFile:       binary,
+		JailerBinary:   c.jailerBinary(),
+		ChrootBaseDir:  c.chrootBaseDir(),
+		ChrootStrategy: jailerStaging{uid: c.UID, gid: c.GID},
+		CgroupVersion:  c.cgroupVersion(),
+	}
+	return
+}
+
+// command forges the jailer command line.
+//
+// firecracker-go-sdk can build one as well, but it provides no way to pass cgroup limits.
+func (c JailerConfig) command(ctx context.Context, vmID string, netNS string, stdin io.Reader, stdout, stderr io.Writer) (cmd *exec.Cmd, err error) {
+	binary, err := c.firecrackerBinary()
+	if err != nil {
+		return
+	}
+
+	args := []string{
+		"--id", vmID,
+		"--uid", strconv.Itoa(c.UID),
+		"--gid", strconv.Itoa(c.GID),
+		"--exec-file", binary,
+		"--chroot-base-dir", c.chrootBaseDir(),
+		"--cgroup-version", c.cgroupVersion(),
+	}
+	if netNS != "" {
+		args = append(args, "--netns", netNS)
+	}
+	args = append(args, c.cgroupArgs()...)
+	// Firecracker installs its default seccomp filters when no seccomp argument is given.
+	args = append(args, "--", "--api-sock", jailerSocketName)
+
+	cmd = exec.CommandContext(ctx, c.jailerBinary(), args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	return
+}
+
+// cleanup removes the jail and cgroups left by jailer.
+func (c JailerConfig) cleanup(vmID string) (err error) {
+	err = os.RemoveAll(c.jailDir(vmID))
+	if err != nil {
+		err = fmt.Errorf("removing jail: %w", err)
+		return
+	}
+
+	binary, _ := c.firecrackerBinary()
+	name := filepath.Base(binary)
+	cgroups, _ := filepath.Glob(filepath.Join("/sys/fs/cgroup", "*", name, vmID))
+	cgroups = append(cgroups, filepath.Join("/sys/fs/cgroup", name, vmID))
+	for _, dir := range cgroups {
+		// cgroup directories can only be removed by rmdir
+		rmErr := os.Remove(dir)
+		if rmErr != nil && !errors.Is(rmErr, os.ErrNotExist) {
+			err = fmt.Errorf("removing cgroup %s: %w", dir, rmErr)
+		}
+	}
+
+	return
+}
+
+// jailerStaging places the kernel into the chroot and hands over
+// files in the chroot to the jailed user.
+//
+// Drives and logs are expected to be created inside the chroot already,
+// since hard linking, which firecracker-go-sdk's NaiveChrootStrategy uses,
+// does not work across file systems.
+type jailerStaging struct {
+	uid int
+	gid int
+}
+
+func (s jailerStaging) AdaptHandlers(handlers *firecracker.Handlers) (err error) {
+	if !handlers.FcInit.Has(firecracker.CreateLogFilesHandlerName) {
+		err = firecracker.ErrRequiredHandlerMissing
+		return
+	}
+
+	handlers.FcInit = handlers.FcInit.AppendAfter(firecracker.CreateLogFilesHandlerName, firecracker.Handler{
+		Name: firecracker.LinkFilesToRootFSHandlerName,
+		Fn:   s.stage,
+	})
+	return
+}
+
+func (s jailerStaging) stage(_ context.Context, m *firecracker.Machine) (err error) {
+	chroot := filepath.Dir(m.Cfg.SocketPath)
+
+	// the kernel is copied rather than hard linked to keep the original's owner intact
+	kernel := filepath.Join(chroot, jailerKernelName)
+	err = copyFile(m.Cfg.KernelImagePath, kernel)
+	if err != nil {
+		err = fmt.Errorf("staging kernel: %w", err)
+		return
+	}
+	err = os.Chown(kernel, s.uid, s.gid)
+	if err != nil {
+		err = fmt.Errorf("chown kernel: %w", err)
+		return
+	}
+	m.Cfg.KernelImagePath = jailerKernelName
+
+	for i, drive := range m.Cfg.Drives {
+		var rel string
+		rel, err = s.handOver(chroot, firecracker.StringValue(drive.PathOnHost))
+		if err != nil {
+			err = fmt.Errorf("staging drive: %w", err)
+			return
+		}
+		m.Cfg.Drives[i].PathOnHost = firecracker.String(rel)
+	}
+
+	// log files are created by CreateLogFilesHandler
+	for _, path := range []*string{&m.Cfg.LogPath, &m.Cfg.MetricsPath} {
+		if *path == "" {
+			continue
+		}
+		*path, err = s.handOver(chroot, *path)
+		if err != nil {
+			err = fmt.Errorf("staging log: %w", err)
+			return
+		}
+	}
+
+	return
+}
+
+// handOver chowns the file in chroot to the jailed user,
+// and returns its path relative to chroot.
+func (s jailerStaging) handOver(chroot, hostPath string) (rel string, err error) {
+	rel, err = filepath.Rel(chroot, hostPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		err = fmt.Errorf("%s is not in chroot %s", hostPath, chroot)
+		return
+	}
+
+	err = os.Chown(hostPath, s.uid, s.gid)
+	if err != nil {
+		err = fmt.Errorf("chown %s: %w", hostPath, err)
+		return
+	}
+
+	return
+}
+
+func copyFile(src, dst string) (err error) {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return
+	}
+	defer dstFile.Close()
+
+	_, err = io.Copy(dstFile, srcFile)
+	if err != nil {
+		return
+	}
+
+	err = dstFile.Close()
+	return
+}
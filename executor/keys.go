@@ -0,0 +1,133 @@
+package executor
+
+import (
+	"archive/tar"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// vmKeys is the SSH key pairs generated for every microVM,
+// so that no private key is shared among VMs or shipped with Tart.
+type vmKeys struct {
+	// Tart logs in with it
+	client ssh.Signer
+	// PEM encoded private key of client, for debugging
+	clientPEM []byte
+	// sshd in the VM serves with it
+	host ssh.Signer
+	// PEM encoded private key of host
+	hostPEM []byte
+}
+
+func generateVMKeys() (keys vmKeys, err error) {
+	_, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		err = fmt.Errorf("generating client key: %w", err)
+		return
+	}
+	keys.client, err = ssh.NewSignerFromKey(clientKey)
+	if err != nil {
+		err = fmt.Errorf("client signer: %w", err)
+		return
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(clientKey)
+	if err != nil {
+		err = fmt.Errorf("marshaling client key: %w", err)
+		return
+	}
+	keys.clientPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	// sshd reads ECDSA keys in PEM, while ed25519 ones must be in OpenSSH format,
+	// which x/crypto/ssh can not marshal.
+	hostKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		err = fmt.Errorf("generating host key: %w", err)
+		return
+	}
+	keys.host, err = ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		err = fmt.Errorf("host signer: %w", err)
+		return
+	}
+	der, err = x509.MarshalECPrivateKey(hostKey)
+	if err != nil {
+		err = fmt.Errorf("marshaling host key: %w", err)
+		return
+	}
+	keys.hostPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+
+	return
+}
+
+// configDriveFile is a file placed on the config drive.
+type configDriveFile struct {
+	// absolute path in the VM
+	path    string
+	mode    int64
+	content []byte
+}
+
+func (k vmKeys) configDriveFiles() []configDriveFile {
+	return []configDriveFile{
+		{
+			path:    "/root/.ssh/authorized_keys",
+			mode:    0600,
+			content: ssh.MarshalAuthorizedKey(k.client.PublicKey()),
+		},
+		{
+			path:    "/etc/ssh/ssh_host_ecdsa_key",
+			mode:    0600,
+			content: k.hostPEM,
+		},
+		{
+			path:    "/etc/ssh/ssh_host_ecdsa_key.pub",
+			mode:    0644,
+			content: ssh.MarshalAuthorizedKey(k.host.PublicKey()),
+		},
+	}
+}
+
+// writeConfigDrive writes a tar archive whose content is extracted to / by
+// the guest at boot, before sshd starts. See rootfs/in-container-setup.sh.
+//
+// A tar archive is always a multiple of 512 bytes, so it can be attached as
+// a block device as is, without the need of any file system.
+func writeConfigDrive(w io.Writer, files []configDriveFile) (err error) {
+	now := time.Now()
+	archive := tar.NewWriter(w)
+	for _, file := range files {
+		err = archive.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     "." + file.path,
+			Mode:     file.mode,
+			Size:     int64(len(file.content)),
+			ModTime:  now,
+		})
+		if err != nil {
+			err = fmt.Errorf("writing header of %s: %w", file.path, err)
+			return
+		}
+		_, err = archive.Write(file.content)
+		if err != nil {
+			err = fmt.Errorf("writing %s: %w", file.path, err)
+			return
+		}
+	}
+
+	err = archive.Close()
+	if err != nil {
+		err = fmt.Errorf("closing tar: %w", err)
+		return
+	}
+
+	return
+}
@@ -0,0 +1,61 @@
+package executor
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestWriteConfigDrive(t *testing.T) {
+	keys, err := generateVMKeys()
+	require.NoError(t, err)
+
+	var drive bytes.Buffer
+	require.NoError(t, writeConfigDrive(&drive, keys.configDriveFiles()))
+	// attached as a block device as is
+	assert.Zero(t, drive.Len()%512)
+
+	type file struct {
+		mode    int64
+		content []byte
+	}
+	files := make(map[string]file)
+	archive := tar.NewReader(&drive)
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		assert.Equal(t, byte(tar.TypeReg), header.Typeflag, header.Name)
+		content, err := io.ReadAll(archive)
+		require.NoError(t, err)
+		files[header.Name] = file{mode: header.Mode, content: content}
+	}
+	require.Len(t, files, 3)
+
+	// extracted to / by the guest
+	authorizedKeys := files["./root/.ssh/authorized_keys"]
+	assert.Equal(t, int64(0600), authorizedKeys.mode)
+	authorized, _, _, _, err := ssh.ParseAuthorizedKey(authorizedKeys.content)
+	require.NoError(t, err)
+	assert.Equal(t, keys.client.PublicKey().Marshal(), authorized.Marshal())
+
+	hostKey := files["./etc/ssh/ssh_host_ecdsa_key"]
+	assert.Equal(t, int64(0600), hostKey.mode)
+	host, err := ssh.ParsePrivateKey(hostKey.content)
+	require.NoError(t, err)
+	assert.Equal(t, keys.host.PublicKey().Marshal(), host.PublicKey().Marshal())
+
+	hostPublicKey := files["./etc/ssh/ssh_host_ecdsa_key.pub"]
+	assert.Equal(t, int64(0644), hostPublicKey.mode)
+	hostPublic, _, _, _, err := ssh.ParseAuthorizedKey(hostPublicKey.content)
+	require.NoError(t, err)
+	assert.Equal(t, keys.host.PublicKey().Marshal(), hostPublic.Marshal())
+}
@@ -0,0 +1,147 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// MMDS is reachable at this address in the microVM
+	mmdsAddress = "169.254.169.254"
+
+	MMDSv1  = "V1"
+	MMDSv2  = "V2"
+	MMDSOff = "off"
+
+	setMetadataHandlerName = "tart.SetMetadata"
+)
+
+// Metadata is published to the microVM through Firecracker MMDS,
+// with which the guest configures itself at boot.
+//
+// The guest reads it from http://169.254.169.254/tart
+type Metadata struct {
+	Hostname string          `json:"hostname"`
+	Job      JobMetadata     `json:"job"`
+	Project  ProjectMetadata `json:"project"`
+	Runner   RunnerMetadata  `json:"runner"`
+	Network  NetworkMetadata `json:"network"`
+	// public keys in authorized_keys format
+	SSHAuthorizedKeys []string `json:"ssh_authorized_keys"`
+	// public and unmasked job variables
+	Variables map[string]string `json:"variables"`
+}
+
+type JobMetadata struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Stage string `json:"stage"`
+}
+
+type ProjectMetadata struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type RunnerMetadata struct {
+	ID          string `json:"id"`
+	Description string `json:"description"`
+}
+
+type NetworkMetadata struct {
+	IP          string   `json:"ip"`
+	Gateway     string   `json:"gateway"`
+	Netmask     string   `json:"netmask"`
+	Nameservers []string `json:"nameservers"`
+}
+
+func (c Config) mmdsVersion() string {
+	if c.MMDSVersion == "" {
+		return MMDSv1
+	}
+
+	return c.MMDSVersion
+}
+
+// mmdsEnabled reports whether metadata is published,
+// which requires network and Firecracker.
+func (c Config) mmdsEnabled() bool {
+	return !c.Offline && c.hypervisor() == HypervisorFirecracker && c.mmdsVersion() != MMDSOff
+}
+
+// metadata forges the document for MMDS.
+// In CNI mode, network is filled in by the hypervisor once it's known.
+func (e *MicroVM) metadata() (metadata Metadata) {
+	job := e.build.job
+	metadata = Metadata{
+		Hostname: e.vmID,
+		Job: JobMetadata{
+			ID:    job.ID,
+			Name:  job.JobInfo.Name,
+			Stage: job.JobInfo.Stage,
+		},
+		Project: ProjectMetadata{
+			ID:   job.JobInfo.ProjectID,
+			Name: job.JobInfo.ProjectName,
+		},
+		Runner: RunnerMetadata{
+			ID:          e.build.variable("CI_RUNNER_ID"),
+			Description: e.build.variable("CI_RUNNER_DESCRIPTION"),
+		},
+		Network: NetworkMetadata{
+			IP:          e.config.IP,
+			Gateway:     e.config.GatewayIP,
+			Netmask:     e.config.Netmask,
+			Nameservers: e.config.Nameservers,
+		},
+		SSHAuthorizedKeys: []string{
+			strings.TrimSpace(string(ssh.MarshalAuthorizedKey(e.keys.client.PublicKey()))),
+		},
+		Variables: make(map[string]string),
+	}
+
+	for _, v := range job.Variables {
+		if !v.Public || v.Masked {
+			continue
+		}
+		metadata.Variables[v.Key] = v.Value
+	}
+
+	return
+}
+
+// setMetadataHandler publishes metadata right after MMDS is configured,
+// so that it's available as soon as the guest boots.
+// In CNI mode, network is read from the CNI result in the machine.
+func (h *firecrackerHypervisor) setMetadataHandler(metadata Metadata) firecracker.Handler {
+	return firecracker.Handler{
+		Name: setMetadataHandlerName,
+		Fn: func(ctx context.Context, m *firecracker.Machine) (err error) {
+			if h.config.cniEnabled() {
+				iface := m.Cfg.NetworkInterfaces[0]
+				if iface.StaticConfiguration != nil && iface.StaticConfiguration.IPConfiguration != nil {
+					ipConfig := iface.StaticConfiguration.IPConfiguration
+					metadata.Network = NetworkMetadata{
+						IP:          ipConfig.IPAddr.IP.String(),
+						Gateway:     ipConfig.Gateway.String(),
+						Netmask:     net.IP(ipConfig.IPAddr.Mask).String(),
+						Nameservers: ipConfig.Nameservers,
+					}
+				}
+			}
+
+			err = m.SetMetadata(ctx, map[string]Metadata{"tart": metadata})
+			if err != nil {
+				err = fmt.Errorf("setting MMDS metadata: %w", err)
+				return
+			}
+
+			return
+		},
+	}
+}
@@ -0,0 +1,19 @@
+package executor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_MMDSEnabled(t *testing.T) {
+	assert.True(t, Config{}.mmdsEnabled())
+	assert.True(t, Config{MMDSVersion: MMDSv2}.mmdsEnabled())
+	assert.False(t, Config{MMDSVersion: MMDSOff}.mmdsEnabled())
+	assert.False(t, Config{Offline: true}.mmdsEnabled())
+	// QEMU has no MMDS
+	assert.False(t, Config{Hypervisor: HypervisorQEMU}.mmdsEnabled())
+
+	err := Config{KernelPath: "vmlinux", RootFSPath: "rootfs.ext4", Hypervisor: HypervisorQEMU, MMDSVersion: MMDSv1}.Validate()
+	assert.ErrorContains(t, err, "qemu does not support MMDS")
+}
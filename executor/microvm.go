@@ -0,0 +1,681 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nanmu42/tart/imagestore"
+	"github.com/nanmu42/tart/version"
+	"github.com/nanmu42/tart/vmnet"
+
+	"go.uber.org/zap"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	vmMemSizeMiB = 1024
+	vmVcpuCount  = 2
+)
+
+// MicroVM runs the job in a microVM, which is run by a hypervisor.
+type MicroVM struct {
+	logger *zap.Logger
+	// The context must not be cancelled while the microVM is running.
+	ctx    context.Context
+	build  *Build
+	config Config
+
+	tracer
+	// unique ID of the microVM
+	vmID       string
+	hypervisor hypervisor
+	tempRootFS *os.File
+	// serial console and hypervisor logs
+	logs jobLogs
+	// follows the microVM during boot
+	boot *bootWatcher
+	// looks for OOM and disk full on serial console
+	exhaustion exhaustionWatcher
+	// wall time of phases so far
+	phases []PhaseTime
+	// baselines of the exhaustion check
+	oomKills    int64
+	lastMetrics vmMetrics
+	// SSH keys of this microVM
+	keys vmKeys
+	// tar archive carrying keys into the microVM
+	configDrive *os.File
+	// IP address of the microVM, known after the VM starts in CNI mode.
+	vmIP string
+	// drive carrying the repo, in offline mode
+	sourcesImage string
+	// archives in the sources drive to extract, of caches and artifacts of dependencies
+	transferInFiles []string
+	// moves artifacts of offline jobs, optional
+	artifacts ArtifactClient
+	// persistent cache volume, locked until the microVM is closed
+	cacheVolume *cacheVolume
+	// host side Unix socket of vsock device, when transport is agent
+	vsockPath string
+	transport transport
+	// whether network policy rules are installed on the tap device
+	networkPolicyApplied bool
+	// private network shared with services
+	jobNetwork *jobNetwork
+	services   []*serviceVM
+}
+
+func NewMicroVM(opt Option) (e *MicroVM, err error) {
+	err = opt.validate()
+	if err != nil {
+		return
+	}
+
+	logger := opt.Logger.With(zap.Int("jobId", opt.Build.job.ID))
+
+	e = &MicroVM{
+		logger:     logger,
+		ctx:        opt.Ctx,
+		build:      opt.Build,
+		config:     opt.Config,
+		tracer:     tracer{logSink: opt.JobTrace},
+		artifacts:  opt.Artifacts,
+		vmID:       fmt.Sprintf("tart-%d-%d", opt.Build.job.ID, time.Now().UnixNano()),
+		tempRootFS: nil,
+		transport:  nil,
+	}
+	defer func() {
+		if err != nil {
+			// the caller closes the microVM only if it's created,
+			// the RootFS clone alone takes as much disk as the image
+			closeErr := e.Close(context.Background())
+			if closeErr != nil {
+				logger.Warn("cleaning up microVM failed to create", zap.Error(closeErr))
+			}
+		}
+	}()
+
+	// drives must reside in the chroot under jailer
+	tempDir := ""
+	if e.config.Jailer.Enabled {
+		tempDir = e.config.Jailer.chrootDir(e.vmID)
+		err = os.MkdirAll(tempDir, 0755)
+		if err != nil {
+			err = fmt.Errorf("creating chroot: %w", err)
+			return
+		}
+	}
+
+	e.logs, err = createJobLogs(e.config.Diagnosis, e.vmID, tempDir)
+	if err != nil {
+		err = fmt.Errorf("creating logs: %w", err)
+		return
+	}
+
+	e.hypervisor = newHypervisor(e.ctx, e.config, e.vmID, e.logs)
+
+	if e.config.transport() == TransportAgent {
+		e.vsockPath = fmt.Sprintf("/tmp/tart-vsock-%s.socket", e.vmID)
+		if e.config.Jailer.Enabled {
+			e.vsockPath = filepath.Join(tempDir, agentVsockName)
+		}
+	}
+
+	e.tempRootFS, err = cloneRootFS(e.config, tempDir)
+	if err != nil {
+		return
+	}
+
+	e.keys, err = generateVMKeys()
+	if err != nil {
+		err = fmt.Errorf("generating SSH keys: %w", err)
+		return
+	}
+	e.configDrive, err = os.CreateTemp(tempDir, "tart-config-*.tar")
+	if err != nil {
+		err = fmt.Errorf("creating config drive: %w", err)
+		return
+	}
+	err = writeConfigDrive(e.configDrive, e.keys.configDriveFiles())
+	if err != nil {
+		err = fmt.Errorf("writing config drive: %w", err)
+		return
+	}
+	err = e.configDrive.Sync()
+	if err != nil {
+		err = fmt.Errorf("file system sync on config drive: %w", err)
+		return
+	}
+
+	return
+}
+
+// cloneRootFS copies RootFS of config into dir for a microVM to write to,
+// verifying digests of images in the image store.
+func cloneRootFS(config Config, dir string) (f *os.File, err error) {
+	rootFSOrigin, err := os.Open(config.RootFSPath)
+	if err != nil {
+		err = fmt.Errorf("open original RootFS file: %w", err)
+		return
+	}
+	defer rootFSOrigin.Close()
+
+	f, err = os.CreateTemp(dir, "tart-rootfs-*.ext4")
+	if err != nil {
+		err = fmt.Errorf("creating temp rootFS: %w", err)
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+			f = nil
+		}
+	}()
+
+	var rootFS io.Writer = f
+	var rootFSVerifier *imagestore.Verifier
+	if config.rootFSDigest != "" {
+		rootFSVerifier, err = imagestore.NewVerifier(config.rootFSDigest)
+		if err != nil {
+			return
+		}
+		rootFS = io.MultiWriter(f, rootFSVerifier)
+	}
+	_, err = io.Copy(rootFS, rootFSOrigin)
+	if err != nil {
+		err = fmt.Errorf("clone rootFS: %w", err)
+		return
+	}
+	if rootFSVerifier != nil {
+		err = rootFSVerifier.Verify()
+		if err != nil {
+			err = fmt.Errorf("verifying rootFS %s: %w", config.RootFSPath, err)
+			return
+		}
+	}
+	if config.kernelDigest != "" {
+		err = imagestore.Verify(config.KernelPath, config.kernelDigest)
+		if err != nil {
+			err = fmt.Errorf("verifying kernel %s: %w", config.KernelPath, err)
+			return
+		}
+	}
+	err = f.Sync()
+	if err != nil {
+		err = fmt.Errorf("file system sync on rootFS: %w", err)
+		return
+	}
+
+	return
+}
+
+// Prepare start the VM, clones the repo.
+func (e *MicroVM) Prepare(ctx context.Context) (err error) {
+	vmCreated := false
+	defer func() {
+		if err != nil {
+			e.logger.Debug("Build failed during preparing", zap.Error(err))
+			_ = e.redLine("Build failed during preparing: %s", err)
+			if vmCreated && e.transport == nil {
+				// the microVM failed to boot or can not be connected
+				e.dumpLogs()
+			}
+		}
+	}()
+
+	prepareStart := time.Now()
+	err = e.yellowLine("Running with %s\n", version.FullName)
+	if err != nil {
+		return
+	}
+
+	e.logger.Debug("Spinning up microVM...", zap.Stringer("hypervisor", e.hypervisor))
+	err = e.blueLine("Spinning up microVM with %s...", e.hypervisor)
+	if err != nil {
+		return
+	}
+
+	image := e.build.job.Image.Name
+	if image == "" {
+		image = e.config.DefaultImage
+	}
+	switch {
+	case image == "":
+	case !e.config.imagesEnabled():
+		err = e.yellowLine("Image %s is ignored, this runner has no image catalog and boots its default kernel and RootFS", image)
+	default:
+		err = e.line("Using image %s...", image)
+	}
+	if err != nil {
+		return
+	}
+
+	if !e.config.Offline {
+		err = e.applyNetworkPolicy(ctx)
+		if err != nil {
+			err = fmt.Errorf("applying network policy: %w", err)
+			return
+		}
+	}
+
+	e.boot = newBootWatcher(e.config.Boot.consoleMarker())
+	spec := vmSpec{
+		kernelArgs:  e.kernelArgs(),
+		rootFS:      e.tempRootFS.Name(),
+		configDrive: e.configDrive.Name(),
+		console:     io.MultiWriter(e.logs.console, e.boot, &e.exhaustion),
+		vsockPath:   e.vsockPath,
+	}
+	mirrorDrive, sourcesDrive, cacheDrive := -1, -1, -1
+	if e.config.Offline {
+		e.sourcesImage, err = e.sourcesDrive(ctx, e.driveDir())
+		if err != nil {
+			return
+		}
+		sourcesDrive = len(spec.drives)
+		spec.drives = append(spec.drives, vmDrive{path: e.sourcesImage})
+	} else if e.config.GitCache.enabled() {
+		if path := e.gitMirrorDrive(ctx); path != "" {
+			mirrorDrive = len(spec.drives)
+			spec.drives = append(spec.drives, vmDrive{path: path, readOnly: true})
+		}
+	}
+	if e.config.CacheDrive.enabled() {
+		if path := e.cacheDrive(ctx); path != "" {
+			cacheDrive = len(spec.drives)
+			spec.drives = append(spec.drives, vmDrive{path: path})
+		}
+	}
+	if len(e.build.job.Services) > 0 {
+		var nic vmNIC
+		nic, err = e.startServices(ctx)
+		if err != nil {
+			return
+		}
+		spec.nics = append(spec.nics, nic)
+	}
+	if e.config.mmdsEnabled() {
+		metadata := e.metadata()
+		spec.metadata = &metadata
+	}
+
+	var readyListener net.Listener
+	if e.config.transport() == TransportAgent {
+		// the agent signals readiness once it's serving
+		readyListener, err = e.listenAgentReady()
+		if err != nil {
+			return
+		}
+		defer readyListener.Close()
+	}
+
+	e.logger.Debug("MicroVM is initialized, starting...", zap.String("VMID", e.vmID))
+	err = e.greenLine("MicroVM %s is initialized, starting...", e.vmID)
+	if err != nil {
+		return
+	}
+
+	vmCreated = true
+	err = e.hypervisor.start(ctx, spec)
+	if err != nil {
+		err = fmt.Errorf("starting the VM: %w", err)
+		return
+	}
+
+	e.vmIP, err = e.hypervisor.ip()
+	if err != nil {
+		return
+	}
+
+	if e.config.Offline {
+		e.logger.Debug("MicroVM started offline, connecting...")
+		err = e.greenLine("MicroVM started offline, connecting...")
+	} else {
+		e.logger.Debug("MicroVM started, connecting...", zap.String("IP", e.vmIP))
+		err = e.greenLine("MicroVM started on %s, connecting...", e.vmIP)
+	}
+	if err != nil {
+		return
+	}
+
+	e.transport, err = e.waitBoot(ctx, readyListener)
+	if err != nil {
+		return
+	}
+	e.trackPhase(PhaseBoot, prepareStart)
+	e.startMemorySampler(ctx)
+	getSourcesStart := time.Now()
+
+	if cacheDrive >= 0 {
+		err = e.mountCache(ctx, guestDrive(cacheDrive))
+		if err != nil {
+			return
+		}
+	}
+
+	if len(e.services) > 0 {
+		servicesStart := time.Now()
+		err = e.linkServices(ctx)
+		if err != nil {
+			return
+		}
+
+		err = e.waitServices(ctx)
+		if err != nil {
+			return
+		}
+		e.trackPhase(PhaseServices, servicesStart)
+		getSourcesStart = time.Now()
+	}
+	defer e.trackPhase(PhaseGetSources, getSourcesStart)
+
+	if e.config.Offline {
+		err = e.greenLine("MicroVM connected, mounting sources...")
+		if err != nil {
+			return
+		}
+
+		err = e.mountSources(ctx, guestDrive(sourcesDrive))
+		if err != nil {
+			return
+		}
+
+		err = e.greenLine("Sources mounted.")
+		if err != nil {
+			return
+		}
+
+		return
+	}
+
+	err = e.greenLine("MicroVM connected, cloning repo and checking out...")
+	if err != nil {
+		return
+	}
+
+	reference := ""
+	if mirrorDrive >= 0 {
+		reference = e.mountGitMirror(ctx, guestDrive(mirrorDrive))
+	}
+
+	err = cloneRepo(ctx, e.logger, e, e.build, reference)
+	if err != nil {
+		return
+	}
+
+	err = e.greenLine("Repo cloned and checked out.")
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// RunStep runs script in the microVM.
+func (e *MicroVM) RunStep(ctx context.Context, stage Stage, script string) (err error) {
+	if e.transport == nil {
+		err = errors.New("microVM is not connected")
+		return
+	}
+
+	if stage == StageStepScript {
+		defer e.trackPhase(PhaseStepScript, time.Now())
+	}
+	err = e.transport.run(ctx, stage, script, e.logSink, e.logSink)
+	if ctx.Err() != nil {
+		// cancelled or timed out
+		return
+	}
+
+	exhausted := e.checkExhaustion(ctx)
+	if exhausted == nil {
+		return
+	}
+	if err != nil {
+		exhausted.Err = err
+		err = exhausted
+		return
+	}
+	// the step survived
+	err = e.yellowLine("WARNING: %s", exhausted)
+
+	return
+}
+
+// Upload writes content to path in the microVM,
+// a relative path is relative to home directory.
+func (e *MicroVM) Upload(ctx context.Context, path string, mode uint32, content io.Reader) (err error) {
+	if e.transport == nil {
+		err = errors.New("microVM is not connected")
+		return
+	}
+
+	err = e.transport.upload(ctx, path, mode, content)
+	return
+}
+
+// Download reads the file at path in the microVM into w,
+// a relative path is relative to home directory.
+func (e *MicroVM) Download(ctx context.Context, path string, w io.Writer) (err error) {
+	if e.transport == nil {
+		err = errors.New("microVM is not connected")
+		return
+	}
+
+	err = e.transport.download(ctx, path, w)
+	return
+}
+
+// Close tears down the microVM, running every step even if some fail,
+// so that nothing, the cache volume lock in particular, outlives the job.
+// The first error is returned, the rest are logged.
+func (e *MicroVM) Close(ctx context.Context) (err error) {
+	fail := func(stepErr error) {
+		if err == nil {
+			err = stepErr
+			return
+		}
+		e.logger.Warn("closing microVM", zap.Error(stepErr))
+	}
+
+	if e.transport != nil {
+		_ = e.transport.Close()
+	}
+
+	if e.hypervisor != nil {
+		stopErr := e.hypervisor.stop(ctx)
+		if stopErr != nil {
+			fail(fmt.Errorf("stopping VM: %w", stopErr))
+		}
+	}
+	servicesErr := e.closeServices(ctx)
+	if servicesErr != nil {
+		fail(servicesErr)
+	}
+	if e.vsockPath != "" {
+		_ = os.Remove(e.vsockPath)
+		_ = os.Remove(agentReadyPath(e.vsockPath))
+	}
+	if e.networkPolicyApplied {
+		policyErr := vmnet.RemoveEgressPolicy(e.config.TapDevice)
+		if policyErr != nil {
+			fail(fmt.Errorf("removing network policy: %w", policyErr))
+		}
+	}
+
+	if e.tempRootFS != nil {
+		tempRootFSPath := e.tempRootFS.Name()
+		_ = e.tempRootFS.Close()
+		_ = os.Remove(tempRootFSPath)
+	}
+
+	if e.configDrive != nil {
+		configDrivePath := e.configDrive.Name()
+		_ = e.configDrive.Close()
+		_ = os.Remove(configDrivePath)
+	}
+	if e.sourcesImage != "" {
+		_ = os.Remove(e.sourcesImage)
+	}
+	if e.cacheVolume != nil {
+		// the microVM is gone, the volume is free for other jobs
+		e.cacheVolume.release()
+	}
+
+	// before the jail is gone
+	e.logs.close(e.config.Diagnosis, e.logger)
+
+	if e.config.Jailer.Enabled {
+		cleanupErr := e.config.Jailer.cleanup(e.vmID)
+		if cleanupErr != nil {
+			fail(fmt.Errorf("cleaning up jail: %w", cleanupErr))
+		}
+	}
+
+	return
+}
+
+// driveDir is where drives of the microVM are placed,
+// which must be in the chroot under jailer.
+func (e *MicroVM) driveDir() string {
+	if e.config.Jailer.Enabled {
+		return e.config.Jailer.chrootDir(e.vmID)
+	}
+
+	return os.TempDir()
+}
+
+func (e *MicroVM) kernelArgs() string {
+	args := e.hypervisor.kernelArgs()
+	if e.config.Offline {
+		return args
+	}
+	if e.config.cniEnabled() {
+		// firecracker-go-sdk appends ip= from the CNI result
+		return args
+	}
+
+	return args + " " + fmt.Sprintf("ip=%s::%s:%s::eth0:off", e.config.IP, e.config.GatewayIP, e.config.Netmask)
+}
+
+// applyNetworkPolicy installs outbound traffic rules on the tap device,
+// taking the job's request into account.
+func (e *MicroVM) applyNetworkPolicy(ctx context.Context) (err error) {
+	policy := e.config.NetworkPolicy
+	requested, ok := vmnet.PolicyFromVariables(
+		e.build.variable(vmnet.PolicyVariable),
+		e.build.variable(vmnet.PolicyAllowVariable),
+	)
+	if e.config.cniEnabled() {
+		// the tap device is created by CNI plugins, out of our reach
+		if ok && !requested.IsFull() {
+			err = fmt.Errorf("%s and %s are not supported by this runner, whose network is provided by CNI", vmnet.PolicyVariable, vmnet.PolicyAllowVariable)
+		}
+		return
+	}
+	if ok {
+		policy, err = policy.Tighten(requested)
+		if err != nil {
+			return
+		}
+	}
+
+	if policy.IsFull() {
+		return
+	}
+
+	err = e.line("Network policy: %s", policy)
+	if err != nil {
+		return
+	}
+
+	err = vmnet.ApplyEgressPolicy(ctx, e.config.TapDevice, net.ParseIP(e.config.GatewayIP), policy)
+	if err != nil {
+		return
+	}
+	e.networkPolicyApplied = true
+
+	return
+}
+
+// waitBoot waits for the microVM to be ready and connects to it,
+// giving up as soon as the microVM is found dead.
+func (e *MicroVM) waitBoot(ctx context.Context, readyListener net.Listener) (t transport, err error) {
+	timeout, err := e.config.Boot.timeout()
+	if err != nil {
+		return
+	}
+	bootCtx, cancelBoot := e.boot.watch(ctx, timeout, e.hypervisor.wait)
+	defer cancelBoot()
+
+	defer func() {
+		if cause := e.boot.err(); err != nil && cause != nil {
+			err = fmt.Errorf("microVM died during boot: %w", cause)
+		}
+	}()
+
+	if e.config.Boot.readiness() == ReadinessConsole {
+		e.logger.Debug("waiting for ready marker on serial console")
+		err = e.boot.waitReady(bootCtx)
+		if err != nil {
+			return
+		}
+	}
+
+	if e.config.transport() == TransportAgent {
+		t, err = e.connectAgent(bootCtx, readyListener)
+	} else {
+		t, err = e.connectSSH(bootCtx)
+	}
+
+	return
+}
+
+// connectSSH retries until ctx is done since the VM is booting and may not be ready.
+func (e *MicroVM) connectSSH(ctx context.Context) (t transport, err error) {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			err = fmt.Errorf("waiting for SSH connection to VM: %w", err)
+			return
+		case <-ticker.C:
+			var client *ssh.Client
+			client, err = e.dialSSH()
+			if err == nil {
+				t = &sshTransport{client: client}
+				return
+			}
+			e.logger.Debug("trying to establishing SSH connection to VM", zap.Error(err))
+		}
+	}
+}
+
+func (e *MicroVM) dialSSH() (client *ssh.Client, err error) {
+	config := &ssh.ClientConfig{
+		User: "root",
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(e.keys.client),
+		},
+		HostKeyCallback: ssh.FixedHostKey(e.keys.host.PublicKey()),
+		Timeout:         5 * time.Second,
+	}
+
+	client, err = ssh.Dial("tcp", net.JoinHostPort(e.vmIP, "22"), config)
+	if err != nil {
+		err = fmt.Errorf("dialing ssh: %w", err)
+		return
+	}
+
+	return
+}
@@ -0,0 +1,84 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nanmu42/tart/network"
+	"github.com/nanmu42/tart/vmnet"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestMicroVM_ApplyNetworkPolicy_CNI(t *testing.T) {
+	tests := []struct {
+		mode    string
+		wantErr bool
+	}{
+		{mode: ""},
+		{mode: "full"},
+		{mode: "none", wantErr: true},
+		{mode: "allowlist", wantErr: true},
+	}
+	for _, tt := range tests {
+		build, err := NewBuild(BuildOpt{
+			Job: network.RequestJobResp{
+				Variables: []network.JobVariable{
+					{Key: vmnet.PolicyVariable, Value: tt.mode},
+					{Key: vmnet.PolicyAllowVariable, Value: "example.com"},
+				},
+			},
+			WorkingDir: "ci-repo",
+		})
+		require.NoError(t, err)
+
+		var trace bytes.Buffer
+		e := &MicroVM{
+			logger: zap.NewNop(),
+			build:  build,
+			config: Config{CNINetworkName: "tart", TapDevice: "tap0"},
+			tracer: tracer{logSink: &trace},
+		}
+		err = e.applyNetworkPolicy(context.Background())
+		if tt.wantErr {
+			assert.ErrorContains(t, err, "CNI", tt.mode)
+			continue
+		}
+		require.NoError(t, err, tt.mode)
+		assert.False(t, e.networkPolicyApplied, tt.mode)
+	}
+}
+
+func TestNewMicroVM_CleansUpOnFailure(t *testing.T) {
+	build, err := NewBuild(BuildOpt{
+		Job:        network.RequestJobResp{ID: 42},
+		WorkingDir: "ci-repo",
+	})
+	require.NoError(t, err)
+	logDir := t.TempDir()
+
+	_, err = NewMicroVM(Option{
+		Logger:   zap.NewNop(),
+		Ctx:      context.Background(),
+		Build:    build,
+		JobTrace: &bytes.Buffer{},
+		Config: Config{
+			KernelPath: "vmlinux",
+			// fails after the logs are created
+			RootFSPath: filepath.Join(t.TempDir(), "missing.ext4"),
+			Offline:    true,
+			Transport:  TransportAgent,
+			Diagnosis:  DiagnosisConfig{LogDir: logDir},
+		},
+	})
+	require.ErrorContains(t, err, "RootFS")
+
+	entries, err := os.ReadDir(logDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
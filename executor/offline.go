@@ -0,0 +1,122 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// room for the job to write in sources drive
+	sourcesDriveHeadroom = 2 << 30
+)
+
+// sourcesDrive clones the repo on the host into an ext4 image,
+// which is mounted at working directory in offline microVMs.
+// Caches and artifacts of dependencies go along in transferDir of it.
+func (e *MicroVM) sourcesDrive(ctx context.Context, dir string) (path string, err error) {
+	err = e.line("Cloning repo on the host...")
+	if err != nil {
+		return
+	}
+
+	cloneDir, err := os.MkdirTemp("", "tart-sources-*")
+	if err != nil {
+		err = fmt.Errorf("creating clone directory: %w", err)
+		return
+	}
+	defer os.RemoveAll(cloneDir)
+
+	reference := ""
+	if e.config.GitCache.enabled() {
+		m, mirrorErr := openGitMirror(ctx, e.config.GitCache, e.build.repoURL())
+		if mirrorErr != nil {
+			e.logger.Warn("git cache is not available", zap.Error(mirrorErr))
+			_ = e.yellowLine("Git cache is skipped: %s", mirrorErr)
+		} else {
+			m.release()
+			reference = m.dir
+		}
+	}
+
+	err = e.build.cloneOnHost(ctx, filepath.Join(cloneDir, "sources"), reference)
+	if err != nil {
+		err = fmt.Errorf("cloning repo on the host: %w", err)
+		return
+	}
+
+	err = e.transferIn(ctx, filepath.Join(cloneDir, "sources"))
+	if err != nil {
+		return
+	}
+
+	size, err := dirSize(cloneDir)
+	if err != nil {
+		err = fmt.Errorf("measuring sources: %w", err)
+		return
+	}
+
+	path = filepath.Join(dir, fmt.Sprintf("tart-sources-%s.ext4", e.vmID))
+	err = mkfsExt4(ctx, path, size+size/4+sourcesDriveHeadroom, "sources", filepath.Join(cloneDir, "sources"), true)
+	if err != nil {
+		err = fmt.Errorf("making sources drive: %w", err)
+		return
+	}
+
+	return
+}
+
+// mountSources mounts sources drive at working directory in the microVM,
+// extracting caches and artifacts of dependencies carried in.
+func (e *MicroVM) mountSources(ctx context.Context, device string) (err error) {
+	workingDir := path.Join(agentHome, e.build.workingDir)
+	script := fmt.Sprintf("mkdir -p %[1]s && mount %[2]s %[1]s && %[3]s", workingDir, device, e.extractScript(workingDir))
+	err = e.RunStep(ctx, StageGetSources, script)
+	if err != nil {
+		err = fmt.Errorf("mounting sources drive: %w", err)
+		return
+	}
+
+	return
+}
+
+// cloneOnHost clones the repo into dir, borrowing objects from the mirror at reference if it's not empty.
+// The clone is self-contained, and credentials are removed from its remote URL.
+func (b *Build) cloneOnHost(ctx context.Context, dir string, reference string) (err error) {
+	args := []string{"clone", "--quiet"}
+	if reference != "" {
+		args = append(args, "--reference-if-able", reference, "--dissociate")
+	}
+	args = append(args, "-b", b.job.GitInfo.Ref, "--single-branch")
+	if b.job.GitInfo.Depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(b.job.GitInfo.Depth))
+	}
+	args = append(args, b.repoURL(), dir)
+
+	defer func() {
+		if err != nil {
+			err = maskURLPassword(err, b.repoURL())
+		}
+	}()
+
+	err = runGit(ctx, args...)
+	if err != nil {
+		return
+	}
+
+	if u, parseErr := url.Parse(b.repoURL()); parseErr == nil && u.User != nil {
+		u.User = nil
+		err = runGit(ctx, "-C", dir, "remote", "set-url", "origin", u.String())
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
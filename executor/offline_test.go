@@ -0,0 +1,34 @@
+package executor
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/nanmu42/tart/network"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuild_CloneOnHost(t *testing.T) {
+	ctx := context.Background()
+	repo := gitRepo(t)
+	build, err := NewBuild(BuildOpt{
+		Job: network.RequestJobResp{
+			GitInfo: network.GitInfo{Ref: "main", RepoURL: "file://" + repo},
+		},
+		WorkingDir: "ci-repo",
+	})
+	require.NoError(t, err)
+
+	m, err := openGitMirror(ctx, GitCacheConfig{Dir: t.TempDir()}, build.repoURL())
+	require.NoError(t, err)
+	m.release()
+
+	dir := filepath.Join(t.TempDir(), "sources")
+	require.NoError(t, build.cloneOnHost(ctx, dir, m.dir))
+	assert.FileExists(t, filepath.Join(dir, "README.md"))
+	// the clone must be self-contained
+	assert.NoFileExists(t, filepath.Join(dir, ".git", "objects", "info", "alternates"))
+}
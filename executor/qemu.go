@@ -0,0 +1,204 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// QEMUConfig is config of QEMU hypervisor.
+type QEMUConfig struct {
+	// QEMU system emulator binary
+	Binary string `comment:"QEMU system emulator binary, defaults to qemu-system-x86_64 in $PATH"`
+	// accelerator of QEMU
+	Accel string `comment:"accelerator of QEMU, auto, kvm or tcg, defaults to auto, which picks kvm if /dev/kvm is usable and falls back to tcg software emulation otherwise"`
+}
+
+const (
+	AccelAuto = "auto"
+	AccelKVM  = "kvm"
+	AccelTCG  = "tcg"
+
+	defaultQEMUBinary = "qemu-system-x86_64"
+	// how long QEMU is given to exit on SIGTERM
+	qemuStopTimeout = 10 * time.Second
+)
+
+func (c QEMUConfig) Validate() (err error) {
+	switch c.Accel {
+	case "", AccelAuto, AccelKVM, AccelTCG:
+	default:
+		err = fmt.Errorf("unknown accel %q", c.Accel)
+		return
+	}
+
+	return
+}
+
+func (c QEMUConfig) binary() string {
+	if c.Binary == "" {
+		return defaultQEMUBinary
+	}
+
+	return c.Binary
+}
+
+// accel resolves auto into kvm or tcg.
+func (c QEMUConfig) accel() string {
+	switch c.Accel {
+	case AccelKVM, AccelTCG:
+		return c.Accel
+	}
+
+	kvm, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		return AccelTCG
+	}
+	_ = kvm.Close()
+
+	return AccelKVM
+}
+
+// qemuHypervisor runs the microVM with QEMU microvm machine,
+// which provides virtio-mmio devices like Firecracker does,
+// so that the same kernel and rootFS work.
+//
+// MMDS and vsock are not available.
+type qemuHypervisor struct {
+	config Config
+	// resolved accelerator
+	accel string
+
+	cmd *exec.Cmd
+	// closed when QEMU exits
+	exited  chan struct{}
+	exitErr error
+}
+
+func (h *qemuHypervisor) String() string {
+	return fmt.Sprintf("QEMU(%s)", h.accel)
+}
+
+func (h *qemuHypervisor) kernelArgs() string {
+	return "root=/dev/vda ro console=ttyS0 reboot=k panic=1 pci=off nomodules random.trust_cpu=on"
+}
+
+func (h *qemuHypervisor) args(spec vmSpec) []string {
+	cpu := "max"
+	if h.accel == AccelKVM {
+		cpu = "host"
+	}
+
+	args := []string{
+		"-M", "microvm",
+		"-accel", h.accel,
+		"-cpu", cpu,
+		"-m", strconv.Itoa(vmMemSizeMiB),
+		"-smp", strconv.Itoa(vmVcpuCount),
+		"-nodefaults",
+		"-no-user-config",
+		"-display", "none",
+		// a panicked guest should end QEMU, like Firecracker does
+		"-no-reboot",
+		"-serial", "stdio",
+		"-kernel", h.config.KernelPath,
+		"-append", spec.kernelArgs,
+		"-drive", "id=rootfs,file=" + spec.rootFS + ",format=raw,if=none",
+		"-device", "virtio-blk-device,drive=rootfs",
+		"-drive", "id=config,file=" + spec.configDrive + ",format=raw,if=none,readonly=on",
+		"-device", "virtio-blk-device,drive=config",
+		"-netdev", "tap,id=net0,ifname=" + h.config.TapDevice + ",script=no,downscript=no",
+		"-device", "virtio-net-device,netdev=net0,mac=" + h.config.TapMac,
+	}
+	for i, nic := range spec.nics {
+		id := fmt.Sprintf("net%d", i+1)
+		args = append(args,
+			"-netdev", "tap,id="+id+",ifname="+nic.tap+",script=no,downscript=no",
+			"-device", "virtio-net-device,netdev="+id+",mac="+nic.mac,
+		)
+	}
+	for i, drive := range spec.drives {
+		id := fmt.Sprintf("drive%d", i)
+		option := "id=" + id + ",file=" + drive.path + ",format=raw,if=none"
+		if drive.readOnly {
+			option += ",readonly=on"
+		}
+		args = append(args, "-drive", option, "-device", "virtio-blk-device,drive="+id)
+	}
+
+	return args
+}
+
+func (h *qemuHypervisor) start(_ context.Context, spec vmSpec) (err error) {
+	// QEMU is stopped explicitly, the microVM outlives Prepare.
+	cmd := exec.Command(h.config.QEMU.binary(), h.args(spec)...)
+	cmd.Stdout = spec.console
+	cmd.Stderr = spec.console
+
+	err = cmd.Start()
+	if err != nil {
+		err = fmt.Errorf("starting QEMU: %w", err)
+		return
+	}
+	h.cmd = cmd
+	h.exited = make(chan struct{})
+
+	go func() {
+		h.exitErr = cmd.Wait()
+		close(h.exited)
+	}()
+
+	return
+}
+
+func (h *qemuHypervisor) ip() (ip string, err error) {
+	ip = h.config.IP
+	return
+}
+
+func (h *qemuHypervisor) metrics(_ context.Context) (m vmMetrics, err error) {
+	// not reported by QEMU
+	return
+}
+
+func (h *qemuHypervisor) wait(ctx context.Context) (err error) {
+	if h.cmd == nil {
+		err = errors.New("QEMU is not started")
+		return
+	}
+
+	select {
+	case <-h.exited:
+		err = h.exitErr
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	return
+}
+
+func (h *qemuHypervisor) stop(_ context.Context) (err error) {
+	if h.cmd == nil {
+		return
+	}
+
+	// the disks are thrown away, no need for a graceful shutdown of the guest
+	_ = h.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-h.exited:
+	case <-time.After(qemuStopTimeout):
+		err = h.cmd.Process.Kill()
+		if err != nil {
+			err = fmt.Errorf("killing QEMU: %w", err)
+			return
+		}
+		<-h.exited
+	}
+
+	return
+}
@@ -0,0 +1,698 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nanmu42/tart/network"
+	"github.com/nanmu42/tart/vmnet"
+
+	"go.uber.org/zap"
+)
+
+// ServicesConfig runs services of jobs, like postgres and redis, in microVMs
+// sharing a private network with the microVM of the job.
+type ServicesConfig struct {
+	// catalog of service images, enables services if not empty
+	Images []ServiceImageConfig `comment:"catalog of service images jobs may pick with services keyword in .gitlab-ci.yml, services are disabled if empty"`
+	// private networks of jobs are carved out of it
+	Subnet string `comment:"subnet in CIDR notation where private networks of jobs are carved out as /24s, defaults to 10.89.0.0/16. It must not overlap other networks of the host"`
+	// how long to wait for services to be ready
+	ReadyTimeout string `comment:"how long to wait for services to be ready, e.g. 1m, defaults to 2m. The job goes on with a warning after that"`
+}
+
+// ServiceImageConfig is a service image in the catalog.
+//
+// The image is booted with job variables and variables of the service
+// written to /etc/tart/service.env as KEY="value" lines,
+// which the service may read with EnvironmentFile of systemd.
+type ServiceImageConfig struct {
+	// name in .gitlab-ci.yml
+	Name string `comment:"name of the service in .gitlab-ci.yml, e.g. postgres:14 or postgres, which matches any tag unless a name with the tag exists"`
+	// tag in the image store
+	Tag string `comment:"tag of the image in the image store, managed by tart images, instead of KernelPath and RootFSPath"`
+	// path to linux kernel file
+	KernelPath string `comment:"path to linux kernel file, defaults to KernelPath of the executor"`
+	// path to RootFS file
+	RootFSPath string `comment:"path to RootFS file"`
+	// TCP ports the service listens on
+	Ports []int `comment:"TCP ports the service listens on, the service is ready once all of them accept connections. If empty, the service is ready once the ready marker of Boot shows on serial console"`
+}
+
+const (
+	defaultServicesSubnet       = "10.89.0.0/16"
+	defaultServicesReadyTimeout = 2 * time.Minute
+	// tap devices of a job network are numbered in two digits at most
+	maxServices = 16
+	// where variables are written to in service microVMs
+	serviceEnvPath = "/etc/tart/service.env"
+)
+
+func (c ServicesConfig) Validate(executor Config) (err error) {
+	names := make(map[string]bool, len(c.Images))
+	for i, image := range c.Images {
+		if image.Name == "" {
+			err = fmt.Errorf("name of service image #%d is required", i)
+			return
+		}
+		if names[image.Name] {
+			err = fmt.Errorf("duplicated service image %s", image.Name)
+			return
+		}
+		names[image.Name] = true
+
+		err = executor.validateImage(image.image())
+		if err != nil {
+			return
+		}
+		for _, port := range image.Ports {
+			if port <= 0 || port > 65535 {
+				err = fmt.Errorf("port %d of service image %s is out of range", port, image.Name)
+				return
+			}
+		}
+	}
+
+	_, _, err = c.subnet()
+	if err != nil {
+		return
+	}
+	_, err = c.readyTimeout()
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func (c ServicesConfig) enabled() bool {
+	return len(c.Images) > 0
+}
+
+// subnet returns the subnet and how many /24 networks it holds.
+func (c ServicesConfig) subnet() (subnet *net.IPNet, count int, err error) {
+	cidr := c.Subnet
+	if cidr == "" {
+		cidr = defaultServicesSubnet
+	}
+
+	_, subnet, err = net.ParseCIDR(cidr)
+	if err != nil {
+		err = fmt.Errorf("parsing subnet: %w", err)
+		return
+	}
+	if subnet.IP.To4() == nil {
+		err = fmt.Errorf("only IPv4 subnet is supported, got %q", cidr)
+		return
+	}
+	ones, _ := subnet.Mask.Size()
+	if ones < 8 || ones > 24 {
+		err = fmt.Errorf("prefix length of subnet %q must be between 8 and 24", cidr)
+		return
+	}
+
+	count = 1 << (24 - ones)
+	return
+}
+
+func (c ServicesConfig) readyTimeout() (timeout time.Duration, err error) {
+	if c.ReadyTimeout == "" {
+		timeout = defaultServicesReadyTimeout
+		return
+	}
+
+	timeout, err = time.ParseDuration(c.ReadyTimeout)
+	if err != nil {
+		err = fmt.Errorf("parsing ready timeout: %w", err)
+		return
+	}
+	if timeout <= 0 {
+		err = fmt.Errorf("ready timeout must be positive, got %s", timeout)
+		return
+	}
+
+	return
+}
+
+// lookup finds the image of the service named in .gitlab-ci.yml,
+// an exact match wins over one ignoring the tag.
+func (c ServicesConfig) lookup(name string) (image ServiceImageConfig, err error) {
+	for _, candidate := range []string{name, imageRepository(name)} {
+		for _, image = range c.Images {
+			if image.Name == candidate {
+				return
+			}
+		}
+	}
+
+	var names []string
+	for _, image := range c.Images {
+		names = append(names, image.Name)
+	}
+	available := strings.Join(names, ", ")
+	if available == "" {
+		available = "none, please remove services keyword from .gitlab-ci.yml"
+	}
+
+	err = &UnsupportedError{Reason: fmt.Sprintf("service %s is not supported by this runner, available services: %s", name, available)}
+	return
+}
+
+// checkServices makes sure the runner offers all services of the job.
+func (c ServicesConfig) checkServices(services []network.Service) (err error) {
+	if len(services) > maxServices {
+		err = &UnsupportedError{Reason: fmt.Sprintf("a job may have %d services at most on this runner, got %d", maxServices, len(services))}
+		return
+	}
+
+	for _, service := range services {
+		_, err = c.lookup(service.Name)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (s ServiceImageConfig) image() ImageConfig {
+	return ImageConfig{
+		Name:       s.Name,
+		Tag:        s.Tag,
+		KernelPath: s.KernelPath,
+		RootFSPath: s.RootFSPath,
+	}
+}
+
+// imageRepository strips tag and digest from the image name.
+func imageRepository(name string) string {
+	if idx := strings.IndexByte(name, '@'); idx >= 0 {
+		name = name[:idx]
+	}
+	if idx := strings.LastIndexByte(name, ':'); idx > strings.LastIndexByte(name, '/') {
+		name = name[:idx]
+	}
+
+	return name
+}
+
+var hostnamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9_.-]*[a-zA-Z0-9])?$`)
+
+// serviceAliases returns hostnames of the service, after GitLab Runner:
+// aliases in .gitlab-ci.yml, and ones derived from the image name,
+// e.g. tutum/wordpress:latest gives tutum__wordpress and tutum-wordpress.
+func serviceAliases(service network.Service) (aliases []string) {
+	seen := make(map[string]bool)
+	add := func(alias string) {
+		if seen[alias] || !hostnamePattern.MatchString(alias) {
+			return
+		}
+		seen[alias] = true
+		aliases = append(aliases, alias)
+	}
+
+	for _, alias := range strings.FieldsFunc(service.Alias, func(r rune) bool {
+		return r == ',' || r == ' '
+	}) {
+		add(alias)
+	}
+	repository := imageRepository(service.Name)
+	add(strings.ReplaceAll(repository, "/", "__"))
+	add(strings.ReplaceAll(repository, "/", "-"))
+
+	return
+}
+
+// jobNetwork is the private network of a job and its services,
+// which is a /24 carved out of the services subnet.
+// The host takes the first address, the microVM of the job the second one,
+// and services the rest.
+type jobNetwork struct {
+	vmnet.Config
+	// flock held while the network is in use
+	lock *os.File
+	// address of the first IP in the network
+	base net.IP
+}
+
+// allocateJobNetwork sets up a free private network with a tap device
+// for the microVM of the job and each of the services.
+func (c Config) allocateJobNetwork(services int) (n *jobNetwork, err error) {
+	subnet, count, err := c.Services.subnet()
+	if err != nil {
+		return
+	}
+
+	lockDir := filepath.Join(os.TempDir(), "tart-services")
+	err = os.MkdirAll(lockDir, 0700)
+	if err != nil {
+		err = fmt.Errorf("creating lock directory: %w", err)
+		return
+	}
+
+	for i := 0; i < count; i++ {
+		var lock *os.File
+		lock, err = os.OpenFile(filepath.Join(lockDir, fmt.Sprintf("%d.lock", i)), os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			err = fmt.Errorf("opening lock: %w", err)
+			return
+		}
+		err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			// taken by another job
+			_ = lock.Close()
+			continue
+		}
+		if err != nil {
+			_ = lock.Close()
+			err = fmt.Errorf("locking network: %w", err)
+			return
+		}
+
+		base := make(net.IP, net.IPv4len)
+		copy(base, subnet.IP.To4())
+		base[1] += byte(i >> 8)
+		base[2] += byte(i)
+		n = &jobNetwork{
+			Config: vmnet.Config{
+				Subnet:   fmt.Sprintf("%s/24", base),
+				Bridge:   fmt.Sprintf("tsvc%d", i),
+				TapCount: services + 1,
+			},
+			lock: lock,
+			base: base,
+		}
+		if c.Jailer.Enabled {
+			n.TapOwnerUID = c.Jailer.UID
+			n.TapOwnerGID = c.Jailer.GID
+		}
+
+		err = vmnet.SetupIsolated(n.Config)
+		if err != nil {
+			_ = lock.Close()
+			n = nil
+			err = fmt.Errorf("setting up network %s: %w", base, err)
+			return
+		}
+
+		return
+	}
+
+	err = fmt.Errorf("all %d private networks are in use", count)
+	return
+}
+
+// ip returns the idx-th address of the network, starting from 1.
+func (n *jobNetwork) ip(idx int) string {
+	ip := make(net.IP, net.IPv4len)
+	copy(ip, n.base)
+	ip[3] = byte(idx)
+
+	return ip.String()
+}
+
+// mac derives a locally administered MAC address from the IP.
+func (n *jobNetwork) mac(idx int) string {
+	return fmt.Sprintf("02:fc:%02x:%02x:%02x:%02x", n.base[0], n.base[1], n.base[2], idx)
+}
+
+// release tears down the network and gives it back to the pool.
+func (n *jobNetwork) release() (err error) {
+	err = vmnet.Teardown(n.Config)
+	if err != nil {
+		// the lock is kept until the runner exits,
+		// so that other jobs do not take the half torn down network
+		err = fmt.Errorf("tearing down network %s, which is left out of the pool: %w", n.Subnet, err)
+		return
+	}
+	_ = n.lock.Close()
+
+	return
+}
+
+// serviceVM is a microVM running a service of the job.
+type serviceVM struct {
+	// name in .gitlab-ci.yml
+	name    string
+	aliases []string
+	ip      string
+	ports   []int
+
+	vmID        string
+	config      Config
+	hypervisor  hypervisor
+	logs        jobLogs
+	boot        *bootWatcher
+	rootFS      *os.File
+	configDrive *os.File
+}
+
+// startServices sets up the job network and boots services,
+// returning the network interface the microVM of the job joins the network with.
+func (e *MicroVM) startServices(ctx context.Context) (nic vmNIC, err error) {
+	services := e.build.job.Services
+
+	e.jobNetwork, err = e.config.allocateJobNetwork(len(services))
+	if err != nil {
+		err = fmt.Errorf("allocating private network: %w", err)
+		return
+	}
+	nic = vmNIC{
+		tap: e.jobNetwork.TapName(0),
+		mac: e.jobNetwork.mac(2),
+	}
+
+	for i, service := range services {
+		err = e.line("Starting service %s...", service.Name)
+		if err != nil {
+			return
+		}
+
+		var vm *serviceVM
+		vm, err = e.startService(ctx, service, i+1)
+		if vm != nil {
+			e.services = append(e.services, vm)
+		}
+		if err != nil {
+			err = fmt.Errorf("starting service %s: %w", service.Name, err)
+			return
+		}
+	}
+
+	return
+}
+
+// startService boots the service on the tap-th tap device of the job network.
+func (e *MicroVM) startService(ctx context.Context, service network.Service, tap int) (vm *serviceVM, err error) {
+	image, err := e.config.Services.lookup(service.Name)
+	if err != nil {
+		return
+	}
+	config, err := e.config.withImageConfig(image.image())
+	if err != nil {
+		return
+	}
+
+	ipIdx := tap + 2
+	vm = &serviceVM{
+		name:    service.Name,
+		aliases: serviceAliases(service),
+		ip:      e.jobNetwork.ip(ipIdx),
+		ports:   image.Ports,
+		vmID:    fmt.Sprintf("%s-svc%d", e.vmID, tap),
+		boot:    newBootWatcher(e.config.Boot.consoleMarker()),
+	}
+	if len(service.Entrypoint) > 0 || len(service.Command) > 0 {
+		err = e.yellowLine("Entrypoint and command of service %s are ignored, services run as their images are built", service.Name)
+		if err != nil {
+			return
+		}
+	}
+
+	gateway, err := e.jobNetwork.GatewayAddr()
+	if err != nil {
+		return
+	}
+	config.IP = vm.ip
+	config.GatewayIP = gateway.IP.String()
+	config.Netmask = net.IP(gateway.Mask).String()
+	config.TapDevice = e.jobNetwork.TapName(tap)
+	config.TapMac = e.jobNetwork.mac(ipIdx)
+	config.CNINetworkName = ""
+	config.Offline = false
+	vm.config = config
+
+	tempDir := ""
+	if config.Jailer.Enabled {
+		tempDir = config.Jailer.chrootDir(vm.vmID)
+		err = os.MkdirAll(tempDir, 0755)
+		if err != nil {
+			err = fmt.Errorf("creating chroot: %w", err)
+			return
+		}
+	}
+
+	vm.logs, err = createJobLogs(config.Diagnosis, vm.vmID, tempDir)
+	if err != nil {
+		err = fmt.Errorf("creating logs: %w", err)
+		return
+	}
+	vm.hypervisor = newHypervisor(e.ctx, config, vm.vmID, vm.logs)
+
+	vm.rootFS, err = cloneRootFS(config, tempDir)
+	if err != nil {
+		return
+	}
+
+	vm.configDrive, err = os.CreateTemp(tempDir, "tart-config-*.tar")
+	if err != nil {
+		err = fmt.Errorf("creating config drive: %w", err)
+		return
+	}
+	err = writeConfigDrive(vm.configDrive, []configDriveFile{{
+		path:    serviceEnvPath,
+		mode:    0600,
+		content: serviceEnv(e.build.job.Variables, service.Variables),
+	}})
+	if err != nil {
+		err = fmt.Errorf("writing config drive: %w", err)
+		return
+	}
+	err = vm.configDrive.Sync()
+	if err != nil {
+		err = fmt.Errorf("file system sync on config drive: %w", err)
+		return
+	}
+
+	hostname := ""
+	if len(vm.aliases) > 0 {
+		hostname = vm.aliases[0]
+	}
+	spec := vmSpec{
+		kernelArgs:  vm.hypervisor.kernelArgs() + " " + fmt.Sprintf("ip=%s::%s:%s:%s:eth0:off", config.IP, config.GatewayIP, config.Netmask, hostname),
+		rootFS:      vm.rootFS.Name(),
+		configDrive: vm.configDrive.Name(),
+		console:     io.MultiWriter(vm.logs.console, vm.boot),
+	}
+	e.logger.Debug("starting service", zap.String("service", service.Name), zap.String("VMID", vm.vmID), zap.String("IP", vm.ip))
+	err = vm.hypervisor.start(ctx, spec)
+	if err != nil {
+		err = fmt.Errorf("starting the VM: %w", err)
+		return
+	}
+
+	return
+}
+
+// serviceEnv forges the env file of the service,
+// where variables of the service override job variables.
+func serviceEnv(jobVariables, serviceVariables []network.JobVariable) []byte {
+	var buf bytes.Buffer
+	for _, variables := range [][]network.JobVariable{jobVariables, serviceVariables} {
+		for _, v := range variables {
+			if !envKeyPattern.MatchString(v.Key) {
+				continue
+			}
+			_, _ = fmt.Fprintf(&buf, "%s=%q\n", v.Key, v.Value)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+var envKeyPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// linkServices joins the microVM of the job to the job network,
+// and writes aliases of services into /etc/hosts.
+func (e *MicroVM) linkServices(ctx context.Context) (err error) {
+	var script strings.Builder
+	fmt.Fprintf(&script, "dev=$(grep -il '%s' /sys/class/net/*/address | cut -d/ -f5)\n", e.jobNetwork.mac(2))
+	fmt.Fprintf(&script, "ip addr add %s/24 dev \"$dev\" && ip link set \"$dev\" up\n", e.jobNetwork.ip(2))
+	script.WriteString("cat >> /etc/hosts <<'EOF'\n")
+	for _, vm := range e.services {
+		if len(vm.aliases) == 0 {
+			continue
+		}
+		fmt.Fprintf(&script, "%s %s\n", vm.ip, strings.Join(vm.aliases, " "))
+	}
+	script.WriteString("EOF\n")
+
+	err = e.RunStep(ctx, StageGetSources, script.String())
+	if err != nil {
+		err = fmt.Errorf("linking services: %w", err)
+		return
+	}
+
+	return
+}
+
+// waitServices waits for services to be ready,
+// the job goes on with warnings for services not ready in time.
+func (e *MicroVM) waitServices(ctx context.Context) (err error) {
+	timeout, err := e.config.Services.readyTimeout()
+	if err != nil {
+		return
+	}
+
+	err = e.line("Waiting for services to be up and running (timeout %s)...", timeout)
+	if err != nil {
+		return
+	}
+
+	errs := make([]error, len(e.services))
+	var wg sync.WaitGroup
+	for i, vm := range e.services {
+		wg.Add(1)
+		go func(i int, vm *serviceVM) {
+			defer wg.Done()
+			errs[i] = vm.waitReady(ctx, timeout)
+		}(i, vm)
+	}
+	wg.Wait()
+
+	for i, vm := range e.services {
+		if errs[i] == nil {
+			continue
+		}
+
+		e.logger.Debug("service is not ready", zap.String("service", vm.name), zap.Error(errs[i]))
+		err = e.yellowLine("*** WARNING: Service %s probably didn't start properly: %s", vm.name, errs[i])
+		if err != nil {
+			return
+		}
+		e.dumpServiceConsole(vm)
+	}
+
+	return
+}
+
+// waitReady waits for ports of the service to accept connections,
+// or the ready marker if the service has no ports.
+func (vm *serviceVM) waitReady(ctx context.Context, timeout time.Duration) (err error) {
+	readyCtx, cancel := vm.boot.watch(ctx, timeout, vm.hypervisor.wait)
+	defer cancel()
+
+	defer func() {
+		if cause := vm.boot.err(); err != nil && cause != nil {
+			err = fmt.Errorf("microVM died: %w", cause)
+		}
+	}()
+
+	if len(vm.ports) == 0 {
+		err = vm.boot.waitReady(readyCtx)
+		return
+	}
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for _, port := range vm.ports {
+		address := net.JoinHostPort(vm.ip, fmt.Sprint(port))
+		for {
+			var conn net.Conn
+			conn, err = net.DialTimeout("tcp", address, time.Second)
+			if err == nil {
+				_ = conn.Close()
+				break
+			}
+
+			select {
+			case <-readyCtx.Done():
+				err = fmt.Errorf("waiting for port %d: %w", port, err)
+				return
+			case <-ticker.C:
+			}
+		}
+	}
+
+	return
+}
+
+// dumpServiceConsole writes the tail of serial console of the service into the job log.
+func (e *MicroVM) dumpServiceConsole(vm *serviceVM) {
+	lines, err := tailFile(vm.logs.console.Name(), e.config.Diagnosis.tailLines())
+	if err != nil {
+		e.logger.Debug("tailing service console", zap.String("service", vm.name), zap.Error(err))
+		return
+	}
+	if len(lines) == 0 {
+		return
+	}
+
+	err = e.section("service_console", fmt.Sprintf("Serial console of service %s, last %d lines", vm.name, len(lines)), true, func(w io.Writer) (err error) {
+		for _, line := range lines {
+			_, err = fmt.Fprintln(w, strings.TrimRight(line, "\r"))
+			if err != nil {
+				return
+			}
+		}
+		return
+	})
+	if err != nil {
+		e.logger.Debug("dumping service console", zap.String("service", vm.name), zap.Error(err))
+	}
+}
+
+// close stops the service and removes its files,
+// running every step even if some fail, the first error is returned.
+func (vm *serviceVM) close(ctx context.Context, logger *zap.Logger) (err error) {
+	if vm.hypervisor != nil {
+		stopErr := vm.hypervisor.stop(ctx)
+		if stopErr != nil {
+			err = fmt.Errorf("stopping VM: %w", stopErr)
+		}
+	}
+
+	for _, f := range []*os.File{vm.rootFS, vm.configDrive} {
+		if f == nil {
+			continue
+		}
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}
+
+	if vm.logs.dir != "" {
+		vm.logs.close(vm.config.Diagnosis, logger)
+	}
+
+	if vm.config.Jailer.Enabled {
+		cleanupErr := vm.config.Jailer.cleanup(vm.vmID)
+		if cleanupErr != nil && err == nil {
+			err = fmt.Errorf("cleaning up jail: %w", cleanupErr)
+		}
+	}
+
+	return
+}
+
+// closeServices stops services and tears down the job network.
+func (e *MicroVM) closeServices(ctx context.Context) (err error) {
+	for _, vm := range e.services {
+		closeErr := vm.close(ctx, e.logger)
+		if closeErr != nil && err == nil {
+			err = fmt.Errorf("closing service %s: %w", vm.name, closeErr)
+		}
+	}
+	e.services = nil
+
+	if e.jobNetwork != nil {
+		releaseErr := e.jobNetwork.release()
+		if releaseErr != nil && err == nil {
+			err = releaseErr
+		}
+		e.jobNetwork = nil
+	}
+
+	return
+}
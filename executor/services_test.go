@@ -0,0 +1,66 @@
+package executor
+
+import (
+	"testing"
+
+	"github.com/nanmu42/tart/network"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServicesConfig_Lookup(t *testing.T) {
+	config := ServicesConfig{
+		Images: []ServiceImageConfig{
+			{Name: "postgres", RootFSPath: "postgres-15.ext4", Ports: []int{5432}},
+			{Name: "postgres:14", RootFSPath: "postgres-14.ext4", Ports: []int{5432}},
+			{Name: "redis", RootFSPath: "redis.ext4"},
+		},
+	}
+	require.NoError(t, config.Validate(Config{KernelPath: "vmlinux"}))
+
+	image, err := config.lookup("postgres:14")
+	require.NoError(t, err)
+	assert.Equal(t, "postgres-14.ext4", image.RootFSPath)
+	image, err = config.lookup("postgres:15-alpine")
+	require.NoError(t, err)
+	assert.Equal(t, "postgres-15.ext4", image.RootFSPath)
+	image, err = config.lookup("redis@sha256:0123")
+	require.NoError(t, err)
+	assert.Equal(t, "redis.ext4", image.RootFSPath)
+
+	var unsupportedErr *UnsupportedError
+	err = config.checkServices([]network.Service{{Name: "redis"}, {Name: "mysql:8"}})
+	require.ErrorAs(t, err, &unsupportedErr)
+	assert.EqualError(t, err, "service mysql:8 is not supported by this runner, available services: postgres, postgres:14, redis")
+
+	config.Images[2].Ports = []int{65536}
+	assert.Error(t, config.Validate(Config{KernelPath: "vmlinux"}))
+	config.Images[2].Ports = nil
+	config.Subnet = "10.89.0.0/25"
+	assert.Error(t, config.Validate(Config{KernelPath: "vmlinux"}))
+	config.Subnet = ""
+	config.ReadyTimeout = "-1m"
+	assert.Error(t, config.Validate(Config{KernelPath: "vmlinux"}))
+}
+
+func TestServiceAliases(t *testing.T) {
+	assert.Equal(t, []string{"postgres"}, serviceAliases(network.Service{Name: "postgres:14"}))
+	// registry port makes no valid hostname
+	assert.Equal(t, []string{"db", "pg"}, serviceAliases(network.Service{
+		Name:  "registry.example.com:5000/tutum/wordpress:latest",
+		Alias: "db, pg",
+	}))
+	assert.Equal(t, []string{"db", "registry.example.com__tutum__wordpress", "registry.example.com-tutum-wordpress"}, serviceAliases(network.Service{
+		Name:  "registry.example.com/tutum/wordpress:latest",
+		Alias: "db",
+	}))
+}
+
+func TestServiceEnv(t *testing.T) {
+	env := serviceEnv(
+		[]network.JobVariable{{Key: "CI_JOB_ID", Value: "42"}, {Key: "POSTGRES_PASSWORD", Value: "job"}},
+		[]network.JobVariable{{Key: "POSTGRES_PASSWORD", Value: "p@ss \"word\""}, {Key: "not-a-key", Value: "x"}},
+	)
+	assert.Equal(t, "CI_JOB_ID=\"42\"\nPOSTGRES_PASSWORD=\"job\"\nPOSTGRES_PASSWORD=\"p@ss \\\"word\\\"\"\n", string(env))
+}
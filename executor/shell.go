@@ -0,0 +1,248 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"github.com/nanmu42/tart/version"
+
+	"go.uber.org/zap"
+)
+
+// ShellConfig is config of shell executor.
+type ShellConfig struct {
+	// where job directories are created
+	BuildsDir string `comment:"directory where a temporary directory is created for every job, defaults to system temp directory"`
+}
+
+func (c ShellConfig) Validate() (err error) {
+	if c.BuildsDir == "" {
+		return
+	}
+
+	info, err := os.Stat(c.BuildsDir)
+	if err != nil {
+		err = fmt.Errorf("builds directory: %w", err)
+		return
+	}
+	if !info.IsDir() {
+		err = fmt.Errorf("builds directory %s is not a directory", c.BuildsDir)
+		return
+	}
+
+	return
+}
+
+// Shell runs the job with bash on the host,
+// in a temporary directory which serves as home directory of the job.
+//
+// There's no isolation at all, only trusted jobs should be run this way.
+type Shell struct {
+	logger *zap.Logger
+	build  *Build
+	config Config
+
+	tracer
+	// home directory of the job
+	dir string
+}
+
+func NewShell(opt Option) (s *Shell, err error) {
+	err = opt.validate()
+	if err != nil {
+		return
+	}
+
+	s = &Shell{
+		logger: opt.Logger.With(zap.Int("jobId", opt.Build.job.ID)),
+		build:  opt.Build,
+		config: opt.Config,
+		tracer: tracer{logSink: opt.JobTrace},
+	}
+
+	s.dir, err = os.MkdirTemp(s.config.Shell.BuildsDir, fmt.Sprintf("tart-build-%d-*", opt.Build.job.ID))
+	if err != nil {
+		err = fmt.Errorf("creating job directory: %w", err)
+		return
+	}
+
+	return
+}
+
+// Prepare clones the repo.
+func (s *Shell) Prepare(ctx context.Context) (err error) {
+	defer func() {
+		if err != nil {
+			s.logger.Debug("Build failed during preparing", zap.Error(err))
+			_ = s.redLine("Build failed during preparing: %s", err)
+		}
+	}()
+
+	err = s.yellowLine("Running with %s\n", version.FullName)
+	if err != nil {
+		return
+	}
+
+	hostname, _ := os.Hostname()
+	err = s.greenLine("Running on %s in %s, cloning repo and checking out...", hostname, s.dir)
+	if err != nil {
+		return
+	}
+
+	reference := ""
+	if s.config.GitCache.enabled() {
+		reference = s.gitMirrorDir(ctx)
+	}
+
+	err = cloneRepo(ctx, s.logger, s, s.build, reference)
+	if err != nil {
+		return
+	}
+
+	err = s.greenLine("Repo cloned and checked out.")
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// RunStep writes script into a file and runs it with bash in job directory.
+// The script and its children are killed if ctx is done.
+func (s *Shell) RunStep(ctx context.Context, stage Stage, script string) (err error) {
+	file, err := os.CreateTemp(s.dir, fmt.Sprintf(".tart-%s-*.sh", stage))
+	if err != nil {
+		err = fmt.Errorf("creating script file: %w", err)
+		return
+	}
+	defer os.Remove(file.Name())
+	_, err = io.WriteString(file, script)
+	if err != nil {
+		_ = file.Close()
+		err = fmt.Errorf("writing script file: %w", err)
+		return
+	}
+	err = file.Close()
+	if err != nil {
+		err = fmt.Errorf("closing script file: %w", err)
+		return
+	}
+
+	args := scriptCommand(file.Name())
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = s.dir
+	cmd.Env = append(os.Environ(), "HOME="+s.dir)
+	cmd.Stdout = s.logSink
+	cmd.Stderr = s.logSink
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	err = cmd.Start()
+	if err != nil {
+		err = fmt.Errorf("starting bash: %w", err)
+		return
+	}
+
+	exited := make(chan struct{})
+	defer close(exited)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-exited:
+		}
+	}()
+
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		err = &ExitError{Code: exitErr.ExitCode()}
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("running bash: %w", err)
+		return
+	}
+
+	return
+}
+
+func (s *Shell) Upload(_ context.Context, path string, mode uint32, content io.Reader) (err error) {
+	path = s.path(path)
+	if mode == 0 {
+		mode = 0644
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		err = fmt.Errorf("creating parent directory: %w", err)
+		return
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(mode))
+	if err != nil {
+		err = fmt.Errorf("opening %s: %w", path, err)
+		return
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, content)
+	if err != nil {
+		err = fmt.Errorf("writing %s: %w", path, err)
+		return
+	}
+	err = file.Chmod(os.FileMode(mode))
+	if err != nil {
+		err = fmt.Errorf("chmod %s: %w", path, err)
+		return
+	}
+	err = file.Close()
+	if err != nil {
+		err = fmt.Errorf("closing %s: %w", path, err)
+		return
+	}
+
+	return
+}
+
+func (s *Shell) Download(_ context.Context, path string, w io.Writer) (err error) {
+	path = s.path(path)
+	file, err := os.Open(path)
+	if err != nil {
+		err = fmt.Errorf("opening %s: %w", path, err)
+		return
+	}
+	defer file.Close()
+
+	_, err = io.Copy(w, file)
+	if err != nil {
+		err = fmt.Errorf("reading %s: %w", path, err)
+		return
+	}
+
+	return
+}
+
+// Close removes the job directory.
+func (s *Shell) Close(_ context.Context) (err error) {
+	err = os.RemoveAll(s.dir)
+	if err != nil {
+		err = fmt.Errorf("removing job directory: %w", err)
+		return
+	}
+
+	return
+}
+
+// path resolves relative path against job directory.
+func (s *Shell) path(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+
+	return filepath.Join(s.dir, path)
+}
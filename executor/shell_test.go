@@ -0,0 +1,124 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nanmu42/tart/network"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// gitRepo creates a repo with a single commit on branch main.
+func gitRepo(t *testing.T) string {
+	t.Helper()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README.md"), []byte("tart\n"), 0644))
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"add", "README.md"},
+		{"-c", "user.name=tart", "-c", "user.email=tart@example.com", "commit", "-q", "-m", "init"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		output, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(output))
+	}
+
+	return dir
+}
+
+func runShellJob(t *testing.T, repo string, gitCache GitCacheConfig, script ...string) (result BuildResult, trace string) {
+	t.Helper()
+
+	build, err := NewBuild(BuildOpt{
+		Job: network.RequestJobResp{
+			ID: 42,
+			GitInfo: network.GitInfo{
+				Depth:   1,
+				Ref:     "main",
+				RepoURL: "file://" + repo,
+			},
+			Steps: []network.JobStep{
+				{Name: "script", Script: script, Timeout: 60, When: "on_success"},
+			},
+			Variables: []network.JobVariable{
+				{Key: "GREETING", Value: "hello tart"},
+			},
+		},
+		WorkingDir: "ci-repo",
+	})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	ctx := context.Background()
+	logger := zap.NewNop()
+	exe, err := New(Option{
+		Logger:   logger,
+		Ctx:      ctx,
+		Build:    build,
+		JobTrace: &buf,
+		Config: Config{
+			Kind:     KindShell,
+			Shell:    ShellConfig{BuildsDir: t.TempDir()},
+			GitCache: gitCache,
+		},
+	})
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, exe.Close(ctx)) }()
+
+	require.NoError(t, exe.Prepare(ctx))
+
+	result = RunBuild(ctx, logger, exe, build, &buf)
+	trace = buf.String()
+	return
+}
+
+func TestShell_RunBuild(t *testing.T) {
+	repo := gitRepo(t)
+	result, trace := runShellJob(t, repo, GitCacheConfig{}, "test -f README.md", "echo $GREETING")
+	assert.NoError(t, result.Err)
+	assert.Contains(t, trace, "hello tart")
+	// commands are echoed without expansion
+	assert.Contains(t, trace, "$ echo $GREETING")
+
+	result, _ = runShellJob(t, repo, GitCacheConfig{}, "exit 3")
+	assert.Error(t, result.Err)
+	assert.Equal(t, 3, result.ExitCode)
+	assert.Equal(t, network.FailureReasonScriptFailure, result.FailureReason)
+}
+
+func TestShell_File(t *testing.T) {
+	ctx := context.Background()
+	build, err := NewBuild(BuildOpt{WorkingDir: "ci-repo"})
+	require.NoError(t, err)
+	exe, err := NewShell(Option{
+		Logger:   zap.NewNop(),
+		Ctx:      ctx,
+		Build:    build,
+		JobTrace: &bytes.Buffer{},
+		Config:   Config{Kind: KindShell},
+	})
+	require.NoError(t, err)
+	defer exe.Close(ctx)
+
+	err = exe.Upload(ctx, "sub/file", 0600, strings.NewReader("content"))
+	require.NoError(t, err)
+
+	var got bytes.Buffer
+	err = exe.Download(ctx, filepath.Join(exe.dir, "sub", "file"), &got)
+	require.NoError(t, err)
+	assert.Equal(t, "content", got.String())
+}
@@ -0,0 +1,279 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/nanmu42/tart/helper"
+	"github.com/nanmu42/tart/version"
+
+	"go.uber.org/zap"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSHConfig is config of ssh executor.
+type SSHConfig struct {
+	// hosts to run jobs on
+	Hosts []string `comment:"hosts to run jobs on, in the form of host or host:port. For each job, hosts are tried in random order until one connects"`
+	// user to log in as
+	User string `comment:"user to log in as"`
+	// path to private key
+	IdentityFile string `comment:"path to private key to log in with"`
+	// known_hosts file pinning host keys
+	KnownHostsFile string `comment:"path to known_hosts file pinning keys of hosts, connections to hosts not in it are refused"`
+	// where job directories are created on hosts
+	BuildsDir string `comment:"directory on hosts where a temporary directory is created for every job, defaults to /tmp"`
+}
+
+const defaultSSHBuildsDir = "/tmp"
+
+func (c SSHConfig) Validate() (err error) {
+	if len(c.Hosts) == 0 {
+		err = errors.New("hosts are required")
+		return
+	}
+	if c.User == "" {
+		err = errors.New("user is required")
+		return
+	}
+	if c.IdentityFile == "" {
+		err = errors.New("identity file is required")
+		return
+	}
+	if c.KnownHostsFile == "" {
+		err = errors.New("known hosts file is required")
+		return
+	}
+
+	return
+}
+
+func (c SSHConfig) buildsDir() string {
+	if c.BuildsDir == "" {
+		return defaultSSHBuildsDir
+	}
+
+	return c.BuildsDir
+}
+
+// clientConfig reads key and known hosts.
+func (c SSHConfig) clientConfig() (config *ssh.ClientConfig, err error) {
+	key, err := os.ReadFile(c.IdentityFile)
+	if err != nil {
+		err = fmt.Errorf("reading identity file: %w", err)
+		return
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		err = fmt.Errorf("parsing identity file: %w", err)
+		return
+	}
+	hostKeyCallback, err := knownhosts.New(c.KnownHostsFile)
+	if err != nil {
+		err = fmt.Errorf("reading known hosts file: %w", err)
+		return
+	}
+
+	config = &ssh.ClientConfig{
+		User: c.User,
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(signer),
+		},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         10 * time.Second,
+	}
+	return
+}
+
+// SSH runs the job on an existing host over SSH,
+// in a temporary directory which serves as home directory of the job.
+type SSH struct {
+	logger *zap.Logger
+	build  *Build
+	config Config
+
+	tracer
+	// the host connected
+	host      string
+	transport *sshTransport
+}
+
+func NewSSH(opt Option) (s *SSH, err error) {
+	err = opt.validate()
+	if err != nil {
+		return
+	}
+
+	s = &SSH{
+		logger: opt.Logger.With(zap.Int("jobId", opt.Build.job.ID)),
+		build:  opt.Build,
+		config: opt.Config,
+		tracer: tracer{logSink: opt.JobTrace},
+	}
+	return
+}
+
+// Prepare connects to a host, creates job directory and clones the repo.
+func (s *SSH) Prepare(ctx context.Context) (err error) {
+	defer func() {
+		if err != nil {
+			s.logger.Debug("Build failed during preparing", zap.Error(err))
+			_ = s.redLine("Build failed during preparing: %s", err)
+		}
+	}()
+
+	err = s.yellowLine("Running with %s\n", version.FullName)
+	if err != nil {
+		return
+	}
+
+	client, err := s.connect()
+	if err != nil {
+		return
+	}
+	s.transport = &sshTransport{client: client}
+
+	dir, err := s.makeJobDir()
+	if err != nil {
+		return
+	}
+	s.transport.dir = dir
+
+	s.logger.Debug("connected to host", zap.String("host", s.host), zap.String("dir", dir))
+	err = s.greenLine("Running on %s in %s, cloning repo and checking out...", s.host, dir)
+	if err != nil {
+		return
+	}
+
+	err = cloneRepo(ctx, s.logger, s, s.build, "")
+	if err != nil {
+		return
+	}
+
+	err = s.greenLine("Repo cloned and checked out.")
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// connect tries hosts in random order, so that jobs are spread across them.
+func (s *SSH) connect() (client *ssh.Client, err error) {
+	config, err := s.config.SSH.clientConfig()
+	if err != nil {
+		return
+	}
+
+	hosts := make([]string, len(s.config.SSH.Hosts))
+	copy(hosts, s.config.SSH.Hosts)
+	rand.Shuffle(len(hosts), func(i, j int) {
+		hosts[i], hosts[j] = hosts[j], hosts[i]
+	})
+
+	for _, host := range hosts {
+		address := host
+		if _, _, splitErr := net.SplitHostPort(host); splitErr != nil {
+			address = net.JoinHostPort(host, "22")
+		}
+
+		client, err = ssh.Dial("tcp", address, config)
+		if err == nil {
+			s.host = host
+			return
+		}
+
+		s.logger.Info("connecting to host", zap.String("host", host), zap.Error(err))
+		_ = s.line("Can not connect to %s: %s", host, err)
+	}
+
+	err = fmt.Errorf("none of %d hosts can be connected, last error: %w", len(hosts), err)
+	return
+}
+
+func (s *SSH) makeJobDir() (dir string, err error) {
+	session, err := s.transport.client.NewSession()
+	if err != nil {
+		err = fmt.Errorf("init ssh session: %w", err)
+		return
+	}
+	defer session.Close()
+
+	template := path.Join(s.config.SSH.buildsDir(), fmt.Sprintf("tart-build-%d-XXXXXXXX", s.build.job.ID))
+	output, err := session.Output("mktemp -d " + helper.ShellEscape(template))
+	if err != nil {
+		err = fmt.Errorf("creating job directory: %w", err)
+		return
+	}
+
+	dir = strings.TrimSpace(string(output))
+	return
+}
+
+// RunStep runs script with bash in job directory on the host.
+func (s *SSH) RunStep(ctx context.Context, stage Stage, script string) (err error) {
+	if s.transport == nil {
+		err = errors.New("host is not connected")
+		return
+	}
+
+	err = s.transport.run(ctx, stage, script, s.logSink, s.logSink)
+	return
+}
+
+func (s *SSH) Upload(ctx context.Context, path string, mode uint32, content io.Reader) (err error) {
+	if s.transport == nil {
+		err = errors.New("host is not connected")
+		return
+	}
+
+	err = s.transport.upload(ctx, path, mode, content)
+	return
+}
+
+func (s *SSH) Download(ctx context.Context, path string, w io.Writer) (err error) {
+	if s.transport == nil {
+		err = errors.New("host is not connected")
+		return
+	}
+
+	err = s.transport.download(ctx, path, w)
+	return
+}
+
+// Close removes the job directory and disconnects.
+func (s *SSH) Close(_ context.Context) (err error) {
+	if s.transport == nil {
+		return
+	}
+	defer s.transport.Close()
+
+	if s.transport.dir == "" {
+		return
+	}
+
+	session, err := s.transport.client.NewSession()
+	if err != nil {
+		err = fmt.Errorf("init ssh session: %w", err)
+		return
+	}
+	defer session.Close()
+
+	err = session.Run("rm -rf " + helper.ShellEscape(s.transport.dir))
+	if err != nil {
+		err = fmt.Errorf("removing job directory on %s: %w", s.host, err)
+		return
+	}
+
+	return
+}
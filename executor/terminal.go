@@ -0,0 +1,101 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/nanmu42/tart/session"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// terminalType is what shells of web terminals see as TERM,
+// Gitlab renders them with xterm.js.
+const terminalType = "xterm-256color"
+
+// ValidateTerminal tells whether microVMs of the config can serve web terminals,
+// whose shells are opened over SSH.
+func (c Config) ValidateTerminal() (err error) {
+	if c.kind() == KindFirecracker && c.transport() != TransportSSH {
+		err = errors.New("web terminals require ssh transport")
+		return
+	}
+
+	return
+}
+
+// Shell runs a login shell with a PTY in the working directory of the job,
+// over an SSH connection of its own, for web terminals.
+func (e *MicroVM) Shell(ctx context.Context, stdin io.Reader, stdout io.Writer, size session.Size, resize <-chan session.Size) (err error) {
+	if e.transport == nil {
+		err = errors.New("microVM is not connected")
+		return
+	}
+	err = e.config.ValidateTerminal()
+	if err != nil {
+		return
+	}
+
+	client, err := e.dialSSH()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	err = runShell(ctx, client, path.Join(agentHome, e.build.workingDir), stdin, stdout, size, resize)
+	return
+}
+
+// runShell runs a login shell in dir with a PTY over client.
+func runShell(ctx context.Context, client *ssh.Client, dir string, stdin io.Reader, stdout io.Writer, size session.Size, resize <-chan session.Size) (err error) {
+	shell, err := client.NewSession()
+	if err != nil {
+		err = fmt.Errorf("init ssh session: %w", err)
+		return
+	}
+	defer shell.Close()
+
+	err = shell.RequestPty(terminalType, size.Height, size.Width, ssh.TerminalModes{ssh.ECHO: 1})
+	if err != nil {
+		err = fmt.Errorf("requesting PTY: %w", err)
+		return
+	}
+	shell.Stdin = stdin
+	// the PTY merges stderr into stdout
+	shell.Stdout = stdout
+	err = shell.Start(LoginShell(dir))
+	if err != nil {
+		err = fmt.Errorf("starting shell: %w", err)
+		return
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- shell.Wait()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// closing the connection hangs up the shell
+			err = ctx.Err()
+			return
+		case err = <-exited:
+			var exitErr *ssh.ExitError
+			if errors.As(err, &exitErr) {
+				// what the shell exits with is the user's business
+				err = nil
+			}
+			return
+		case size, ok := <-resize:
+			if !ok {
+				resize = nil
+				continue
+			}
+			_ = shell.WindowChange(size.Height, size.Width)
+		}
+	}
+}
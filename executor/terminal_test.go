@@ -0,0 +1,40 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nanmu42/tart/session"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRunShell(t *testing.T) {
+	keys, err := generateVMKeys()
+	require.NoError(t, err)
+	client, err := DebugSession{
+		Address:   serveSSH(t, keys),
+		User:      "root",
+		ClientKey: string(keys.clientPEM),
+		HostKey:   string(ssh.MarshalAuthorizedKey(keys.host.PublicKey())),
+	}.Dial()
+	require.NoError(t, err)
+	defer client.Close()
+
+	var stdout bytes.Buffer
+	resize := make(chan session.Size)
+	err = runShell(context.Background(), client, "/root/ci-repo", strings.NewReader(""), &stdout, session.Size{Width: 80, Height: 24}, resize)
+	require.NoError(t, err)
+	assert.Equal(t, LoginShell("/root/ci-repo"), stdout.String())
+}
+
+func TestConfig_ValidateTerminal(t *testing.T) {
+	assert.NoError(t, Config{}.ValidateTerminal())
+	assert.NoError(t, Config{Transport: TransportSSH}.ValidateTerminal())
+	assert.ErrorContains(t, Config{Transport: TransportAgent}.ValidateTerminal(), "ssh transport")
+	assert.ErrorContains(t, Config{Offline: true, Transport: TransportAgent}.ValidateTerminal(), "ssh transport")
+}
@@ -0,0 +1,93 @@
+package executor
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// tracer prints to job trace.
+type tracer struct {
+	logSink io.Writer
+}
+
+func (t tracer) redLine(format string, args ...any) (err error) {
+	_, err = io.WriteString(t.logSink, color.HiRedString(format+"\n", args...))
+	if err != nil {
+		err = fmt.Errorf("print red line: %w", err)
+		return
+	}
+
+	return
+}
+
+func (t tracer) yellowLine(format string, args ...any) (err error) {
+	_, err = io.WriteString(t.logSink, color.HiYellowString(format+"\n", args...))
+	if err != nil {
+		err = fmt.Errorf("print yellow line: %w", err)
+		return
+	}
+
+	return
+}
+
+func (t tracer) blueLine(format string, args ...any) (err error) {
+	_, err = io.WriteString(t.logSink, color.HiBlueString(format+"\n", args...))
+	if err != nil {
+		err = fmt.Errorf("print blue line: %w", err)
+		return
+	}
+
+	return
+}
+
+func (t tracer) greenLine(format string, args ...any) (err error) {
+	_, err = io.WriteString(t.logSink, color.HiGreenString(format+"\n", args...))
+	if err != nil {
+		err = fmt.Errorf("print green line: %w", err)
+		return
+	}
+
+	return
+}
+
+func (t tracer) line(format string, args ...any) (err error) {
+	_, err = fmt.Fprintf(t.logSink, format+"\n", args...)
+	if err != nil {
+		err = fmt.Errorf("print line: %w", err)
+		return
+	}
+
+	return
+}
+
+// section wraps what body writes in a Gitlab job log section.
+//
+// See https://docs.gitlab.com/ee/ci/jobs/#custom-collapsible-sections
+func (t tracer) section(name, header string, collapsed bool, body func(w io.Writer) error) (err error) {
+	option := ""
+	if collapsed {
+		option = "[collapsed=true]"
+	}
+
+	_, err = fmt.Fprintf(t.logSink, "\x1b[0Ksection_start:%d:%s%s\r\x1b[0K%s\n", time.Now().Unix(), name, option, header)
+	if err != nil {
+		err = fmt.Errorf("starting section: %w", err)
+		return
+	}
+
+	err = body(t.logSink)
+	if err != nil {
+		return
+	}
+
+	_, err = fmt.Fprintf(t.logSink, "\x1b[0Ksection_end:%d:%s\r\x1b[0K\n", time.Now().Unix(), name)
+	if err != nil {
+		err = fmt.Errorf("ending section: %w", err)
+		return
+	}
+
+	return
+}
@@ -0,0 +1,666 @@
+package executor
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/nanmu42/tart/helper"
+	"github.com/nanmu42/tart/network"
+
+	"go.uber.org/zap"
+)
+
+// transferDir is where caches and artifacts are exchanged in the sources drive of offline microVMs,
+// relative to the root of the drive, which is the working directory.
+const transferDir = ".tart-transfer"
+
+// ArtifactClient moves artifacts of jobs between Gitlab and the runner.
+type ArtifactClient interface {
+	DownloadArtifacts(ctx context.Context, param network.DownloadArtifactsParam) error
+	UploadArtifacts(ctx context.Context, param network.UploadArtifactsParam) error
+}
+
+// Transferer is an executor carrying caches and artifacts of the job out of the environment.
+type Transferer interface {
+	// TransferOut saves caches and uploads artifacts the job declares,
+	// succeeded tells whether the job succeeded, which their when keyword depends on.
+	TransferOut(ctx context.Context, succeeded bool) error
+}
+
+// TransferOut saves caches and uploads artifacts of the job after it's run,
+// executors unable to do so are skipped.
+func TransferOut(ctx context.Context, logger *zap.Logger, exe Executor, build *Build, jobTrace io.Writer, succeeded bool) (err error) {
+	transferer, ok := exe.(Transferer)
+	if !ok {
+		return
+	}
+
+	err = transferer.TransferOut(ctx, succeeded)
+	if err != nil {
+		logger.Warn("transferring caches and artifacts", zap.Int("jobId", build.job.ID), zap.Error(err))
+		_ = tracer{logSink: jobTrace}.redLine("Transferring caches and artifacts failed: %s", err)
+		return
+	}
+
+	return
+}
+
+// whenMatches reports whether the when keyword of caches and artifacts holds.
+func whenMatches(when string, succeeded bool) bool {
+	switch when {
+	case "always":
+		return true
+	case "on_failure":
+		return !succeeded
+	default:
+		return succeeded
+	}
+}
+
+func cacheKey(cache network.Cache) string {
+	if cache.Key == "" {
+		return "default"
+	}
+
+	return cache.Key
+}
+
+// cachesToRestore are caches of the build to restore before the job.
+func (b *Build) cachesToRestore() (caches []network.Cache) {
+	for _, cache := range b.job.Cache {
+		if cache.Policy == "push" {
+			continue
+		}
+		caches = append(caches, cache)
+	}
+
+	return
+}
+
+// cachesToSave are caches of the build to save after the job.
+func (b *Build) cachesToSave(succeeded bool) (caches []network.Cache) {
+	for _, cache := range b.job.Cache {
+		if cache.Policy == "pull" || !whenMatches(cache.When, succeeded) {
+			continue
+		}
+		caches = append(caches, cache)
+	}
+
+	return
+}
+
+// artifactsToUpload are artifacts of the build to upload after the job,
+// reports are left out, which are not supported.
+func (b *Build) artifactsToUpload(succeeded bool) (artifacts []network.Artifact, reports int) {
+	for _, artifact := range b.job.Artifacts {
+		if !whenMatches(artifact.When, succeeded) {
+			continue
+		}
+		if artifact.Type != "" && artifact.Type != "archive" {
+			reports++
+			continue
+		}
+		artifacts = append(artifacts, artifact)
+	}
+
+	return
+}
+
+// archiveScript packs caches and artifacts in dir into tar archives in transferDir of dir,
+// named cache-<i>.tar and artifacts-<i>.tar after their order.
+// Paths are globs relative to dir, in which ** matches any number of directories.
+func (b *Build) archiveScript(w io.Writer, dir string, caches []network.Cache, artifacts []network.Artifact) (err error) {
+	var script strings.Builder
+	script.WriteString(`set -euo pipefail
+shopt -s globstar nullglob
+cd ` + helper.ShellEscape(dir) + `
+rm -rf ` + transferDir + `
+mkdir ` + transferDir + `
+# archive <output> <untracked> <path>..., excluding globs in excludes
+archive() {
+	local output=$1 untracked=$2
+	shift 2
+	# globs expand without word splitting
+	local IFS= files=() pattern file
+	for pattern in "$@"; do
+		for file in $pattern; do
+			if [[ -e $file || -L $file ]]; then
+				files+=("$file")
+			fi
+		done
+	done
+	if [[ $untracked == true ]]; then
+		while IFS= read -r -d '' file; do
+			files+=("$file")
+		done < <(git ls-files -o -z)
+	fi
+	if ((${#files[@]} == 0)); then
+		echo "WARNING: no matching files for $output"
+	fi
+	if ((${#files[@]} > 0)); then
+		printf '%s\0' "${files[@]}"
+	fi | tar -cf "$output" --exclude=` + transferDir + ` "${excludes[@]/#/--exclude=}" --null -T -
+}
+`)
+
+	writeArchive := func(output string, untracked bool, paths []string, excludes []string) {
+		script.WriteString("excludes=(")
+		for i, exclude := range excludes {
+			if i > 0 {
+				script.WriteString(" ")
+			}
+			script.WriteString(helper.ShellEscape(exclude))
+		}
+		script.WriteString(")\n")
+		fmt.Fprintf(&script, "archive %s %t", path.Join(transferDir, output), untracked)
+		for _, p := range paths {
+			script.WriteString(" " + helper.ShellEscape(p))
+		}
+		script.WriteString("\n")
+	}
+	for i, cache := range caches {
+		writeArchive(fmt.Sprintf("cache-%d.tar", i), cache.Untracked, cache.Paths, nil)
+	}
+	for i, artifact := range artifacts {
+		writeArchive(fmt.Sprintf("artifacts-%d.tar", i), artifact.Untracked, artifact.Paths, artifact.Exclude)
+	}
+
+	_, err = io.WriteString(w, script.String())
+	if err != nil {
+		err = fmt.Errorf("wrting to writer: %w", err)
+		return
+	}
+
+	return
+}
+
+// cachePath is where the cache of the project is kept on the host.
+func (e *MicroVM) cachePath(cache network.Cache) string {
+	sum := sha256.Sum256([]byte(cacheKey(cache)))
+	return filepath.Join(
+		e.config.OfflineCacheDir,
+		fmt.Sprintf("project-%d", e.build.job.JobInfo.ProjectID),
+		hex.EncodeToString(sum[:8])+".tar",
+	)
+}
+
+// transferIn puts caches and artifacts of dependencies into transferDir of sourcesDir on the host,
+// which are extracted in the microVM once the sources drive is mounted.
+func (e *MicroVM) transferIn(ctx context.Context, sourcesDir string) (err error) {
+	dir := filepath.Join(sourcesDir, transferDir)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		err = fmt.Errorf("creating transfer directory: %w", err)
+		return
+	}
+	// archives are extracted in the order they are added
+	nextFile := func() string {
+		return filepath.Join(dir, fmt.Sprintf("in-%d.tar", len(e.transferInFiles)))
+	}
+
+	caches := e.build.cachesToRestore()
+	if len(caches) > 0 && e.config.OfflineCacheDir == "" {
+		err = e.yellowLine("WARNING: caches are skipped, OfflineCacheDir is not set on this runner")
+		if err != nil {
+			return
+		}
+		caches = nil
+	}
+	for _, cache := range caches {
+		key := cacheKey(cache)
+		file := nextFile()
+		copyErr := copyFile(e.cachePath(cache), file)
+		if errors.Is(copyErr, fs.ErrNotExist) {
+			err = e.line("Cache %s is not found, it's created after the job", key)
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if copyErr != nil {
+			_ = os.Remove(file)
+			e.logger.Warn("restoring cache", zap.String("key", key), zap.Error(copyErr))
+			err = e.yellowLine("WARNING: restoring cache %s: %s", key, copyErr)
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		e.transferInFiles = append(e.transferInFiles, filepath.Base(file))
+		err = e.line("Cache %s is restored", key)
+		if err != nil {
+			return
+		}
+	}
+
+	for _, dependency := range e.build.job.Dependencies {
+		if dependency.ArtifactsFile.Filename == "" {
+			continue
+		}
+		if e.artifacts == nil {
+			err = errors.New("artifacts can not be downloaded without Gitlab client")
+			return
+		}
+
+		err = e.line("Downloading artifacts of %s(%d)...", dependency.Name, dependency.ID)
+		if err != nil {
+			return
+		}
+		file := nextFile()
+		err = e.downloadArtifacts(ctx, dependency, file)
+		if err != nil {
+			err = fmt.Errorf("downloading artifacts of %s(%d): %w", dependency.Name, dependency.ID, err)
+			return
+		}
+		e.transferInFiles = append(e.transferInFiles, filepath.Base(file))
+	}
+
+	return
+}
+
+// downloadArtifacts downloads artifacts of dependency into a tar archive at dest.
+func (e *MicroVM) downloadArtifacts(ctx context.Context, dependency network.Dependency, dest string) (err error) {
+	archive, err := os.CreateTemp("", "tart-artifacts-*.zip")
+	if err != nil {
+		err = fmt.Errorf("creating temp file: %w", err)
+		return
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+
+	err = e.artifacts.DownloadArtifacts(ctx, network.DownloadArtifactsParam{
+		JobToken: dependency.Token,
+		JobID:    dependency.ID,
+		Writer:   archive,
+	})
+	if err != nil {
+		return
+	}
+
+	err = zipToTar(archive.Name(), dest)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// extractScript extracts what transferIn puts into dir,
+// in which the sources drive is mounted.
+func (e *MicroVM) extractScript(dir string) string {
+	var script strings.Builder
+	script.WriteString("cd " + helper.ShellEscape(dir))
+	for _, name := range e.transferInFiles {
+		script.WriteString(" && tar -xf " + path.Join(transferDir, name))
+	}
+	script.WriteString(" && rm -rf " + transferDir)
+
+	return script.String()
+}
+
+// TransferOut packs caches and artifacts in the sources drive,
+// which is then frozen so that the host reads them out of it,
+// keeping caches on the host and uploading artifacts to Gitlab.
+// Only offline microVMs do so.
+func (e *MicroVM) TransferOut(ctx context.Context, succeeded bool) (err error) {
+	if !e.config.Offline || e.transport == nil {
+		return
+	}
+
+	var caches []network.Cache
+	if e.config.OfflineCacheDir != "" {
+		caches = e.build.cachesToSave(succeeded)
+	}
+	artifacts, reports := e.build.artifactsToUpload(succeeded)
+	if reports > 0 {
+		err = e.yellowLine("WARNING: %d artifacts reports are skipped, which are not supported", reports)
+		if err != nil {
+			return
+		}
+	}
+	if len(caches) == 0 && len(artifacts) == 0 {
+		return
+	}
+
+	err = e.blueLine("Archiving caches and artifacts...")
+	if err != nil {
+		return
+	}
+	workingDir := path.Join(agentHome, e.build.workingDir)
+	var script strings.Builder
+	err = e.build.archiveScript(&script, workingDir, caches, artifacts)
+	if err != nil {
+		err = fmt.Errorf("forging archive script: %w", err)
+		return
+	}
+	// the host reads the drive, which must be consistent
+	script.WriteString("sync\ncd /\nmount -o remount,ro " + helper.ShellEscape(workingDir) + "\n")
+	err = e.RunStep(ctx, StageArchive, script.String())
+	if err != nil {
+		err = fmt.Errorf("archiving caches and artifacts: %w", err)
+		return
+	}
+
+	for i, cache := range caches {
+		key := cacheKey(cache)
+		saveErr := e.saveCache(ctx, cache, fmt.Sprintf("cache-%d.tar", i))
+		if saveErr != nil {
+			// the job does not depend on caches
+			e.logger.Warn("saving cache", zap.String("key", key), zap.Error(saveErr))
+			err = e.yellowLine("WARNING: saving cache %s: %s", key, saveErr)
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		err = e.line("Cache %s is saved", key)
+		if err != nil {
+			return
+		}
+	}
+
+	for i, artifact := range artifacts {
+		err = e.uploadArtifacts(ctx, artifact, fmt.Sprintf("artifacts-%d.tar", i))
+		if err != nil {
+			err = fmt.Errorf("uploading artifacts: %w", err)
+			return
+		}
+	}
+
+	return
+}
+
+// saveCache keeps the archive of cache in the sources drive on the host.
+func (e *MicroVM) saveCache(ctx context.Context, cache network.Cache, name string) (err error) {
+	dest := e.cachePath(cache)
+	err = os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		err = fmt.Errorf("creating cache directory: %w", err)
+		return
+	}
+
+	// jobs restoring the cache meanwhile see either the old or the new one
+	temp := fmt.Sprintf("%s.%s", dest, e.vmID)
+	err = dumpFromExt4(ctx, e.sourcesImage, "/"+path.Join(transferDir, name), temp)
+	if err != nil {
+		return
+	}
+	err = os.Rename(temp, dest)
+	if err != nil {
+		_ = os.Remove(temp)
+		err = fmt.Errorf("renaming cache: %w", err)
+		return
+	}
+
+	return
+}
+
+// uploadArtifacts uploads the archive of artifact in the sources drive to Gitlab.
+func (e *MicroVM) uploadArtifacts(ctx context.Context, artifact network.Artifact, name string) (err error) {
+	if e.artifacts == nil {
+		err = errors.New("artifacts can not be uploaded without Gitlab client")
+		return
+	}
+
+	dir, err := os.MkdirTemp("", "tart-artifacts-*")
+	if err != nil {
+		err = fmt.Errorf("creating temp directory: %w", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	archive := filepath.Join(dir, name)
+	err = dumpFromExt4(ctx, e.sourcesImage, "/"+path.Join(transferDir, name), archive)
+	if err != nil {
+		return
+	}
+	zipPath := filepath.Join(dir, "artifacts.zip")
+	files, err := tarToZip(archive, zipPath)
+	if err != nil {
+		return
+	}
+
+	filename := artifact.Name
+	if filename == "" {
+		filename = "artifacts"
+	}
+	filename += ".zip"
+	if files == 0 {
+		err = e.yellowLine("WARNING: %s is not uploaded, which has no files", filename)
+		return
+	}
+
+	err = e.line("Uploading %s with %d files...", filename, files)
+	if err != nil {
+		return
+	}
+	zipFile, err := os.Open(zipPath)
+	if err != nil {
+		err = fmt.Errorf("opening zip archive: %w", err)
+		return
+	}
+	defer zipFile.Close()
+
+	err = e.artifacts.UploadArtifacts(ctx, network.UploadArtifactsParam{
+		JobToken: e.build.job.Token,
+		JobID:    e.build.job.ID,
+		Reader:   zipFile,
+		Filename: filename,
+		ExpireIn: artifact.ExpireIn,
+	})
+	if err != nil {
+		return
+	}
+
+	err = e.line("%s is uploaded", filename)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// dumpFromExt4 copies file src in the ext4 image to dest, without mounting the image.
+func dumpFromExt4(ctx context.Context, image string, src string, dest string) (err error) {
+	request := fmt.Sprintf("dump %q %q", src, dest)
+	output, err := exec.CommandContext(ctx, "debugfs", "-R", request, image).CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("running debugfs: %w, output: %s", err, output)
+		return
+	}
+	// debugfs exits zero on failed requests
+	_, err = os.Stat(dest)
+	if err != nil {
+		err = fmt.Errorf("dumping %s with debugfs, output: %s", src, output)
+		return
+	}
+
+	return
+}
+
+// tarToZip converts the tar archive at src into a zip archive at dest,
+// keeping directories, regular files and symlinks, files counts the latter two.
+func tarToZip(src string, dest string) (files int, err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		err = fmt.Errorf("opening tar archive: %w", err)
+		return
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		err = fmt.Errorf("creating zip archive: %w", err)
+		return
+	}
+	defer out.Close()
+
+	tr := tar.NewReader(in)
+	zw := zip.NewWriter(out)
+	for {
+		var header *tar.Header
+		header, err = tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			err = fmt.Errorf("reading tar archive: %w", err)
+			return
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir, tar.TypeReg, tar.TypeSymlink:
+		default:
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(header.Name, "./"), "/")
+		if name == "" || name == "." {
+			// the root
+			continue
+		}
+
+		var zipHeader *zip.FileHeader
+		zipHeader, err = zip.FileInfoHeader(header.FileInfo())
+		if err != nil {
+			err = fmt.Errorf("converting header of %s: %w", header.Name, err)
+			return
+		}
+		zipHeader.Name = name
+		if header.Typeflag == tar.TypeDir {
+			zipHeader.Name += "/"
+		} else {
+			zipHeader.Method = zip.Deflate
+			files++
+		}
+
+		var w io.Writer
+		w, err = zw.CreateHeader(zipHeader)
+		if err != nil {
+			err = fmt.Errorf("writing zip archive: %w", err)
+			return
+		}
+		switch header.Typeflag {
+		case tar.TypeSymlink:
+			_, err = io.WriteString(w, header.Linkname)
+		case tar.TypeReg:
+			_, err = io.Copy(w, tr)
+		}
+		if err != nil {
+			err = fmt.Errorf("writing %s into zip archive: %w", header.Name, err)
+			return
+		}
+	}
+
+	err = zw.Close()
+	if err != nil {
+		err = fmt.Errorf("closing zip archive: %w", err)
+		return
+	}
+	err = out.Close()
+	if err != nil {
+		err = fmt.Errorf("closing zip archive: %w", err)
+		return
+	}
+
+	return
+}
+
+// zipToTar converts the zip archive at src into a tar archive at dest,
+// keeping directories, regular files and symlinks.
+func zipToTar(src string, dest string) (err error) {
+	zr, err := zip.OpenReader(src)
+	if err != nil {
+		err = fmt.Errorf("opening zip archive: %w", err)
+		return
+	}
+	defer zr.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		err = fmt.Errorf("creating tar archive: %w", err)
+		return
+	}
+	defer out.Close()
+
+	tw := tar.NewWriter(out)
+	for _, f := range zr.File {
+		err = writeTarEntry(tw, f)
+		if err != nil {
+			err = fmt.Errorf("converting %s: %w", f.Name, err)
+			return
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		err = fmt.Errorf("closing tar archive: %w", err)
+		return
+	}
+	err = out.Close()
+	if err != nil {
+		err = fmt.Errorf("closing tar archive: %w", err)
+		return
+	}
+
+	return
+}
+
+// writeTarEntry writes f of a zip archive into tw.
+func writeTarEntry(tw *tar.Writer, f *zip.File) (err error) {
+	info := f.FileInfo()
+	mode := info.Mode()
+	if !mode.IsDir() && !mode.IsRegular() && mode&fs.ModeSymlink == 0 {
+		return
+	}
+
+	var content io.ReadCloser
+	if !mode.IsDir() {
+		content, err = f.Open()
+		if err != nil {
+			return
+		}
+		defer content.Close()
+	}
+
+	link := ""
+	if mode&fs.ModeSymlink != 0 {
+		var target []byte
+		target, err = io.ReadAll(content)
+		if err != nil {
+			return
+		}
+		link = string(target)
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return
+	}
+	header.Name = f.Name
+	err = tw.WriteHeader(header)
+	if err != nil {
+		return
+	}
+	if mode.IsRegular() {
+		_, err = io.Copy(tw, content)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
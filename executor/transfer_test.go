@@ -0,0 +1,316 @@
+package executor
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/nanmu42/tart/network"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// fakeArtifactClient serves a zip archive with files as artifacts of every job,
+// and keeps what's uploaded.
+type fakeArtifactClient struct {
+	files    map[string]string
+	uploaded map[string][]byte
+}
+
+func (c *fakeArtifactClient) DownloadArtifacts(_ context.Context, param network.DownloadArtifactsParam) (err error) {
+	zw := zip.NewWriter(param.Writer)
+	for name, content := range c.files {
+		var w io.Writer
+		w, err = zw.Create(name)
+		if err != nil {
+			return
+		}
+		_, err = io.WriteString(w, content)
+		if err != nil {
+			return
+		}
+	}
+
+	err = zw.Close()
+	return
+}
+
+func (c *fakeArtifactClient) UploadArtifacts(_ context.Context, param network.UploadArtifactsParam) (err error) {
+	if c.uploaded == nil {
+		c.uploaded = make(map[string][]byte)
+	}
+	c.uploaded[param.Filename], err = io.ReadAll(param.Reader)
+	return
+}
+
+// tarFiles lists regular files in the tar archive at path, with their content.
+func tarFiles(t *testing.T, path string) map[string]string {
+	t.Helper()
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	files := make(map[string]string)
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		content, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		files[header.Name] = string(content)
+	}
+
+	return files
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+}
+
+func TestBuild_ArchiveScript(t *testing.T) {
+	repo := gitRepo(t)
+	writeFiles(t, repo, map[string]string{
+		"build/a.bin":     "a",
+		"build/sub/b.bin": "b",
+		"build/c.txt":     "c",
+		".cache/d":        "d",
+	})
+
+	build, err := NewBuild(BuildOpt{WorkingDir: "ci-repo"})
+	require.NoError(t, err)
+	var script bytes.Buffer
+	err = build.archiveScript(&script, repo,
+		[]network.Cache{{Key: "deps", Untracked: true}},
+		[]network.Artifact{
+			{Paths: []string{"build/**/*.bin", "missing/", "it's"}, Exclude: []string{"build/sub/*"}},
+			{Paths: []string{"missing/"}},
+		},
+	)
+	require.NoError(t, err)
+
+	output, err := exec.Command("bash", "-c", script.String()).CombinedOutput()
+	require.NoError(t, err, string(output))
+	assert.Contains(t, string(output), "no matching files for .tart-transfer/artifacts-1.tar")
+
+	assert.Equal(t, map[string]string{
+		"build/a.bin":     "a",
+		"build/sub/b.bin": "b",
+		"build/c.txt":     "c",
+		".cache/d":        "d",
+	}, tarFiles(t, filepath.Join(repo, transferDir, "cache-0.tar")))
+	assert.Equal(t, map[string]string{
+		"build/a.bin": "a",
+	}, tarFiles(t, filepath.Join(repo, transferDir, "artifacts-0.tar")))
+	assert.Empty(t, tarFiles(t, filepath.Join(repo, transferDir, "artifacts-1.tar")))
+}
+
+func TestBuild_TransferredOnWhen(t *testing.T) {
+	build, err := NewBuild(BuildOpt{
+		Job: network.RequestJobResp{
+			Cache: []network.Cache{
+				{Key: "default"},
+				{Key: "pull", Policy: "pull"},
+				{Key: "push", Policy: "push"},
+				{Key: "always", When: "always"},
+			},
+			Artifacts: []network.Artifact{
+				{Name: "default"},
+				{Name: "failure", When: "on_failure"},
+				{Name: "junit", Type: "junit", When: "always"},
+			},
+		},
+		WorkingDir: "ci-repo",
+	})
+	require.NoError(t, err)
+
+	keys := func(caches []network.Cache) (keys []string) {
+		for _, cache := range caches {
+			keys = append(keys, cache.Key)
+		}
+		return
+	}
+	assert.Equal(t, []string{"default", "pull", "always"}, keys(build.cachesToRestore()))
+	assert.Equal(t, []string{"default", "push", "always"}, keys(build.cachesToSave(true)))
+	assert.Equal(t, []string{"always"}, keys(build.cachesToSave(false)))
+
+	artifacts, reports := build.artifactsToUpload(true)
+	require.Len(t, artifacts, 1)
+	assert.Equal(t, "default", artifacts[0].Name)
+	assert.Equal(t, 1, reports)
+	artifacts, _ = build.artifactsToUpload(false)
+	require.Len(t, artifacts, 1)
+	assert.Equal(t, "failure", artifacts[0].Name)
+}
+
+func TestTarZipRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	writeFiles(t, src, map[string]string{
+		"a.txt":     "a",
+		"sub/b.txt": "b",
+	})
+	require.NoError(t, os.Symlink("a.txt", filepath.Join(src, "link")))
+
+	tarPath := filepath.Join(dir, "in.tar")
+	output, err := exec.Command("tar", "-cf", tarPath, "-C", src, ".").CombinedOutput()
+	require.NoError(t, err, string(output))
+
+	zipPath := filepath.Join(dir, "out.zip")
+	files, err := tarToZip(tarPath, zipPath)
+	require.NoError(t, err)
+	assert.Equal(t, 3, files)
+
+	zr, err := zip.OpenReader(zipPath)
+	require.NoError(t, err)
+	defer zr.Close()
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"a.txt", "link", "sub/", "sub/b.txt"}, names)
+
+	backPath := filepath.Join(dir, "back.tar")
+	require.NoError(t, zipToTar(zipPath, backPath))
+	assert.Equal(t, map[string]string{
+		"a.txt":     "a",
+		"sub/b.txt": "b",
+	}, tarFiles(t, backPath))
+
+	back, err := os.Open(backPath)
+	require.NoError(t, err)
+	defer back.Close()
+	tr := tar.NewReader(back)
+	for {
+		header, err := tr.Next()
+		require.NoError(t, err)
+		if header.Name == "link" {
+			assert.Equal(t, byte(tar.TypeSymlink), header.Typeflag)
+			assert.Equal(t, "a.txt", header.Linkname)
+			break
+		}
+	}
+}
+
+func TestMicroVM_TransferIn(t *testing.T) {
+	build, err := NewBuild(BuildOpt{
+		Job: network.RequestJobResp{
+			JobInfo: network.JobInfo{ProjectID: 7},
+			Cache: []network.Cache{
+				{Key: "deps"},
+				{Key: "missing"},
+				{Key: "pushed", Policy: "push"},
+			},
+			Dependencies: []network.Dependency{
+				{ID: 1, Name: "compile", ArtifactsFile: network.ArtifactsFile{Filename: "artifacts.zip"}},
+				{ID: 2, Name: "lint"},
+			},
+		},
+		WorkingDir: "ci-repo",
+	})
+	require.NoError(t, err)
+
+	var trace bytes.Buffer
+	e := &MicroVM{
+		logger:    zap.NewNop(),
+		build:     build,
+		config:    Config{OfflineCacheDir: t.TempDir()},
+		tracer:    tracer{logSink: &trace},
+		artifacts: &fakeArtifactClient{files: map[string]string{"bin/app": "app"}},
+	}
+
+	cacheDir := filepath.Join(t.TempDir(), "cache")
+	writeFiles(t, cacheDir, map[string]string{"deps/lib": "lib"})
+	cache := e.cachePath(network.Cache{Key: "deps"})
+	require.NoError(t, os.MkdirAll(filepath.Dir(cache), 0755))
+	output, err := exec.Command("tar", "-cf", cache, "-C", cacheDir, "deps").CombinedOutput()
+	require.NoError(t, err, string(output))
+
+	sources := t.TempDir()
+	require.NoError(t, e.transferIn(context.Background(), sources))
+	// caches go before artifacts, which win on conflicts
+	assert.Equal(t, []string{"in-0.tar", "in-1.tar"}, e.transferInFiles)
+	assert.Equal(t, map[string]string{"deps/lib": "lib"}, tarFiles(t, filepath.Join(sources, transferDir, "in-0.tar")))
+	assert.Equal(t, map[string]string{"bin/app": "app"}, tarFiles(t, filepath.Join(sources, transferDir, "in-1.tar")))
+	assert.Contains(t, trace.String(), "Cache missing is not found")
+
+	// extracted in the microVM
+	script := e.extractScript(sources)
+	output, err = exec.Command("bash", "-c", script).CombinedOutput()
+	require.NoError(t, err, string(output))
+	assert.FileExists(t, filepath.Join(sources, "deps", "lib"))
+	assert.FileExists(t, filepath.Join(sources, "bin", "app"))
+	assert.NoDirExists(t, filepath.Join(sources, transferDir))
+}
+
+func TestMicroVM_TransferOutOfDrive(t *testing.T) {
+	for _, name := range []string{"mkfs.ext4", "debugfs"} {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("%s is not available", name)
+		}
+	}
+
+	dir := t.TempDir()
+	sources := filepath.Join(dir, "sources")
+	writeFiles(t, sources, map[string]string{"dist/app": "app"})
+	require.NoError(t, os.MkdirAll(filepath.Join(sources, transferDir), 0755))
+	for _, name := range []string{"cache-0.tar", "artifacts-0.tar"} {
+		output, err := exec.Command("tar", "-cf", filepath.Join(sources, transferDir, name), "-C", sources, "dist").CombinedOutput()
+		require.NoError(t, err, string(output))
+	}
+	image := filepath.Join(dir, "sources.ext4")
+	require.NoError(t, mkfsExt4(context.Background(), image, 64<<20, "sources", sources, true))
+
+	build, err := NewBuild(BuildOpt{
+		Job:        network.RequestJobResp{ID: 42, JobInfo: network.JobInfo{ProjectID: 7}},
+		WorkingDir: "ci-repo",
+	})
+	require.NoError(t, err)
+	client := &fakeArtifactClient{}
+	var trace bytes.Buffer
+	e := &MicroVM{
+		logger:       zap.NewNop(),
+		build:        build,
+		config:       Config{OfflineCacheDir: t.TempDir()},
+		tracer:       tracer{logSink: &trace},
+		vmID:         "tart-42",
+		sourcesImage: image,
+		artifacts:    client,
+	}
+
+	cache := network.Cache{Key: "dist"}
+	require.NoError(t, e.saveCache(context.Background(), cache, "cache-0.tar"))
+	assert.Equal(t, map[string]string{"dist/app": "app"}, tarFiles(t, e.cachePath(cache)))
+
+	require.NoError(t, e.uploadArtifacts(context.Background(), network.Artifact{Name: "dist"}, "artifacts-0.tar"))
+	require.Contains(t, client.uploaded, "dist.zip")
+	zr, err := zip.NewReader(bytes.NewReader(client.uploaded["dist.zip"]), int64(len(client.uploaded["dist.zip"])))
+	require.NoError(t, err)
+	require.Len(t, zr.File, 2)
+	assert.Equal(t, "dist/app", zr.File[1].Name)
+
+	err = e.saveCache(context.Background(), cache, "missing.tar")
+	assert.ErrorContains(t, err, "debugfs")
+}
@@ -0,0 +1,319 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nanmu42/tart/agent"
+	"github.com/nanmu42/tart/helper"
+
+	"go.uber.org/zap"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// TransportSSH talks to sshd in the microVM over network.
+	TransportSSH = "ssh"
+	// TransportAgent talks to tart agent in the microVM over vsock.
+	TransportAgent = "agent"
+
+	// context ID of the microVM on vsock
+	guestCID = 3
+	// vsock device socket relative to chroot under jailer
+	agentVsockName = "vsock.socket"
+	// the agent runs as root, scripts run here as they do in SSH sessions
+	agentHome = "/root"
+)
+
+// scriptShell runs stage scripts from files,
+// skipping profiles so that scripts behave the same everywhere.
+var scriptShell = []string{"bash", "--noprofile", "--norc", "-eo", "pipefail"}
+
+// scriptCommand returns the command line running script file at path.
+func scriptCommand(path string) []string {
+	return append(scriptShell[:len(scriptShell):len(scriptShell)], path)
+}
+
+// LoginShell returns the command line running a login shell in dir, for humans.
+func LoginShell(dir string) string {
+	return fmt.Sprintf(`cd %s 2>/dev/null; exec "${SHELL:-bash}" -l`, helper.ShellEscape(dir))
+}
+
+// scriptName names the script file of stage, which is unique in the job.
+func scriptName(stage Stage) string {
+	return fmt.Sprintf("tart-%s-%d.sh", stage, time.Now().UnixNano())
+}
+
+// errExitMissing is returned when the script ends without reporting its exit status.
+var errExitMissing = errors.New("script exited without exit status")
+
+// ExitError reports a script exited with non-zero code.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("script exited with code %d", e.Code)
+}
+
+// transport runs scripts in the microVM.
+type transport interface {
+	// run writes script of stage into a file and runs it with bash,
+	// returns *ExitError if the script exits non-zero.
+	run(ctx context.Context, stage Stage, script string, stdout, stderr io.Writer) error
+	// upload writes content to path, a relative path is relative to home directory.
+	upload(ctx context.Context, path string, mode uint32, content io.Reader) error
+	// download reads the file at path into w, a relative path is relative to home directory.
+	download(ctx context.Context, path string, w io.Writer) error
+	Close() error
+}
+
+type sshTransport struct {
+	client *ssh.Client
+	// optional, serves as working and home directory of scripts
+	dir string
+}
+
+// command makes cmd run in dir.
+func (s *sshTransport) command(cmd string) string {
+	if s.dir == "" {
+		return cmd
+	}
+
+	return fmt.Sprintf("cd %s && %s", helper.ShellEscape(s.dir), cmd)
+}
+
+// run sends script through stdin of the session into a file only the user can read,
+// runs it, then removes it.
+func (s *sshTransport) run(ctx context.Context, stage Stage, script string, stdout, stderr io.Writer) (err error) {
+	session, err := s.client.NewSession()
+	if err != nil {
+		err = fmt.Errorf("init ssh session: %w", err)
+		return
+	}
+	defer session.Close()
+
+	session.Stdin = strings.NewReader(script)
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	dir := s.dir
+	if dir == "" {
+		dir = "/tmp"
+	}
+	scriptPath := helper.ShellEscape(path.Join(dir, "."+scriptName(stage)))
+	cmd := fmt.Sprintf("(umask 077 && cat > %[1]s) && %[2]s %[1]s; code=$?; rm -f %[1]s; exit $code",
+		scriptPath, strings.Join(scriptShell, " "))
+	if s.dir != "" {
+		cmd = s.command(fmt.Sprintf("export HOME=%s && %s", helper.ShellEscape(s.dir), cmd))
+	}
+	err = session.Start(cmd)
+	if err != nil {
+		err = fmt.Errorf("sending script over SSH: %w", err)
+		return
+	}
+
+	exited := make(chan struct{})
+	defer close(exited)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// not every SSH server supports signals, closing the session helps then
+			_ = session.Signal(ssh.SIGKILL)
+			_ = session.Close()
+		case <-exited:
+		}
+	}()
+
+	err = session.Wait()
+	switch typed := err.(type) {
+	case *ssh.ExitError:
+		err = &ExitError{Code: typed.ExitStatus()}
+	case *ssh.ExitMissingError:
+		err = errExitMissing
+	}
+
+	return
+}
+
+func (s *sshTransport) upload(ctx context.Context, path string, mode uint32, content io.Reader) (err error) {
+	session, err := s.client.NewSession()
+	if err != nil {
+		err = fmt.Errorf("init ssh session: %w", err)
+		return
+	}
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	session.Stdin = content
+	session.Stderr = &stderr
+
+	if mode == 0 {
+		mode = 0644
+	}
+	quoted := helper.ShellEscape(path)
+	err = session.Run(s.command(fmt.Sprintf("mkdir -p \"$(dirname %s)\" && cat > %s && chmod %o %s", quoted, quoted, mode, quoted)))
+	if err != nil {
+		err = fmt.Errorf("uploading %s over SSH: %w, stderr: %s", path, err, stderr.String())
+		return
+	}
+
+	return
+}
+
+func (s *sshTransport) download(ctx context.Context, path string, w io.Writer) (err error) {
+	session, err := s.client.NewSession()
+	if err != nil {
+		err = fmt.Errorf("init ssh session: %w", err)
+		return
+	}
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	session.Stdout = w
+	session.Stderr = &stderr
+
+	err = session.Run(s.command("cat " + helper.ShellEscape(path)))
+	if err != nil {
+		err = fmt.Errorf("downloading %s over SSH: %w, stderr: %s", path, err, stderr.String())
+		return
+	}
+
+	return
+}
+
+func (s *sshTransport) Close() error {
+	return s.client.Close()
+}
+
+type agentTransport struct {
+	client *agent.Client
+}
+
+// run puts script into a file, runs it, then removes it.
+func (a *agentTransport) run(ctx context.Context, stage Stage, script string, stdout, stderr io.Writer) (err error) {
+	scriptPath := path.Join("/tmp", scriptName(stage))
+	err = a.client.PutFile(ctx, scriptPath, 0600, strings.NewReader(script))
+	if err != nil {
+		err = fmt.Errorf("putting script with agent: %w", err)
+		return
+	}
+	defer func() {
+		if ctx.Err() != nil {
+			// the microVM is going away
+			return
+		}
+		_, _ = a.client.Exec(ctx, agent.Command{Args: []string{"rm", "-f", scriptPath}})
+	}()
+
+	code, err := a.client.Exec(ctx, agent.Command{
+		Args:   scriptCommand(scriptPath),
+		Dir:    agentHome,
+		Stdout: stdout,
+		Stderr: stderr,
+	})
+	if err != nil {
+		err = fmt.Errorf("running script with agent: %w", err)
+		return
+	}
+	if code != 0 {
+		err = &ExitError{Code: code}
+		return
+	}
+
+	return
+}
+
+func (a *agentTransport) upload(ctx context.Context, path string, mode uint32, content io.Reader) (err error) {
+	err = a.client.PutFile(ctx, agentPath(path), mode, content)
+	if err != nil {
+		err = fmt.Errorf("uploading %s with agent: %w", path, err)
+		return
+	}
+
+	return
+}
+
+func (a *agentTransport) download(ctx context.Context, path string, w io.Writer) (err error) {
+	err = a.client.GetFile(ctx, agentPath(path), w)
+	if err != nil {
+		err = fmt.Errorf("downloading %s with agent: %w", path, err)
+		return
+	}
+
+	return
+}
+
+func agentPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+
+	return filepath.Join(agentHome, path)
+}
+
+func (a *agentTransport) Close() error {
+	return nil
+}
+
+// agentReadyPath is where Firecracker forwards connections
+// from the guest to the host on the ready port.
+func agentReadyPath(vsockPath string) string {
+	return fmt.Sprintf("%s_%d", vsockPath, agent.DefaultReadyPort)
+}
+
+func (e *MicroVM) listenAgentReady() (l net.Listener, err error) {
+	path := agentReadyPath(e.vsockPath)
+	_ = os.Remove(path)
+	l, err = net.Listen("unix", path)
+	if err != nil {
+		err = fmt.Errorf("listening for agent readiness: %w", err)
+		return
+	}
+
+	if e.config.Jailer.Enabled {
+		// Firecracker connects to it as the jailed user
+		err = os.Chown(path, e.config.Jailer.UID, e.config.Jailer.GID)
+		if err != nil {
+			_ = l.Close()
+			err = fmt.Errorf("chown agent readiness socket: %w", err)
+			return
+		}
+	}
+
+	return
+}
+
+// connectAgent waits for the agent to signal readiness, then checks it with a ping.
+func (e *MicroVM) connectAgent(ctx context.Context, readyListener net.Listener) (t transport, err error) {
+	err = agent.WaitReady(ctx, readyListener)
+	if err != nil {
+		err = fmt.Errorf("waiting for agent to be ready: %w", err)
+		return
+	}
+	e.logger.Debug("agent is ready")
+
+	client, err := agent.NewClient(agent.FirecrackerDialer(e.vsockPath, agent.DefaultPort))
+	if err != nil {
+		return
+	}
+	err = client.Ping(ctx)
+	if err != nil {
+		e.logger.Debug("pinging agent", zap.Error(err))
+		err = fmt.Errorf("pinging agent: %w", err)
+		return
+	}
+
+	t = &agentTransport{client: client}
+	return
+}
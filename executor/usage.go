@@ -0,0 +1,302 @@
+package executor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nanmu42/tart/helper"
+	"github.com/nanmu42/tart/metrics"
+
+	"go.uber.org/zap"
+)
+
+// Phases of a job in the microVM.
+const (
+	PhaseBoot       = "boot"
+	PhaseServices   = "services"
+	PhaseGetSources = "get_sources"
+	PhaseStepScript = "step_script"
+
+	// how long collecting usage in the guest may take
+	usageTimeout = 10 * time.Second
+	// where the guest keeps peak memory usage in KiB
+	memoryPeakPath = "/run/tart-memory-peak"
+)
+
+// PhaseTime is wall time of a phase of the job.
+type PhaseTime struct {
+	Name     string
+	Duration time.Duration
+}
+
+// Usage is resources a job used.
+type Usage struct {
+	Phases []PhaseTime
+	// CPU time of the guest, on all vCPUs
+	CPUTime time.Duration
+	// peak memory usage of the guest in bytes, zero if unknown
+	PeakMemory int64
+	// memory size of the guest in bytes
+	MemorySize int64
+	// bytes written to drives
+	DiskWritten int64
+	// bytes received and transmitted over network
+	NetworkIn  int64
+	NetworkOut int64
+}
+
+// UsageReporter is an executor measuring resources jobs use.
+type UsageReporter interface {
+	// Usage returns resources used so far, which is called before Close.
+	Usage(ctx context.Context) (Usage, error)
+}
+
+var (
+	jobPhaseSeconds = metrics.Default.NewCounterVec(
+		"tart_job_phase_seconds_total",
+		"Wall time of phases of jobs in microVMs.",
+		"project", "phase",
+	)
+	jobCPUSeconds = metrics.Default.NewCounterVec(
+		"tart_job_cpu_seconds_total",
+		"CPU time of microVMs of jobs.",
+		"project",
+	)
+	jobPeakMemoryBytes = metrics.Default.NewHistogramVec(
+		"tart_job_peak_memory_bytes",
+		"Peak memory usage of microVMs of jobs.",
+		metrics.ExponentialBuckets(64<<20, 2, 8),
+		"project",
+	)
+	jobDiskWrittenBytes = metrics.Default.NewCounterVec(
+		"tart_job_disk_written_bytes_total",
+		"Bytes written to drives by microVMs of jobs.",
+		"project",
+	)
+	jobNetworkBytes = metrics.Default.NewCounterVec(
+		"tart_job_network_bytes_total",
+		"Bytes microVMs of jobs received(in) and transmitted(out) over network.",
+		"project", "direction",
+	)
+)
+
+// ReportUsage writes resources the job used into the job log and the runner log,
+// and records them in metrics. Executors not measuring usage are skipped.
+func ReportUsage(ctx context.Context, logger *zap.Logger, exe Executor, build *Build, jobTrace io.Writer) {
+	reporter, ok := exe.(UsageReporter)
+	if !ok {
+		return
+	}
+
+	usage, err := reporter.Usage(ctx)
+	if err != nil {
+		logger.Warn("collecting resource usage", zap.Int("jobId", build.job.ID), zap.Error(err))
+		return
+	}
+
+	project := build.project()
+	fields := []zap.Field{
+		zap.Int("jobId", build.job.ID),
+		zap.String("project", project),
+		zap.Duration("cpuTime", usage.CPUTime),
+		zap.Int64("peakMemory", usage.PeakMemory),
+		zap.Int64("diskWritten", usage.DiskWritten),
+		zap.Int64("networkIn", usage.NetworkIn),
+		zap.Int64("networkOut", usage.NetworkOut),
+	}
+	for _, phase := range usage.Phases {
+		fields = append(fields, zap.Duration(phase.Name, phase.Duration))
+		jobPhaseSeconds.Add(phase.Duration.Seconds(), project, phase.Name)
+	}
+	logger.Info("job resource usage", fields...)
+
+	jobCPUSeconds.Add(usage.CPUTime.Seconds(), project)
+	if usage.PeakMemory > 0 {
+		jobPeakMemoryBytes.Observe(float64(usage.PeakMemory), project)
+	}
+	jobDiskWrittenBytes.Add(float64(usage.DiskWritten), project)
+	jobNetworkBytes.Add(float64(usage.NetworkIn), project, "in")
+	jobNetworkBytes.Add(float64(usage.NetworkOut), project, "out")
+
+	err = tracer{logSink: jobTrace}.section("resource_usage", "Resource usage", false, func(w io.Writer) error {
+		return usage.write(w)
+	})
+	if err != nil {
+		logger.Debug("writing resource usage", zap.Error(err))
+	}
+}
+
+func (u Usage) write(w io.Writer) (err error) {
+	var phases []string
+	for _, phase := range u.Phases {
+		phases = append(phases, fmt.Sprintf("%s %s", phase.Name, phase.Duration.Round(100*time.Millisecond)))
+	}
+	peakMemory := "unknown"
+	if u.PeakMemory > 0 {
+		peakMemory = helper.HumanSize(u.PeakMemory)
+	}
+
+	_, err = fmt.Fprintf(w, "Wall time:      %s\nCPU time:       %s\nPeak memory:    %s of %s\nDisk written:   %s\nNetwork in/out: %s / %s\n",
+		strings.Join(phases, ", "),
+		u.CPUTime.Round(10*time.Millisecond),
+		peakMemory, helper.HumanSize(u.MemorySize),
+		helper.HumanSize(u.DiskWritten),
+		helper.HumanSize(u.NetworkIn), helper.HumanSize(u.NetworkOut),
+	)
+	return
+}
+
+// project names the project of the job in metrics.
+func (b *Build) project() string {
+	if path := b.variable("CI_PROJECT_PATH"); path != "" {
+		return path
+	}
+
+	return strconv.Itoa(b.job.JobInfo.ProjectID)
+}
+
+// memorySamplerScript keeps the peak of used memory in KiB,
+// detaching from the session so that it outlives the script.
+const memorySamplerScript = `setsid sh -c 'peak=0; while :; do
+	used=$(awk "/^MemTotal:/ {t = \$2} /^MemAvailable:/ {a = \$2} END {print t - a}" /proc/meminfo)
+	if [ "$used" -gt "$peak" ]; then peak=$used; echo "$peak" > ` + memoryPeakPath + `; fi
+	sleep 1
+done' </dev/null >/dev/null 2>&1 &
+`
+
+// guestUsageScript prints CPU time in clock ticks, peak memory in KiB,
+// bytes written to drives, and bytes received and transmitted over network.
+const guestUsageScript = `echo "clk_tck $(getconf CLK_TCK)"
+awk '$1 == "cpu" {printf "cpu %.0f\n", $2 + $3 + $4 + $7 + $8}' /proc/stat
+echo "memory_peak $(cat ` + memoryPeakPath + ` 2>/dev/null || echo 0)"
+awk '$3 ~ /^vd[a-z]+$/ {sum += $10 * 512} END {printf "disk_written %.0f\n", sum}' /proc/diskstats
+awk -F'[: ]+' 'NR > 2 && $2 != "lo" {rx += $3; tx += $11} END {printf "network %.0f %.0f\n", rx, tx}' /proc/net/dev
+`
+
+// guestCounters is what the guest usage script reports.
+type guestCounters struct {
+	cpuTime     time.Duration
+	peakMemory  int64
+	diskWritten int64
+	networkIn   int64
+	networkOut  int64
+}
+
+func parseGuestUsage(output []byte) (counters guestCounters, err error) {
+	var clkTck, cpuTicks int64
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		values := make([]int64, len(fields)-1)
+		for i, field := range fields[1:] {
+			values[i], err = strconv.ParseInt(field, 10, 64)
+			if err != nil {
+				err = fmt.Errorf("parsing %q: %w", scanner.Text(), err)
+				return
+			}
+		}
+
+		switch fields[0] {
+		case "clk_tck":
+			clkTck = values[0]
+		case "cpu":
+			cpuTicks = values[0]
+		case "memory_peak":
+			counters.peakMemory = values[0] << 10
+		case "disk_written":
+			counters.diskWritten = values[0]
+		case "network":
+			if len(values) == 2 {
+				counters.networkIn, counters.networkOut = values[0], values[1]
+			}
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return
+	}
+
+	if clkTck > 0 {
+		counters.cpuTime = time.Duration(cpuTicks) * time.Second / time.Duration(clkTck)
+	}
+
+	return
+}
+
+// trackPhase adds wall time since start to the phase.
+func (e *MicroVM) trackPhase(name string, start time.Time) {
+	elapsed := time.Since(start)
+	for i := range e.phases {
+		if e.phases[i].Name == name {
+			e.phases[i].Duration += elapsed
+			return
+		}
+	}
+
+	e.phases = append(e.phases, PhaseTime{Name: name, Duration: elapsed})
+}
+
+// startMemorySampler starts tracking peak memory in the guest,
+// jobs go on without peak memory if it fails.
+func (e *MicroVM) startMemorySampler(ctx context.Context) {
+	err := e.transport.run(ctx, StageGetSources, memorySamplerScript, io.Discard, io.Discard)
+	if err != nil {
+		e.logger.Debug("starting memory sampler in guest", zap.Error(err))
+	}
+}
+
+// Usage collects usage from the guest and the hypervisor,
+// the hypervisor tells drive and network I/O if it reports metrics.
+// What can not be collected is left zero.
+func (e *MicroVM) Usage(ctx context.Context) (usage Usage, err error) {
+	usage = Usage{
+		Phases:     e.phases,
+		MemorySize: vmMemSizeMiB << 20,
+	}
+
+	if e.transport != nil {
+		usageCtx, cancel := context.WithTimeout(ctx, usageTimeout)
+		var output bytes.Buffer
+		runErr := e.transport.run(usageCtx, StageStepScript, guestUsageScript, &output, io.Discard)
+		cancel()
+		var counters guestCounters
+		if runErr == nil {
+			counters, runErr = parseGuestUsage(output.Bytes())
+		}
+		if runErr != nil {
+			e.logger.Debug("collecting usage in guest", zap.Error(runErr))
+		}
+
+		usage.CPUTime = counters.cpuTime
+		usage.PeakMemory = counters.peakMemory
+		usage.DiskWritten = counters.diskWritten
+		usage.NetworkIn = counters.networkIn
+		usage.NetworkOut = counters.networkOut
+	}
+
+	if e.hypervisor == nil {
+		return
+	}
+	vm, metricsErr := e.hypervisor.metrics(ctx)
+	if metricsErr != nil {
+		e.logger.Debug("reading metrics of microVM", zap.Error(metricsErr))
+		return
+	}
+	if vm.reported {
+		usage.DiskWritten = int64(vm.diskWritten)
+		usage.NetworkIn = int64(vm.networkIn)
+		usage.NetworkOut = int64(vm.networkOut)
+	}
+
+	return
+}
@@ -0,0 +1,79 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nanmu42/tart/metrics"
+	"github.com/nanmu42/tart/network"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestParseGuestUsage(t *testing.T) {
+	counters, err := parseGuestUsage([]byte("clk_tck 100\ncpu 12345\nmemory_peak 524288\ndisk_written 1073741824\nnetwork 2048 1024\n"))
+	require.NoError(t, err)
+	assert.Equal(t, guestCounters{
+		cpuTime:     123450 * time.Millisecond,
+		peakMemory:  512 << 20,
+		diskWritten: 1 << 30,
+		networkIn:   2048,
+		networkOut:  1024,
+	}, counters)
+
+	_, err = parseGuestUsage([]byte("cpu 1.2e+09\n"))
+	assert.Error(t, err)
+}
+
+// usageExecutor is an executor reporting fixed usage.
+type usageExecutor struct {
+	Executor
+	usage Usage
+}
+
+func (e usageExecutor) Usage(_ context.Context) (Usage, error) {
+	return e.usage, nil
+}
+
+func TestReportUsage(t *testing.T) {
+	build, err := NewBuild(BuildOpt{
+		Job: network.RequestJobResp{
+			ID:        42,
+			Variables: []network.JobVariable{{Key: "CI_PROJECT_PATH", Value: "group/usage-test"}},
+		},
+		WorkingDir: "ci-repo",
+	})
+	require.NoError(t, err)
+
+	var trace bytes.Buffer
+	ReportUsage(context.Background(), zap.NewNop(), usageExecutor{usage: Usage{
+		Phases:      []PhaseTime{{PhaseBoot, 3 * time.Second}, {PhaseStepScript, 90 * time.Second}},
+		CPUTime:     75 * time.Second,
+		PeakMemory:  700 << 20,
+		MemorySize:  1 << 30,
+		DiskWritten: 3 << 29,
+		NetworkIn:   10 << 20,
+		NetworkOut:  1 << 10,
+	}}, build, &trace)
+
+	assert.Contains(t, trace.String(), "Wall time:      boot 3s, step_script 1m30s\n")
+	assert.Contains(t, trace.String(), "Peak memory:    700.0MiB of 1.0GiB\n")
+	assert.Contains(t, trace.String(), "Disk written:   1.5GiB\n")
+	assert.Contains(t, trace.String(), "Network in/out: 10.0MiB / 1.0KiB\n")
+
+	var exposed bytes.Buffer
+	require.NoError(t, metrics.Default.Write(&exposed))
+	assert.Contains(t, exposed.String(), `tart_job_phase_seconds_total{project="group/usage-test",phase="step_script"} 90`)
+	assert.Contains(t, exposed.String(), `tart_job_cpu_seconds_total{project="group/usage-test"} 75`)
+	assert.Contains(t, exposed.String(), `tart_job_network_bytes_total{project="group/usage-test",direction="in"} 1.048576e+07`)
+	assert.Contains(t, exposed.String(), `tart_job_peak_memory_bytes_bucket{project="group/usage-test",le="1.073741824e+09"} 1`)
+
+	// executors not measuring usage are skipped
+	trace.Reset()
+	ReportUsage(context.Background(), zap.NewNop(), &Shell{}, build, &trace)
+	assert.Empty(t, trace.String())
+}
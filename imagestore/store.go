@@ -0,0 +1,511 @@
+// Package imagestore keeps kernels and RootFS images of microVMs by SHA-256 digest,
+// and names pairs of them with tags.
+package imagestore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultDir is where the store lives if not configured.
+const DefaultDir = "/var/lib/tart/images"
+
+// ErrNotFound is returned for unknown tags.
+var ErrNotFound = errors.New("image not found")
+
+var tagPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:-]{0,127}$`)
+
+// Store is a directory like:
+//
+//	blobs/sha256/<hex>	kernels and RootFS images, read-only
+//	tags.json		tags and the blobs they point to
+//	lock			serializes writers
+type Store struct {
+	dir string
+}
+
+// Image is a tagged pair of kernel and RootFS.
+type Image struct {
+	Tag     string    `json:"tag"`
+	Kernel  Blob      `json:"kernel"`
+	RootFS  Blob      `json:"rootfs"`
+	Created time.Time `json:"created"`
+}
+
+type Blob struct {
+	// e.g. sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+	// file name when imported, informational
+	Source string `json:"source"`
+}
+
+// Open opens the store at dir, creating it if needed.
+func Open(dir string) (s *Store, err error) {
+	if dir == "" {
+		dir = DefaultDir
+	}
+
+	err = os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755)
+	if err != nil {
+		err = fmt.Errorf("creating image store: %w", err)
+		return
+	}
+
+	s = &Store{dir: dir}
+	return
+}
+
+// Dir is where the store is.
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// BlobPath returns the path of the blob of digest.
+func (s *Store) BlobPath(digest string) (path string, err error) {
+	hexDigest, err := parseDigest(digest)
+	if err != nil {
+		return
+	}
+
+	path = filepath.Join(s.dir, "blobs", "sha256", hexDigest)
+	return
+}
+
+// Import copies the kernel and the RootFS into the store and tags them,
+// replacing what the tag pointed to.
+// The RootFS is checked with e2fsck, so that a half-copied file is never imported.
+func (s *Store) Import(ctx context.Context, tag string, kernelPath string, rootFSPath string) (img Image, err error) {
+	if !tagPattern.MatchString(tag) {
+		err = fmt.Errorf("invalid tag %q, which consists of letters, digits, '.', '_', ':' and '-'", tag)
+		return
+	}
+
+	err = checkKernel(kernelPath)
+	if err != nil {
+		err = fmt.Errorf("checking kernel: %w", err)
+		return
+	}
+	err = checkRootFS(ctx, rootFSPath)
+	if err != nil {
+		err = fmt.Errorf("checking RootFS: %w", err)
+		return
+	}
+
+	unlock, err := s.lock(syscall.LOCK_EX)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	img = Image{
+		Tag:     tag,
+		Created: time.Now().UTC(),
+	}
+	img.Kernel, err = s.addBlob(kernelPath)
+	if err != nil {
+		err = fmt.Errorf("importing kernel: %w", err)
+		return
+	}
+	img.RootFS, err = s.addBlob(rootFSPath)
+	if err != nil {
+		err = fmt.Errorf("importing RootFS: %w", err)
+		return
+	}
+
+	tags, err := s.readTags()
+	if err != nil {
+		return
+	}
+	tags[tag] = img
+	err = s.writeTags(tags)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// List returns all images sorted by tag.
+func (s *Store) List() (images []Image, err error) {
+	unlock, err := s.lock(syscall.LOCK_SH)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	tags, err := s.readTags()
+	if err != nil {
+		return
+	}
+
+	for _, img := range tags {
+		images = append(images, img)
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Tag < images[j].Tag
+	})
+
+	return
+}
+
+// Get returns the image of tag, or ErrNotFound.
+func (s *Store) Get(tag string) (img Image, err error) {
+	unlock, err := s.lock(syscall.LOCK_SH)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	tags, err := s.readTags()
+	if err != nil {
+		return
+	}
+
+	img, ok := tags[tag]
+	if !ok {
+		err = fmt.Errorf("%w: %s", ErrNotFound, tag)
+		return
+	}
+
+	return
+}
+
+// Remove deletes the tag, blobs are left for GC.
+func (s *Store) Remove(tag string) (err error) {
+	unlock, err := s.lock(syscall.LOCK_EX)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	tags, err := s.readTags()
+	if err != nil {
+		return
+	}
+	if _, ok := tags[tag]; !ok {
+		err = fmt.Errorf("%w: %s", ErrNotFound, tag)
+		return
+	}
+
+	delete(tags, tag)
+	err = s.writeTags(tags)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// GC deletes blobs no tag points to, and leftovers of interrupted imports.
+// Running microVMs are not affected, since they boot from copies or open files.
+func (s *Store) GC() (removed []string, freed int64, err error) {
+	unlock, err := s.lock(syscall.LOCK_EX)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	tags, err := s.readTags()
+	if err != nil {
+		return
+	}
+	inUse := make(map[string]bool)
+	for _, img := range tags {
+		inUse[img.Kernel.Digest] = true
+		inUse[img.RootFS.Digest] = true
+	}
+
+	blobDir := filepath.Join(s.dir, "blobs", "sha256")
+	entries, err := os.ReadDir(blobDir)
+	if err != nil {
+		err = fmt.Errorf("reading blobs: %w", err)
+		return
+	}
+	for _, entry := range entries {
+		if inUse["sha256:"+entry.Name()] {
+			continue
+		}
+
+		var info fs.FileInfo
+		info, err = entry.Info()
+		if err != nil {
+			return
+		}
+		err = os.Remove(filepath.Join(blobDir, entry.Name()))
+		if err != nil {
+			err = fmt.Errorf("removing blob: %w", err)
+			return
+		}
+
+		name := entry.Name()
+		if !strings.HasPrefix(name, ".") {
+			name = "sha256:" + name
+		}
+		removed = append(removed, name)
+		freed += info.Size()
+	}
+
+	return
+}
+
+// Verify errors if the file at path does not match digest,
+// e.g. it's corrupted on disk or truncated.
+func Verify(path string, digest string) (err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	verifier, err := NewVerifier(digest)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(verifier, file)
+	if err != nil {
+		err = fmt.Errorf("reading %s: %w", path, err)
+		return
+	}
+
+	return verifier.Verify()
+}
+
+// Verifier checks what's written to it against a digest.
+type Verifier struct {
+	digest string
+	hash   hash.Hash
+}
+
+func NewVerifier(digest string) (v *Verifier, err error) {
+	_, err = parseDigest(digest)
+	if err != nil {
+		return
+	}
+
+	v = &Verifier{digest: digest, hash: sha256.New()}
+	return
+}
+
+func (v *Verifier) Write(p []byte) (int, error) {
+	return v.hash.Write(p)
+}
+
+// Verify errors if what's written does not match the digest.
+func (v *Verifier) Verify() error {
+	got := "sha256:" + hex.EncodeToString(v.hash.Sum(nil))
+	if got != v.digest {
+		return fmt.Errorf("digest mismatch, want %s, got %s, the file is corrupted, please import the image again", v.digest, got)
+	}
+
+	return nil
+}
+
+// addBlob copies the file at path into the store, unless it's there already.
+func (s *Store) addBlob(path string) (blob Blob, err error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+
+	temp, err := os.CreateTemp(filepath.Join(s.dir, "blobs", "sha256"), ".import-*")
+	if err != nil {
+		err = fmt.Errorf("creating temp file: %w", err)
+		return
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+
+	hash := sha256.New()
+	blob.Size, err = io.Copy(io.MultiWriter(temp, hash), src)
+	if err != nil {
+		err = fmt.Errorf("copying: %w", err)
+		return
+	}
+	err = temp.Sync()
+	if err != nil {
+		err = fmt.Errorf("syncing: %w", err)
+		return
+	}
+	err = temp.Chmod(0444)
+	if err != nil {
+		return
+	}
+
+	blob.Digest = "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	blob.Source = filepath.Base(path)
+
+	target, err := s.BlobPath(blob.Digest)
+	if err != nil {
+		return
+	}
+	if Verify(target, blob.Digest) == nil {
+		return
+	}
+	// missing or corrupted
+	err = os.Rename(temp.Name(), target)
+	if err != nil {
+		err = fmt.Errorf("renaming blob: %w", err)
+		return
+	}
+
+	return
+}
+
+func (s *Store) readTags() (tags map[string]Image, err error) {
+	tags = make(map[string]Image)
+
+	data, err := os.ReadFile(filepath.Join(s.dir, "tags.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("reading tags: %w", err)
+		return
+	}
+
+	err = json.Unmarshal(data, &tags)
+	if err != nil {
+		err = fmt.Errorf("decoding tags: %w", err)
+		return
+	}
+
+	return
+}
+
+func (s *Store) writeTags(tags map[string]Image) (err error) {
+	data, err := json.MarshalIndent(tags, "", "  ")
+	if err != nil {
+		err = fmt.Errorf("encoding tags: %w", err)
+		return
+	}
+
+	path := filepath.Join(s.dir, "tags.json")
+	err = os.WriteFile(path+".tmp", data, 0644)
+	if err != nil {
+		err = fmt.Errorf("writing tags: %w", err)
+		return
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		err = fmt.Errorf("renaming tags: %w", err)
+		return
+	}
+
+	return
+}
+
+// lock takes a flock of how on the store.
+func (s *Store) lock(how int) (unlock func(), err error) {
+	file, err := os.OpenFile(filepath.Join(s.dir, "lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		err = fmt.Errorf("opening lock file: %w", err)
+		return
+	}
+	err = syscall.Flock(int(file.Fd()), how)
+	if err != nil {
+		_ = file.Close()
+		err = fmt.Errorf("locking image store: %w", err)
+		return
+	}
+
+	unlock = func() {
+		_ = syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		_ = file.Close()
+	}
+	return
+}
+
+func parseDigest(digest string) (hexDigest string, err error) {
+	hexDigest = strings.TrimPrefix(digest, "sha256:")
+	if _, decodeErr := hex.DecodeString(hexDigest); decodeErr != nil || len(hexDigest) != sha256.Size*2 || !strings.HasPrefix(digest, "sha256:") {
+		err = fmt.Errorf("invalid digest %q", digest)
+		return
+	}
+
+	return
+}
+
+// checkKernel refuses files which are neither vmlinux nor bzImage.
+func checkKernel(path string) (err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	header := make([]byte, 0x206)
+	n, _ := io.ReadFull(file, header)
+	header = header[:n]
+	if bytes.HasPrefix(header, []byte("\x7fELF")) {
+		return
+	}
+	if len(header) >= 0x206 && string(header[0x202:0x206]) == "HdrS" {
+		return
+	}
+
+	err = errors.New("neither a vmlinux ELF nor a bzImage")
+	return
+}
+
+// checkRootFS checks the RootFS is as large as its file system, which a half-copied file is not,
+// then runs e2fsck read-only on it.
+func checkRootFS(ctx context.Context, path string) (err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return
+	}
+	superblock := make([]byte, 1024)
+	_, err = file.ReadAt(superblock, 1024)
+	if err != nil {
+		err = fmt.Errorf("reading superblock: %w", err)
+		return
+	}
+	if binary.LittleEndian.Uint16(superblock[0x38:]) != 0xEF53 {
+		err = errors.New("not an ext4 file system")
+		return
+	}
+	blockSize := int64(1024) << binary.LittleEndian.Uint32(superblock[0x18:])
+	blocks := int64(binary.LittleEndian.Uint32(superblock[0x4:]))
+	// 64bit feature
+	if binary.LittleEndian.Uint32(superblock[0x60:])&0x80 != 0 {
+		blocks |= int64(binary.LittleEndian.Uint32(superblock[0x150:])) << 32
+	}
+	if info.Size() < blocks*blockSize {
+		err = fmt.Errorf("file is %d bytes, smaller than its file system of %d bytes, is it half-copied?", info.Size(), blocks*blockSize)
+		return
+	}
+
+	output, err := exec.CommandContext(ctx, "e2fsck", "-n", "-f", path).CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("running e2fsck: %w, output: %s", err, output)
+		return
+	}
+
+	return
+}
@@ -0,0 +1,79 @@
+package imagestore
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testImage(t *testing.T) (kernel string, rootFS string) {
+	dir := t.TempDir()
+
+	kernel = filepath.Join(dir, "vmlinux")
+	require.NoError(t, os.WriteFile(kernel, []byte("\x7fELF fake kernel"), 0644))
+
+	rootFS = filepath.Join(dir, "rootfs.ext4")
+	output, err := exec.Command("mkfs.ext4", "-q", "-F", rootFS, "4M").CombinedOutput()
+	require.NoError(t, err, string(output))
+
+	return
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	store, err := Open(t.TempDir())
+	require.NoError(t, err)
+	kernel, rootFS := testImage(t)
+
+	img, err := store.Import(ctx, "jammy-go", kernel, rootFS)
+	require.NoError(t, err)
+	_, err = store.Import(ctx, "jammy-node", kernel, rootFS)
+	require.NoError(t, err)
+
+	images, err := store.List()
+	require.NoError(t, err)
+	require.Len(t, images, 2)
+	assert.Equal(t, "jammy-go", images[0].Tag)
+	assert.Equal(t, img.RootFS.Digest, images[1].RootFS.Digest)
+
+	got, err := store.Get("jammy-go")
+	require.NoError(t, err)
+	assert.Equal(t, img.Kernel, got.Kernel)
+	_, err = store.Get("alpine")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// corruption is caught before boot, and re-importing repairs it
+	rootFSBlob, err := store.BlobPath(img.RootFS.Digest)
+	require.NoError(t, err)
+	require.NoError(t, Verify(rootFSBlob, img.RootFS.Digest))
+	require.NoError(t, os.Chmod(rootFSBlob, 0644))
+	require.NoError(t, os.Truncate(rootFSBlob, 1<<20))
+	assert.ErrorContains(t, Verify(rootFSBlob, img.RootFS.Digest), "digest mismatch")
+	_, err = store.Import(ctx, "jammy-go", kernel, rootFS)
+	require.NoError(t, err)
+	assert.NoError(t, Verify(rootFSBlob, img.RootFS.Digest))
+
+	// half-copied RootFS is refused
+	require.NoError(t, os.Truncate(rootFS, 1<<20))
+	_, err = store.Import(ctx, "broken", kernel, rootFS)
+	assert.ErrorContains(t, err, "checking RootFS")
+	_, err = store.Import(ctx, "not a tag", kernel, rootFS)
+	assert.ErrorContains(t, err, "invalid tag")
+
+	// blobs are shared until no tag points to them
+	require.NoError(t, store.Remove("jammy-go"))
+	removed, _, err := store.GC()
+	require.NoError(t, err)
+	assert.Empty(t, removed)
+	require.NoError(t, store.Remove("jammy-node"))
+	removed, freed, err := store.GC()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{img.Kernel.Digest, img.RootFS.Digest}, removed)
+	assert.EqualValues(t, img.Kernel.Size+img.RootFS.Size, freed)
+	assert.ErrorIs(t, store.Remove("jammy-node"), ErrNotFound)
+}
@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	cpu := r.NewCounterVec("tart_job_cpu_seconds_total", "Guest CPU time of jobs.", "project")
+	memory := r.NewHistogramVec("tart_job_peak_memory_bytes", "Peak memory of jobs.", []float64{1, 10}, "project")
+
+	cpu.Add(1.5, "group/b")
+	cpu.Add(2, `group/"a"`)
+	cpu.Add(1, "group/b")
+	memory.Observe(1, "group/b")
+	memory.Observe(5, "group/b")
+	memory.Observe(100, "group/b")
+
+	var buf bytes.Buffer
+	require.NoError(t, r.Write(&buf))
+	assert.Equal(t, `# HELP tart_job_cpu_seconds_total Guest CPU time of jobs.
+# TYPE tart_job_cpu_seconds_total counter
+tart_job_cpu_seconds_total{project="group/\"a\""} 2
+tart_job_cpu_seconds_total{project="group/b"} 2.5
+# HELP tart_job_peak_memory_bytes Peak memory of jobs.
+# TYPE tart_job_peak_memory_bytes histogram
+tart_job_peak_memory_bytes_bucket{project="group/b",le="1"} 1
+tart_job_peak_memory_bytes_bucket{project="group/b",le="10"} 2
+tart_job_peak_memory_bytes_bucket{project="group/b",le="+Inf"} 3
+tart_job_peak_memory_bytes_sum{project="group/b"} 106
+tart_job_peak_memory_bytes_count{project="group/b"} 3
+`, buf.String())
+
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, buf.String(), recorder.Body.String())
+	assert.Contains(t, recorder.Header().Get("Content-Type"), "version=0.0.4")
+
+	assert.Panics(t, func() { cpu.Add(-1, "group/b") })
+	assert.Panics(t, func() { cpu.Add(1) })
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -192,11 +193,13 @@ func (c *Client) Register(ctx context.Context, param RegisterParam) (accessToken
 
 var ErrNoJobAvailable = errors.New("no job available")
 
-func (c *Client) RequestJob(ctx context.Context, accessToken string) (job RequestJobResp, err error) {
+// RequestJob asks for a job, session is where the job's session server is reached, if any.
+func (c *Client) RequestJob(ctx context.Context, accessToken string, session *SessionInfo) (job RequestJobResp, err error) {
 	reqBody := RequestJobReq{
 		Info:       c.info(),
 		LastUpdate: c.lastUpdateCursor.Load(),
 		Token:      accessToken,
+		Session:    session,
 	}
 
 	req, err := c.newRequest(ctx, http.MethodPost, "/api/v4/jobs/request", reqBody)
@@ -377,3 +380,100 @@ func (c *Client) AppendJobTrace(ctx context.Context, param AppendJobTraceParam)
 	nextRangeStart = param.RangeStart + param.ContentLength
 	return
 }
+
+type DownloadArtifactsParam struct {
+	// Token of the job owning artifacts
+	JobToken string
+	// ID of the job owning artifacts
+	JobID int
+	// where the zip archive goes
+	Writer io.Writer
+}
+
+// DownloadArtifacts downloads the artifacts archive of a job, which is a zip archive.
+func (c *Client) DownloadArtifacts(ctx context.Context, param DownloadArtifactsParam) (err error) {
+	req, err := c.newRequest(ctx, http.MethodGet, fmt.Sprintf("/api/v4/jobs/%d/artifacts", param.JobID), nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Job-Token", param.JobToken)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		err = fmt.Errorf("calling Gitlab API: %w", err)
+		return
+	}
+	defer drainAndCloseBody(resp)
+
+	err = isResponseOK(resp)
+	if err != nil {
+		return
+	}
+
+	_, err = io.Copy(param.Writer, resp.Body)
+	if err != nil {
+		err = fmt.Errorf("receiving artifacts: %w", err)
+		return
+	}
+
+	return
+}
+
+type UploadArtifactsParam struct {
+	// Job's authentication token
+	JobToken string
+	// Job's ID
+	JobID int
+	// zip archive of artifacts
+	Reader io.Reader
+	// file name of the archive, e.g. artifacts.zip
+	Filename string
+	// how long Gitlab keeps artifacts, e.g. 30 days, defaults to the instance setting
+	ExpireIn string
+}
+
+// UploadArtifacts uploads a zip archive as artifacts of the job.
+func (c *Client) UploadArtifacts(ctx context.Context, param UploadArtifactsParam) (err error) {
+	query := url.Values{}
+	query.Set("artifact_type", "archive")
+	query.Set("artifact_format", "zip")
+	if param.ExpireIn != "" {
+		query.Set("expire_in", param.ExpireIn)
+	}
+
+	// the archive is streamed rather than buffered, which may be large
+	bodyReader, bodyWriter := io.Pipe()
+	form := multipart.NewWriter(bodyWriter)
+	go func() {
+		part, err := form.CreateFormFile("file", param.Filename)
+		if err == nil {
+			_, err = io.Copy(part, param.Reader)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		_ = bodyWriter.CloseWithError(err)
+	}()
+	defer bodyReader.Close()
+
+	req, err := c.newRequest(ctx, http.MethodPost, fmt.Sprintf("/api/v4/jobs/%d/artifacts?%s", param.JobID, query.Encode()), bodyReader)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Job-Token", param.JobToken)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		err = fmt.Errorf("calling Gitlab API: %w", err)
+		return
+	}
+	defer drainAndCloseBody(resp)
+
+	err = isResponseOK(resp)
+	if err != nil {
+		return
+	}
+
+	return
+}
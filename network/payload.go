@@ -1,5 +1,10 @@
 package network
 
+import (
+	"bytes"
+	"encoding/json"
+)
+
 // Features describes the runner's abilities.
 // Since Tart is a toy runner, a very limited set of features are supported.
 type Features struct {
@@ -16,6 +21,8 @@ type Features struct {
 	TraceReset              bool `json:"trace_reset"`
 	TraceChecksum           bool `json:"trace_checksum"`
 	TraceSize               bool `json:"trace_size"`
+	Terminal                bool `json:"terminal"`
+	Session                 bool `json:"session"`
 }
 
 type RegisterReq struct {
@@ -68,20 +75,75 @@ type RequestJobReq struct {
 	LastUpdate string `json:"last_update"`
 	// Runner's authentication token
 	Token string `json:"token"`
+	// session server of the job, if any
+	Session *SessionInfo `json:"session,omitempty"`
+}
+
+// SessionInfo tells Gitlab where to reach the session server for the job.
+type SessionInfo struct {
+	// e.g. https://runner.example.com:8093/session/<id>
+	URL string `json:"url"`
+	// PEM encoded TLS certificate of the session server
+	Certificate string `json:"certificate"`
+	// value of Authorization header Gitlab sends
+	Authorization string `json:"authorization"`
 }
 
 type RequestJobResp struct {
 	ID            int             `json:"id"`
 	AllowGitFetch bool            `json:"allow_git_fetch"`
-	Artifacts     interface{}     `json:"artifacts"`
+	Artifacts     []Artifact      `json:"artifacts"`
+	Cache         []Cache         `json:"cache"`
 	Credentials   []JobCredential `json:"credentials"`
+	Dependencies  []Dependency    `json:"dependencies"`
 	GitInfo       GitInfo         `json:"git_info"`
+	Image         Image           `json:"image"`
 	JobInfo       JobInfo         `json:"job_info"`
+	Services      []Service       `json:"services"`
 	Steps         []JobStep       `json:"steps"`
 	Token         string          `json:"token"`
 	Variables     []JobVariable   `json:"variables"`
 }
 
+// Artifact is an entry of the artifacts keyword of the job.
+type Artifact struct {
+	Name      string   `json:"name"`
+	Untracked bool     `json:"untracked"`
+	Paths     []string `json:"paths"`
+	Exclude   []string `json:"exclude"`
+	// on_success, on_failure or always
+	When     string `json:"when"`
+	ExpireIn string `json:"expire_in"`
+	// archive for paths, others are reports
+	Type   string `json:"artifact_type"`
+	Format string `json:"artifact_format"`
+}
+
+// Cache is an entry of the cache keyword of the job.
+type Cache struct {
+	Key       string `json:"key"`
+	Untracked bool   `json:"untracked"`
+	// pull-push, pull or push
+	Policy string   `json:"policy"`
+	Paths  []string `json:"paths"`
+	// on_success, on_failure or always
+	When string `json:"when"`
+}
+
+// Dependency is a job whose artifacts the job receives.
+type Dependency struct {
+	ID            int           `json:"id"`
+	Token         string        `json:"token"`
+	Name          string        `json:"name"`
+	ArtifactsFile ArtifactsFile `json:"artifacts_file"`
+}
+
+type ArtifactsFile struct {
+	// empty if the job has no artifacts
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+}
+
 type JobCredential struct {
 	Password string `json:"password"`
 	Type     string `json:"type"`
@@ -107,6 +169,51 @@ type JobInfo struct {
 	Stage       string `json:"stage"`
 }
 
+// Image is the image keyword of the job.
+type Image struct {
+	Name       string   `json:"name"`
+	Alias      string   `json:"alias,omitempty"`
+	Entrypoint []string `json:"entrypoint,omitempty"`
+	Command    []string `json:"command,omitempty"`
+}
+
+// UnmarshalJSON accepts both the image name as a string and the object form.
+func (i *Image) UnmarshalJSON(data []byte) (err error) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(`"`)) {
+		*i = Image{}
+		err = json.Unmarshal(data, &i.Name)
+		return
+	}
+
+	// avoids recursion
+	type image Image
+	err = json.Unmarshal(data, (*image)(i))
+	return
+}
+
+// Service is an entry of the services keyword of the job.
+type Service struct {
+	Name       string        `json:"name"`
+	Alias      string        `json:"alias,omitempty"`
+	Entrypoint []string      `json:"entrypoint,omitempty"`
+	Command    []string      `json:"command,omitempty"`
+	Variables  []JobVariable `json:"variables,omitempty"`
+}
+
+// UnmarshalJSON accepts both the service name as a string and the object form.
+func (s *Service) UnmarshalJSON(data []byte) (err error) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(`"`)) {
+		*s = Service{}
+		err = json.Unmarshal(data, &s.Name)
+		return
+	}
+
+	// avoids recursion
+	type service Service
+	err = json.Unmarshal(data, (*service)(s))
+	return
+}
+
 type JobStep struct {
 	AllowFailure bool     `json:"allow_failure"`
 	Name         string   `json:"name"`
@@ -12,5 +12,10 @@ docker run -i --name jammy-rootfs -h tart-jammy ubuntu:jammy bash -s < ./in-cont
 dirs="bin etc home lib lib64 opt root sbin usr var"
 for d in $dirs; do sudo docker cp jammy-rootfs:/"$d" /tmp/my-rootfs; done
 
+# tart agent, serving the host over vsock when Transport is agent
+CGO_ENABLED=0 go build -o /tmp/tart-agent ../cmd/tart
+sudo install -D -m 0755 /tmp/tart-agent /tmp/my-rootfs/usr/local/bin/tart
+rm -f /tmp/tart-agent
+
 sudo umount /tmp/my-rootfs
 docker rm -f jammy-rootfs
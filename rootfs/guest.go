@@ -0,0 +1,261 @@
+package rootfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// guestFile is a file Tart needs in the guest, see in-container-setup.sh.
+type guestFile struct {
+	path    string
+	mode    fs.FileMode
+	content string
+}
+
+var guestFiles = []guestFile{
+	{
+		path: "/etc/ssh/sshd_config.d/tart.conf",
+		mode: 0644,
+		content: `PasswordAuthentication no
+PermitRootLogin prohibit-password
+HostKey /etc/ssh/ssh_host_ecdsa_key
+`,
+	},
+	{
+		// keys are generated by Tart for every microVM and delivered by the config drive
+		path: "/etc/systemd/system/tart-config-drive.service",
+		mode: 0644,
+		content: `[Unit]
+Description=Extract Tart config drive
+ConditionPathExists=/dev/vdb
+Before=ssh.service
+
+[Service]
+Type=oneshot
+ExecStart=/bin/tar -xf /dev/vdb -C / --no-same-owner
+
+[Install]
+WantedBy=multi-user.target
+`,
+	},
+	{
+		path: "/usr/local/sbin/tart-metadata",
+		mode: 0755,
+		content: `#!/bin/bash
+set -euo pipefail
+
+mmds=169.254.169.254
+ip route add "$mmds" dev eth0 2>/dev/null || true
+
+headers=()
+if token=$(curl -sf --max-time 2 -X PUT -H 'X-metadata-token-ttl-seconds: 60' "http://$mmds/latest/api/token"); then
+  headers=(-H "X-metadata-token: $token")
+fi
+metadata=$(curl -sf --max-time 2 "${headers[@]}" -H 'Accept: application/json' "http://$mmds/tart")
+
+hostname="$(jq -r '.hostname' <<<"$metadata")"
+hostname "$hostname"
+echo "$hostname" > /etc/hostname
+echo "127.0.1.1 $hostname" >> /etc/hosts
+
+nameservers="$(jq -r '.network.nameservers // [] | .[] | "nameserver " + .' <<<"$metadata")"
+if [ -n "$nameservers" ]; then
+  echo "$nameservers" > /etc/resolv.conf
+fi
+
+if tz="$(jq -er '.variables.TZ' <<<"$metadata")" && [ -e "/usr/share/zoneinfo/$tz" ]; then
+  ln -sf "/usr/share/zoneinfo/$tz" /etc/localtime
+fi
+`,
+	},
+	{
+		path: "/etc/systemd/system/tart-metadata.service",
+		mode: 0644,
+		content: `[Unit]
+Description=Configure guest with Tart metadata
+After=network.target
+Before=ssh.service
+
+[Service]
+Type=oneshot
+ExecStart=/usr/local/sbin/tart-metadata
+
+[Install]
+WantedBy=multi-user.target
+`,
+	},
+	{
+		path: "/etc/systemd/system/tart-agent.service",
+		mode: 0644,
+		content: `[Unit]
+Description=Tart guest agent
+ConditionPathExists=/usr/local/bin/tart
+After=tart-config-drive.service tart-metadata.service
+
+[Service]
+Environment=HOME=/root
+EnvironmentFile=-/etc/environment
+ExecStart=/usr/local/bin/tart agent
+Restart=on-failure
+
+[Install]
+WantedBy=multi-user.target
+`,
+	},
+	{
+		// see Readiness under [Executor.Boot]
+		path: "/etc/systemd/system/tart-ready.service",
+		mode: 0644,
+		content: `[Unit]
+Description=Print Tart ready marker on serial console
+After=ssh.service tart-agent.service
+
+[Service]
+Type=oneshot
+ExecStart=/bin/sh -c 'echo TART-READY > /dev/ttyS0'
+
+[Install]
+WantedBy=multi-user.target
+`,
+	},
+	{
+		// no login prompt on the serial console
+		path: "/etc/systemd/system/serial-getty@ttyS0.service.d/autologin.conf",
+		mode: 0644,
+		content: `[Service]
+ExecStart=
+ExecStart=-/sbin/agetty --autologin root -o '-p -- \u' --keep-baud 115200,38400,9600 %I $TERM
+`,
+	},
+}
+
+// units enabled in multi-user.target
+var guestUnits = []string{
+	"tart-config-drive.service",
+	"tart-metadata.service",
+	"tart-agent.service",
+	"tart-ready.service",
+}
+
+// units interfering with Tart
+var guestDisabledUnits = []string{
+	"/etc/systemd/system/multi-user.target.wants/systemd-resolved.service",
+	"/etc/systemd/system/dbus-org.freedesktop.resolve1.service",
+	"/etc/systemd/system/sysinit.target.wants/systemd-timesyncd.service",
+}
+
+// checkGuest makes sure the image comes with what the injected units need,
+// since packages are not installed.
+func (t *tree) checkGuest(opt BuildOpt) (err error) {
+	if !t.exists("/sbin/init") {
+		err = errors.New("/sbin/init is missing, install systemd-sysv in the image")
+		return
+	}
+	if !t.exists("/lib/systemd/systemd") && !t.exists("/usr/lib/systemd/systemd") {
+		err = errors.New("systemd is missing, install systemd in the image")
+		return
+	}
+	if opt.AgentPath == "" && !t.exists("/usr/sbin/sshd") && !t.exists("/sbin/sshd") {
+		err = errors.New("sshd is missing, install openssh-server in the image, or provide the agent for agent transport")
+		return
+	}
+
+	return
+}
+
+// injectGuest adds what Tart needs in the guest to the tree.
+func (t *tree) injectGuest(opt BuildOpt, env []string) (err error) {
+	err = t.checkGuest(opt)
+	if err != nil {
+		return
+	}
+
+	for _, file := range guestFiles {
+		err = t.writeFile(file.path, file.mode, file.content)
+		if err != nil {
+			err = fmt.Errorf("writing %s: %w", file.path, err)
+			return
+		}
+	}
+
+	for _, unit := range guestUnits {
+		err = t.symlink("/etc/systemd/system/multi-user.target.wants/"+unit, "/etc/systemd/system/"+unit)
+		if err != nil {
+			err = fmt.Errorf("enabling %s: %w", unit, err)
+			return
+		}
+	}
+	for _, unit := range guestDisabledUnits {
+		err = t.removeGlob(unit)
+		if err != nil {
+			err = fmt.Errorf("disabling %s: %w", unit, err)
+			return
+		}
+	}
+
+	// host keys are delivered by the config drive
+	err = t.removeGlob("/etc/ssh/ssh_host_*")
+	if err != nil {
+		err = fmt.Errorf("removing host keys: %w", err)
+		return
+	}
+	// /root may be a symlink, e.g. to /var/roothome
+	sshDir, err := t.resolve("/root/.ssh")
+	if err != nil {
+		return
+	}
+	err = t.mkdirAll(sshDir)
+	if err != nil {
+		err = fmt.Errorf("creating /root/.ssh: %w", err)
+		return
+	}
+	err = t.setMode(sshDir, 0700)
+	if err != nil {
+		return
+	}
+
+	// overridden by metadata at boot, container images often link it to systemd-resolved
+	var resolvConf strings.Builder
+	for _, nameserver := range opt.Nameservers {
+		resolvConf.WriteString("nameserver " + nameserver + "\n")
+	}
+	err = t.writeFile("/etc/resolv.conf", 0644, resolvConf.String())
+	if err != nil {
+		err = fmt.Errorf("writing /etc/resolv.conf: %w", err)
+		return
+	}
+
+	// environment of the image, e.g. PATH of golang images,
+	// which the agent and SSH sessions with pam_env pick up
+	if len(env) > 0 {
+		var environment strings.Builder
+		for _, kv := range env {
+			key, value, _ := strings.Cut(kv, "=")
+			fmt.Fprintf(&environment, "%s=%q\n", key, value)
+		}
+		err = t.writeFile("/etc/environment", 0644, environment.String())
+		if err != nil {
+			err = fmt.Errorf("writing /etc/environment: %w", err)
+			return
+		}
+	}
+
+	if opt.AgentPath != "" {
+		var agent []byte
+		agent, err = os.ReadFile(opt.AgentPath)
+		if err != nil {
+			err = fmt.Errorf("reading agent: %w", err)
+			return
+		}
+		err = t.writeFile("/usr/local/bin/tart", 0755, string(agent))
+		if err != nil {
+			err = fmt.Errorf("installing agent: %w", err)
+			return
+		}
+	}
+
+	return
+}
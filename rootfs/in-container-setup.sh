@@ -9,27 +9,126 @@ deb http://mirrors.bfsu.edu.cn/ubuntu/ jammy-security main restricted universe m
 EOF
 
 # necessary packages, including systemd and ssh server
-packages="ca-certificates udev systemd-sysv iproute2 curl tzdata zip openssh-server git build-essential"
+packages="ca-certificates udev systemd-sysv iproute2 curl jq tzdata zip openssh-server git build-essential"
 DEBIAN_FRONTEND=noninteractive apt-get update
 DEBIAN_FRONTEND=noninteractive apt-get install --no-install-recommends -y $packages < /dev/null # by default apt-get openssh-server reads from Stdin, stops script execution.
 rm -rf /var/lib/apt/lists/* # clear APT cache
 
 # ssh login method
-echo 'PasswordAuthentication yes' >> /etc/ssh/sshd_config
+# Keys are generated by Tart for every microVM and delivered by the config drive,
+# a tar archive attached as /dev/vdb, which is extracted before sshd starts.
+rm -f /etc/ssh/ssh_host_*
 mkdir -p /root/.ssh
-echo 'ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQCtJ4YxqZ6O6pUuaJpXqVMyTyRIfsU20sqS8gKAlx+xyRjb79C1UQpX60wpV6fH3s1wS2InItQPnrYItqofkQAgmn6POCzp1eaBMVWOw1Ke4LAC5KUONc/0nzoTzDR/5cle9aNd3yYDGTlm8ZXDx6xOVIrI9ymC2E5T3rQJ8aB22iEBMMoOAdUnhCB7dAtn1cCCLBAw9rqswJGr4ngYiID5eYfzeladGp9KqyFA8aAluL3JW12TAwM10ENG03wk8laXCfa7ECBC2OWwlLnoJI2Wnbfw67Wobt6yrcD7KJ2xpL9YBj8g2XPu4B29rqde3DFNmpLV8jtlqI9rE4S2igYX ci@tart-host' > /root/.ssh/authorized_keys
+chmod 700 /root/.ssh
+cat <<EOF > /etc/ssh/sshd_config.d/tart.conf
+PasswordAuthentication no
+PermitRootLogin prohibit-password
+HostKey /etc/ssh/ssh_host_ecdsa_key
+EOF
+cat <<EOF > /etc/systemd/system/tart-config-drive.service
+[Unit]
+Description=Extract Tart config drive
+ConditionPathExists=/dev/vdb
+Before=ssh.service
+
+[Service]
+Type=oneshot
+ExecStart=/bin/tar -xf /dev/vdb -C / --no-same-owner
+
+[Install]
+WantedBy=multi-user.target
+EOF
+ln -s /etc/systemd/system/tart-config-drive.service /etc/systemd/system/multi-user.target.wants/tart-config-drive.service
 
 # Disable resolved and ntpd
 rm -f /etc/systemd/system/multi-user.target.wants/systemd-resolved.service
 rm -f /etc/systemd/system/dbus-org.freedesktop.resolve1.service
 rm -f /etc/systemd/system/sysinit.target.wants/systemd-timesyncd.service
 
-# DNS
+# DNS, overridden by metadata from Tart at boot
 cat <<EOF > /etc/resolv.conf
 nameserver 223.5.5.5
 nameserver 223.6.6.6
 EOF
 
+# Configure hostname and DNS with metadata published by Tart through Firecracker MMDS.
+# A session token is acquired first, which MMDS V2 requires and V1 accepts.
+cat <<'EOF' > /usr/local/sbin/tart-metadata
+#!/bin/bash
+set -euo pipefail
+
+mmds=169.254.169.254
+ip route add "$mmds" dev eth0 2>/dev/null || true
+
+headers=()
+if token=$(curl -sf --max-time 2 -X PUT -H 'X-metadata-token-ttl-seconds: 60' "http://$mmds/latest/api/token"); then
+  headers=(-H "X-metadata-token: $token")
+fi
+metadata=$(curl -sf --max-time 2 "${headers[@]}" -H 'Accept: application/json' "http://$mmds/tart")
+
+hostname="$(jq -r '.hostname' <<<"$metadata")"
+hostname "$hostname"
+echo "$hostname" > /etc/hostname
+echo "127.0.1.1 $hostname" >> /etc/hosts
+
+nameservers="$(jq -r '.network.nameservers // [] | .[] | "nameserver " + .' <<<"$metadata")"
+if [ -n "$nameservers" ]; then
+  echo "$nameservers" > /etc/resolv.conf
+fi
+
+if tz="$(jq -er '.variables.TZ' <<<"$metadata")" && [ -e "/usr/share/zoneinfo/$tz" ]; then
+  ln -sf "/usr/share/zoneinfo/$tz" /etc/localtime
+fi
+EOF
+chmod +x /usr/local/sbin/tart-metadata
+cat <<EOF > /etc/systemd/system/tart-metadata.service
+[Unit]
+Description=Configure guest with Tart metadata
+After=network.target
+Before=ssh.service
+
+[Service]
+Type=oneshot
+ExecStart=/usr/local/sbin/tart-metadata
+
+[Install]
+WantedBy=multi-user.target
+EOF
+ln -s /etc/systemd/system/tart-metadata.service /etc/systemd/system/multi-user.target.wants/tart-metadata.service
+
+# tart agent, which is installed by build-jammy.sh
+cat <<EOF > /etc/systemd/system/tart-agent.service
+[Unit]
+Description=Tart guest agent
+ConditionPathExists=/usr/local/bin/tart
+After=tart-config-drive.service tart-metadata.service
+
+[Service]
+Environment=HOME=/root
+EnvironmentFile=/etc/environment
+ExecStart=/usr/local/bin/tart agent
+Restart=on-failure
+
+[Install]
+WantedBy=multi-user.target
+EOF
+ln -s /etc/systemd/system/tart-agent.service /etc/systemd/system/multi-user.target.wants/tart-agent.service
+
+# Tell Tart the guest is ready on serial console, see Readiness under [Executor.Boot]
+cat <<EOF > /etc/systemd/system/tart-ready.service
+[Unit]
+Description=Print Tart ready marker on serial console
+After=ssh.service tart-agent.service
+
+[Service]
+Type=oneshot
+ExecStart=/bin/sh -c 'echo TART-READY > /dev/ttyS0'
+
+[Install]
+WantedBy=multi-user.target
+EOF
+ln -s /etc/systemd/system/tart-ready.service /etc/systemd/system/multi-user.target.wants/tart-ready.service
+
 # Auto-login
 # The serial getty service hooks up the login prompt to the kernel console at
 # ttyS0 (where Firecracker connects its serial console).
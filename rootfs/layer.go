@@ -0,0 +1,392 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+	// symlinks followed when resolving a path, as Linux does
+	maxSymlinks = 40
+)
+
+// inode is metadata of a file in the tree, which can not be set
+// on the staging directory without root, and is applied to the image afterwards.
+type inode struct {
+	mode    fs.FileMode
+	uid     int
+	gid     int
+	modTime time.Time
+	// for devices
+	major, minor int64
+}
+
+// tree is the root file system being built in a staging directory.
+type tree struct {
+	dir string
+	// keyed by absolute paths in the image, e.g. /etc/passwd
+	inodes map[string]*inode
+}
+
+func newTree(dir string) *tree {
+	return &tree{
+		dir:    dir,
+		inodes: map[string]*inode{"/": {mode: fs.ModeDir | 0755}},
+	}
+}
+
+// applyLayer applies a layer to the tree, as overlay file systems do.
+func (t *tree) applyLayer(r io.Reader) (err error) {
+	// paths this layer has added, which opaque whiteouts keep
+	added := make(map[string]bool)
+
+	tr := tar.NewReader(r)
+	for {
+		var header *tar.Header
+		header, err = tr.Next()
+		if errors.Is(err, io.EOF) {
+			err = nil
+			return
+		}
+		if err != nil {
+			err = fmt.Errorf("reading layer: %w", err)
+			return
+		}
+
+		name := path.Clean("/" + header.Name)
+		if name == "/" {
+			continue
+		}
+
+		var dir string
+		dir, err = t.resolve(path.Dir(name))
+		if err != nil {
+			return
+		}
+		base := path.Base(name)
+
+		switch {
+		case base == whiteoutOpaque:
+			err = t.clearDir(dir, added)
+		case strings.HasPrefix(base, whiteoutPrefix):
+			err = t.remove(path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+		default:
+			name = path.Join(dir, base)
+			err = t.add(name, header, tr)
+			added[name] = true
+		}
+		if err != nil {
+			err = fmt.Errorf("applying %s: %w", header.Name, err)
+			return
+		}
+	}
+}
+
+// add creates the entry of header at name, replacing what's there unless both are directories.
+func (t *tree) add(name string, header *tar.Header, content io.Reader) (err error) {
+	hostPath := t.hostPath(name)
+	node := &inode{
+		mode:    header.FileInfo().Mode(),
+		uid:     header.Uid,
+		gid:     header.Gid,
+		modTime: header.ModTime,
+		major:   header.Devmajor,
+		minor:   header.Devminor,
+	}
+
+	existing, statErr := os.Lstat(hostPath)
+	if statErr == nil && !(existing.IsDir() && header.Typeflag == tar.TypeDir) {
+		err = t.remove(name)
+		if err != nil {
+			return
+		}
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		// writable for adding children, the mode is applied to the image later
+		err = os.MkdirAll(hostPath, 0755)
+	case tar.TypeReg:
+		err = writeFile(hostPath, content, 0644)
+	case tar.TypeSymlink:
+		err = os.Symlink(header.Linkname, hostPath)
+	case tar.TypeLink:
+		var target string
+		target, err = t.resolve(path.Clean("/" + header.Linkname))
+		if err != nil {
+			return
+		}
+		err = os.Link(t.hostPath(target), hostPath)
+		if err != nil {
+			return
+		}
+		// hard links share the inode
+		node = t.inodes[target]
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		// created in the image later, a placeholder keeps the name in the directory
+		err = writeFile(hostPath, strings.NewReader(""), 0644)
+	default:
+		// e.g. GNU sparse and extended headers, not found in images in practice
+		err = fmt.Errorf("unsupported type %q", header.Typeflag)
+	}
+	if err != nil {
+		return
+	}
+
+	if node != nil {
+		t.inodes[name] = node
+	}
+	return
+}
+
+// remove deletes name and everything under it.
+func (t *tree) remove(name string) (err error) {
+	err = os.RemoveAll(t.hostPath(name))
+	if err != nil {
+		return
+	}
+
+	for p := range t.inodes {
+		if p == name || strings.HasPrefix(p, name+"/") {
+			delete(t.inodes, p)
+		}
+	}
+
+	return
+}
+
+// clearDir removes children of dir that lower layers have added.
+func (t *tree) clearDir(dir string, added map[string]bool) (err error) {
+	entries, err := os.ReadDir(t.hostPath(dir))
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		name := path.Join(dir, entry.Name())
+		if added[name] {
+			continue
+		}
+		err = t.remove(name)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// resolve follows symlinks in name within the tree, and returns the real path.
+// Absolute symlinks are relative to the root of the tree, and nothing goes above it.
+func (t *tree) resolve(name string) (resolved string, err error) {
+	resolved = "/"
+	remaining := strings.Split(strings.TrimPrefix(name, "/"), "/")
+	followed := 0
+
+	for len(remaining) > 0 {
+		part := remaining[0]
+		remaining = remaining[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, part)
+		info, statErr := os.Lstat(t.hostPath(next))
+		if statErr != nil || info.Mode()&fs.ModeSymlink == 0 {
+			// missing parts are created as they come
+			resolved = next
+			continue
+		}
+
+		followed++
+		if followed > maxSymlinks {
+			err = fmt.Errorf("too many levels of symbolic links in %s", name)
+			return
+		}
+
+		var target string
+		target, err = os.Readlink(t.hostPath(next))
+		if err != nil {
+			return
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		remaining = append(strings.Split(target, "/"), remaining...)
+	}
+
+	return
+}
+
+// exists reports whether name, symlinks followed, is in the tree.
+func (t *tree) exists(name string) bool {
+	resolved, err := t.resolve(name)
+	if err != nil {
+		return false
+	}
+
+	_, err = os.Lstat(t.hostPath(resolved))
+	return err == nil
+}
+
+func (t *tree) hostPath(name string) string {
+	return filepath.Join(t.dir, filepath.FromSlash(name))
+}
+
+// writeFile adds a regular file at name owned by root, following symlinks in its parents.
+func (t *tree) writeFile(name string, mode fs.FileMode, content string) (err error) {
+	dir, err := t.resolve(path.Dir(name))
+	if err != nil {
+		return
+	}
+	err = t.mkdirAll(dir)
+	if err != nil {
+		return
+	}
+
+	return t.add(path.Join(dir, path.Base(name)), &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     int64(mode),
+		ModTime:  time.Unix(0, 0),
+	}, strings.NewReader(content))
+}
+
+// symlink adds a symlink at name to target.
+func (t *tree) symlink(name string, target string) (err error) {
+	dir, err := t.resolve(path.Dir(name))
+	if err != nil {
+		return
+	}
+	err = t.mkdirAll(dir)
+	if err != nil {
+		return
+	}
+
+	return t.add(path.Join(dir, path.Base(name)), &tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Name:     name,
+		Linkname: target,
+		Mode:     0777,
+		ModTime:  time.Unix(0, 0),
+	}, nil)
+}
+
+// mkdirAll creates the resolved directory dir and its parents owned by root.
+func (t *tree) mkdirAll(dir string) (err error) {
+	if dir == "/" {
+		return
+	}
+	err = t.mkdirAll(path.Dir(dir))
+	if err != nil {
+		return
+	}
+
+	if info, statErr := os.Lstat(t.hostPath(dir)); statErr == nil && info.IsDir() {
+		return
+	}
+	return t.add(dir, &tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     dir,
+		Mode:     0755,
+		ModTime:  time.Unix(0, 0),
+	}, nil)
+}
+
+// setMode changes permission bits of name.
+func (t *tree) setMode(name string, perm fs.FileMode) (err error) {
+	node, ok := t.inodes[name]
+	if !ok {
+		err = fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+		return
+	}
+
+	node.mode = node.mode&^fs.ModePerm | perm
+	return
+}
+
+// removeGlob removes names matching pattern, e.g. /etc/ssh/ssh_host_*.
+// Only the base of pattern may have wildcards, symlinks in its directory are followed within the tree.
+func (t *tree) removeGlob(pattern string) (err error) {
+	dir, err := t.resolve(path.Dir(pattern))
+	if err != nil {
+		return
+	}
+
+	entries, err := os.ReadDir(t.hostPath(dir))
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		var matched bool
+		matched, err = path.Match(path.Base(pattern), entry.Name())
+		if err != nil {
+			return
+		}
+		if !matched {
+			continue
+		}
+		err = t.remove(path.Join(dir, entry.Name()))
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// statMode converts fs.FileMode to st_mode of Linux.
+func statMode(mode fs.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		m |= syscall.S_ISUID
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= syscall.S_ISGID
+	}
+	if mode&fs.ModeSticky != 0 {
+		m |= syscall.S_ISVTX
+	}
+
+	switch {
+	case mode.IsDir():
+		m |= syscall.S_IFDIR
+	case mode&fs.ModeSymlink != 0:
+		m |= syscall.S_IFLNK
+	case mode&fs.ModeCharDevice != 0:
+		m |= syscall.S_IFCHR
+	case mode&fs.ModeDevice != 0:
+		m |= syscall.S_IFBLK
+	case mode&fs.ModeNamedPipe != 0:
+		m |= syscall.S_IFIFO
+	default:
+		m |= syscall.S_IFREG
+	}
+
+	return m
+}
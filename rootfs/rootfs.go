@@ -0,0 +1,263 @@
+// Package rootfs builds RootFS images of microVMs from container images,
+// with neither root nor Docker.
+package rootfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type BuildOpt struct {
+	// OCI image layout directory, or docker save tarball
+	Source string
+	// picks the image if Source contains many, e.g. golang:1.19
+	Ref string
+	// picks the image in multi-platform indexes
+	Platform string
+	// path of the ext4 image file
+	Output string
+	// size of the image in bytes
+	Size int64
+	// written into /etc/resolv.conf
+	Nameservers []string
+	// statically linked tart binary installed as the agent, optional
+	AgentPath string
+	// where temporary files go, defaults to os.TempDir()
+	TempDir string
+}
+
+func (o BuildOpt) validate() (err error) {
+	if o.Source == "" {
+		err = errors.New("source is required")
+		return
+	}
+	if o.Output == "" {
+		err = errors.New("output is required")
+		return
+	}
+	if o.Size <= 0 {
+		err = fmt.Errorf("size must be positive, got %d", o.Size)
+		return
+	}
+
+	return
+}
+
+// Build writes an ext4 image of the container image with Tart's guest requirements.
+//
+// Layers are applied in a staging directory, which mkfs.ext4 copies into the image.
+// Ownership, modes and device nodes are then fixed with debugfs,
+// since they can not be set in the staging directory without root.
+func Build(ctx context.Context, opt BuildOpt) (err error) {
+	err = opt.validate()
+	if err != nil {
+		return
+	}
+	if opt.Platform == "" {
+		opt.Platform = "linux/amd64"
+	}
+
+	workDir, err := os.MkdirTemp(opt.TempDir, "tart-rootfs-*")
+	if err != nil {
+		err = fmt.Errorf("creating work directory: %w", err)
+		return
+	}
+	defer os.RemoveAll(workDir)
+
+	img, err := openImage(opt.Source, opt.Ref, opt.Platform, workDir)
+	if err != nil {
+		err = fmt.Errorf("opening image: %w", err)
+		return
+	}
+
+	staging := filepath.Join(workDir, "rootfs")
+	err = os.Mkdir(staging, 0755)
+	if err != nil {
+		err = fmt.Errorf("creating staging directory: %w", err)
+		return
+	}
+	t := newTree(staging)
+
+	for i, l := range img.layers {
+		err = t.applyLayerFile(l)
+		if err != nil {
+			err = fmt.Errorf("layer #%d: %w", i, err)
+			return
+		}
+	}
+
+	err = t.injectGuest(opt, img.env)
+	if err != nil {
+		err = fmt.Errorf("injecting guest requirements: %w", err)
+		return
+	}
+
+	err = t.writeImage(ctx, opt.Output, opt.Size, workDir)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func (t *tree) applyLayerFile(l layer) (err error) {
+	r, err := l.open()
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	err = t.applyLayer(r)
+	if err != nil {
+		return
+	}
+
+	// tar padding after the end of archive, and the digest is verified at EOF
+	_, err = io.Copy(io.Discard, r)
+	if err != nil {
+		err = fmt.Errorf("reading layer: %w", err)
+		return
+	}
+
+	return
+}
+
+// writeImage makes the ext4 image of the tree at output.
+func (t *tree) writeImage(ctx context.Context, output string, size int64, workDir string) (err error) {
+	script, err := t.debugfsScript()
+	if err != nil {
+		return
+	}
+
+	// mkfs.ext4 copies modification times from the staging directory
+	err = t.applyModTimes()
+	if err != nil {
+		err = fmt.Errorf("setting modification times: %w", err)
+		return
+	}
+
+	tempOutput := output + ".tmp"
+	_ = os.Remove(tempOutput)
+	defer os.Remove(tempOutput)
+
+	args := []string{"-q", "-F", "-L", "rootfs", "-d", t.dir, tempOutput, strconv.FormatInt(size/1024, 10) + "k"}
+	stdout, err := exec.CommandContext(ctx, "mkfs.ext4", args...).CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("running mkfs.ext4: %w, output: %s", err, stdout)
+		return
+	}
+
+	scriptPath := filepath.Join(workDir, "debugfs.script")
+	err = os.WriteFile(scriptPath, script, 0644)
+	if err != nil {
+		err = fmt.Errorf("writing debugfs script: %w", err)
+		return
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "debugfs", "-w", "-f", scriptPath, tempOutput)
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		err = fmt.Errorf("running debugfs: %w, stderr: %s", err, stderr.Bytes())
+		return
+	}
+	// debugfs exits zero on failed commands, which print to stderr after the banner
+	for _, line := range strings.Split(stderr.String(), "\n") {
+		if line != "" && !strings.HasPrefix(line, "debugfs ") {
+			err = fmt.Errorf("running debugfs: %s", line)
+			return
+		}
+	}
+
+	err = os.Rename(tempOutput, output)
+	if err != nil {
+		err = fmt.Errorf("renaming image: %w", err)
+		return
+	}
+
+	return
+}
+
+// debugfsScript sets ownership and modes of all files, and creates device nodes.
+func (t *tree) debugfsScript() (script []byte, err error) {
+	var names []string
+	err = filepath.WalkDir(t.dir, func(hostPath string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(t.dir, hostPath)
+		if err != nil {
+			return err
+		}
+		names = append(names, path.Clean("/"+filepath.ToSlash(rel)))
+		return nil
+	})
+	if err != nil {
+		err = fmt.Errorf("walking staging directory: %w", err)
+		return
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		if strings.ContainsAny(name, "\"\n") {
+			err = fmt.Errorf("unsupported file name %q", name)
+			return
+		}
+
+		node, ok := t.inodes[name]
+		if !ok {
+			// parents without entries in layers
+			var info fs.FileInfo
+			info, err = os.Lstat(t.hostPath(name))
+			if err != nil {
+				return
+			}
+			node = &inode{mode: info.Mode()}
+		}
+
+		// mknod of debugfs creates in the working directory
+		quoted, base := `"`+name+`"`, `"`+path.Base(name)+`"`
+		replace := fmt.Sprintf("cd \"%s\"\nrm %s\nmknod %s", path.Dir(name), base, base)
+		switch {
+		case node.mode&fs.ModeNamedPipe != 0:
+			fmt.Fprintf(&buf, "%s p\ncd /\n", replace)
+		case node.mode&fs.ModeCharDevice != 0:
+			fmt.Fprintf(&buf, "%s c %d %d\ncd /\n", replace, node.major, node.minor)
+		case node.mode&fs.ModeDevice != 0:
+			fmt.Fprintf(&buf, "%s b %d %d\ncd /\n", replace, node.major, node.minor)
+		}
+		fmt.Fprintf(&buf, "sif %s uid %d\nsif %s gid %d\nsif %s mode 0%o\n",
+			quoted, node.uid, quoted, node.gid, quoted, statMode(node.mode))
+	}
+
+	script = buf.Bytes()
+	return
+}
+
+func (t *tree) applyModTimes() (err error) {
+	for name, node := range t.inodes {
+		if node.mode&fs.ModeSymlink != 0 || node.modTime.IsZero() {
+			continue
+		}
+
+		err = os.Chtimes(t.hostPath(name), node.modTime, node.modTime)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
@@ -0,0 +1,290 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func layerTar(t *testing.T, headers ...*tar.Header) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, header := range headers {
+		if header.Typeflag == 0 {
+			header.Typeflag = tar.TypeReg
+		}
+		content := []byte("content of " + header.Name)
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(content))
+		}
+		require.NoError(t, tw.WriteHeader(header))
+		if header.Typeflag == tar.TypeReg {
+			_, err := tw.Write(content)
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+
+	return buf.Bytes()
+}
+
+// guestLayer has what Tart needs from images.
+func guestLayer(t *testing.T) []byte {
+	return layerTar(t,
+		&tar.Header{Typeflag: tar.TypeDir, Name: "sbin/", Mode: 0755},
+		&tar.Header{Typeflag: tar.TypeDir, Name: "usr/lib/systemd/", Mode: 0755},
+		&tar.Header{Typeflag: tar.TypeDir, Name: "usr/sbin/", Mode: 0755},
+		&tar.Header{Name: "usr/lib/systemd/systemd", Mode: 0755},
+		&tar.Header{Typeflag: tar.TypeSymlink, Name: "sbin/init", Linkname: "/usr/lib/systemd/systemd"},
+		&tar.Header{Name: "usr/sbin/sshd", Mode: 0755},
+	)
+}
+
+// dockerSave writes a tarball in the format of docker save.
+func dockerSave(t *testing.T, env []string, layers ...[]byte) string {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	add := func(name string, content []byte) {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}))
+		_, err := tw.Write(content)
+		require.NoError(t, err)
+	}
+
+	manifest := dockerManifest{Config: "config.json", RepoTags: []string{"test:latest"}}
+	for i, l := range layers {
+		name := filepath.Join(string(rune('a'+i)), "layer.tar")
+		add(name, l)
+		manifest.Layers = append(manifest.Layers, name)
+	}
+	var config imageConfig
+	config.Config.Env = env
+	configJSON, err := json.Marshal(config)
+	require.NoError(t, err)
+	add("config.json", configJSON)
+	manifestJSON, err := json.Marshal([]dockerManifest{manifest})
+	require.NoError(t, err)
+	add("manifest.json", manifestJSON)
+	require.NoError(t, tw.Close())
+
+	path := filepath.Join(t.TempDir(), "image.tar")
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0644))
+	return path
+}
+
+func debugfs(t *testing.T, image string, request string) string {
+	output, err := exec.Command("debugfs", "-R", request, image).CombinedOutput()
+	require.NoError(t, err, string(output))
+	return string(output)
+}
+
+func TestBuild(t *testing.T) {
+	dir := func(name string, mode int64, uid int) *tar.Header {
+		return &tar.Header{Typeflag: tar.TypeDir, Name: name, Mode: mode, Uid: uid, Gid: uid}
+	}
+
+	lower := layerTar(t,
+		dir("etc/", 0755, 0),
+		&tar.Header{Name: "etc/old", Mode: 0644},
+		&tar.Header{Name: "etc/shadow", Mode: 0640, Gid: 42},
+		dir("etc/ssh/", 0755, 0),
+		&tar.Header{Name: "etc/ssh/ssh_host_rsa_key", Mode: 0600},
+		dir("usr/", 0755, 0),
+		dir("usr/lib/", 0755, 0),
+		dir("usr/bin/", 0755, 0),
+		&tar.Header{Name: "usr/bin/passwd", Mode: 04755},
+		&tar.Header{Typeflag: tar.TypeSymlink, Name: "lib", Linkname: "usr/lib"},
+		dir("var/cache/", 0755, 0),
+		&tar.Header{Name: "var/cache/stale", Mode: 0644},
+		dir("home/user/", 0700, 1000),
+		dir("dev/", 0755, 0),
+		&tar.Header{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0666, Devmajor: 1, Devminor: 3},
+		// absolute symlinks resolve in the image, never on the host
+		&tar.Header{Typeflag: tar.TypeSymlink, Name: "escape", Linkname: "/../../"},
+	)
+	upper := layerTar(t,
+		&tar.Header{Name: "etc/.wh.old"},
+		dir("var/cache/", 0755, 0),
+		&tar.Header{Name: "var/cache/new", Mode: 0644},
+		&tar.Header{Name: "var/cache/.wh..wh..opq"},
+		&tar.Header{Name: "lib/libfoo.so", Mode: 0755},
+		&tar.Header{Typeflag: tar.TypeLink, Name: "usr/bin/passwd2", Linkname: "usr/bin/passwd"},
+		&tar.Header{Name: "escape/etc/escaped", Mode: 0644},
+	)
+	source := dockerSave(t, []string{"PATH=/usr/local/go/bin:/usr/bin:/bin"}, guestLayer(t), lower, upper)
+
+	output := filepath.Join(t.TempDir(), "rootfs.ext4")
+	err := Build(context.Background(), BuildOpt{
+		Source:      source,
+		Output:      output,
+		Size:        32 << 20,
+		Nameservers: []string{"192.0.2.53"},
+	})
+	require.NoError(t, err)
+
+	notFound := regexp.MustCompile(`File not found`)
+	assert.Regexp(t, notFound, debugfs(t, output, "stat /etc/old"))
+	assert.Regexp(t, notFound, debugfs(t, output, "stat /var/cache/stale"))
+	assert.Regexp(t, notFound, debugfs(t, output, "stat /etc/ssh/ssh_host_rsa_key"))
+	assert.Contains(t, debugfs(t, output, "cat /var/cache/new"), "content of var/cache/new")
+	assert.Contains(t, debugfs(t, output, "cat /usr/lib/libfoo.so"), "content of lib/libfoo.so")
+	assert.Contains(t, debugfs(t, output, "cat /etc/escaped"), "content of escape/etc/escaped")
+
+	assert.Regexp(t, `Mode:\s+04755`, debugfs(t, output, "stat /usr/bin/passwd"))
+	assert.Regexp(t, `Links: 2`, debugfs(t, output, "stat /usr/bin/passwd2"))
+	assert.Regexp(t, `Group:\s+42`, debugfs(t, output, "stat /etc/shadow"))
+	assert.Regexp(t, `User:\s+1000\s+Group:\s+1000`, debugfs(t, output, "stat /home/user"))
+	assert.Regexp(t, `Mode:\s+0700`, debugfs(t, output, "stat /home/user"))
+	assert.Regexp(t, `Type: character special`, debugfs(t, output, "stat /dev/null"))
+	assert.Regexp(t, `major 1, minor 3|Device major/minor number: 01:03`, debugfs(t, output, "stat /dev/null"))
+
+	assert.Contains(t, debugfs(t, output, "cat /etc/resolv.conf"), "nameserver 192.0.2.53")
+	assert.Contains(t, debugfs(t, output, "cat /etc/environment"), `PATH="/usr/local/go/bin:/usr/bin:/bin"`)
+	assert.Contains(t, debugfs(t, output, "cat /etc/ssh/sshd_config.d/tart.conf"), "PermitRootLogin prohibit-password")
+	assert.Regexp(t, `Type: symlink`, debugfs(t, output, "stat /etc/systemd/system/multi-user.target.wants/tart-config-drive.service"))
+	assert.Regexp(t, `Mode:\s+0700`, debugfs(t, output, "stat /root/.ssh"))
+	assert.Regexp(t, `User:\s+0\s+Group:\s+0`, debugfs(t, output, "stat /usr/local/sbin/tart-metadata"))
+}
+
+// ociLayout writes an OCI image layout with a gzipped layer.
+func ociLayout(t *testing.T, layer []byte) string {
+	dir := t.TempDir()
+	addBlob := func(content []byte) string {
+		sum := sha256.Sum256(content)
+		digest := hex.EncodeToString(sum[:])
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "blobs", "sha256", digest), content, 0644))
+		return "sha256:" + digest
+	}
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, err := zw.Write(layer)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	manifest, err := json.Marshal(ociManifest{
+		Config: descriptor{Digest: addBlob([]byte(`{"config":{"Env":["LANG=C.UTF-8"]}}`))},
+		Layers: []descriptor{
+			{MediaType: "application/vnd.oci.image.layer.v1.tar", Digest: addBlob(guestLayer(t))},
+			{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip", Digest: addBlob(gz.Bytes())},
+		},
+	})
+	require.NoError(t, err)
+	index, err := json.Marshal(ociIndex{Manifests: []descriptor{{
+		Digest:      addBlob(manifest),
+		Annotations: map[string]string{annotationRefName: "latest"},
+	}}})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "index.json"), index, 0644))
+
+	return dir
+}
+
+func TestBuild_OCILayout(t *testing.T) {
+	source := ociLayout(t, layerTar(t, &tar.Header{Name: "etc/os-release", Mode: 0644}))
+	output := filepath.Join(t.TempDir(), "rootfs.ext4")
+
+	opt := BuildOpt{Source: source, Ref: "latest", Output: output, Size: 32 << 20}
+	require.NoError(t, Build(context.Background(), opt))
+	assert.Contains(t, debugfs(t, output, "cat /etc/os-release"), "content of etc/os-release")
+	assert.Contains(t, debugfs(t, output, "cat /etc/environment"), `LANG="C.UTF-8"`)
+
+	// tampered blobs are refused
+	blobs, err := filepath.Glob(filepath.Join(source, "blobs", "sha256", "*"))
+	require.NoError(t, err)
+	for _, blob := range blobs {
+		content, err := os.ReadFile(blob)
+		require.NoError(t, err)
+		if bytes.HasPrefix(content, []byte{0x1f, 0x8b}) {
+			require.NoError(t, os.WriteFile(blob, layerTar(t, &tar.Header{Name: "etc/evil", Mode: 0644}), 0644))
+		}
+	}
+	assert.ErrorContains(t, Build(context.Background(), opt), "digest mismatch")
+}
+
+func TestBuild_GuestRequirements(t *testing.T) {
+	systemd := &tar.Header{Name: "lib/systemd/systemd", Mode: 0755}
+	init := &tar.Header{Typeflag: tar.TypeSymlink, Name: "sbin/init", Linkname: "../lib/systemd/systemd"}
+	sshd := &tar.Header{Name: "usr/sbin/sshd", Mode: 0755}
+	agent := filepath.Join(t.TempDir(), "tart")
+	require.NoError(t, os.WriteFile(agent, []byte("agent"), 0755))
+
+	tests := []struct {
+		name      string
+		headers   []*tar.Header
+		agentPath string
+		wantErr   string
+	}{
+		{name: "complete", headers: []*tar.Header{systemd, init, sshd}},
+		{name: "agent without sshd", headers: []*tar.Header{systemd, init}, agentPath: agent},
+		{name: "no init", headers: []*tar.Header{systemd, sshd}, wantErr: "/sbin/init is missing"},
+		{name: "dangling init", headers: []*tar.Header{init, sshd}, wantErr: "/sbin/init is missing"},
+		{name: "no sshd", headers: []*tar.Header{systemd, init}, wantErr: "sshd is missing"},
+	}
+	for _, tt := range tests {
+		headers := []*tar.Header{
+			{Typeflag: tar.TypeDir, Name: "sbin/", Mode: 0755},
+			{Typeflag: tar.TypeDir, Name: "lib/systemd/", Mode: 0755},
+			{Typeflag: tar.TypeDir, Name: "usr/sbin/", Mode: 0755},
+		}
+		for _, header := range tt.headers {
+			// layerTar fills in sizes
+			copied := *header
+			headers = append(headers, &copied)
+		}
+		opt := BuildOpt{
+			Source:    dockerSave(t, nil, layerTar(t, headers...)),
+			Output:    filepath.Join(t.TempDir(), "rootfs.ext4"),
+			Size:      32 << 20,
+			AgentPath: tt.agentPath,
+		}
+		err := Build(context.Background(), opt)
+		if tt.wantErr != "" {
+			assert.ErrorContains(t, err, tt.wantErr, tt.name)
+			continue
+		}
+		assert.NoError(t, err, tt.name)
+	}
+}
+
+func TestBuild_SymlinkedParents(t *testing.T) {
+	// absolute symlinks of the image happen to point at real directories of the builder
+	host := t.TempDir()
+	hostKey := filepath.Join(host, "ssh", "ssh_host_rsa_key")
+	hostUnit := filepath.Join(host, "system", "multi-user.target.wants", "systemd-resolved.service")
+	for _, path := range []string{hostKey, hostUnit} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte("of the builder"), 0600))
+	}
+
+	layer := layerTar(t,
+		&tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0755},
+		&tar.Header{Typeflag: tar.TypeSymlink, Name: "etc/ssh", Linkname: filepath.Join(host, "ssh")},
+		&tar.Header{Typeflag: tar.TypeDir, Name: "etc/systemd/", Mode: 0755},
+		&tar.Header{Typeflag: tar.TypeSymlink, Name: "etc/systemd/system", Linkname: filepath.Join(host, "system")},
+		&tar.Header{Typeflag: tar.TypeDir, Name: "var/roothome/", Mode: 0755},
+		&tar.Header{Typeflag: tar.TypeSymlink, Name: "root", Linkname: "/var/roothome"},
+	)
+	source := dockerSave(t, nil, guestLayer(t), layer)
+	output := filepath.Join(t.TempDir(), "rootfs.ext4")
+	require.NoError(t, Build(context.Background(), BuildOpt{Source: source, Output: output, Size: 32 << 20}))
+
+	assert.FileExists(t, hostKey)
+	assert.FileExists(t, hostUnit)
+
+	assert.Regexp(t, `Type: symlink`, debugfs(t, output, "stat /root"))
+	assert.Regexp(t, `Mode:\s+0700`, debugfs(t, output, "stat /var/roothome/.ssh"))
+	assert.Contains(t, debugfs(t, output, "cat /etc/ssh/sshd_config.d/tart.conf"), "PermitRootLogin prohibit-password")
+}
@@ -0,0 +1,470 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// media types of OCI and Docker images, which are told apart by their content anyway
+const (
+	mediaTypeOCIIndex      = "application/vnd.oci.image.index.v1+json"
+	mediaTypeDockerList    = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeLayerZstd     = "application/vnd.oci.image.layer.v1.tar+zstd"
+	annotationRefName      = "org.opencontainers.image.ref.name"
+	annotationContainerRef = "io.containerd.image.name"
+)
+
+// image is a container image read from disk.
+type image struct {
+	// layers from the bottom up
+	layers []layer
+	// environment variables of the image config, e.g. PATH=/usr/local/go/bin:...
+	env []string
+}
+
+// layer is a tar archive of file system changes, optionally gzipped.
+type layer struct {
+	path string
+	// sha256 digest of the file, verified when read if not empty
+	digest string
+}
+
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations"`
+	Platform    *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform"`
+}
+
+// ociIndex is index.json of OCI layout, or a multi-platform image index.
+type ociIndex struct {
+	MediaType string       `json:"mediaType"`
+	Manifests []descriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    descriptor   `json:"config"`
+	Layers    []descriptor `json:"layers"`
+	// present in image indexes
+	Manifests []descriptor `json:"manifests"`
+}
+
+// dockerManifest is an entry of manifest.json in docker save tarballs.
+type dockerManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+type imageConfig struct {
+	Config struct {
+		Env []string `json:"Env"`
+	} `json:"config"`
+}
+
+// openImage reads the image at src, which is an OCI image layout directory,
+// or a docker save tarball, or its extracted directory.
+// ref picks the image if there are many, platform is like linux/amd64.
+// A temporary directory may be created under tmpDir for tarballs.
+func openImage(src string, ref string, platform string, tmpDir string) (img image, err error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		err = fmt.Errorf("stat image: %w", err)
+		return
+	}
+
+	dir := src
+	if !info.IsDir() {
+		dir, err = os.MkdirTemp(tmpDir, "tart-image-*")
+		if err != nil {
+			err = fmt.Errorf("creating temp directory: %w", err)
+			return
+		}
+
+		err = extractArchive(src, dir)
+		if err != nil {
+			err = fmt.Errorf("extracting image tarball: %w", err)
+			return
+		}
+	}
+
+	// docker save tarballs since Docker 25 are OCI layouts as well, manifest.json is preferred for tags
+	if _, statErr := os.Stat(filepath.Join(dir, "manifest.json")); statErr == nil {
+		img, err = openDockerArchive(dir, ref)
+		return
+	}
+	if _, statErr := os.Stat(filepath.Join(dir, "index.json")); statErr == nil {
+		img, err = openOCILayout(dir, ref, platform)
+		return
+	}
+
+	err = errors.New("neither an OCI image layout nor a docker save tarball")
+	return
+}
+
+func openDockerArchive(dir string, ref string) (img image, err error) {
+	var manifests []dockerManifest
+	err = readJSON(filepath.Join(dir, "manifest.json"), "", &manifests)
+	if err != nil {
+		return
+	}
+
+	var manifest *dockerManifest
+	for i := range manifests {
+		if ref == "" || contains(manifests[i].RepoTags, ref) {
+			manifest = &manifests[i]
+			break
+		}
+	}
+	if manifest == nil {
+		err = fmt.Errorf("image %s not found in the tarball", ref)
+		return
+	}
+	if ref == "" && len(manifests) > 1 {
+		err = fmt.Errorf("tarball contains %d images, pick one with ref", len(manifests))
+		return
+	}
+
+	for _, name := range manifest.Layers {
+		var path string
+		path, err = secureJoin(dir, name)
+		if err != nil {
+			return
+		}
+		img.layers = append(img.layers, layer{path: path, digest: digestOfBlobPath(name)})
+	}
+
+	if manifest.Config != "" {
+		var config imageConfig
+		var path string
+		path, err = secureJoin(dir, manifest.Config)
+		if err != nil {
+			return
+		}
+		err = readJSON(path, digestOfBlobPath(manifest.Config), &config)
+		if err != nil {
+			return
+		}
+		img.env = config.Config.Env
+	}
+
+	return
+}
+
+func openOCILayout(dir string, ref string, platform string) (img image, err error) {
+	var index ociIndex
+	err = readJSON(filepath.Join(dir, "index.json"), "", &index)
+	if err != nil {
+		return
+	}
+
+	var candidates []descriptor
+	for _, d := range index.Manifests {
+		if ref == "" || d.Annotations[annotationRefName] == ref || d.Annotations[annotationContainerRef] == ref {
+			candidates = append(candidates, d)
+		}
+	}
+	switch {
+	case len(candidates) == 0:
+		err = fmt.Errorf("image %s not found in the layout", ref)
+		return
+	case len(candidates) > 1 && ref == "":
+		err = fmt.Errorf("layout contains %d images, pick one with ref", len(candidates))
+		return
+	}
+
+	manifest, err := resolveManifest(dir, candidates[0], platform)
+	if err != nil {
+		return
+	}
+
+	for _, d := range manifest.Layers {
+		if d.MediaType == mediaTypeLayerZstd {
+			err = fmt.Errorf("zstd compressed layer %s is not supported", d.Digest)
+			return
+		}
+
+		var path string
+		path, err = blobPath(dir, d.Digest)
+		if err != nil {
+			return
+		}
+		img.layers = append(img.layers, layer{path: path, digest: d.Digest})
+	}
+
+	if manifest.Config.Digest != "" {
+		var config imageConfig
+		var path string
+		path, err = blobPath(dir, manifest.Config.Digest)
+		if err != nil {
+			return
+		}
+		err = readJSON(path, manifest.Config.Digest, &config)
+		if err != nil {
+			return
+		}
+		img.env = config.Config.Env
+	}
+
+	return
+}
+
+// resolveManifest reads the manifest d points to, walking down image indexes by platform.
+func resolveManifest(dir string, d descriptor, platform string) (manifest ociManifest, err error) {
+	// an index rarely nests more than once
+	for depth := 0; depth < 4; depth++ {
+		var path string
+		path, err = blobPath(dir, d.Digest)
+		if err != nil {
+			return
+		}
+		manifest = ociManifest{}
+		err = readJSON(path, d.Digest, &manifest)
+		if err != nil {
+			return
+		}
+
+		if manifest.MediaType != mediaTypeOCIIndex && manifest.MediaType != mediaTypeDockerList && len(manifest.Manifests) == 0 {
+			return
+		}
+
+		found := false
+		for _, m := range manifest.Manifests {
+			if m.Platform != nil && m.Platform.OS+"/"+m.Platform.Architecture == platform {
+				d, found = m, true
+				break
+			}
+		}
+		if !found {
+			err = fmt.Errorf("no image for platform %s", platform)
+			return
+		}
+	}
+
+	err = errors.New("image indexes nest too deep")
+	return
+}
+
+func blobPath(dir string, digest string) (path string, err error) {
+	algorithm, hexDigest, ok := strings.Cut(digest, ":")
+	if !ok || algorithm != "sha256" || len(hexDigest) != sha256.Size*2 {
+		err = fmt.Errorf("unsupported digest %q", digest)
+		return
+	}
+
+	path = filepath.Join(dir, "blobs", algorithm, hexDigest)
+	return
+}
+
+// digestOfBlobPath tells the digest from paths like blobs/sha256/<hex>,
+// or empty string for paths like <id>/layer.tar, whose digest is not known.
+func digestOfBlobPath(name string) string {
+	dir, hexDigest := filepath.Split(name)
+	if filepath.Clean(dir) != filepath.Join("blobs", "sha256") || len(hexDigest) != sha256.Size*2 {
+		return ""
+	}
+
+	return "sha256:" + hexDigest
+}
+
+func readJSON(path string, digest string, v any) (err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		err = fmt.Errorf("opening %s: %w", filepath.Base(path), err)
+		return
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if digest != "" {
+		r = newVerifyingReader(file, digest)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		err = fmt.Errorf("reading %s: %w", filepath.Base(path), err)
+		return
+	}
+
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		err = fmt.Errorf("decoding %s: %w", filepath.Base(path), err)
+		return
+	}
+
+	return
+}
+
+// open returns the uncompressed tar stream of the layer, whose digest is verified at EOF.
+func (l layer) open() (r io.ReadCloser, err error) {
+	file, err := os.Open(l.path)
+	if err != nil {
+		err = fmt.Errorf("opening layer: %w", err)
+		return
+	}
+
+	var verified io.Reader = file
+	if l.digest != "" {
+		verified = newVerifyingReader(file, l.digest)
+	}
+	buffered := bufio.NewReader(verified)
+
+	magic, _ := buffered.Peek(2)
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		var gz *gzip.Reader
+		gz, err = gzip.NewReader(buffered)
+		if err != nil {
+			_ = file.Close()
+			err = fmt.Errorf("decompressing layer: %w", err)
+			return
+		}
+		r = readCloser{Reader: gz, closers: []io.Closer{gz, file}}
+		return
+	}
+
+	r = readCloser{Reader: buffered, closers: []io.Closer{file}}
+	return
+}
+
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r readCloser) Close() (err error) {
+	for _, c := range r.closers {
+		if closeErr := c.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	return
+}
+
+// verifyingReader errors at EOF if the content does not match the digest.
+type verifyingReader struct {
+	r      io.Reader
+	hash   hash.Hash
+	digest string
+}
+
+func newVerifyingReader(r io.Reader, digest string) *verifyingReader {
+	return &verifyingReader{r: r, hash: sha256.New(), digest: digest}
+}
+
+func (v *verifyingReader) Read(p []byte) (n int, err error) {
+	n, err = v.r.Read(p)
+	v.hash.Write(p[:n])
+	if errors.Is(err, io.EOF) {
+		if got := "sha256:" + hex.EncodeToString(v.hash.Sum(nil)); got != v.digest {
+			err = fmt.Errorf("digest mismatch, want %s, got %s", v.digest, got)
+		}
+	}
+
+	return
+}
+
+// extractArchive extracts regular files and directories of the tarball at src into dir,
+// which is all image tarballs carry.
+func extractArchive(src string, dir string) (err error) {
+	file, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	tr := tar.NewReader(file)
+	for {
+		var header *tar.Header
+		header, err = tr.Next()
+		if errors.Is(err, io.EOF) {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		var path string
+		path, err = secureJoin(dir, header.Name)
+		if err != nil {
+			return
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0755)
+		case tar.TypeReg:
+			err = writeFile(path, tr, 0644)
+		case tar.TypeSymlink:
+			// layers shared between images in old docker save tarballs
+			var target string
+			target, err = secureJoin(dir, filepath.Join(filepath.Dir(header.Name), header.Linkname))
+			if err != nil {
+				return
+			}
+			err = os.MkdirAll(filepath.Dir(path), 0755)
+			if err == nil {
+				err = os.Symlink(target, path)
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func writeFile(path string, r io.Reader, mode os.FileMode) (err error) {
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(file, r)
+	if closeErr := file.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+
+	return
+}
+
+// secureJoin joins name to dir lexically, refusing names escaping dir.
+func secureJoin(dir string, name string) (path string, err error) {
+	path = filepath.Join(dir, filepath.Clean("/"+name))
+	if path != dir && !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+		err = fmt.Errorf("path %q escapes the image", name)
+		return
+	}
+
+	return
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
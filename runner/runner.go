@@ -9,6 +9,7 @@ import (
 
 	"github.com/nanmu42/tart/executor"
 	"github.com/nanmu42/tart/network"
+	"github.com/nanmu42/tart/session"
 
 	"go.uber.org/zap"
 )
@@ -18,6 +19,8 @@ type Opt struct {
 	AccessToken    string
 	Client         *network.Client
 	ExecutorConfig executor.Config
+	// optional, serves web terminals of jobs
+	SessionServer *session.Server
 }
 
 type Runner struct {
@@ -25,6 +28,11 @@ type Runner struct {
 	accessToken    string
 	client         *network.Client
 	executorConfig executor.Config
+	sessionServer  *session.Server
+	// session offered in job requests, until a job takes it
+	nextSession *session.Session
+	// sessions of jobs received, by job ID
+	jobSessions map[int]*session.Session
 }
 
 func NewRunner(opt Opt) (runner *Runner, err error) {
@@ -33,6 +41,8 @@ func NewRunner(opt Opt) (runner *Runner, err error) {
 		accessToken:    opt.AccessToken,
 		client:         opt.Client,
 		executorConfig: opt.ExecutorConfig,
+		sessionServer:  opt.SessionServer,
+		jobSessions:    make(map[int]*session.Session),
 	}
 	return
 }
@@ -52,9 +62,19 @@ func (r *Runner) PollNewJob(ctx context.Context) (job network.RequestJobResp, er
 			// relax
 		}
 
-		job, err = r.client.RequestJob(ctx, r.accessToken)
+		var sessionInfo *network.SessionInfo
+		sessionInfo, err = r.sessionInfo()
+		if err != nil {
+			return
+		}
+
+		job, err = r.client.RequestJob(ctx, r.accessToken, sessionInfo)
 		if err == nil {
 			r.logger.Info("got new job", zap.Reflect("job", job))
+			if r.nextSession != nil {
+				r.jobSessions[job.ID] = r.nextSession
+				r.nextSession = nil
+			}
 			return
 		}
 		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
@@ -65,9 +85,33 @@ func (r *Runner) PollNewJob(ctx context.Context) (job network.RequestJobResp, er
 	}
 }
 
+// sessionInfo returns the session offered in job requests, nil if the session server is disabled.
+func (r *Runner) sessionInfo() (info *network.SessionInfo, err error) {
+	if r.sessionServer == nil {
+		return
+	}
+
+	if r.nextSession == nil {
+		r.nextSession, err = r.sessionServer.NewSession()
+		if err != nil {
+			err = fmt.Errorf("creating session: %w", err)
+			return
+		}
+	}
+
+	info = r.sessionServer.Info(r.nextSession)
+	return
+}
+
 func (r *Runner) RunJob(ctx context.Context, job network.RequestJobResp) (err error) {
 	var result executor.BuildResult
 
+	jobSession := r.jobSessions[job.ID]
+	if jobSession != nil {
+		delete(r.jobSessions, job.ID)
+		defer r.sessionServer.Close(jobSession)
+	}
+
 	traceSink, err := network.NewJobTrace(network.JobTraceOpt{
 		Logger:   r.logger,
 		Client:   r.client,
@@ -86,7 +130,15 @@ func (r *Runner) RunJob(ctx context.Context, job network.RequestJobResp) (err er
 		}
 		if err != nil {
 			r.logger.Info("job failed", zap.Error(err), zap.Int("jobId", job.ID))
-			_ = traceSink.Fail(ctx, 0, network.FailureReasonRunnerSystemFailure)
+			reason := network.FailureReasonRunnerSystemFailure
+			var unsupportedErr *executor.UnsupportedError
+			var exhaustedErr *executor.ExhaustionError
+			if errors.As(err, &unsupportedErr) {
+				reason = network.FailureReasonRunnerUnsupported
+			} else if errors.As(err, &exhaustedErr) {
+				reason = exhaustedErr.FailureReason()
+			}
+			_ = traceSink.Fail(ctx, 0, reason)
 			return
 		}
 
@@ -103,18 +155,21 @@ func (r *Runner) RunJob(ctx context.Context, job network.RequestJobResp) (err er
 		return
 	}
 
-	exe, err := executor.NewExecutor(executor.Option{
-		Logger:   r.logger,
-		Ctx:      ctx,
-		Build:    build,
-		JobTrace: traceSink,
-		Config:   r.executorConfig,
+	exe, err := executor.New(executor.Option{
+		Logger:    r.logger,
+		Ctx:       ctx,
+		Build:     build,
+		JobTrace:  traceSink,
+		Artifacts: r.client,
+		Config:    r.executorConfig,
 	})
 	if err != nil {
 		err = fmt.Errorf("initializing executor: %w", err)
 		return
 	}
 	defer exe.Close(ctx)
+	// before the environment is gone
+	defer executor.ReportUsage(ctx, r.logger, exe, build, traceSink)
 
 	// since we are building our own runner, we may add some meme we like.
 	if isTodayThursday() {
@@ -127,8 +182,23 @@ func (r *Runner) RunJob(ctx context.Context, job network.RequestJobResp) (err er
 		return
 	}
 
-	result = exe.Build()
+	if terminal, ok := exe.(session.Terminal); ok && jobSession != nil {
+		jobSession.SetTerminal(terminal)
+	}
+
+	result = executor.RunBuild(ctx, r.logger, exe, build, traceSink)
+	transferErr := executor.TransferOut(ctx, r.logger, exe, build, traceSink, result.Err == nil)
+	if result.Err == nil && transferErr != nil {
+		result = executor.BuildResult{
+			Err:           transferErr,
+			FailureReason: network.FailureReasonRunnerSystemFailure,
+		}
+	}
 	err = result.Err
+	if err != nil {
+		executor.HoldForDebug(ctx, r.logger, exe, build)
+	}
+	r.waitTerminals(ctx, jobSession, traceSink)
 	if err != nil {
 		err = fmt.Errorf("running build: %w", err)
 		return
@@ -136,3 +206,17 @@ func (r *Runner) RunJob(ctx context.Context, job network.RequestJobResp) (err er
 
 	return
 }
+
+// waitTerminals keeps the environment while web terminals are connected,
+// at most for the timeout of the session server.
+func (r *Runner) waitTerminals(ctx context.Context, jobSession *session.Session, jobTrace io.Writer) {
+	if jobSession == nil || jobSession.Attached() == 0 {
+		return
+	}
+
+	timeout := r.sessionServer.Timeout()
+	_, _ = fmt.Fprintf(jobTrace, "Terminal is connected, waiting for it to disconnect, at most for %s...\n", timeout)
+	if !jobSession.WaitDetached(ctx, timeout) {
+		_, _ = io.WriteString(jobTrace, "Terminal is disconnected as the job finishes.\n")
+	}
+}
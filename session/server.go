@@ -0,0 +1,325 @@
+// Package session implements the session server of the runner,
+// through which Gitlab opens interactive web terminals into running jobs.
+//
+// Every job gets a session, whose URL, TLS certificate and authorization token
+// are sent to Gitlab when the job is requested.
+// Gitlab connects to the exec endpoint of the session with websocket,
+// which is bridged to a shell in the environment of the job.
+package session
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nanmu42/tart/network"
+
+	"go.uber.org/zap"
+)
+
+// Config is config of the session server.
+type Config struct {
+	// address to listen on, enables the session server if not empty
+	ListenAddress string `comment:"address the session server serving web terminals of jobs listens on, e.g. :8093, enables the session server if not empty"`
+	// address Gitlab reaches the session server at
+	AdvertiseAddress string `comment:"host:port Gitlab reaches the session server at over HTTPS, e.g. runner.example.com:8093, defaults to ListenAddress"`
+	// TLS certificate
+	CertFile string `comment:"path to TLS certificate in PEM, a self-signed one for AdvertiseAddress is generated on start if empty. Either way, Gitlab is told to trust it"`
+	// TLS private key
+	KeyFile string `comment:"path to TLS private key in PEM, required with CertFile"`
+	// how long a finished job waits for terminals
+	Timeout string `comment:"how long a finished job waits for its web terminals to disconnect, e.g. 10m, defaults to 30m"`
+}
+
+const (
+	defaultTimeout = 30 * time.Minute
+	// path prefix of sessions
+	sessionPrefix = "/session/"
+)
+
+// Enabled tells whether the session server should run.
+func (c Config) Enabled() bool {
+	return c.ListenAddress != ""
+}
+
+func (c Config) Validate() (err error) {
+	if !c.Enabled() {
+		return
+	}
+
+	host, _, err := net.SplitHostPort(c.advertiseAddress())
+	if err != nil {
+		err = fmt.Errorf("parsing advertise address: %w", err)
+		return
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		err = fmt.Errorf("advertise address %s has no host Gitlab can reach", c.advertiseAddress())
+		return
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		err = errors.New("cert file and key file must be set together")
+		return
+	}
+	_, err = c.timeout()
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func (c Config) advertiseAddress() string {
+	if c.AdvertiseAddress == "" {
+		return c.ListenAddress
+	}
+
+	return c.AdvertiseAddress
+}
+
+func (c Config) timeout() (timeout time.Duration, err error) {
+	if c.Timeout == "" {
+		timeout = defaultTimeout
+		return
+	}
+
+	timeout, err = time.ParseDuration(c.Timeout)
+	if err != nil {
+		err = fmt.Errorf("parsing timeout: %w", err)
+		return
+	}
+
+	return
+}
+
+// Server serves sessions of jobs over HTTPS.
+type Server struct {
+	logger  *zap.Logger
+	config  Config
+	timeout time.Duration
+	// PEM encoded certificate Gitlab is told to trust
+	certificate []byte
+	keyPair     tls.Certificate
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func NewServer(logger *zap.Logger, config Config) (s *Server, err error) {
+	err = config.Validate()
+	if err != nil {
+		return
+	}
+
+	s = &Server{
+		logger:   logger,
+		config:   config,
+		sessions: make(map[string]*Session),
+	}
+	s.timeout, err = config.timeout()
+	if err != nil {
+		return
+	}
+
+	if config.CertFile != "" {
+		s.certificate, err = os.ReadFile(config.CertFile)
+		if err != nil {
+			err = fmt.Errorf("reading cert file: %w", err)
+			return
+		}
+		s.keyPair, err = tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			err = fmt.Errorf("loading key pair: %w", err)
+			return
+		}
+
+		return
+	}
+
+	host, _, _ := net.SplitHostPort(config.advertiseAddress())
+	s.certificate, s.keyPair, err = selfSignedCertificate(host)
+	if err != nil {
+		err = fmt.Errorf("generating self-signed certificate: %w", err)
+		return
+	}
+
+	return
+}
+
+// selfSignedCertificate generates a certificate of host, which signs itself.
+func selfSignedCertificate(host string) (certificate []byte, keyPair tls.Certificate, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		err = fmt.Errorf("generating key: %w", err)
+		return
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		err = fmt.Errorf("generating serial number: %w", err)
+		return
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: host, Organization: []string{"Tart"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		err = fmt.Errorf("creating certificate: %w", err)
+		return
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		err = fmt.Errorf("marshaling key: %w", err)
+		return
+	}
+
+	certificate = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPair, err = tls.X509KeyPair(certificate, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	if err != nil {
+		err = fmt.Errorf("loading key pair: %w", err)
+		return
+	}
+
+	return
+}
+
+// Timeout is how long a finished job waits for its terminals to disconnect.
+func (s *Server) Timeout() time.Duration {
+	return s.timeout
+}
+
+// Serve serves sessions on ListenAddress until ctx is done.
+func (s *Server) Serve(ctx context.Context) (err error) {
+	listener, err := net.Listen("tcp", s.config.ListenAddress)
+	if err != nil {
+		err = fmt.Errorf("listening on %s: %w", s.config.ListenAddress, err)
+		return
+	}
+
+	err = s.serve(ctx, listener)
+	return
+}
+
+func (s *Server) serve(ctx context.Context, listener net.Listener) (err error) {
+	server := &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{s.keyPair},
+			MinVersion:   tls.VersionTLS12,
+		},
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		// hijacked terminal connections are closed with their sessions
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	err = server.ServeTLS(listener, "", "")
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+
+	return
+}
+
+// NewSession creates a session, which is served until it's closed.
+func (s *Server) NewSession() (session *Session, err error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return
+	}
+	token, err := randomHex(32)
+	if err != nil {
+		return
+	}
+
+	session = newSession(s.logger.With(zap.String("session", id)), id, token)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[id] = session
+
+	return
+}
+
+// Info tells Gitlab how to reach the session.
+func (s *Server) Info(session *Session) *network.SessionInfo {
+	return &network.SessionInfo{
+		URL:           "https://" + s.config.advertiseAddress() + sessionPrefix + session.id,
+		Certificate:   string(s.certificate),
+		Authorization: session.token,
+	}
+}
+
+// Close stops serving the session and disconnects its terminals.
+func (s *Server) Close(session *Session) {
+	s.mu.Lock()
+	delete(s.sessions, session.id)
+	s.mu.Unlock()
+
+	session.close()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// /session/<id>/exec
+	rest := strings.TrimPrefix(r.URL.Path, sessionPrefix)
+	id, endpoint, _ := strings.Cut(rest, "/")
+	if rest == r.URL.Path || endpoint != "exec" {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	session, ok := s.sessions[id]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	session.serveTerminal(w, r)
+}
+
+func randomHex(size int) (s string, err error) {
+	buf := make([]byte, size)
+	_, err = rand.Read(buf)
+	if err != nil {
+		err = fmt.Errorf("reading random bytes: %w", err)
+		return
+	}
+
+	s = hex.EncodeToString(buf)
+	return
+}
@@ -0,0 +1,293 @@
+package session
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	// binary frames carry terminal data, text frames, if any, resize the terminal
+	// in the form of {"width": 80, "height": 24}
+	subprotocolTerminal = "terminal.gitlab.com"
+	// text frames carry base64 encoded terminal data
+	subprotocolBase64 = "base64.terminal.gitlab.com"
+
+	// keeps proxies between Gitlab and the runner from closing idle terminals
+	pingInterval = 30 * time.Second
+	writeTimeout = 10 * time.Second
+)
+
+// Size is the size of a terminal in characters.
+type Size struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// defaultSize is the terminal size before Gitlab tells any.
+var defaultSize = Size{Width: 80, Height: 24}
+
+// Terminal is the environment of a job opening interactive shells.
+type Terminal interface {
+	// Shell runs a shell with a PTY of size, wired to stdin and stdout,
+	// and resizes the PTY for every size received, until the shell exits or ctx is done.
+	Shell(ctx context.Context, stdin io.Reader, stdout io.Writer, size Size, resize <-chan Size) error
+}
+
+// Session is the session of a job, serving terminals once its terminal is set.
+type Session struct {
+	logger *zap.Logger
+	id     string
+	token  string
+	// done once the session is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	terminal Terminal
+	attached int
+	// closed when the last terminal disconnects
+	detached chan struct{}
+}
+
+func newSession(logger *zap.Logger, id, token string) *Session {
+	ctx, cancel := context.WithCancel(context.Background())
+	detached := make(chan struct{})
+	close(detached)
+
+	return &Session{
+		logger:   logger,
+		id:       id,
+		token:    token,
+		ctx:      ctx,
+		cancel:   cancel,
+		detached: detached,
+	}
+}
+
+// SetTerminal lets Gitlab open terminals into t, which is usually called
+// once the environment of the job is prepared.
+func (s *Session) SetTerminal(t Terminal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.terminal = t
+}
+
+// Attached returns how many terminals are connected.
+func (s *Session) Attached() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.attached
+}
+
+// WaitDetached waits for all terminals to disconnect, at most for timeout,
+// returning whether they did.
+func (s *Session) WaitDetached(ctx context.Context, timeout time.Duration) bool {
+	s.mu.Lock()
+	detached := s.detached
+	s.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-detached:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *Session) attach() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.attached == 0 {
+		s.detached = make(chan struct{})
+	}
+	s.attached++
+}
+
+func (s *Session) detach() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.attached--
+	if s.attached == 0 {
+		close(s.detached)
+	}
+}
+
+// close disconnects terminals.
+func (s *Session) close() {
+	s.cancel()
+}
+
+var upgrader = websocket.Upgrader{
+	Subprotocols: []string{subprotocolTerminal, subprotocolBase64},
+	// Gitlab is no browser, the Authorization header is what counts
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// serveTerminal bridges the websocket connection to a shell of the terminal.
+func (s *Session) serveTerminal(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(s.token)) != 1 {
+		s.logger.Info("terminal request with invalid authorization", zap.String("remote", r.RemoteAddr))
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if s.ctx.Err() != nil {
+		http.Error(w, "session is closed", http.StatusGone)
+		return
+	}
+
+	s.mu.Lock()
+	terminal := s.terminal
+	s.mu.Unlock()
+	if terminal == nil {
+		http.Error(w, "terminal is not available yet, the job is preparing", http.StatusServiceUnavailable)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has replied
+		s.logger.Info("upgrading terminal connection", zap.Error(err))
+		return
+	}
+	defer conn.Close()
+
+	s.attach()
+	defer s.detach()
+	s.logger.Info("terminal connected", zap.String("remote", r.RemoteAddr), zap.String("subprotocol", conn.Subprotocol()))
+	defer s.logger.Info("terminal disconnected", zap.String("remote", r.RemoteAddr))
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	stdin, stdinWriter := io.Pipe()
+	resize := make(chan Size, 1)
+	go func() {
+		// the client is gone, so is the shell
+		defer cancel()
+		err := readFrames(conn, stdinWriter, resize)
+		_ = stdinWriter.CloseWithError(err)
+	}()
+	go ping(ctx, conn)
+
+	stdout := &frameWriter{conn: conn, base64: conn.Subprotocol() == subprotocolBase64}
+	err = terminal.Shell(ctx, stdin, stdout, defaultSize, resize)
+	if err != nil && ctx.Err() == nil {
+		s.logger.Info("running shell of terminal", zap.Error(err))
+		_ = stdout.close(websocket.CloseInternalServerErr, err.Error())
+		return
+	}
+
+	_ = stdout.close(websocket.CloseNormalClosure, "")
+}
+
+// readFrames writes terminal data from conn into stdin, and sends sizes to resize,
+// until the connection is closed.
+func readFrames(conn *websocket.Conn, stdin io.Writer, resize chan Size) (err error) {
+	base64Encoded := conn.Subprotocol() == subprotocolBase64
+	for {
+		var (
+			messageType int
+			message     []byte
+		)
+		messageType, message, err = conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		switch {
+		case messageType == websocket.TextMessage && base64Encoded:
+			message, err = base64.StdEncoding.DecodeString(string(message))
+			if err != nil {
+				return
+			}
+		case messageType == websocket.TextMessage:
+			var size Size
+			if json.Unmarshal(message, &size) == nil && size.Width > 0 && size.Height > 0 {
+				// only the latest size matters
+				select {
+				case <-resize:
+				default:
+				}
+				resize <- size
+			}
+			continue
+		}
+
+		_, err = stdin.Write(message)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// frameWriter writes terminal data as frames, which is safe for concurrent use.
+type frameWriter struct {
+	mu     sync.Mutex
+	conn   *websocket.Conn
+	base64 bool
+}
+
+func (f *frameWriter) Write(p []byte) (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_ = f.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if f.base64 {
+		err = f.conn.WriteMessage(websocket.TextMessage, []byte(base64.StdEncoding.EncodeToString(p)))
+	} else {
+		err = f.conn.WriteMessage(websocket.BinaryMessage, p)
+	}
+	if err != nil {
+		return
+	}
+
+	n = len(p)
+	return
+}
+
+func (f *frameWriter) close(code int, text string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// the reason must fit in a control frame
+	if len(text) > 120 {
+		text = text[:120]
+	}
+	return f.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(writeTimeout))
+}
+
+func ping(ctx context.Context, conn *websocket.Conn) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout))
+			if errors.Is(err, websocket.ErrCloseSent) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package session
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// echoTerminal upper-cases lines it reads and tells sizes it gets,
+// exiting on a line of exit.
+type echoTerminal struct{}
+
+func (echoTerminal) Shell(ctx context.Context, stdin io.Reader, stdout io.Writer, size Size, resize <-chan Size) error {
+	fmt.Fprintf(stdout, "size %dx%d\n", size.Width, size.Height)
+
+	lines := make(chan string, 16)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(stdin)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case size := <-resize:
+			fmt.Fprintf(stdout, "size %dx%d\n", size.Width, size.Height)
+		case line, ok := <-lines:
+			if !ok || line == "exit" {
+				return nil
+			}
+			fmt.Fprintln(stdout, strings.ToUpper(line))
+		}
+	}
+}
+
+func startServer(t *testing.T) *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server, err := NewServer(zap.NewNop(), Config{
+		ListenAddress:    listener.Addr().String(),
+		AdvertiseAddress: listener.Addr().String(),
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- server.serve(ctx, listener)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		assert.NoError(t, <-served)
+	})
+
+	return server
+}
+
+// dialTerminal connects to the session as Gitlab does.
+func dialTerminal(server *Server, session *Session, subprotocol, authorization string) (*websocket.Conn, *http.Response, error) {
+	info := server.Info(session)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM([]byte(info.Certificate))
+	dialer := websocket.Dialer{
+		TLSClientConfig:  &tls.Config{RootCAs: roots},
+		Subprotocols:     []string{subprotocol},
+		HandshakeTimeout: 5 * time.Second,
+	}
+	header := http.Header{"Authorization": []string{authorization}}
+
+	return dialer.Dial(strings.Replace(info.URL, "https://", "wss://", 1)+"/exec", header)
+}
+
+func readText(t *testing.T, conn *websocket.Conn, want string) {
+	var got strings.Builder
+	for !strings.Contains(got.String(), want) {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		messageType, message, err := conn.ReadMessage()
+		require.NoError(t, err, "got %q so far", got.String())
+		if messageType == websocket.TextMessage {
+			message, err = base64.StdEncoding.DecodeString(string(message))
+			require.NoError(t, err)
+		}
+		got.Write(message)
+	}
+}
+
+func TestSession_Terminal(t *testing.T) {
+	server := startServer(t)
+	session, err := server.NewSession()
+	require.NoError(t, err)
+	info := server.Info(session)
+	assert.True(t, strings.HasPrefix(info.URL, "https://127.0.0.1:"))
+	assert.Contains(t, info.Certificate, "BEGIN CERTIFICATE")
+	token := info.Authorization
+
+	// the job is preparing
+	_, resp, err := dialTerminal(server, session, subprotocolTerminal, token)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	session.SetTerminal(echoTerminal{})
+	_, resp, err = dialTerminal(server, session, subprotocolTerminal, "wrong")
+	require.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	conn, _, err := dialTerminal(server, session, subprotocolTerminal, token)
+	require.NoError(t, err)
+	assert.Equal(t, subprotocolTerminal, conn.Subprotocol())
+	readText(t, conn, "size 80x24\n")
+	assert.Equal(t, 1, session.Attached())
+
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, []byte("hello\n")))
+	readText(t, conn, "HELLO\n")
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"width": 120, "height": 40}`)))
+	readText(t, conn, "size 120x40\n")
+
+	// the job waits for the terminal
+	assert.False(t, session.WaitDetached(context.Background(), 100*time.Millisecond))
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, []byte("exit\n")))
+	assert.True(t, session.WaitDetached(context.Background(), 5*time.Second))
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure), "got %v", err)
+	_ = conn.Close()
+	assert.Equal(t, 0, session.Attached())
+}
+
+func TestSession_Base64(t *testing.T) {
+	server := startServer(t)
+	session, err := server.NewSession()
+	require.NoError(t, err)
+	session.SetTerminal(echoTerminal{})
+
+	conn, _, err := dialTerminal(server, session, subprotocolBase64, server.Info(session).Authorization)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, subprotocolBase64, conn.Subprotocol())
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(base64.StdEncoding.EncodeToString([]byte("base64\n")))))
+	readText(t, conn, "BASE64\n")
+}
+
+func TestServer_Close(t *testing.T) {
+	server := startServer(t)
+	session, err := server.NewSession()
+	require.NoError(t, err)
+	session.SetTerminal(echoTerminal{})
+	token := server.Info(session).Authorization
+
+	conn, _, err := dialTerminal(server, session, subprotocolTerminal, token)
+	require.NoError(t, err)
+	defer conn.Close()
+	readText(t, conn, "size 80x24\n")
+
+	// the job is over
+	server.Close(session)
+	assert.True(t, session.WaitDetached(context.Background(), 5*time.Second))
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, _, err = conn.ReadMessage()
+	assert.Error(t, err)
+
+	_, resp, err := dialTerminal(server, session, subprotocolTerminal, token)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestConfig_Validate(t *testing.T) {
+	assert.NoError(t, Config{}.Validate())
+	assert.NoError(t, Config{ListenAddress: ":8093", AdvertiseAddress: "runner.example.com:8093"}.Validate())
+	assert.Error(t, Config{ListenAddress: ":8093"}.Validate())
+	assert.Error(t, Config{ListenAddress: "0.0.0.0:8093"}.Validate())
+	assert.Error(t, Config{ListenAddress: "10.0.0.1:8093", CertFile: "cert.pem"}.Validate())
+	assert.Error(t, Config{ListenAddress: "10.0.0.1:8093", Timeout: "soon"}.Validate())
+}
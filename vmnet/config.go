@@ -0,0 +1,122 @@
+package vmnet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Config describes the host side network of microVMs:
+// a bridge holding the gateway address, tap devices enslaved to the bridge,
+// and NAT from the subnet to the uplink interface.
+type Config struct {
+	// set up the network on tart run and tear it down on exit
+	Auto bool `comment:"set up the network on tart run and tear it down on exit"`
+	// subnet of microVMs in CIDR notation, the bridge takes the first address
+	Subnet string `comment:"subnet of microVMs in CIDR notation, e.g. 172.18.0.0/24, the bridge takes the first address"`
+	// uplink interface for NAT, like eth0
+	Uplink string `comment:"uplink interface for NAT, like eth0"`
+	// bridge name like tart0
+	Bridge string `comment:"bridge name like tart0, tap devices are named after it, e.g. tart0-tap0"`
+	// how many tap devices to create
+	TapCount int `comment:"how many tap devices to create"`
+	// uid owning the tap devices
+	TapOwnerUID int `comment:"uid owning the tap devices, Firecracker running as this user can attach to them"`
+	// gid owning the tap devices
+	TapOwnerGID int `comment:"gid owning the tap devices, Firecracker running in this group can attach to them"`
+}
+
+// DefaultConfig matches the defaults of rootfs/setup-tuntap.sh
+func DefaultConfig() Config {
+	return Config{
+		Auto:        false,
+		Subnet:      "172.18.0.0/24",
+		Uplink:      "eth0",
+		Bridge:      "tart0",
+		TapCount:    1,
+		TapOwnerUID: 0,
+		TapOwnerGID: 0,
+	}
+}
+
+func (c Config) Validate() (err error) {
+	if c.Uplink == "" {
+		err = errors.New("uplink interface is required")
+		return
+	}
+
+	return c.validateDevices()
+}
+
+// validateDevices checks the config except the uplink,
+// which isolated networks go without.
+func (c Config) validateDevices() (err error) {
+	if c.Bridge == "" {
+		err = errors.New("bridge name is required")
+		return
+	}
+	if c.TapCount <= 0 {
+		err = fmt.Errorf("tap count must be positive, got %d", c.TapCount)
+		return
+	}
+	// IFNAMSIZ is 16, including the trailing zero
+	if len(c.TapName(c.TapCount-1)) > 15 {
+		err = fmt.Errorf("bridge name %q is too long for naming tap devices", c.Bridge)
+		return
+	}
+
+	_, err = c.GatewayAddr()
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// TapName returns name of the idx-th tap device, idx starts from zero.
+func (c Config) TapName(idx int) string {
+	return fmt.Sprintf("%s-tap%d", c.Bridge, idx)
+}
+
+// TapNames returns names of all tap devices.
+func (c Config) TapNames() (names []string) {
+	for i := 0; i < c.TapCount; i++ {
+		names = append(names, c.TapName(i))
+	}
+
+	return
+}
+
+// GatewayAddr returns the address of bridge, which is the first
+// address in the subnet, along with the subnet mask.
+func (c Config) GatewayAddr() (addr *net.IPNet, err error) {
+	ip, subnet, err := net.ParseCIDR(c.Subnet)
+	if err != nil {
+		err = fmt.Errorf("parsing subnet: %w", err)
+		return
+	}
+	if ip.To4() == nil {
+		err = fmt.Errorf("only IPv4 subnet is supported, got %q", c.Subnet)
+		return
+	}
+	ones, bits := subnet.Mask.Size()
+	if bits-ones < 2 {
+		err = fmt.Errorf("subnet %q is too small", c.Subnet)
+		return
+	}
+
+	gateway := make(net.IP, net.IPv4len)
+	copy(gateway, subnet.IP.To4())
+	gateway[3]++
+
+	addr = &net.IPNet{
+		IP:   gateway,
+		Mask: subnet.Mask,
+	}
+	return
+}
+
+// nftTableName is the name of nftables table holding NAT and forward rules.
+func (c Config) nftTableName() string {
+	return "tart-" + c.Bridge
+}
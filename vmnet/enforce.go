@@ -0,0 +1,272 @@
+package vmnet
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// ack bit of flags in TCP header
+const tcpFlagACK = 0x10
+
+func policyTableName(tap string) string {
+	return "tart-policy-" + tap
+}
+
+// ApplyEgressPolicy enforces policy on traffic coming from the tap device.
+// Hostnames in the allowlist are resolved at the moment.
+// host is the address of the host on the tap side,
+// of which only DNS is reachable besides the allowed,
+// while replies of SSH are let through.
+//
+// When the tap device is enslaved to a bridge, rules are installed in the bridge family
+// on prerouting, otherwise in the ip family on forward and input,
+// the latter covering traffic to addresses of the host.
+//
+// The equivalent of allowlist mode in a bridge is:
+//
+//	table bridge tart-policy-<tap> {
+//		chain egress {
+//			type filter hook prerouting priority filter;
+//			iifname <tap> meta protocol arp accept
+//			iifname <tap> meta protocol != ip drop
+//			iifname <tap> ip daddr <host> tcp sport 22 tcp flags & ack == ack accept
+//			iifname <tap> ip daddr <host> meta l4proto {tcp, udp} th dport 53 accept
+//			iifname <tap> ip daddr <allowed> [meta l4proto tcp th dport <port>] accept
+//			iifname <tap> drop
+//		}
+//	}
+func ApplyEgressPolicy(ctx context.Context, tap string, host net.IP, policy EgressPolicy) (err error) {
+	err = policy.Validate()
+	if err != nil {
+		err = fmt.Errorf("validating policy: %w", err)
+		return
+	}
+	if policy.IsFull() {
+		err = RemoveEgressPolicy(tap)
+		return
+	}
+	if host.To4() == nil {
+		err = fmt.Errorf("host address %q is not IPv4", host)
+		return
+	}
+
+	var allowed []allowEntry
+	if policy.mode() == PolicyAllowlist {
+		allowed, err = resolveEntries(ctx, policy)
+		if err != nil {
+			return
+		}
+	}
+
+	link, err := netlink.LinkByName(tap)
+	if err != nil {
+		err = fmt.Errorf("looking up tap device: %w", err)
+		return
+	}
+	bridged := link.Attrs().MasterIndex != 0
+
+	conn, err := nftables.New()
+	if err != nil {
+		err = fmt.Errorf("connecting to nftables: %w", err)
+		return
+	}
+
+	table := &nftables.Table{
+		Name:   policyTableName(tap),
+		Family: nftables.TableFamilyIPv4,
+	}
+	chains := []*nftables.Chain{
+		{
+			Name:     "egress",
+			Table:    table,
+			Type:     nftables.ChainTypeFilter,
+			Hooknum:  nftables.ChainHookForward,
+			Priority: nftables.ChainPriorityFilter,
+		},
+		{
+			Name:     "input",
+			Table:    table,
+			Type:     nftables.ChainTypeFilter,
+			Hooknum:  nftables.ChainHookInput,
+			Priority: nftables.ChainPriorityFilter,
+		},
+	}
+	if bridged {
+		// bridge prerouting sees traffic to the host as well
+		table.Family = nftables.TableFamilyBridge
+		chains = chains[:1]
+		chains[0].Hooknum = nftables.ChainHookPrerouting
+	}
+
+	resetTable(conn, table)
+
+	fromTap := matchIIFName(tap)
+	accept := []expr.Any{verdict(expr.VerdictAccept)}
+	hostNet := &net.IPNet{IP: host.To4(), Mask: net.CIDRMask(32, 32)}
+	for _, chain := range chains {
+		conn.AddChain(chain)
+
+		if bridged {
+			conn.AddRule(rule(table, chain, fromTap, matchProtocol(unix.ETH_P_ARP, true), accept))
+			conn.AddRule(rule(table, chain, fromTap, matchProtocol(unix.ETH_P_IP, false), []expr.Any{verdict(expr.VerdictDrop)}))
+		}
+		// replies of SSH, conntrack is not relied on since bridge family support of it is optional
+		conn.AddRule(rule(table, chain, fromTap, matchIPv4Net(hostNet, true), matchTCPReply(22), accept))
+		for _, proto := range []byte{unix.IPPROTO_TCP, unix.IPPROTO_UDP} {
+			conn.AddRule(rule(table, chain,
+				fromTap,
+				matchIPv4Net(hostNet, true),
+				matchDestPort(proto, 53),
+				accept,
+			))
+		}
+		for _, entry := range allowed {
+			if entry.port == 0 {
+				conn.AddRule(rule(table, chain, fromTap, matchIPv4Net(entry.network, true), accept))
+				continue
+			}
+
+			for _, proto := range []byte{unix.IPPROTO_TCP, unix.IPPROTO_UDP} {
+				conn.AddRule(rule(table, chain,
+					fromTap,
+					matchIPv4Net(entry.network, true),
+					matchDestPort(proto, entry.port),
+					accept,
+				))
+			}
+		}
+		conn.AddRule(rule(table, chain, fromTap, []expr.Any{verdict(expr.VerdictDrop)}))
+	}
+
+	err = conn.Flush()
+	if err != nil {
+		err = fmt.Errorf("applying rules: %w", err)
+		return
+	}
+
+	return
+}
+
+// RemoveEgressPolicy removes rules installed by ApplyEgressPolicy.
+// It's safe to call even if there's none.
+func RemoveEgressPolicy(tap string) (err error) {
+	conn, err := nftables.New()
+	if err != nil {
+		err = fmt.Errorf("connecting to nftables: %w", err)
+		return
+	}
+
+	for _, family := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyBridge} {
+		deleteTable(conn, &nftables.Table{
+			Name:   policyTableName(tap),
+			Family: family,
+		})
+	}
+
+	err = conn.Flush()
+	if err != nil {
+		err = fmt.Errorf("deleting rules: %w", err)
+		return
+	}
+
+	return
+}
+
+// resolveEntries turns hostnames into IPv4 addresses.
+func resolveEntries(ctx context.Context, policy EgressPolicy) (resolved []allowEntry, err error) {
+	entries, err := policy.entries()
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.host == "" {
+			resolved = append(resolved, entry)
+			continue
+		}
+
+		var addrs []net.IPAddr
+		addrs, err = net.DefaultResolver.LookupIPAddr(ctx, entry.host)
+		if err != nil {
+			err = fmt.Errorf("resolving %s: %w", entry.host, err)
+			return
+		}
+		for _, addr := range addrs {
+			if addr.IP.To4() == nil {
+				continue
+			}
+			resolved = append(resolved, allowEntry{
+				network: &net.IPNet{IP: addr.IP.To4(), Mask: net.CIDRMask(32, 32)},
+				port:    entry.port,
+			})
+		}
+	}
+
+	return
+}
+
+// meta protocol <proto>, or meta protocol != <proto> if equal is false
+func matchProtocol(proto uint16, equal bool) []expr.Any {
+	op := expr.CmpOpEq
+	if !equal {
+		op = expr.CmpOpNeq
+	}
+
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyPROTOCOL, Register: 1},
+		&expr.Cmp{Op: op, Register: 1, Data: binaryutil.BigEndian.PutUint16(proto)},
+	}
+}
+
+// meta l4proto <proto> th dport <port>
+func matchDestPort(proto byte, port uint16) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       2,
+			Len:          2,
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(port)},
+	}
+}
+
+// tcp sport <port> tcp flags & ack == ack
+//
+// It matches replies only, since opening a connection takes a packet without ack.
+func matchTCPReply(port uint16) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       0,
+			Len:          2,
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(port)},
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       13,
+			Len:          1,
+		},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            1,
+			Mask:           []byte{tcpFlagACK},
+			Xor:            []byte{0},
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{tcpFlagACK}},
+	}
+}
@@ -0,0 +1,96 @@
+package vmnet
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// SetupIsolated creates the bridge and tap devices like Setup does,
+// but the network has no way out: microVMs on the bridge reach each other
+// and the bridge address only, traffic is never forwarded from or to the bridge.
+//
+// Uplink in cfg is ignored. The network is removed by Teardown.
+func SetupIsolated(cfg Config) (err error) {
+	err = cfg.validateDevices()
+	if err != nil {
+		err = fmt.Errorf("validating config: %w", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			_ = Teardown(cfg)
+		}
+	}()
+
+	bridge, _, err := setupBridge(cfg)
+	if err != nil {
+		err = fmt.Errorf("setting up bridge: %w", err)
+		return
+	}
+
+	for _, name := range cfg.TapNames() {
+		_, err = setupTap(cfg, name, bridge)
+		if err != nil {
+			err = fmt.Errorf("setting up tap device %s: %w", name, err)
+			return
+		}
+	}
+
+	err = setupIsolation(cfg)
+	if err != nil {
+		err = fmt.Errorf("setting up nftables rules: %w", err)
+		return
+	}
+
+	return
+}
+
+// setupIsolation is the equivalent of:
+//
+//	table ip tart-<bridge> {
+//		chain forward {
+//			type filter hook forward priority filter;
+//			iifname <bridge> drop
+//			oifname <bridge> drop
+//		}
+//	}
+func setupIsolation(cfg Config) (err error) {
+	conn, err := nftables.New()
+	if err != nil {
+		err = fmt.Errorf("connecting to nftables: %w", err)
+		return
+	}
+
+	table := &nftables.Table{
+		Name:   cfg.nftTableName(),
+		Family: nftables.TableFamilyIPv4,
+	}
+	resetTable(conn, table)
+
+	forward := conn.AddChain(&nftables.Chain{
+		Name:     "forward",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+	})
+	conn.AddRule(rule(table, forward,
+		matchIIFName(cfg.Bridge),
+		[]expr.Any{verdict(expr.VerdictDrop)},
+	))
+	conn.AddRule(rule(table, forward,
+		matchOIFName(cfg.Bridge),
+		[]expr.Any{verdict(expr.VerdictDrop)},
+	))
+
+	err = conn.Flush()
+	if err != nil {
+		err = fmt.Errorf("applying rules: %w", err)
+		return
+	}
+
+	return
+}
@@ -0,0 +1,107 @@
+package vmnet
+
+import (
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// Following helpers forge nftables expressions,
+// the comment on each one is its nft syntax equivalent.
+
+// ifname pads interface name into the form kernel compares with.
+func ifname(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name)
+	return b
+}
+
+// iifname <name>
+func matchIIFName(name string) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname(name)},
+	}
+}
+
+// oifname <name>
+func matchOIFName(name string) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname(name)},
+	}
+}
+
+// ip saddr <subnet>, or ip daddr <subnet> if dest is true
+func matchIPv4Net(subnet *net.IPNet, dest bool) []expr.Any {
+	// offsets in IPv4 header
+	offset := uint32(12)
+	if dest {
+		offset = 16
+	}
+
+	return []expr.Any{
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       offset,
+			Len:          net.IPv4len,
+		},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            net.IPv4len,
+			Mask:           subnet.Mask,
+			Xor:            make([]byte, net.IPv4len),
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: subnet.IP.Mask(subnet.Mask).To4()},
+	}
+}
+
+// ct state established,related
+func matchEstablished() []expr.Any {
+	return []expr.Any{
+		&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(expr.CtStateBitESTABLISHED | expr.CtStateBitRELATED),
+			Xor:            binaryutil.NativeEndian.PutUint32(0),
+		},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+	}
+}
+
+func verdict(kind expr.VerdictKind) expr.Any {
+	return &expr.Verdict{Kind: kind}
+}
+
+func rule(table *nftables.Table, chain *nftables.Chain, exprs ...[]expr.Any) *nftables.Rule {
+	r := &nftables.Rule{
+		Table: table,
+		Chain: chain,
+	}
+	for _, e := range exprs {
+		r.Exprs = append(r.Exprs, e...)
+	}
+
+	return r
+}
+
+// resetTable makes sure an empty table exists after the batch is flushed.
+func resetTable(conn *nftables.Conn, table *nftables.Table) {
+	// adding before deleting makes deletion never fail
+	conn.AddTable(table)
+	conn.DelTable(table)
+	conn.AddTable(table)
+}
+
+// deleteTable removes the table if it exists.
+func deleteTable(conn *nftables.Conn, table *nftables.Table) {
+	conn.AddTable(table)
+	conn.DelTable(table)
+}
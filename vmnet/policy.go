@@ -0,0 +1,226 @@
+package vmnet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type PolicyMode string
+
+const (
+	// PolicyNone denies all outbound traffic of microVM
+	PolicyNone PolicyMode = "none"
+	// PolicyAllowlist allows outbound traffic to listed destinations only
+	PolicyAllowlist PolicyMode = "allowlist"
+	// PolicyFull allows all outbound traffic
+	PolicyFull PolicyMode = "full"
+)
+
+// EgressPolicy controls where microVM can reach.
+// DNS of the host is always reachable, and so are SSH replies to the host
+// since Tart relies on them. The rest of the host is reachable only if allowed.
+type EgressPolicy struct {
+	// none, allowlist or full
+	Mode PolicyMode `comment:"none, allowlist or full, defaults to full"`
+	// allowed destinations in allowlist mode
+	Allow []string `comment:"allowed destinations in allowlist mode, each one is a CIDR, an IP or a hostname, with an optional port, e.g. 10.0.0.0/8, 223.5.5.5:53, gitlab.example.com:443"`
+}
+
+func (p EgressPolicy) mode() PolicyMode {
+	if p.Mode == "" {
+		return PolicyFull
+	}
+
+	return p.Mode
+}
+
+// IsFull reports whether the policy puts no restriction.
+func (p EgressPolicy) IsFull() bool {
+	return p.mode() == PolicyFull
+}
+
+func (p EgressPolicy) Validate() (err error) {
+	switch p.mode() {
+	case PolicyNone, PolicyFull:
+		return
+	case PolicyAllowlist:
+		_, err = p.entries()
+		return
+	default:
+		err = fmt.Errorf("unknown network policy mode %q", p.Mode)
+		return
+	}
+}
+
+func (p EgressPolicy) String() string {
+	if p.mode() != PolicyAllowlist {
+		return string(p.mode())
+	}
+
+	return fmt.Sprintf("%s(%s)", p.mode(), strings.Join(p.Allow, ", "))
+}
+
+// Tighten returns the policy requested by a job.
+// A job can only ask for a policy no looser than p.
+func (p EgressPolicy) Tighten(requested EgressPolicy) (tightened EgressPolicy, err error) {
+	err = requested.Validate()
+	if err != nil {
+		err = fmt.Errorf("invalid requested network policy: %w", err)
+		return
+	}
+
+	switch {
+	case requested.mode() == PolicyNone, p.mode() == PolicyFull:
+		tightened = requested
+		return
+	case p.mode() == PolicyNone, requested.mode() == PolicyFull:
+		err = fmt.Errorf("network policy %s is looser than the allowed %s", requested, p)
+		return
+	}
+
+	// both are allowlist
+	allowed, err := p.entries()
+	if err != nil {
+		return
+	}
+	wanted, err := requested.entries()
+	if err != nil {
+		return
+	}
+
+	for i, want := range wanted {
+		if !want.coveredByAny(allowed) {
+			err = fmt.Errorf("network policy destination %q is not allowed by %s", requested.Allow[i], p)
+			return
+		}
+	}
+
+	tightened = requested
+	return
+}
+
+const (
+	// PolicyVariable is the job variable to tighten network policy,
+	// value is one of none, allowlist and full.
+	PolicyVariable = "TART_NETWORK_POLICY"
+	// PolicyAllowVariable is the job variable listing allowed destinations
+	// in allowlist mode, separated by comma.
+	PolicyAllowVariable = "TART_NETWORK_ALLOW"
+)
+
+// PolicyFromVariables forges the policy requested by job variables.
+// ok is false if the job does not ask for any policy.
+func PolicyFromVariables(mode, allow string) (policy EgressPolicy, ok bool) {
+	if mode == "" {
+		return
+	}
+
+	policy.Mode = PolicyMode(strings.TrimSpace(mode))
+	for _, item := range strings.Split(allow, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		policy.Allow = append(policy.Allow, item)
+	}
+
+	ok = true
+	return
+}
+
+// allowEntry is the parsed form of an allowlist item.
+type allowEntry struct {
+	// either host or network is set
+	host    string
+	network *net.IPNet
+	// zero means any port
+	port uint16
+}
+
+func (p EgressPolicy) entries() (entries []allowEntry, err error) {
+	for _, item := range p.Allow {
+		var entry allowEntry
+		entry, err = parseAllowEntry(item)
+		if err != nil {
+			err = fmt.Errorf("parsing network policy destination %q: %w", item, err)
+			return
+		}
+		entries = append(entries, entry)
+	}
+
+	return
+}
+
+func parseAllowEntry(item string) (entry allowEntry, err error) {
+	item = strings.TrimSpace(item)
+	if item == "" {
+		err = errors.New("empty destination")
+		return
+	}
+
+	// only IPv4 is supported so the last colon always separates the port
+	if idx := strings.LastIndexByte(item, ':'); idx >= 0 {
+		var port uint64
+		port, err = strconv.ParseUint(item[idx+1:], 10, 16)
+		if err != nil || port == 0 {
+			err = fmt.Errorf("invalid port %q", item[idx+1:])
+			return
+		}
+		entry.port = uint16(port)
+		item = item[:idx]
+	}
+
+	if strings.Contains(item, "/") {
+		var network *net.IPNet
+		_, network, err = net.ParseCIDR(item)
+		if err != nil {
+			return
+		}
+		if network.IP.To4() == nil {
+			err = errors.New("only IPv4 is supported")
+			return
+		}
+		entry.network = network
+		return
+	}
+
+	if ip := net.ParseIP(item); ip != nil {
+		if ip.To4() == nil {
+			err = errors.New("only IPv4 is supported")
+			return
+		}
+		entry.network = &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}
+		return
+	}
+
+	entry.host = strings.ToLower(item)
+	return
+}
+
+// coveredBy reports whether all destinations of e are allowed by other.
+func (e allowEntry) coveredBy(other allowEntry) bool {
+	if other.port != 0 && other.port != e.port {
+		return false
+	}
+
+	if e.host != "" || other.host != "" {
+		return e.host == other.host
+	}
+
+	ones, _ := e.network.Mask.Size()
+	otherOnes, _ := other.network.Mask.Size()
+	return otherOnes <= ones && other.network.Contains(e.network.IP)
+}
+
+func (e allowEntry) coveredByAny(others []allowEntry) bool {
+	for _, other := range others {
+		if e.coveredBy(other) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,61 @@
+package vmnet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEgressPolicy_Tighten(t *testing.T) {
+	allowlist := EgressPolicy{
+		Mode:  PolicyAllowlist,
+		Allow: []string{"10.0.0.0/8", "223.5.5.5:53", "gitlab.example.com:443"},
+	}
+
+	var tests = []struct {
+		name      string
+		policy    EgressPolicy
+		requested EgressPolicy
+		wantErr   bool
+	}{
+		{"full to none", EgressPolicy{Mode: PolicyFull}, EgressPolicy{Mode: PolicyNone}, false},
+		{"default is full", EgressPolicy{}, allowlist, false},
+		{"none to full", EgressPolicy{Mode: PolicyNone}, EgressPolicy{Mode: PolicyFull}, true},
+		{"none to allowlist", EgressPolicy{Mode: PolicyNone}, allowlist, true},
+		{"allowlist to full", allowlist, EgressPolicy{Mode: PolicyFull}, true},
+		{"allowlist to none", allowlist, EgressPolicy{Mode: PolicyNone}, false},
+		{"allowlist to itself", allowlist, allowlist, false},
+		{"narrower subnet", allowlist, EgressPolicy{Mode: PolicyAllowlist, Allow: []string{"10.1.0.0/16:22", "10.2.3.4"}}, false},
+		{"wider subnet", allowlist, EgressPolicy{Mode: PolicyAllowlist, Allow: []string{"10.0.0.0/7"}}, true},
+		{"any port", allowlist, EgressPolicy{Mode: PolicyAllowlist, Allow: []string{"223.5.5.5"}}, true},
+		{"other port", allowlist, EgressPolicy{Mode: PolicyAllowlist, Allow: []string{"223.5.5.5:80"}}, true},
+		{"same host", allowlist, EgressPolicy{Mode: PolicyAllowlist, Allow: []string{"GitLab.example.com:443"}}, false},
+		{"other host", allowlist, EgressPolicy{Mode: PolicyAllowlist, Allow: []string{"example.com:443"}}, true},
+		{"invalid request", allowlist, EgressPolicy{Mode: "some"}, true},
+		{"invalid port", allowlist, EgressPolicy{Mode: PolicyAllowlist, Allow: []string{"10.0.0.1:http"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.policy.Tighten(tt.requested)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.requested, got)
+		})
+	}
+}
+
+func TestPolicyFromVariables(t *testing.T) {
+	_, ok := PolicyFromVariables("", "10.0.0.0/8")
+	assert.False(t, ok)
+
+	policy, ok := PolicyFromVariables("allowlist", " 10.0.0.0/8, ,example.com:443")
+	assert.True(t, ok)
+	assert.Equal(t, EgressPolicy{
+		Mode:  PolicyAllowlist,
+		Allow: []string{"10.0.0.0/8", "example.com:443"},
+	}, policy)
+}
@@ -0,0 +1,293 @@
+package vmnet
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+)
+
+const ipForwardPath = "/proc/sys/net/ipv4/ip_forward"
+
+// Setup creates the bridge and tap devices, enables IP forwarding,
+// and installs NAT and forward rules.
+//
+// Setup is idempotent, devices created by a previous run are reused
+// and rules are replaced. On error, devices created by this call are removed,
+// while those of a previous run are left to microVMs using them.
+// Rules are replaced in one transaction, which leaves the old ones on failure.
+func Setup(cfg Config) (err error) {
+	err = cfg.Validate()
+	if err != nil {
+		err = fmt.Errorf("validating config: %w", err)
+		return
+	}
+
+	// devices created by this call
+	var created []string
+	defer func() {
+		if err != nil {
+			// taps go before the bridge they are enslaved to
+			for i := len(created) - 1; i >= 0; i-- {
+				_ = deleteLink(created[i])
+			}
+		}
+	}()
+
+	bridge, bridgeCreated, err := setupBridge(cfg)
+	if bridgeCreated {
+		created = append(created, cfg.Bridge)
+	}
+	if err != nil {
+		err = fmt.Errorf("setting up bridge: %w", err)
+		return
+	}
+
+	for _, name := range cfg.TapNames() {
+		var tapCreated bool
+		tapCreated, err = setupTap(cfg, name, bridge)
+		if tapCreated {
+			created = append(created, name)
+		}
+		if err != nil {
+			err = fmt.Errorf("setting up tap device %s: %w", name, err)
+			return
+		}
+	}
+
+	err = os.WriteFile(ipForwardPath, []byte("1"), 0644)
+	if err != nil {
+		err = fmt.Errorf("enabling IP forwarding: %w", err)
+		return
+	}
+
+	err = setupNAT(cfg)
+	if err != nil {
+		err = fmt.Errorf("setting up nftables rules: %w", err)
+		return
+	}
+
+	return
+}
+
+// Teardown removes rules and devices created by Setup.
+// Resources that do not exist are skipped.
+//
+// IP forwarding is left enabled since other services on the host
+// may depend on it.
+func Teardown(cfg Config) (err error) {
+	conn, err := nftables.New()
+	if err != nil {
+		err = fmt.Errorf("connecting to nftables: %w", err)
+		return
+	}
+	deleteTable(conn, &nftables.Table{
+		Name:   cfg.nftTableName(),
+		Family: nftables.TableFamilyIPv4,
+	})
+	err = conn.Flush()
+	if err != nil {
+		err = fmt.Errorf("deleting nftables table: %w", err)
+		return
+	}
+
+	for _, name := range append(cfg.TapNames(), cfg.Bridge) {
+		err = deleteLink(name)
+		if err != nil {
+			err = fmt.Errorf("deleting %s: %w", name, err)
+			return
+		}
+	}
+
+	return
+}
+
+// setupBridge creates the bridge unless it exists, created tells which is the case.
+func setupBridge(cfg Config) (bridge netlink.Link, created bool, err error) {
+	bridge, err = netlink.LinkByName(cfg.Bridge)
+	if isLinkNotFound(err) {
+		err = netlink.LinkAdd(&netlink.Bridge{
+			LinkAttrs: netlink.LinkAttrs{Name: cfg.Bridge},
+		})
+		if err != nil {
+			err = fmt.Errorf("adding bridge: %w", err)
+			return
+		}
+		created = true
+
+		bridge, err = netlink.LinkByName(cfg.Bridge)
+	}
+	if err != nil {
+		err = fmt.Errorf("looking up bridge: %w", err)
+		return
+	}
+	if bridge.Type() != "bridge" {
+		err = fmt.Errorf("link %s exists but is a %s", cfg.Bridge, bridge.Type())
+		return
+	}
+
+	gateway, err := cfg.GatewayAddr()
+	if err != nil {
+		return
+	}
+	err = netlink.AddrReplace(bridge, &netlink.Addr{IPNet: gateway})
+	if err != nil {
+		err = fmt.Errorf("assigning address %s: %w", gateway, err)
+		return
+	}
+
+	err = netlink.LinkSetUp(bridge)
+	if err != nil {
+		err = fmt.Errorf("setting link up: %w", err)
+		return
+	}
+
+	return
+}
+
+// setupTap creates the tap device unless it exists, created tells which is the case.
+func setupTap(cfg Config, name string, bridge netlink.Link) (created bool, err error) {
+	tap, err := netlink.LinkByName(name)
+	if isLinkNotFound(err) {
+		tuntap := &netlink.Tuntap{
+			LinkAttrs: netlink.LinkAttrs{Name: name},
+			Mode:      netlink.TUNTAP_MODE_TAP,
+			Flags:     netlink.TUNTAP_NO_PI | netlink.TUNTAP_VNET_HDR,
+			Owner:     uint32(cfg.TapOwnerUID),
+			Group:     uint32(cfg.TapOwnerGID),
+		}
+		err = netlink.LinkAdd(tuntap)
+		// the device is persistent, file descriptors are not needed any more.
+		for _, fd := range tuntap.Fds {
+			_ = fd.Close()
+		}
+		if err != nil {
+			err = fmt.Errorf("adding tap: %w", err)
+			return
+		}
+		created = true
+
+		tap, err = netlink.LinkByName(name)
+	}
+	if err != nil {
+		err = fmt.Errorf("looking up tap: %w", err)
+		return
+	}
+	if tap.Type() != "tuntap" {
+		err = fmt.Errorf("link %s exists but is a %s", name, tap.Type())
+		return
+	}
+
+	err = netlink.LinkSetMaster(tap, bridge)
+	if err != nil {
+		err = fmt.Errorf("enslaving to bridge: %w", err)
+		return
+	}
+
+	err = netlink.LinkSetUp(tap)
+	if err != nil {
+		err = fmt.Errorf("setting link up: %w", err)
+		return
+	}
+
+	return
+}
+
+// setupNAT is the equivalent of:
+//
+//	table ip tart-<bridge> {
+//		chain postrouting {
+//			type nat hook postrouting priority srcnat;
+//			ip saddr <subnet> oifname <uplink> masquerade
+//		}
+//		chain forward {
+//			type filter hook forward priority filter;
+//			iifname <bridge> oifname <uplink> accept
+//			oifname <bridge> ct state established,related accept
+//		}
+//	}
+func setupNAT(cfg Config) (err error) {
+	gateway, err := cfg.GatewayAddr()
+	if err != nil {
+		return
+	}
+
+	conn, err := nftables.New()
+	if err != nil {
+		err = fmt.Errorf("connecting to nftables: %w", err)
+		return
+	}
+
+	table := &nftables.Table{
+		Name:   cfg.nftTableName(),
+		Family: nftables.TableFamilyIPv4,
+	}
+	resetTable(conn, table)
+
+	postrouting := conn.AddChain(&nftables.Chain{
+		Name:     "postrouting",
+		Table:    table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	})
+	conn.AddRule(rule(table, postrouting,
+		matchIPv4Net(gateway, false),
+		matchOIFName(cfg.Uplink),
+		[]expr.Any{&expr.Masq{}},
+	))
+
+	forward := conn.AddChain(&nftables.Chain{
+		Name:     "forward",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+	})
+	conn.AddRule(rule(table, forward,
+		matchIIFName(cfg.Bridge),
+		matchOIFName(cfg.Uplink),
+		[]expr.Any{verdict(expr.VerdictAccept)},
+	))
+	conn.AddRule(rule(table, forward,
+		matchOIFName(cfg.Bridge),
+		matchEstablished(),
+		[]expr.Any{verdict(expr.VerdictAccept)},
+	))
+
+	err = conn.Flush()
+	if err != nil {
+		err = fmt.Errorf("applying rules: %w", err)
+		return
+	}
+
+	return
+}
+
+func deleteLink(name string) (err error) {
+	link, err := netlink.LinkByName(name)
+	if isLinkNotFound(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("looking up link: %w", err)
+		return
+	}
+
+	err = netlink.LinkDel(link)
+	if err != nil {
+		err = fmt.Errorf("deleting link: %w", err)
+		return
+	}
+
+	return
+}
+
+func isLinkNotFound(err error) bool {
+	var notFound netlink.LinkNotFoundError
+	return errors.As(err, &notFound)
+}
@@ -0,0 +1,259 @@
+package vmnet
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+)
+
+// requireNetNS skips the test unless it's explicitly asked to run,
+// since the test modifies network of the current namespace.
+//
+// To run in an unprivileged network namespace:
+//
+//	unshare -rn env TART_TEST_NETNS=1 go test ./vmnet/...
+func requireNetNS(t *testing.T) {
+	if os.Getenv("TART_TEST_NETNS") == "" {
+		t.Skip("TART_TEST_NETNS is not set, skipping test modifying host network")
+	}
+}
+
+func TestSetupTeardown(t *testing.T) {
+	requireNetNS(t)
+
+	err := netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "uplink0"}})
+	require.NoError(t, err)
+	defer func() {
+		link, _ := netlink.LinkByName("uplink0")
+		_ = netlink.LinkDel(link)
+	}()
+
+	cfg := Config{
+		Subnet:   "172.18.0.0/24",
+		Uplink:   "uplink0",
+		Bridge:   "tarttest",
+		TapCount: 2,
+	}
+
+	// twice for idempotency
+	for i := 0; i < 2; i++ {
+		err = Setup(cfg)
+		require.NoError(t, err)
+	}
+
+	bridge, err := netlink.LinkByName("tarttest")
+	require.NoError(t, err)
+	addrs, err := netlink.AddrList(bridge, netlink.FAMILY_V4)
+	require.NoError(t, err)
+	require.Len(t, addrs, 1)
+	assert.Equal(t, "172.18.0.1/24", addrs[0].IPNet.String())
+
+	for _, name := range []string{"tarttest-tap0", "tarttest-tap1"} {
+		tap, err := netlink.LinkByName(name)
+		require.NoError(t, err)
+		assert.Equal(t, bridge.Attrs().Index, tap.Attrs().MasterIndex)
+	}
+
+	conn, err := nftables.New()
+	require.NoError(t, err)
+	tables, err := conn.ListTablesOfFamily(nftables.TableFamilyIPv4)
+	require.NoError(t, err)
+	require.Len(t, tables, 1)
+	assert.Equal(t, "tart-tarttest", tables[0].Name)
+
+	// twice for idempotency
+	for i := 0; i < 2; i++ {
+		err = Teardown(cfg)
+		require.NoError(t, err)
+	}
+
+	_, err = netlink.LinkByName("tarttest")
+	assert.True(t, isLinkNotFound(err))
+	tables, err = conn.ListTablesOfFamily(nftables.TableFamilyIPv4)
+	require.NoError(t, err)
+	assert.Empty(t, tables)
+}
+
+func TestSetup_RollbackKeepsExisting(t *testing.T) {
+	requireNetNS(t)
+
+	err := netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "uplink0"}})
+	require.NoError(t, err)
+	defer func() {
+		link, _ := netlink.LinkByName("uplink0")
+		_ = netlink.LinkDel(link)
+	}()
+
+	cfg := Config{
+		Subnet:   "172.18.0.0/24",
+		Uplink:   "uplink0",
+		Bridge:   "tarttest",
+		TapCount: 1,
+	}
+	err = Setup(cfg)
+	require.NoError(t, err)
+	defer func() {
+		_ = Teardown(cfg)
+	}()
+
+	// the third tap can not be set up
+	err = netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "tarttest-tap2"}})
+	require.NoError(t, err)
+	defer func() {
+		link, _ := netlink.LinkByName("tarttest-tap2")
+		_ = netlink.LinkDel(link)
+	}()
+
+	cfg.TapCount = 3
+	err = Setup(cfg)
+	require.Error(t, err)
+
+	// devices of the previous run are still in use
+	_, err = netlink.LinkByName("tarttest")
+	assert.NoError(t, err)
+	_, err = netlink.LinkByName("tarttest-tap0")
+	assert.NoError(t, err)
+	_, err = netlink.LinkByName("tarttest-tap1")
+	assert.True(t, isLinkNotFound(err))
+}
+
+func TestSetupIsolated(t *testing.T) {
+	requireNetNS(t)
+
+	cfg := Config{
+		Subnet:   "10.89.0.0/24",
+		Bridge:   "tartjob",
+		TapCount: 2,
+	}
+
+	err := SetupIsolated(cfg)
+	require.NoError(t, err)
+
+	bridge, err := netlink.LinkByName("tartjob")
+	require.NoError(t, err)
+	addrs, err := netlink.AddrList(bridge, netlink.FAMILY_V4)
+	require.NoError(t, err)
+	require.Len(t, addrs, 1)
+	assert.Equal(t, "10.89.0.1/24", addrs[0].IPNet.String())
+
+	conn, err := nftables.New()
+	require.NoError(t, err)
+	table := &nftables.Table{Name: "tart-tartjob", Family: nftables.TableFamilyIPv4}
+	chains, err := conn.ListChainsOfTableFamily(nftables.TableFamilyIPv4)
+	require.NoError(t, err)
+	require.Len(t, chains, 1)
+	assert.Equal(t, "forward", chains[0].Name)
+	rules, err := conn.GetRules(table, chains[0])
+	require.NoError(t, err)
+	assert.Len(t, rules, 2)
+
+	err = Teardown(cfg)
+	require.NoError(t, err)
+
+	_, err = netlink.LinkByName("tartjob-tap1")
+	assert.True(t, isLinkNotFound(err))
+	tables, err := conn.ListTablesOfFamily(nftables.TableFamilyIPv4)
+	require.NoError(t, err)
+	assert.Empty(t, tables)
+}
+
+func TestApplyEgressPolicy(t *testing.T) {
+	requireNetNS(t)
+
+	cfg := Config{
+		Subnet:   "172.18.0.0/24",
+		Uplink:   "lo",
+		Bridge:   "tartpolicy",
+		TapCount: 1,
+	}
+	err := Setup(cfg)
+	require.NoError(t, err)
+	defer func() {
+		_ = Teardown(cfg)
+	}()
+
+	tap := cfg.TapName(0)
+	gateway, err := cfg.GatewayAddr()
+	require.NoError(t, err)
+
+	err = ApplyEgressPolicy(context.Background(), tap, gateway.IP, EgressPolicy{
+		Mode:  PolicyAllowlist,
+		Allow: []string{"10.0.0.0/8", "223.5.5.5:53"},
+	})
+	require.NoError(t, err)
+
+	conn, err := nftables.New()
+	require.NoError(t, err)
+	tables, err := conn.ListTablesOfFamily(nftables.TableFamilyBridge)
+	require.NoError(t, err)
+	require.Len(t, tables, 1)
+	assert.Equal(t, "tart-policy-tartpolicy-tap0", tables[0].Name)
+
+	chains, err := conn.ListChainsOfTableFamily(nftables.TableFamilyBridge)
+	require.NoError(t, err)
+	require.Len(t, chains, 1)
+	rules, err := conn.GetRules(tables[0], chains[0])
+	require.NoError(t, err)
+	// arp, non-ip, host SSH replies, host DNS tcp and udp, 10.0.0.0/8, 223.5.5.5 tcp and udp, drop
+	assert.Len(t, rules, 9)
+
+	// none replaces allowlist
+	err = ApplyEgressPolicy(context.Background(), tap, gateway.IP, EgressPolicy{Mode: PolicyNone})
+	require.NoError(t, err)
+	rules, err = conn.GetRules(tables[0], chains[0])
+	require.NoError(t, err)
+	assert.Len(t, rules, 6)
+
+	err = RemoveEgressPolicy(tap)
+	require.NoError(t, err)
+	tables, err = conn.ListTablesOfFamily(nftables.TableFamilyBridge)
+	require.NoError(t, err)
+	assert.Empty(t, tables)
+}
+
+func TestApplyEgressPolicy_NotBridged(t *testing.T) {
+	requireNetNS(t)
+
+	tap := &netlink.Tuntap{
+		LinkAttrs: netlink.LinkAttrs{Name: "tartpolicy0"},
+		Mode:      netlink.TUNTAP_MODE_TAP,
+		Flags:     netlink.TUNTAP_NO_PI,
+	}
+	err := netlink.LinkAdd(tap)
+	require.NoError(t, err)
+	for _, fd := range tap.Fds {
+		_ = fd.Close()
+	}
+	defer func() {
+		_ = deleteLink("tartpolicy0")
+	}()
+
+	err = ApplyEgressPolicy(context.Background(), "tartpolicy0", net.ParseIP("172.18.0.1"), EgressPolicy{Mode: PolicyNone})
+	require.NoError(t, err)
+	defer func() {
+		_ = RemoveEgressPolicy("tartpolicy0")
+	}()
+
+	conn, err := nftables.New()
+	require.NoError(t, err)
+	tables, err := conn.ListTablesOfFamily(nftables.TableFamilyIPv4)
+	require.NoError(t, err)
+	require.Len(t, tables, 1)
+
+	// traffic to the host takes input rather than forward
+	chains, err := conn.ListChainsOfTableFamily(nftables.TableFamilyIPv4)
+	require.NoError(t, err)
+	require.Len(t, chains, 2)
+	for _, chain := range chains {
+		rules, err := conn.GetRules(tables[0], chain)
+		require.NoError(t, err)
+		// host SSH replies, host DNS tcp and udp, drop
+		assert.Len(t, rules, 4, chain.Name)
+	}
+}